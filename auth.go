@@ -2,24 +2,49 @@ package runway_auth
 
 import (
 	"context"
+	"fmt"
 	"github.com/Runway-Club/auth_lib/domain"
 	aciRepoPkg "github.com/Runway-Club/auth_lib/internal/aci/repo"
+	"github.com/Runway-Club/auth_lib/internal/aci/transfer"
 	aciUseCasePkg "github.com/Runway-Club/auth_lib/internal/aci/usecase"
+	apiKeyRepoPkg "github.com/Runway-Club/auth_lib/internal/apikey/repo"
+	apiKeyUseCasePkg "github.com/Runway-Club/auth_lib/internal/apikey/usecase"
+	auditRepoPkg "github.com/Runway-Club/auth_lib/internal/audit/repo"
+	auditUseCasePkg "github.com/Runway-Club/auth_lib/internal/audit/usecase"
 	authRepoPkg "github.com/Runway-Club/auth_lib/internal/auth/repo"
 	authUseCasePkg "github.com/Runway-Club/auth_lib/internal/auth/usecase"
 	jwtPkg "github.com/Runway-Club/auth_lib/internal/jwt"
+	oauthRepoPkg "github.com/Runway-Club/auth_lib/internal/oauth/repo"
+	oauthUseCasePkg "github.com/Runway-Club/auth_lib/internal/oauth/usecase"
 	providerPkg "github.com/Runway-Club/auth_lib/internal/providers"
+	rebacRepoPkg "github.com/Runway-Club/auth_lib/internal/rebac/repo"
+	rebacUseCasePkg "github.com/Runway-Club/auth_lib/internal/rebac/usecase"
+	"github.com/Runway-Club/auth_lib/utils"
 	"github.com/spf13/viper"
 	"gorm.io/gorm"
+	"io"
+	"log"
+	"sort"
+	"strings"
 )
 
 var (
-	authRepo     domain.AuthRepository
-	aciRepo      domain.ACIRepository
-	authUseCase  domain.AuthUseCase
-	aciUseCase   domain.ACIUseCase
-	jwtGenerator domain.JwtGenerator
-	provider     domain.Provider
+	authRepo        domain.AuthRepository
+	aciRepo         domain.ACIRepository
+	authUseCase     domain.AuthUseCase
+	aciUseCase      domain.ACIUseCase
+	jwtGenerator    domain.JwtGenerator
+	provider        domain.Provider
+	relationRepo    domain.RelationRepository
+	relationUseCase domain.RelationUseCase
+	oauthRepo       domain.OAuthRepository
+	oauthUseCase    domain.OAuthUseCase
+	apiKeyRepo      domain.APIKeyRepository
+	apiKeyUseCase   domain.APIKeyUseCase
+	auditRepo       domain.AuditRepository
+	auditUseCase    domain.AuditUseCase
+	// scopes of oauth tokens by name, they limit the resources a token may access
+	scopes map[string]*domain.ScopeConfig
 )
 
 type InitDialetor func() gorm.Dialector
@@ -33,10 +58,41 @@ func Initialize(configFileName string, authDialector InitDialetor, aciDialector
 		}
 	}
 	jwtGenerator = jwtPkg.NewJwtGenerator()
+	var err error
+	scopes, err = oauthUseCasePkg.LoadScopes()
+	if err != nil {
+		panic(err)
+	}
 	authRepo = authRepoPkg.NewAuthRepository(authDialector())
 	aciRepo = aciRepoPkg.NewACIRepository(aciDialector())
 	authUseCase = authUseCasePkg.NewAuthUseCase(authRepo, jwtGenerator)
 	aciUseCase = aciUseCasePkg.NewACIUseCase(aciRepo)
+	// reconcile the acl declared in the config
+	plan, err := SyncACL(context.Background(), viper.GetBool("runway_auth.acl_sync.dry_run"))
+	if err != nil {
+		panic(err)
+	}
+	if !plan.Empty() {
+		log.Printf("acl sync plan:\n%s", plan)
+	}
+}
+
+// SyncACL reconciles the items managed by the config with runway_auth.acl: declared items are
+// created or updated, items no longer declared are deleted and items created through the api are
+// left untouched. When dryRun is set the plan is returned without being applied.
+func SyncACL(ctx context.Context, dryRun bool) (*domain.SyncPlan, error) {
+	declared, err := aciUseCasePkg.LoadDeclaredACL()
+	if err != nil {
+		return nil, err
+	}
+	plan, err := aciUseCase.PlanSync(ctx, declared)
+	if err != nil {
+		return nil, err
+	}
+	if dryRun {
+		return plan, nil
+	}
+	return plan, aciUseCase.ApplySync(ctx, plan)
 }
 
 func SignUp(ctx context.Context, auth *domain.Auth) error {
@@ -61,10 +117,128 @@ func SignIn(ctx context.Context, username, password string) (token *domain.Token
 	return authUseCase.SignIn(ctx, username, password)
 }
 
+// HasProvider reports whether an identity provider was initialized
+func HasProvider() bool {
+	return provider != nil
+}
+
 func InitGoogleProvider(ctx context.Context, firebaseAdminConfigName string) {
 	provider = providerPkg.NewGoogleProvider(ctx, firebaseAdminConfigName)
 }
 
+// InitRelationStore enables relationship-based authorization using the runway_auth.rebac config
+func InitRelationStore(dialector InitDialetor) {
+	relationRepo = rebacRepoPkg.NewRelationRepository(dialector())
+	relationUseCase = rebacUseCasePkg.NewRelationUseCase(relationRepo)
+}
+
+func GetRelationUseCase() domain.RelationUseCase {
+	return relationUseCase
+}
+
+// InitOAuth enables the OAuth 2.0 authorization server and OpenID Connect provider using the
+// runway_auth.oauth config, see package oauth
+func InitOAuth(dialector InitDialetor) {
+	oauthRepo = oauthRepoPkg.NewOAuthRepository(dialector())
+	oauthUseCase = oauthUseCasePkg.NewOAuthUseCase(oauthRepo, authRepo, jwtGenerator, jwtPkg.NewRSASigner())
+}
+
+func GetOAuthUseCase() domain.OAuthUseCase {
+	return oauthUseCase
+}
+
+// InitAPIKeys enables api keys, they are then accepted wherever a token is
+func InitAPIKeys(dialector InitDialetor) {
+	apiKeyRepo = apiKeyRepoPkg.NewAPIKeyRepository(dialector())
+	apiKeyUseCase = apiKeyUseCasePkg.NewAPIKeyUseCase(apiKeyRepo, authRepo, aciRepo)
+}
+
+func GetAPIKeyUseCase() domain.APIKeyUseCase {
+	return apiKeyUseCase
+}
+
+// InitAudit enables the audit trail of sensitive actions, it is required by Impersonate
+func InitAudit(dialector InitDialetor) {
+	auditRepo = auditRepoPkg.NewAuditRepository(dialector())
+	auditUseCase = auditUseCasePkg.NewAuditUseCase(auditRepo)
+}
+
+func GetAuditUseCase() domain.AuditUseCase {
+	return auditUseCase
+}
+
+// Impersonate issues the user of adminToken a short lived token of targetUid, for support staff to see the
+// product as the user. The admin needs an aci allowing runway_auth.impersonation.resource, "auth/impersonate"
+// by default, with targetUid as payload. The token names the admin in its impersonator claim, returned as
+// domain.Auth.Impersonator by VerifyToken, and every attempt is recorded in the audit trail.
+func Impersonate(ctx context.Context, adminToken, targetUid, reason string) (*domain.Token, error) {
+	if auditUseCase == nil {
+		panic("audit trail not initialized")
+	}
+	admin, claims, err := Authenticate(ctx, adminToken)
+	if err != nil {
+		return nil, err
+	}
+	token, err := impersonate(ctx, admin, claims, targetUid, reason)
+	// the actor is the person behind the token, also when it is an impersonation
+	actorId := admin.Id
+	if admin.Impersonator != "" {
+		actorId = admin.Impersonator
+	}
+	event := &domain.AuditEvent{Action: domain.AuditImpersonate, ActorId: actorId, SubjectId: targetUid, Reason: reason, Allowed: err == nil}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	// an impersonation which can not be audited is not allowed
+	if auditErr := auditUseCase.Record(ctx, event); auditErr != nil {
+		return nil, auditErr
+	}
+	return token, err
+}
+
+func impersonate(ctx context.Context, admin *domain.Auth, claims map[string]interface{}, targetUid, reason string) (*domain.Token, error) {
+	if strings.TrimSpace(reason) == "" {
+		return nil, domain.ErrReasonRequired
+	}
+	// only the session of the admin may impersonate, not a token limited or delegated
+	for _, claim := range []string{"api_key_id", "client_id", "impersonator"} {
+		if _, ok := claims[claim]; ok {
+			return nil, domain.ErrImpersonationForbidden
+		}
+	}
+	resource := viper.GetString("runway_auth.impersonation.resource")
+	if resource == "" {
+		resource = "auth/impersonate"
+	}
+	err := Authorize(ctx, admin, claims, resource, targetUid, nil)
+	if err != nil {
+		return nil, err
+	}
+	return authUseCase.Impersonate(ctx, admin, targetUid)
+}
+
+// CheckRelation verifies token and checks that its user, as subject "user:<id>", has relation on object
+func CheckRelation(ctx context.Context, token, object, relation string) error {
+	if relationUseCase == nil {
+		panic("relation store not initialized")
+	}
+	auth, _, err := jwtGenerator.VerifyToken(token)
+	if err != nil {
+		return err
+	}
+	if auth.TenantId != domain.TenantFromContext(ctx) {
+		return domain.ErrTenantMismatch
+	}
+	found, err := relationUseCase.Check(ctx, object, relation, "user:"+auth.Id)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return domain.ErrPermissionDenied
+	}
+	return nil
+}
+
 func GetAuthUseCase() domain.AuthUseCase {
 	return authUseCase
 }
@@ -73,27 +247,437 @@ func GetACIUseCase() domain.ACIUseCase {
 	return aciUseCase
 }
 
+func GetJwtGenerator() domain.JwtGenerator {
+	return jwtGenerator
+}
+
 func VerifyTokenAndPerm(ctx context.Context, token, resource, payload string) error {
-	auth, _, err := jwtGenerator.VerifyToken(token)
+	return CheckWithAttributes(ctx, token, resource, payload, nil)
+}
+
+// CheckWithAttributes is VerifyTokenAndPerm evaluating aci conditions against attrs,
+// attrs.User is always replaced by the claims of the token
+func CheckWithAttributes(ctx context.Context, token, resource, payload string, attrs *domain.Attributes) error {
+	auth, claims, err := Authenticate(ctx, token)
 	if err != nil {
 		return err
 	}
-	// bypass if auth is static
-	if len(authRepo.GetStaticUserMap(ctx)) > 0 {
-		if _, ok := authRepo.GetStaticUserMap(ctx)[auth.Id]; ok {
-			return nil
+	// a denial is returned as *domain.PermissionDeniedError naming the deciding aci
+	return Authorize(ctx, auth, claims, resource, payload, attrs)
+}
+
+// CheckMany checks every resource and payload pair verifying token only once
+func CheckMany(ctx context.Context, token string, requests []*domain.ResourcePayload) ([]*domain.Decision, error) {
+	auth, claims, requestAttrs, static, err := verifyForPerm(ctx, token, nil)
+	if err != nil {
+		return nil, err
+	}
+	decisions := make([]*domain.Decision, len(requests))
+	// requests outside the scopes of the token are denied without being checked
+	covered := make([]*domain.ResourcePayload, 0, len(requests))
+	coveredIndexes := make([]int, 0, len(requests))
+	for i, request := range requests {
+		decisions[i] = &domain.Decision{Resource: request.Resource, Payload: request.Payload, Allowed: static}
+		if scopeAllows(claims, request.Resource) {
+			covered = append(covered, request)
+			coveredIndexes = append(coveredIndexes, i)
+		} else {
+			decisions[i].Allowed = false
+		}
+	}
+	if len(covered) == 0 {
+		return decisions, nil
+	}
+	if !static {
+		found, err := aciUseCase.CheckPermissions(ctx, auth.Id, auth.RoleId, covered, requestAttrs)
+		if err != nil {
+			return nil, err
+		}
+		for i, index := range coveredIndexes {
+			decisions[index] = found[i]
+		}
+	}
+	// a delegated token is denied what one of its actors is denied
+	for _, actor := range domain.Actors(claims) {
+		if isStatic(ctx, actor) {
+			continue
+		}
+		found, err := aciUseCase.CheckPermissions(ctx, actor.Id, actor.RoleId, covered, requestAttrs)
+		if err != nil {
+			return nil, err
+		}
+		for i, index := range coveredIndexes {
+			if decisions[index].Allowed && !found[i].Allowed {
+				decisions[index] = found[i]
+			}
+		}
+	}
+	return decisions, nil
+}
+
+// ListAllowedPayloads returns the payloads of resource the user of token may access, payload
+// patterns such as "*" are returned as they are with the payloads denied within them
+func ListAllowedPayloads(ctx context.Context, token, resource string) (*domain.AllowedPayloads, error) {
+	auth, claims, requestAttrs, static, err := verifyForPerm(ctx, token, nil)
+	if err != nil {
+		return nil, err
+	}
+	if !scopeAllows(claims, resource) {
+		return &domain.AllowedPayloads{Payloads: []string{}, Except: []string{}}, nil
+	}
+	allowed := &domain.AllowedPayloads{Payloads: []string{"*"}, Except: []string{}}
+	if !static {
+		allowed, err = aciUseCase.ListAllowedPayloads(ctx, auth.Id, auth.RoleId, resource, requestAttrs)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, actor := range domain.Actors(claims) {
+		if isStatic(ctx, actor) {
+			continue
 		}
+		actorAllowed, err := aciUseCase.ListAllowedPayloads(ctx, actor.Id, actor.RoleId, resource, requestAttrs)
+		if err != nil {
+			return nil, err
+		}
+		allowed = intersectPayloads(allowed, actorAllowed)
 	}
+	return allowed, nil
+}
 
-	result, err := aciRepo.CheckByUserId(ctx, auth.Id, resource, payload)
-	if result {
-		return nil
+// intersectPayloads returns the payloads of a matched by a pattern of b, a pattern of a wider than the
+// patterns of b is dropped rather than narrowed, so the result never allows more than both lists.
+// The exceptions of both apply.
+func intersectPayloads(a, b *domain.AllowedPayloads) *domain.AllowedPayloads {
+	both := &domain.AllowedPayloads{Payloads: a.Payloads, Except: make([]string, 0)}
+	switch {
+	case len(a.Payloads) == 1 && a.Payloads[0] == "*":
+		both.Payloads = b.Payloads
+	case len(b.Payloads) == 1 && b.Payloads[0] == "*":
+	default:
+		both.Payloads = make([]string, 0)
+		for _, payload := range a.Payloads {
+			for _, pattern := range b.Payloads {
+				if utils.MatchPayload(pattern, payload) {
+					both.Payloads = append(both.Payloads, payload)
+					break
+				}
+			}
+		}
 	}
-	result, err = aciRepo.CheckByRoleId(ctx, auth.RoleId, resource, payload)
-	if result {
-		return nil
+	seen := make(map[string]bool)
+	for _, except := range append(append([]string{}, a.Except...), b.Except...) {
+		if !seen[except] {
+			seen[except] = true
+			both.Except = append(both.Except, except)
+		}
 	}
-	return domain.ErrPermissionDenied
+	sort.Strings(both.Except)
+	return both
+}
+
+// ExportACL writes the acl of the tenant of ctx together with its static users and the role ids they reference
+func ExportACL(ctx context.Context, w io.Writer, format domain.ACLFormat) error {
+	acl, err := aciUseCase.GetAll(ctx)
+	if err != nil {
+		return err
+	}
+	doc := &domain.ACLDocument{ACL: acl, StaticUsers: make([]*domain.Auth, 0)}
+	roles := make(map[string]bool)
+	for _, aci := range acl {
+		if aci.RoleId != "" {
+			roles[aci.RoleId] = true
+		}
+	}
+	staticUsers, err := authUseCase.GetStaticUserList(ctx)
+	if err != nil {
+		return err
+	}
+	for _, user := range staticUsers.List {
+		if user.TenantId == domain.TenantFromContext(ctx) {
+			doc.StaticUsers = append(doc.StaticUsers, user)
+			roles[user.RoleId] = true
+		}
+	}
+	sort.Slice(doc.StaticUsers, func(i, j int) bool {
+		return doc.StaticUsers[i].Id < doc.StaticUsers[j].Id
+	})
+	for role := range roles {
+		doc.Roles = append(doc.Roles, role)
+	}
+	sort.Strings(doc.Roles)
+	return transfer.Encode(w, doc, format)
+}
+
+// ImportACL imports the acl read from r into the tenant of ctx in a single transaction. Static users
+// and roles of the document are ignored, static users only come from the config. When dryRun is set
+// the plan is returned without being applied.
+func ImportACL(ctx context.Context, r io.Reader, format domain.ACLFormat, mode domain.ImportMode, dryRun bool) (*domain.SyncPlan, error) {
+	doc, err := transfer.Decode(r, format)
+	if err != nil {
+		return nil, err
+	}
+	plan, err := aciUseCase.PlanImport(ctx, doc.ACL, mode)
+	if err != nil {
+		return nil, err
+	}
+	if len(doc.StaticUsers) > 0 {
+		plan.Notes = append(plan.Notes, fmt.Sprintf("%d static users are not imported, static users are only read from the config", len(doc.StaticUsers)))
+	}
+	if len(doc.Roles) > 0 {
+		plan.Notes = append(plan.Notes, fmt.Sprintf("%d roles are not imported, roles are only referenced by items and users", len(doc.Roles)))
+	}
+	if dryRun {
+		return plan, nil
+	}
+	return plan, aciUseCase.ApplySync(ctx, plan)
+}
+
+// Explain traces VerifyTokenAndPerm for token, resource and payload. An invalid token is reported
+// in the explanation rather than as an error.
+func Explain(ctx context.Context, token, resource, payload string) (*domain.Explanation, error) {
+	auth, claims, requestAttrs, static, err := verifyForPerm(ctx, token, nil)
+	if err != nil {
+		return &domain.Explanation{
+			Resource:   resource,
+			Payload:    payload,
+			TokenError: err.Error(),
+			Rules:      make([]*domain.RuleTrace, 0),
+			Reason:     "invalid token",
+		}, nil
+	}
+	if !scopeAllows(claims, resource) {
+		return &domain.Explanation{
+			Resource:   resource,
+			Payload:    payload,
+			TokenValid: true,
+			UserId:     auth.Id,
+			RoleId:     auth.RoleId,
+			TenantId:   auth.TenantId,
+			Rules:      make([]*domain.RuleTrace, 0),
+			Reason:     "token scope does not cover the resource",
+		}, nil
+	}
+	explanation := &domain.Explanation{
+		Resource:   resource,
+		Payload:    payload,
+		TokenValid: true,
+		UserId:     auth.Id,
+		RoleId:     auth.RoleId,
+		TenantId:   auth.TenantId,
+		StaticUser: true,
+		Rules:      make([]*domain.RuleTrace, 0),
+		Allowed:    true,
+		Reason:     "static user bypasses acl",
+	}
+	if !static {
+		explanation, err = aciUseCase.Explain(ctx, auth.Id, auth.RoleId, resource, payload, requestAttrs)
+		if err != nil || !explanation.Allowed {
+			return explanation, err
+		}
+	}
+	// the first actor denying explains the denial of a delegated token
+	for _, actor := range domain.Actors(claims) {
+		if isStatic(ctx, actor) {
+			continue
+		}
+		actorExplanation, err := aciUseCase.Explain(ctx, actor.Id, actor.RoleId, resource, payload, requestAttrs)
+		if err != nil {
+			return nil, err
+		}
+		if !actorExplanation.Allowed {
+			actorExplanation.Reason = "actor " + actor.Id + " denied: " + actorExplanation.Reason
+			return actorExplanation, nil
+		}
+	}
+	return explanation, nil
+}
+
+// verifyForPerm verifies token for a permission check, static is true when the user bypasses the ACL
+func verifyForPerm(ctx context.Context, token string, attrs *domain.Attributes) (auth *domain.Auth, claims map[string]interface{}, requestAttrs *domain.Attributes, static bool, err error) {
+	auth, claims, err = Authenticate(ctx, token)
+	if err != nil {
+		return nil, nil, nil, false, err
+	}
+	requestAttrs, static = attributesFor(ctx, auth, claims, attrs)
+	return auth, claims, requestAttrs, static, nil
+}
+
+// scopeAllows reports whether the scopes of an oauth token and the resources of an api key or of an
+// exchanged token cover resource, other tokens are not limited
+func scopeAllows(claims map[string]interface{}, resource string) bool {
+	if resources, ok := utils.ClaimStrings(claims, "resources"); ok && !utils.MatchAnyResource(resources, resource) {
+		return false
+	}
+	scope, ok := claims["scope"].(string)
+	if !ok {
+		return true
+	}
+	for _, name := range strings.Fields(scope) {
+		if scopes[name] != nil && utils.MatchAnyResource(scopes[name].Resources, resource) {
+			return true
+		}
+	}
+	return false
+}
+
+// actorsAllow checks the permission of the actors of a delegated token, the token is only allowed what
+// its user and all its actors are allowed
+func actorsAllow(ctx context.Context, claims map[string]interface{}, resource, payload string, requestAttrs *domain.Attributes) error {
+	for _, actor := range domain.Actors(claims) {
+		if isStatic(ctx, actor) {
+			continue
+		}
+		err := aciUseCase.CheckPermission(ctx, actor.Id, actor.RoleId, resource, payload, requestAttrs)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// attributesFor returns the attributes of a permission check of auth, static is true when the user bypasses the ACL
+func attributesFor(ctx context.Context, auth *domain.Auth, claims map[string]interface{}, attrs *domain.Attributes) (requestAttrs *domain.Attributes, static bool) {
+	requestAttrs = &domain.Attributes{}
+	if attrs != nil {
+		*requestAttrs = *attrs
+	}
+	requestAttrs.User = claims
+	// bypass if auth is static, the actors of a delegated token are still checked with requestAttrs
+	return requestAttrs, isStatic(ctx, auth)
+}
+
+func isStatic(ctx context.Context, auth *domain.Auth) bool {
+	user, ok := authRepo.GetStaticUserMap(ctx)[auth.Id]
+	return ok && user.TenantId == auth.TenantId
+}
+
+// Authenticate verifies token, a jwt or an api key, for the tenant of ctx and returns its user and claims.
+// Jwts restricted to an audience other than runway_auth.jwt.audience are rejected with
+// domain.ErrInvalidAudience, services of an audience use AuthenticateForAudience.
+func Authenticate(ctx context.Context, token string) (auth *domain.Auth, claims map[string]interface{}, err error) {
+	if key := strings.TrimPrefix(token, "Bearer "); apiKeyUseCase != nil && apiKeyUseCase.IsKey(key) {
+		return authenticateAPIKey(ctx, key)
+	}
+	auth, claims, err = jwtGenerator.VerifyToken(token)
+	if err != nil {
+		return nil, nil, err
+	}
+	if auth.TenantId != domain.TenantFromContext(ctx) {
+		return nil, nil, domain.ErrTenantMismatch
+	}
+	return auth, claims, nil
+}
+
+// AuthenticateForAudience is Authenticate for a service of audience, api keys and tokens of other
+// audiences are rejected with ErrInvalidAudience
+func AuthenticateForAudience(ctx context.Context, token, audience string) (auth *domain.Auth, claims map[string]interface{}, err error) {
+	if key := strings.TrimPrefix(token, "Bearer "); apiKeyUseCase != nil && apiKeyUseCase.IsKey(key) {
+		return nil, nil, domain.ErrInvalidAudience
+	}
+	auth, claims, err = jwtGenerator.VerifyTokenForAudience(token, audience)
+	if err != nil {
+		return nil, nil, err
+	}
+	if auth.TenantId != domain.TenantFromContext(ctx) {
+		return nil, nil, domain.ErrTenantMismatch
+	}
+	return auth, claims, nil
+}
+
+// authenticateAPIKey returns the owner of key with the claims of its jwts, and the id and the resources of the key
+func authenticateAPIKey(ctx context.Context, key string) (*domain.Auth, map[string]interface{}, error) {
+	owner, found, err := apiKeyUseCase.Verify(ctx, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	claims := map[string]interface{}{
+		"id":         owner.Id,
+		"username":   owner.Username,
+		"role_id":    owner.RoleId,
+		"tenant_id":  owner.TenantId,
+		"api_key_id": found.Id,
+	}
+	if len(found.Resources) > 0 {
+		claims["resources"] = found.Resources
+	}
+	return owner, claims, nil
+}
+
+// Introspect returns the state of token, a jwt, an api key or an oauth refresh token, to the resource server
+// authenticated by the client credentials of req, RFC 7662. Tokens which can not be verified are inactive,
+// so are refresh tokens of another client unless the client is a resource server.
+func Introspect(ctx context.Context, req *domain.IntrospectionRequest) (*domain.Introspection, error) {
+	if oauthUseCase == nil {
+		panic("oauth not initialized")
+	}
+	client, err := oauthUseCase.AuthenticateClient(ctx, req.ClientId, req.ClientSecret)
+	if err != nil {
+		return nil, err
+	}
+	token := strings.TrimPrefix(req.Token, "Bearer ")
+	if apiKeyUseCase != nil && apiKeyUseCase.IsKey(token) {
+		// introspecting a key is not a use of it
+		owner, found, err := apiKeyUseCase.Lookup(ctx, token)
+		if err != nil {
+			return &domain.Introspection{}, nil
+		}
+		introspection := introspectionOf(owner, domain.TokenTypeAPIKey)
+		introspection.Iat = found.CreatedAt.Unix()
+		if found.ExpiresAt != nil {
+			introspection.Exp = found.ExpiresAt.Unix()
+		}
+		return introspection, nil
+	}
+	// refresh tokens are opaque, only jwts have dots
+	if strings.Count(token, ".") != 2 {
+		return oauthUseCase.IntrospectRefreshToken(ctx, client, token)
+	}
+	// resource servers introspect the tokens of their audience, which they check in Aud
+	owner, claims, err := jwtGenerator.VerifyTokenOfAnyAudience(token)
+	if err != nil || owner.TenantId != domain.TenantFromContext(ctx) {
+		return &domain.Introspection{}, nil
+	}
+	registered, err := jwtGenerator.Inspect(token)
+	if err != nil {
+		return &domain.Introspection{}, nil
+	}
+	introspection := introspectionOf(owner, domain.TokenTypeAccessToken)
+	introspection.Scope, _ = claims["scope"].(string)
+	introspection.ClientId, _ = claims["client_id"].(string)
+	introspection.Iss = registered.Issuer
+	introspection.Aud = registered.Audience
+	introspection.Iat = registered.IssuedAt.Unix()
+	introspection.Exp = registered.ExpiresAt.Unix()
+	return introspection, nil
+}
+
+func introspectionOf(owner *domain.Auth, tokenType string) *domain.Introspection {
+	return &domain.Introspection{
+		Active:    true,
+		Sub:       owner.Id,
+		Username:  owner.Username,
+		RoleId:    owner.RoleId,
+		TenantId:  owner.TenantId,
+		TokenType: tokenType,
+		// the token of an impersonation must not pass for a session of the user
+		Impersonator: owner.Impersonator,
+	}
+}
+
+// Authorize checks the permission of a user returned by Authenticate without verifying its token again
+func Authorize(ctx context.Context, auth *domain.Auth, claims map[string]interface{}, resource, payload string, attrs *domain.Attributes) error {
+	if !scopeAllows(claims, resource) {
+		return domain.ErrInsufficientScope
+	}
+	requestAttrs, static := attributesFor(ctx, auth, claims, attrs)
+	if !static {
+		err := aciUseCase.CheckPermission(ctx, auth.Id, auth.RoleId, resource, payload, requestAttrs)
+		if err != nil {
+			return err
+		}
+	}
+	return actorsAllow(ctx, claims, resource, payload, requestAttrs)
 }
 
 func CheckAuthWithProvider(ctx context.Context, token string) (bool, error) {
@@ -103,10 +687,18 @@ func CheckAuthWithProvider(ctx context.Context, token string) (bool, error) {
 	return authUseCase.CheckAuthWithProvider(ctx, provider, token)
 }
 
+// VerifyToken verifies token for the tenant of ctx, tokens restricted to an audience other than
+// runway_auth.jwt.audience are rejected with domain.ErrInvalidAudience
 func VerifyToken(ctx context.Context, token string) (auth *domain.Auth, err error) {
 	return authUseCase.Verify(ctx, token)
 }
 
+// VerifyTokenForAudience is VerifyToken for a service of audience, tokens signed in with another
+// domain.WithAudience are rejected
+func VerifyTokenForAudience(ctx context.Context, token, audience string) (auth *domain.Auth, err error) {
+	return authUseCase.VerifyForAudience(ctx, token, audience)
+}
+
 func DeleteAuth(ctx context.Context, id string) error {
 	// delete on provider
 	if provider != nil {
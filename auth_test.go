@@ -1,12 +1,17 @@
 package runway_auth_test
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	auth "github.com/Runway-Club/auth_lib"
 	"github.com/Runway-Club/auth_lib/domain"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestAuth(t *testing.T) {
@@ -102,4 +107,307 @@ func TestAuth(t *testing.T) {
 			t.Error("expected true, got false")
 		}
 	})
+	t.Run("deny overrides allow", func(t *testing.T) {
+		err := auth.GetACIUseCase().Create(context.Background(), &domain.ACI{
+			Id:       "103",
+			Resource: "v1/course.GET",
+			UserId:   "test",
+			Effect:   domain.EffectDeny,
+		})
+		if err != nil {
+			t.Error(err)
+		}
+		token, err := auth.SignIn(context.Background(), "user01", "Strong123456")
+		if err != nil {
+			t.Error(err)
+		}
+		result := auth.VerifyTokenAndPerm(context.Background(), token.Jwt, "v1/course.GET", "")
+		if !errors.Is(result, domain.ErrPermissionDenied) {
+			t.Errorf("expected permission denied, got %v", result)
+		}
+		var denied *domain.PermissionDeniedError
+		if !errors.As(result, &denied) || denied.Rule == nil || denied.Rule.Id != "103" {
+			t.Errorf("expected denial by aci 103, got %v", result)
+		}
+	})
+	t.Run("check with attributes", func(t *testing.T) {
+		err := auth.GetACIUseCase().Create(context.Background(), &domain.ACI{
+			Id:        "104",
+			Resource:  "v1/lesson.PUT",
+			RoleId:    "default",
+			Condition: `user.username == resource.owner && request.time.hour >= 8`,
+		})
+		if err != nil {
+			t.Error(err)
+		}
+		token, err := auth.SignIn(context.Background(), "user01", "Strong123456")
+		if err != nil {
+			t.Error(err)
+		}
+		morning := time.Date(2024, 1, 1, 9, 0, 0, 0, time.UTC)
+		result := auth.CheckWithAttributes(context.Background(), token.Jwt, "v1/lesson.PUT", "", &domain.Attributes{
+			Resource: map[string]interface{}{"owner": "user01"},
+			Time:     morning,
+		})
+		if result != nil {
+			t.Errorf("expected allowed, got %v", result)
+		}
+		result = auth.CheckWithAttributes(context.Background(), token.Jwt, "v1/lesson.PUT", "", &domain.Attributes{
+			Resource: map[string]interface{}{"owner": "user02"},
+			Time:     morning,
+		})
+		if !errors.Is(result, domain.ErrPermissionDenied) {
+			t.Errorf("expected permission denied, got %v", result)
+		}
+		err = auth.GetACIUseCase().Create(context.Background(), &domain.ACI{
+			Resource:  "v1/lesson.PUT",
+			RoleId:    "default",
+			Condition: `user.username ==`,
+		})
+		if !errors.Is(err, domain.ErrInvalidCondition) {
+			t.Errorf("expected invalid condition, got %v", err)
+		}
+	})
+	t.Run("tenant scoped users", func(t *testing.T) {
+		tenantCtx := domain.WithTenant(context.Background(), "club-a")
+		err := auth.SignUp(tenantCtx, &domain.Auth{
+			Username: "user01",
+			Password: "weakpassword",
+		})
+		if !errors.Is(err, domain.ErrInvalidPassword) {
+			t.Errorf("expected tenant password policy, got %v", err)
+		}
+		err = auth.SignUp(tenantCtx, &domain.Auth{
+			Username: "user01",
+			Password: "Strong123456",
+		})
+		if err != nil {
+			t.Error(err)
+		}
+		token, err := auth.SignIn(tenantCtx, "user01", "Strong123456")
+		if err != nil {
+			t.Error(err)
+		}
+		if token.TenantId != "club-a" || token.RoleId != "member" {
+			t.Errorf("expected member of club-a, got %s of %s", token.RoleId, token.TenantId)
+		}
+		result := auth.VerifyTokenAndPerm(context.Background(), token.Jwt, "v1/course.GET", "")
+		if !errors.Is(result, domain.ErrTenantMismatch) {
+			t.Errorf("expected tenant mismatch, got %v", result)
+		}
+		_, err = auth.SignIn(tenantCtx, "admin", "Adminpassword@123")
+		if !errors.Is(err, domain.ErrAuthNotFound) {
+			t.Errorf("expected admin to be unknown in club-a, got %v", err)
+		}
+	})
+	t.Run("check many and list allowed payloads", func(t *testing.T) {
+		for _, aci := range []*domain.ACI{
+			{Id: "105", Resource: "v1/chapter.GET", RoleId: "default", Payload: "chapter-*"},
+			{Id: "106", Resource: "v1/chapter.GET", UserId: "test", Payload: "intro"},
+			{Id: "107", Resource: "v1/chapter.GET", UserId: "test", Payload: "chapter-9", Effect: domain.EffectDeny},
+		} {
+			err := auth.GetACIUseCase().Create(context.Background(), aci)
+			if err != nil {
+				t.Error(err)
+			}
+		}
+		token, err := auth.SignIn(context.Background(), "user01", "Strong123456")
+		if err != nil {
+			t.Error(err)
+		}
+		decisions, err := auth.CheckMany(context.Background(), token.Jwt, []*domain.ResourcePayload{
+			{Resource: "v1/chapter.GET", Payload: "chapter-1"},
+			{Resource: "v1/chapter.GET", Payload: "chapter-9"},
+			{Resource: "v1/chapter.GET", Payload: "intro"},
+			{Resource: "v1/chapter.PUT", Payload: "intro"},
+		})
+		if err != nil {
+			t.Error(err)
+		}
+		expected := []bool{true, false, true, false}
+		for i, decision := range decisions {
+			if decision.Allowed != expected[i] {
+				t.Errorf("%s/%s: expected %v, got %v", decision.Resource, decision.Payload, expected[i], decision.Allowed)
+			}
+		}
+		if decisions[1].Rule == nil || decisions[1].Rule.Id != "107" {
+			t.Error("expected chapter-9 to be denied by aci 107")
+		}
+		payloads, err := auth.ListAllowedPayloads(context.Background(), token.Jwt, "v1/chapter.GET")
+		if err != nil {
+			t.Error(err)
+		}
+		if !reflect.DeepEqual(payloads.Payloads, []string{"chapter-*", "intro"}) || !reflect.DeepEqual(payloads.Except, []string{"chapter-9"}) {
+			t.Errorf("expected [chapter-* intro] except [chapter-9], got %+v", payloads)
+		}
+	})
+	t.Run("explain", func(t *testing.T) {
+		token, err := auth.SignIn(context.Background(), "user01", "Strong123456")
+		if err != nil {
+			t.Error(err)
+		}
+		explanation, err := auth.Explain(context.Background(), token.Jwt, "v1/chapter.GET", "chapter-9")
+		if err != nil {
+			t.Error(err)
+		}
+		if explanation.Allowed || explanation.DecidingRule == nil || explanation.DecidingRule.Id != "107" {
+			t.Errorf("expected denial by aci 107, got %s", explanation.Reason)
+		}
+		applied := 0
+		for _, trace := range explanation.Rules {
+			if trace.Applies {
+				applied++
+			}
+		}
+		if applied != 2 {
+			t.Errorf("expected 2 applied aci, got %d", applied)
+		}
+		explanation, err = auth.Explain(context.Background(), "invalid", "v1/chapter.GET", "")
+		if err != nil {
+			t.Error(err)
+		}
+		if explanation.TokenValid || explanation.Allowed {
+			t.Error("expected invalid token")
+		}
+	})
+	t.Run("import and export acl", func(t *testing.T) {
+		tenantCtx := domain.WithTenant(context.Background(), "club-a")
+		csv := "id,resource,role_id\nimport-1,v1/course.GET,member\nimport-2,v1/course.PUT,member\n"
+		plan, err := auth.ImportACL(tenantCtx, strings.NewReader(csv), domain.FormatCSV, domain.ImportFailOnConflict, false)
+		if err != nil {
+			t.Error(err)
+		}
+		if len(plan.Changes) != 2 {
+			t.Errorf("expected 2 changes, got %s", plan)
+		}
+		_, err = auth.ImportACL(tenantCtx, strings.NewReader(csv), domain.FormatCSV, domain.ImportFailOnConflict, false)
+		if !errors.Is(err, domain.ErrACIConflict) {
+			t.Errorf("expected conflict, got %v", err)
+		}
+		plan, err = auth.ImportACL(tenantCtx, strings.NewReader("id,resource,role_id\nimport-1,v1/course.*,member\n"), domain.FormatCSV, domain.ImportReplace, false)
+		if err != nil {
+			t.Error(err)
+		}
+		if len(plan.Changes) != 2 {
+			t.Errorf("expected update and delete, got %s", plan)
+		}
+		_, err = auth.ImportACL(tenantCtx, strings.NewReader("id,resource\nx,a\nx,b\n"), domain.FormatCSV, domain.ImportMerge, false)
+		if !errors.Is(err, domain.ErrInvalidACI) {
+			t.Errorf("expected duplicate ids to be rejected, got %v", err)
+		}
+		plan, err = auth.ImportACL(tenantCtx, strings.NewReader("id,resource,role_id\ncopy,v1/course.*,member\n"), domain.FormatCSV, domain.ImportMerge, true)
+		if err != nil || !plan.Empty() || len(plan.Notes) != 1 {
+			t.Errorf("expected the copy of import-1 to be reported, got %+v %v", plan, err)
+		}
+		_, err = auth.ImportACL(tenantCtx, strings.NewReader("id,resource,role_id\ncopy,v1/course.*,member\n"), domain.FormatCSV, domain.ImportFailOnConflict, true)
+		if !errors.Is(err, domain.ErrACIConflict) {
+			t.Errorf("expected the copy of import-1 to conflict, got %v", err)
+		}
+		document := `{"acl": [], "static_users": [{"id": "s1", "username": "static01"}], "roles": ["member"]}`
+		plan, err = auth.ImportACL(tenantCtx, strings.NewReader(document), domain.FormatJSON, domain.ImportMerge, true)
+		if err != nil || len(plan.Notes) != 2 {
+			t.Errorf("expected the static users and the roles to be reported, got %+v %v", plan, err)
+		}
+		buffer := &bytes.Buffer{}
+		err = auth.ExportACL(tenantCtx, buffer, domain.FormatJSON)
+		if err != nil {
+			t.Error(err)
+		}
+		if !strings.Contains(buffer.String(), `"resource": "v1/course.*"`) || strings.Contains(buffer.String(), "import-2") {
+			t.Errorf("unexpected export %s", buffer.String())
+		}
+	})
+}
+
+func TestImpersonate(t *testing.T) {
+	dialector := func() gorm.Dialector {
+		return sqlite.Open("file:impersonate?mode=memory&cache=shared")
+	}
+	auth.Initialize("configs/dev.yaml", dialector, dialector, true)
+	auth.InitAudit(dialector)
+	ctx := context.Background()
+	for _, user := range []*domain.Auth{
+		{Id: "support01", Username: "support01", Password: "Strong123456"},
+		{Id: "customer01", Username: "customer01", Password: "Strong123456"},
+		{Id: "admin01", Username: "admin01", Password: "Strong123456"},
+		{Id: "support02", Username: "support02", Password: "Strong123456"},
+		{Id: "guest01", Username: "guest01", Password: "Strong123456"},
+	} {
+		if err := auth.SignUp(ctx, user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := auth.GetAuthUseCase().ChangeRole(ctx, "support01", "support"); err != nil {
+		t.Fatal(err)
+	}
+	if err := auth.GetAuthUseCase().ChangeRole(ctx, "admin01", "admin"); err != nil {
+		t.Fatal(err)
+	}
+	if err := auth.GetAuthUseCase().ChangeRole(ctx, "support02", "support"); err != nil {
+		t.Fatal(err)
+	}
+	// guest has no level in role_levels
+	if err := auth.GetAuthUseCase().ChangeRole(ctx, "guest01", "guest"); err != nil {
+		t.Fatal(err)
+	}
+	support, err := auth.SignIn(ctx, "support01", "Strong123456")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Run("requires the permission", func(t *testing.T) {
+		_, err := auth.Impersonate(ctx, support.Jwt, "customer01", "ticket 42")
+		if !errors.Is(err, domain.ErrPermissionDenied) {
+			t.Errorf("expected permission denied, got %v", err)
+		}
+		err = auth.GetACIUseCase().Create(ctx, &domain.ACI{Id: "support-impersonate", Resource: "auth/impersonate", Payload: "*", RoleId: "support"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = auth.Impersonate(ctx, support.Jwt, "customer01", " ")
+		if !errors.Is(err, domain.ErrReasonRequired) {
+			t.Errorf("expected a reason to be required, got %v", err)
+		}
+	})
+	t.Run("forbidden targets", func(t *testing.T) {
+		for _, target := range []string{"admin", "admin01", "support01", "support02", "guest01"} {
+			_, err := auth.Impersonate(ctx, support.Jwt, target, "ticket 42")
+			if !errors.Is(err, domain.ErrImpersonationForbidden) {
+				t.Errorf("expected impersonating %s to be forbidden, got %v", target, err)
+			}
+		}
+	})
+	t.Run("impersonate", func(t *testing.T) {
+		token, err := auth.Impersonate(ctx, support.Jwt, "customer01", "ticket 42")
+		if err != nil {
+			t.Fatal(err)
+		}
+		user, err := auth.VerifyToken(ctx, token.Jwt)
+		if err != nil || user.Id != "customer01" || user.Impersonator != "support01" {
+			t.Errorf("expected customer01 impersonated by support01, got %+v %v", user, err)
+		}
+		registered, err := auth.GetJwtGenerator().Inspect(token.Jwt)
+		if err != nil || time.Until(registered.ExpiresAt) > 900*time.Second {
+			t.Errorf("expected a short lived token, got %+v %v", registered, err)
+		}
+		_, err = auth.Impersonate(ctx, token.Jwt, "support01", "ticket 42")
+		if !errors.Is(err, domain.ErrImpersonationForbidden) {
+			t.Errorf("expected an impersonation token not to impersonate, got %v", err)
+		}
+	})
+	t.Run("audit trail", func(t *testing.T) {
+		events, err := auth.GetAuditUseCase().List(ctx, &domain.AuditFilter{Action: domain.AuditImpersonate, ActorId: "support01"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the attempt of the impersonation token is recorded for the support staff behind it
+		if len(events) != 9 {
+			t.Fatalf("expected every attempt to be recorded, got %d", len(events))
+		}
+		if !events[1].Allowed || events[1].SubjectId != "customer01" || events[1].Reason != "ticket 42" {
+			t.Errorf("expected the impersonation of customer01, got %+v", events[1])
+		}
+		if events[0].Allowed || events[8].Allowed || events[8].Error == "" {
+			t.Errorf("expected the denials to be recorded, got %+v %+v", events[0], events[8])
+		}
+	})
 }
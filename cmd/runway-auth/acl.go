@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	auth "github.com/Runway-Club/auth_lib"
+	"github.com/Runway-Club/auth_lib/domain"
+	"io"
+	"net"
+	"os"
+	"strconv"
+)
+
+var aciHeader = []string{"id", "resource", "payload", "role", "user", "effect", "condition", "managed by"}
+
+func aciRow(aci *domain.ACI) []string {
+	effect := aci.Effect
+	if effect == "" {
+		effect = domain.EffectAllow
+	}
+	return []string{aci.Id, aci.Resource, aci.Payload, aci.RoleId, aci.UserId, string(effect), aci.Condition, aci.ManagedBy}
+}
+
+func aclList(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("acl list", flag.ExitOnError)
+	user := flags.String("user", "", "only items of the user")
+	role := flags.String("role", "", "only items of the role")
+	_ = flags.Parse(args)
+	aciUseCase := auth.GetACIUseCase()
+	var items []*domain.ACI
+	var err error
+	switch {
+	case *user != "":
+		items, err = aciUseCase.GetByUserId(ctx, *user)
+	case *role != "":
+		items, err = aciUseCase.GetByRoleId(ctx, *role)
+	default:
+		items, err = aciUseCase.GetAll(ctx)
+	}
+	if err != nil {
+		return err
+	}
+	rows := make([][]string, 0, len(items))
+	for _, item := range items {
+		rows = append(rows, aciRow(item))
+	}
+	return render(items, aciHeader, rows)
+}
+
+func aclGrant(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("acl grant", flag.ExitOnError)
+	aci := &domain.ACI{}
+	flags.StringVar(&aci.Id, "id", "", "item id, generated when empty")
+	flags.StringVar(&aci.Resource, "resource", "", "resource or resource pattern")
+	flags.StringVar(&aci.Payload, "payload", "", "payload")
+	flags.StringVar(&aci.RoleId, "role", "", "role id")
+	flags.StringVar(&aci.UserId, "user", "", "user id")
+	client := flags.String("client", "", "oauth client id, the item applies to its client credentials tokens")
+	flags.StringVar(&aci.Condition, "condition", "", "condition expression")
+	deny := flags.Bool("deny", false, "grant a deny item")
+	_ = flags.Parse(args)
+	if *client != "" {
+		if aci.UserId != "" {
+			return fmt.Errorf("-user and -client are exclusive")
+		}
+		aci.UserId = domain.ClientSubject(*client)
+	}
+	if *deny {
+		aci.Effect = domain.EffectDeny
+	}
+	err := auth.GetACIUseCase().Create(ctx, aci)
+	if err != nil {
+		return err
+	}
+	return render(aci, aciHeader, [][]string{aciRow(aci)})
+}
+
+func aclRevoke(ctx context.Context, args []string) error {
+	if err := requireArgs(args, "<id>"); err != nil {
+		return err
+	}
+	err := auth.GetACIUseCase().Delete(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	return renderMessage("revoked %s", args[0])
+}
+
+// subjectFlags parses the subject and the request of acl check and acl explain
+func subjectFlags(ctx context.Context, name string, args []string) (userId, roleId string, attrs *domain.Attributes, rest []string, err error) {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	user := flags.String("user", "", "user id, its role is looked up")
+	client := flags.String("client", "", "oauth client id, its role is looked up")
+	role := flags.String("role", "", "role id, when no user is given")
+	ip := flags.String("ip", "", "client ip of the request")
+	_ = flags.Parse(args)
+	if *user == "" && *client == "" && *role == "" {
+		return "", "", nil, nil, fmt.Errorf("-user, -client or -role is required")
+	}
+	userId, roleId = *user, *role
+	if *client != "" {
+		found, err := auth.GetOAuthUseCase().GetClient(ctx, *client)
+		if err != nil {
+			return "", "", nil, nil, err
+		}
+		userId, roleId = domain.ClientSubject(found.Id), found.RoleId
+	} else if userId != "" {
+		found, err := auth.GetAuthUseCase().GetById(ctx, userId)
+		if err != nil {
+			return "", "", nil, nil, err
+		}
+		roleId = found.RoleId
+	}
+	attrs = &domain.Attributes{}
+	if *ip != "" {
+		if net.ParseIP(*ip) == nil {
+			return "", "", nil, nil, fmt.Errorf("invalid ip %s", *ip)
+		}
+		attrs.ClientIP = *ip
+	}
+	return userId, roleId, attrs, flags.Args(), nil
+}
+
+func aclCheck(ctx context.Context, args []string) error {
+	userId, roleId, attrs, rest, err := subjectFlags(ctx, "acl check", args)
+	if err != nil {
+		return err
+	}
+	if err = requireArgs(rest, "<resource>", "<payload>"); err != nil {
+		return err
+	}
+	decisions, err := auth.GetACIUseCase().CheckPermissions(ctx, userId, roleId, []*domain.ResourcePayload{{Resource: rest[0], Payload: rest[1]}}, attrs)
+	if err != nil {
+		return err
+	}
+	decision := decisions[0]
+	rule := ""
+	if decision.Rule != nil {
+		rule = decision.Rule.Id
+	}
+	return render(decision, []string{"resource", "payload", "allowed", "rule"},
+		[][]string{{decision.Resource, decision.Payload, strconv.FormatBool(decision.Allowed), rule}})
+}
+
+func aclExplain(ctx context.Context, args []string) error {
+	userId, roleId, attrs, rest, err := subjectFlags(ctx, "acl explain", args)
+	if err != nil {
+		return err
+	}
+	if err = requireArgs(rest, "<resource>", "<payload>"); err != nil {
+		return err
+	}
+	explanation, err := auth.GetACIUseCase().Explain(ctx, userId, roleId, rest[0], rest[1], attrs)
+	if err != nil {
+		return err
+	}
+	if !jsonOutput {
+		fmt.Fprintf(stdout, "allowed: %t\nreason: %s\n\n", explanation.Allowed, explanation.Reason)
+	}
+	rows := make([][]string, 0, len(explanation.Rules))
+	for _, trace := range explanation.Rules {
+		rows = append(rows, []string{trace.Rule.Id, trace.Subject, trace.Rule.Resource, aciRow(trace.Rule)[5], strconv.FormatBool(trace.Applies), trace.Reason})
+	}
+	return render(explanation, []string{"rule", "subject", "resource", "effect", "applies", "reason"}, rows)
+}
+
+func aclExport(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("acl export", flag.ExitOnError)
+	format := flags.String("format", "yaml", "yaml|json|csv")
+	out := flags.String("out", "", "output file, stdout by default")
+	_ = flags.Parse(args)
+	var w io.Writer = stdout
+	if *out != "" {
+		file, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+	return auth.ExportACL(ctx, w, domain.ACLFormat(*format))
+}
+
+func aclImport(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("acl import", flag.ExitOnError)
+	format := flags.String("format", "yaml", "yaml|json|csv")
+	mode := flags.String("mode", string(domain.ImportFailOnConflict), "merge|replace|fail-on-conflict")
+	dryRun := flags.Bool("dry-run", false, "only print the plan")
+	_ = flags.Parse(args)
+	var r io.Reader = stdin
+	if flags.NArg() > 0 {
+		file, err := os.Open(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		r = file
+	}
+	plan, err := auth.ImportACL(ctx, r, domain.ACLFormat(*format), domain.ImportMode(*mode), *dryRun)
+	if err != nil {
+		return err
+	}
+	if jsonOutput {
+		return render(plan, nil, nil)
+	}
+	if plan.Empty() {
+		fmt.Fprintln(stdout, "nothing to import")
+		return nil
+	}
+	fmt.Fprintln(stdout, plan)
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	auth "github.com/Runway-Club/auth_lib"
+	"github.com/Runway-Club/auth_lib/domain"
+	"strings"
+	"time"
+)
+
+func apiKeyRow(key *domain.APIKey) []string {
+	status := "active"
+	if key.RevokedAt != nil {
+		status = "revoked"
+	} else if !key.Active(time.Now()) {
+		status = "expired"
+	}
+	lastUsed := ""
+	if key.LastUsedAt != nil {
+		lastUsed = key.LastUsedAt.Format(time.RFC3339)
+	}
+	return []string{key.Id, key.Name, key.Hint + "...", strings.Join(key.Resources, " "), status, lastUsed}
+}
+
+var apiKeyHeader = []string{"id", "name", "hint", "resources", "status", "last used"}
+
+type generatedAPIKey struct {
+	*domain.APIKey
+	// Key is only shown once, it is stored hashed
+	Key string `json:"key"`
+}
+
+func apiKeyCreate(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("apikey create", flag.ExitOnError)
+	user := flags.String("user", "", "id of the owner")
+	name := flags.String("name", "", "name of the key")
+	resources := flags.String("resources", "", "comma separated resource patterns limiting the key")
+	expires := flags.Duration("expires", 0, "lifetime of the key, it does not expire when 0")
+	_ = flags.Parse(args)
+	if *user == "" {
+		return fmt.Errorf("-user is required")
+	}
+	var expiresAt *time.Time
+	if *expires > 0 {
+		at := time.Now().Add(*expires)
+		expiresAt = &at
+	}
+	key, created, err := auth.GetAPIKeyUseCase().Create(ctx, *user, *name, splitList(*resources), expiresAt)
+	if err != nil {
+		return err
+	}
+	if !jsonOutput {
+		// the bare key, so that it can be captured by a shell
+		fmt.Fprintln(stdout, key)
+		return nil
+	}
+	return render(&generatedAPIKey{APIKey: created, Key: key}, nil, nil)
+}
+
+func apiKeyList(ctx context.Context, args []string) error {
+	if err := requireArgs(args, "<user id>"); err != nil {
+		return err
+	}
+	keys, err := auth.GetAPIKeyUseCase().List(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	rows := make([][]string, 0, len(keys))
+	for _, key := range keys {
+		rows = append(rows, apiKeyRow(key))
+	}
+	return render(keys, apiKeyHeader, rows)
+}
+
+func apiKeyRevoke(ctx context.Context, args []string) error {
+	if err := requireArgs(args, "<user id>", "<key id>"); err != nil {
+		return err
+	}
+	err := auth.GetAPIKeyUseCase().Revoke(ctx, args[0], args[1])
+	if err != nil {
+		return err
+	}
+	return renderMessage("revoked api key %s", args[1])
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	auth "github.com/Runway-Club/auth_lib"
+	"github.com/Runway-Club/auth_lib/domain"
+	"time"
+)
+
+func auditList(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("audit list", flag.ExitOnError)
+	action := flags.String("action", "", "only events of action, such as impersonate")
+	actor := flags.String("actor", "", "only events of the actor user id")
+	subject := flags.String("subject", "", "only events on the subject user id")
+	limit := flags.Int("limit", 100, "maximum number of events, the most recent first")
+	_ = flags.Parse(args)
+	events, err := auth.GetAuditUseCase().List(ctx, &domain.AuditFilter{Action: *action, ActorId: *actor, SubjectId: *subject, Limit: *limit})
+	if err != nil {
+		return err
+	}
+	rows := make([][]string, 0, len(events))
+	for _, event := range events {
+		outcome := "allowed"
+		if !event.Allowed {
+			outcome = "denied: " + event.Error
+		}
+		rows = append(rows, []string{event.CreatedAt.Format(time.RFC3339), event.Action, event.ActorId, event.SubjectId,
+			fmt.Sprintf("%q", event.Reason), outcome})
+	}
+	return render(events, []string{"time", "action", "actor", "subject", "reason", "outcome"}, rows)
+}
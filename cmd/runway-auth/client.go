@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"flag"
+	auth "github.com/Runway-Club/auth_lib"
+	"github.com/Runway-Club/auth_lib/domain"
+	"strings"
+)
+
+type registeredClient struct {
+	*domain.OAuthClient
+	// Secret is only shown once, it is stored hashed
+	Secret string `json:"client_secret,omitempty"`
+}
+
+// grantAliases are the short names of the grants named by an urn
+var grantAliases = map[string]string{
+	"device_code":    domain.GrantDeviceCode,
+	"token-exchange": domain.GrantTokenExchange,
+}
+
+func clientRegister(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("client register", flag.ExitOnError)
+	id := flags.String("id", "", "client id, generated when empty")
+	name := flags.String("name", "", "client name")
+	redirectURIs := flags.String("redirect-uris", "", "comma separated redirect uris")
+	scopes := flags.String("scopes", "", "comma separated scopes the client may request")
+	postLogoutRedirectURIs := flags.String("post-logout-redirect-uris", "", "comma separated uris to return to after logging out")
+	confidential := flags.Bool("confidential", false, "generate a client secret")
+	trusted := flags.Bool("trusted", false, "grant requests without consent")
+	grantTypes := flags.String("grant-types", "", "comma separated grant types, authorization_code,refresh_token by default, device_code and token-exchange name the urn grants")
+	role := flags.String("role", "", "role of the client credentials tokens of the client, and of the client acting in exchanged tokens")
+	resourceServer := flags.Bool("resource-server", false, "introspect the refresh tokens of every client")
+	_ = flags.Parse(args)
+	grants := splitList(*grantTypes)
+	for i, grantType := range grants {
+		if urn, ok := grantAliases[grantType]; ok {
+			grants[i] = urn
+		}
+	}
+	client := &domain.OAuthClient{Id: *id, Name: *name, RedirectURIs: splitList(*redirectURIs), Scopes: splitList(*scopes), Trusted: *trusted,
+		PostLogoutRedirectURIs: splitList(*postLogoutRedirectURIs), GrantTypes: grants, RoleId: *role,
+		ResourceServer: *resourceServer}
+	secret, err := auth.GetOAuthUseCase().RegisterClient(ctx, client, *confidential)
+	if err != nil {
+		return err
+	}
+	return render(&registeredClient{OAuthClient: client, Secret: secret}, []string{"client id", "name", "secret", "scopes"},
+		[][]string{{client.Id, client.Name, secret, strings.Join(client.Scopes, " ")}})
+}
+
+func clientDelete(ctx context.Context, args []string) error {
+	if err := requireArgs(args, "<client id>"); err != nil {
+		return err
+	}
+	if _, err := auth.GetOAuthUseCase().GetClient(ctx, args[0]); err != nil {
+		return err
+	}
+	err := auth.GetOAuthUseCase().DeleteClient(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	return renderMessage("deleted client %s", args[0])
+}
+
+// splitList splits a comma separated flag, dropping empty items
+func splitList(value string) []string {
+	items := make([]string, 0)
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
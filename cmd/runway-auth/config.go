@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/Runway-Club/auth_lib/domain"
+	aciUseCase "github.com/Runway-Club/auth_lib/internal/aci/usecase"
+	"github.com/Runway-Club/auth_lib/internal/jwt"
+	rebacUseCase "github.com/Runway-Club/auth_lib/internal/rebac/usecase"
+	"github.com/Runway-Club/auth_lib/utils"
+	"github.com/spf13/viper"
+)
+
+type configCheck struct {
+	Name  string `json:"name"`
+	Error string `json:"error,omitempty"`
+}
+
+// configValidate checks the config the way Initialize reads it, without opening the databases
+func configValidate(ctx context.Context, args []string) error {
+	checks := []struct {
+		name  string
+		check func() error
+	}{
+		{"jwt", validateJwt},
+		{"password", validatePassword},
+		{"acl", validateACL},
+		{"static_users", validateStaticUsers},
+		{"rebac", validateRebac},
+	}
+	results := make([]*configCheck, 0, len(checks))
+	rows := make([][]string, 0, len(checks))
+	failed := 0
+	for _, c := range checks {
+		result := &configCheck{Name: c.name}
+		status := "ok"
+		if err := recovered(c.check); err != nil {
+			result.Error = err.Error()
+			status = "error"
+			failed++
+		}
+		results = append(results, result)
+		rows = append(rows, []string{result.Name, status, result.Error})
+	}
+	err := render(results, []string{"check", "status", "error"}, rows)
+	if err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d checks failed", failed, len(checks))
+	}
+	return nil
+}
+
+// recovered turns the panics of the constructors on bad config into errors
+func recovered(check func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	return check()
+}
+
+func validateJwt() error {
+	jwt.NewJwtGenerator()
+	return nil
+}
+
+func validatePolicy(policy string) error {
+	// any password fails, only an unknown policy fails differently
+	if err := utils.CheckPasswordPolicy("", policy); err == domain.ErrInvalidPasswordPolicy {
+		return fmt.Errorf("%w: %s", err, policy)
+	}
+	return nil
+}
+
+func validatePassword() error {
+	err := validatePolicy(viper.GetString("runway_auth.password.policy"))
+	if err != nil {
+		return err
+	}
+	tenants := make(map[string]*domain.TenantConfig)
+	err = viper.UnmarshalKey("runway_auth.tenants", &tenants)
+	if err != nil {
+		return err
+	}
+	for id, tenant := range tenants {
+		if tenant == nil || tenant.Password.Policy == "" {
+			continue
+		}
+		if err = validatePolicy(tenant.Password.Policy); err != nil {
+			return fmt.Errorf("tenant %s: %w", id, err)
+		}
+	}
+	return nil
+}
+
+func validateACL() error {
+	// checks acl_combining and acl_cache
+	aciUseCase.NewACIUseCase(nil)
+	declared, err := aciUseCase.LoadDeclaredACL()
+	if err != nil {
+		return err
+	}
+	ids := make(map[string]bool)
+	for i, aci := range declared {
+		if aci.Id == "" || aci.Resource == "" {
+			return fmt.Errorf("%w: item %d needs an id and a resource", domain.ErrInvalidACI, i)
+		}
+		if ids[aci.Id] {
+			return fmt.Errorf("%w: duplicated id %s", domain.ErrInvalidACI, aci.Id)
+		}
+		ids[aci.Id] = true
+		if aci.Effect != "" && aci.Effect != domain.EffectAllow && aci.Effect != domain.EffectDeny {
+			return fmt.Errorf("%w: %s has effect %s", domain.ErrInvalidACI, aci.Id, aci.Effect)
+		}
+		if err = utils.ValidateCondition(aci.Condition); err != nil {
+			return fmt.Errorf("%s: %w", aci.Id, err)
+		}
+	}
+	return nil
+}
+
+func validateStaticUsers() error {
+	users := make([]*domain.Auth, 0)
+	err := viper.UnmarshalKey("runway_auth.static_users", &users)
+	if err != nil {
+		return err
+	}
+	ids := make(map[string]bool)
+	usernames := make(map[string]bool)
+	for i, user := range users {
+		if user.Id == "" || user.Username == "" {
+			return fmt.Errorf("static user %d needs an id and a username", i)
+		}
+		if domain.IsClientSubject(user.Id) {
+			return fmt.Errorf("static user id %s is reserved to oauth clients", user.Id)
+		}
+		if ids[user.Id] {
+			return fmt.Errorf("duplicated static user id %s", user.Id)
+		}
+		if usernames[user.TenantId+"/"+user.Username] {
+			return fmt.Errorf("%w: %s", domain.ErrUsernameExist, user.Username)
+		}
+		ids[user.Id] = true
+		usernames[user.TenantId+"/"+user.Username] = true
+	}
+	return nil
+}
+
+func validateRebac() error {
+	namespaces := make([]*domain.NamespaceConfig, 0)
+	err := viper.UnmarshalKey("runway_auth.rebac.namespaces", &namespaces)
+	if err != nil {
+		return err
+	}
+	_, err = rebacUseCase.NewRelationUseCaseWithSchema(nil, namespaces)
+	return err
+}
@@ -0,0 +1,153 @@
+// Command runway-auth administers the users and the acl of a runway auth database.
+//
+//	runway-auth [-config file] [-auth-db dsn] [-aci-db dsn] [-tenant id] [-output table|json] <group> <command> [flags]
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	auth "github.com/Runway-Club/auth_lib"
+	"github.com/Runway-Club/auth_lib/domain"
+	"github.com/spf13/viper"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"os"
+	"sort"
+	"strings"
+)
+
+type command struct {
+	run func(ctx context.Context, args []string) error
+	// standalone commands run without opening the databases
+	standalone bool
+	// oauth commands also open the oauth store, kept in the auth database, acl check and explain
+	// look up the role of oauth clients
+	oauth bool
+	// apiKeys commands also open the api key store, kept in the auth database
+	apiKeys bool
+	// audit commands also open the audit trail, kept in the auth database
+	audit bool
+}
+
+var groups = map[string]map[string]command{
+	"user": {
+		"create":         {run: userCreate},
+		"list":           {run: userList},
+		"delete":         {run: userDelete},
+		"set-role":       {run: userSetRole},
+		"reset-password": {run: userResetPassword},
+	},
+	"acl": {
+		"list":    {run: aclList},
+		"grant":   {run: aclGrant},
+		"revoke":  {run: aclRevoke},
+		"check":   {run: aclCheck, oauth: true},
+		"explain": {run: aclExplain, oauth: true},
+		"export":  {run: aclExport},
+		"import":  {run: aclImport},
+	},
+	"apikey": {
+		"create": {run: apiKeyCreate, apiKeys: true},
+		"list":   {run: apiKeyList, apiKeys: true},
+		"revoke": {run: apiKeyRevoke, apiKeys: true},
+	},
+	"audit": {
+		"list": {run: auditList, audit: true},
+	},
+	"token": {
+		"mint":    {run: tokenMint},
+		"inspect": {run: tokenInspect},
+	},
+	"client": {
+		"register": {run: clientRegister, oauth: true},
+		"delete":   {run: clientDelete, oauth: true},
+	},
+	"config": {
+		"validate": {run: configValidate, standalone: true},
+	},
+	"server": {
+		"openapi": {run: serverOpenAPI, standalone: true},
+	},
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: runway-auth [-config file] [-auth-db dsn] [-aci-db dsn] [-tenant id] [-output table|json] <group> <command> [flags]")
+	names := make([]string, 0)
+	for group, commands := range groups {
+		for name := range commands {
+			names = append(names, group+" "+name)
+		}
+	}
+	sort.Strings(names)
+	fmt.Fprintf(os.Stderr, "commands:\n  %s\n", strings.Join(names, "\n  "))
+}
+
+func main() {
+	flags := flag.NewFlagSet("runway-auth", flag.ExitOnError)
+	flags.Usage = usage
+	configFile := flags.String("config", "configs/dev.yaml", "config file")
+	authDb := flags.String("auth-db", "", "sqlite dsn of the auth database, runway_auth.cli.auth_db by default")
+	aciDb := flags.String("aci-db", "", "sqlite dsn of the acl database, runway_auth.cli.aci_db by default")
+	tenantId := flags.String("tenant", "", "tenant of the users and the acl")
+	output := flags.String("output", "table", "table|json")
+	_ = flags.Parse(os.Args[1:])
+	args := flags.Args()
+	if len(args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := groups[args[0]][args[1]]
+	if !ok || (*output != "table" && *output != "json") {
+		usage()
+		os.Exit(2)
+	}
+	jsonOutput = *output == "json"
+
+	if cmd.standalone {
+		viper.SetConfigFile(*configFile)
+		err := viper.MergeInConfig()
+		if err != nil {
+			fail(err)
+		}
+	} else {
+		// keep the output parsable, errors are reported by the commands
+		logger.Default = logger.Default.LogMode(logger.Silent)
+		// dialectors are opened once the config is loaded
+		auth.Initialize(*configFile, dialector(*authDb, "runway_auth.cli.auth_db"), dialector(*aciDb, "runway_auth.cli.aci_db"), true)
+		if cmd.oauth {
+			auth.InitOAuth(dialector(*authDb, "runway_auth.cli.auth_db"))
+		}
+		if cmd.apiKeys {
+			auth.InitAPIKeys(dialector(*authDb, "runway_auth.cli.auth_db"))
+		}
+		if cmd.audit {
+			auth.InitAudit(dialector(*authDb, "runway_auth.cli.auth_db"))
+		}
+	}
+
+	ctx := domain.WithTenant(context.Background(), *tenantId)
+	err := cmd.run(ctx, args[2:])
+	if err != nil {
+		fail(err)
+	}
+}
+
+// dialector opens dsn, or the dsn configured at key, with sqlite
+func dialector(dsn string, key string) auth.InitDialetor {
+	return func() gorm.Dialector {
+		if dsn == "" {
+			dsn = viper.GetString(key)
+		}
+		if dsn == "" {
+			fail(fmt.Errorf("[required config] %s", strings.TrimPrefix(key, "runway_auth.")))
+		}
+		return sqlite.Open(dsn)
+	}
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, "error:", err)
+	os.Exit(1)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	auth "github.com/Runway-Club/auth_lib"
+	"strings"
+	"testing"
+)
+
+// run runs a command with input on stdin and returns what it printed
+func run(t *testing.T, cmd func(ctx context.Context, args []string) error, input string, args ...string) (string, error) {
+	t.Helper()
+	out := &bytes.Buffer{}
+	stdin, stdout = strings.NewReader(input), out
+	err := cmd(context.Background(), args)
+	return out.String(), err
+}
+
+func TestCommands(t *testing.T) {
+	dsn := "file:cli?mode=memory&cache=shared"
+	auth.Initialize("../../configs/dev.yaml", dialector(dsn, ""), dialector(dsn, ""), true)
+
+	t.Run("user create reads the password from stdin", func(t *testing.T) {
+		_, err := run(t, userCreate, "", "-id", "cli-user", "-username", "cli01")
+		if err == nil {
+			t.Error("expected error password is required")
+		}
+		out, err := run(t, userCreate, "Strong123456\n", "-id", "cli-user", "-username", "cli01")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(out, "cli01") {
+			t.Errorf("unexpected output %q", out)
+		}
+		_, err = auth.SignIn(context.Background(), "cli01", "Strong123456")
+		if err != nil {
+			t.Error(err)
+		}
+	})
+	t.Run("user reset-password reads the password from stdin", func(t *testing.T) {
+		_, err := run(t, userResetPassword, "Reset123456\n", "cli-user", "Reset123456")
+		if err == nil {
+			t.Error("expected error of a password argument")
+		}
+		_, err = run(t, userResetPassword, "Reset123456\n", "cli-user")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = auth.SignIn(context.Background(), "cli01", "Reset123456")
+		if err != nil {
+			t.Error(err)
+		}
+	})
+	t.Run("token mint and inspect", func(t *testing.T) {
+		out, err := run(t, tokenMint, "", "cli-user")
+		if err != nil {
+			t.Fatal(err)
+		}
+		token := strings.TrimSpace(out)
+		user, err := auth.VerifyToken(context.Background(), token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user.Id != "cli-user" {
+			t.Errorf("unexpected user %s", user.Id)
+		}
+		out, err = run(t, tokenInspect, "", token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(out, "true") || !strings.Contains(out, "cli01") {
+			t.Errorf("unexpected output %q", out)
+		}
+		_, err = run(t, tokenMint, "", "missing")
+		if err == nil {
+			t.Error("expected error auth not found")
+		}
+	})
+}
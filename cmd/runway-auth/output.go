@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+// jsonOutput is set by the -output flag
+var jsonOutput bool
+
+// stdin and stdout of the commands, replaced by the tests
+var (
+	stdin  io.Reader = os.Stdin
+	stdout io.Writer = os.Stdout
+)
+
+// render prints value as json, or header and rows as a table
+func render(value interface{}, header []string, rows [][]string) error {
+	if jsonOutput {
+		encoder := json.NewEncoder(stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(value)
+	}
+	w := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, strings.ToUpper(strings.Join(header, "\t")))
+	for _, row := range rows {
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	return w.Flush()
+}
+
+// renderMessage prints a confirmation, as {"message": ...} with json output
+func renderMessage(format string, args ...interface{}) error {
+	message := fmt.Sprintf(format, args...)
+	if jsonOutput {
+		return render(map[string]string{"message": message}, nil, nil)
+	}
+	fmt.Fprintln(stdout, message)
+	return nil
+}
+
+// requireArgs checks the number of positional arguments of a command
+func requireArgs(args []string, names ...string) error {
+	if len(args) != len(names) {
+		return fmt.Errorf("expected arguments: %s", strings.Join(names, " "))
+	}
+	return nil
+}
+
+// readSecret reads a secret from the first line of stdin, so that it does not end up in the shell history or the
+// process list, the prompt is only printed when stdin is a terminal
+func readSecret(prompt string) (string, error) {
+	if file, ok := stdin.(*os.File); ok {
+		if info, err := file.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+			fmt.Fprint(os.Stderr, prompt+": ")
+		}
+	}
+	line, err := bufio.NewReader(stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	secret := strings.TrimRight(line, "\r\n")
+	if secret == "" {
+		return "", fmt.Errorf("%s is required on stdin", prompt)
+	}
+	return secret, nil
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"github.com/Runway-Club/auth_lib/server"
+)
+
+// serverOpenAPI prints the OpenAPI spec of the rest server
+func serverOpenAPI(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("server openapi", flag.ExitOnError)
+	prefix := flags.String("resource-prefix", "", "resource prefix of the admin routes")
+	_ = flags.Parse(args)
+	encoder := json.NewEncoder(stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(server.New(server.Options{ResourcePrefix: *prefix}).OpenAPI())
+}
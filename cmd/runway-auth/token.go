@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	auth "github.com/Runway-Club/auth_lib"
+	"github.com/Runway-Club/auth_lib/internal/auth/usecase"
+)
+
+func tokenMint(ctx context.Context, args []string) error {
+	if err := requireArgs(args, "<user id>"); err != nil {
+		return err
+	}
+	token, err := usecase.IssueToken(ctx, adminUseCase(), args[0])
+	if err != nil {
+		return err
+	}
+	if !jsonOutput {
+		// the bare token, so that it can be captured by a shell
+		fmt.Fprintln(stdout, token.Jwt)
+		return nil
+	}
+	return render(token, nil, nil)
+}
+
+type tokenInfo struct {
+	Valid    bool   `json:"valid"`
+	Error    string `json:"error,omitempty"`
+	UserId   string `json:"user_id,omitempty"`
+	Username string `json:"username,omitempty"`
+	RoleId   string `json:"role_id,omitempty"`
+	TenantId string `json:"tenant_id,omitempty"`
+	// Impersonator is set on the tokens of Impersonate
+	Impersonator string                 `json:"impersonator,omitempty"`
+	Payload      map[string]interface{} `json:"payload,omitempty"`
+}
+
+func tokenInspect(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("token inspect", flag.ExitOnError)
+	_ = flags.Parse(args)
+	if err := requireArgs(flags.Args(), "<token>"); err != nil {
+		return err
+	}
+	info := &tokenInfo{}
+	// the token of any audience is inspected, its aud is shown in the payload
+	user, payload, err := auth.GetJwtGenerator().VerifyTokenOfAnyAudience(flags.Arg(0))
+	if err != nil {
+		info.Error = err.Error()
+	} else {
+		info.Valid = true
+		info.UserId, info.Username, info.RoleId, info.TenantId = user.Id, user.Username, user.RoleId, user.TenantId
+		info.Impersonator = user.Impersonator
+		info.Payload = payload
+	}
+	rows := [][]string{
+		{"valid", fmt.Sprint(info.Valid)},
+		{"error", info.Error},
+		{"user", info.UserId},
+		{"username", info.Username},
+		{"role", info.RoleId},
+		{"tenant", info.TenantId},
+		{"impersonator", info.Impersonator},
+	}
+	return render(info, []string{"field", "value"}, rows)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	auth "github.com/Runway-Club/auth_lib"
+	"github.com/Runway-Club/auth_lib/common"
+	"github.com/Runway-Club/auth_lib/domain"
+	"github.com/Runway-Club/auth_lib/internal/auth/usecase"
+)
+
+func userRow(user *domain.Auth) []string {
+	return []string{user.Id, user.Username, user.RoleId, user.TenantId}
+}
+
+var userHeader = []string{"id", "username", "role", "tenant"}
+
+// adminUseCase is the auth use case with the operations of the administration tools, see usecase.IssueToken
+func adminUseCase() *usecase.AuthUseCase {
+	return auth.GetAuthUseCase().(*usecase.AuthUseCase)
+}
+
+func userCreate(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("user create", flag.ExitOnError)
+	id := flags.String("id", "", "user id, generated when empty")
+	username := flags.String("username", "", "username")
+	role := flags.String("role", "", "role id, the default role when empty")
+	_ = flags.Parse(args)
+	if *username == "" {
+		return fmt.Errorf("-username is required")
+	}
+	password, err := readSecret("password")
+	if err != nil {
+		return err
+	}
+	user := &domain.Auth{Id: *id, Username: *username, Password: password}
+	err = auth.SignUp(ctx, user)
+	if err != nil {
+		return err
+	}
+	if *role != "" {
+		err = auth.GetAuthUseCase().ChangeRole(ctx, user.Id, *role)
+		if err != nil {
+			return err
+		}
+		user.RoleId = *role
+	}
+	user.Password = ""
+	return render(user, userHeader, [][]string{userRow(user)})
+}
+
+func userList(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("user list", flag.ExitOnError)
+	page := flags.Int("page", 1, "page")
+	size := flags.Int("size", 50, "page size")
+	_ = flags.Parse(args)
+	result, err := auth.GetAuthUseCase().List(ctx, &common.QueryOpts{Page: *page, Size: *size})
+	if err != nil {
+		return err
+	}
+	rows := make([][]string, 0, len(result.Data))
+	for _, user := range result.Data {
+		rows = append(rows, userRow(user))
+	}
+	return render(result, userHeader, rows)
+}
+
+func userDelete(ctx context.Context, args []string) error {
+	if err := requireArgs(args, "<id>"); err != nil {
+		return err
+	}
+	err := auth.DeleteAuth(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	return renderMessage("deleted user %s", args[0])
+}
+
+func userSetRole(ctx context.Context, args []string) error {
+	if err := requireArgs(args, "<id>", "<role>"); err != nil {
+		return err
+	}
+	err := auth.GetAuthUseCase().ChangeRole(ctx, args[0], args[1])
+	if err != nil {
+		return err
+	}
+	return renderMessage("set role of user %s to %s", args[0], args[1])
+}
+
+func userResetPassword(ctx context.Context, args []string) error {
+	if err := requireArgs(args, "<id>"); err != nil {
+		return err
+	}
+	password, err := readSecret("password")
+	if err != nil {
+		return err
+	}
+	err = usecase.ResetPassword(ctx, adminUseCase(), args[0], password)
+	if err != nil {
+		return err
+	}
+	return renderMessage("reset password of user %s", args[0])
+}
@@ -0,0 +1,42 @@
+package runway_auth
+
+import (
+	"context"
+	"github.com/Runway-Club/auth_lib/domain"
+)
+
+type authKey struct{}
+
+type authValue struct {
+	auth   *domain.Auth
+	claims map[string]interface{}
+}
+
+// WithAuth returns a copy of ctx carrying the authenticated user and the claims of its token
+func WithAuth(ctx context.Context, auth *domain.Auth, claims map[string]interface{}) context.Context {
+	return context.WithValue(ctx, authKey{}, &authValue{auth: auth, claims: claims})
+}
+
+// FromContext returns the user stored by WithAuth, nil when the request is not authenticated
+func FromContext(ctx context.Context) *domain.Auth {
+	if ctx == nil {
+		return nil
+	}
+	value, _ := ctx.Value(authKey{}).(*authValue)
+	if value == nil {
+		return nil
+	}
+	return value.auth
+}
+
+// ClaimsFromContext returns the token claims stored by WithAuth
+func ClaimsFromContext(ctx context.Context) map[string]interface{} {
+	if ctx == nil {
+		return nil
+	}
+	value, _ := ctx.Value(authKey{}).(*authValue)
+	if value == nil {
+		return nil
+	}
+	return value.claims
+}
@@ -3,19 +3,78 @@ package domain
 import (
 	"context"
 	"errors"
+	"fmt"
 	"github.com/Runway-Club/auth_lib/common"
 	"gorm.io/gorm"
+	"strings"
+	"time"
 )
 
+// ACI is a single access control item. Resource and Payload may be patterns,
+// see utils.MatchResource and utils.MatchPayload for the supported syntax.
 type ACI struct {
 	gorm.Model
-	Id       string `json:"id" gorm:"uniqueIndex" yaml:"id"`
-	Resource string `json:"resource" yaml:"resource"`
+	// Id is unique within a tenant
+	TenantId string `json:"tenant_id" gorm:"primaryKey" yaml:"tenantId"`
+	Id       string `json:"id" gorm:"primaryKey" yaml:"id"`
+	Resource string `json:"resource" gorm:"index" yaml:"resource"`
 	Payload  string `json:"payload" yaml:"payload"`
-	RoleId   string `json:"role_id" yaml:"roleId"`
-	UserId   string `json:"user_id" yaml:"userId"`
+	RoleId   string `json:"role_id" gorm:"index" yaml:"roleId"`
+	UserId   string `json:"user_id" gorm:"index" yaml:"userId"`
+	// Effect is EffectAllow when empty
+	Effect Effect `json:"effect" yaml:"effect"`
+	// Condition is an optional expression evaluated against Attributes, the item only applies when it
+	// evaluates to true, e.g. `request.time.hour >= 8 && user.department == resource.owner_department`
+	Condition string `json:"condition" yaml:"condition"`
+	// ManagedBy is ManagedByConfig for items declared in the config, the sync only touches those
+	ManagedBy string `json:"managed_by" gorm:"index" yaml:"-"`
+	// ResourcePrefix and Wildcard are maintained by the repository to look up resource patterns by index
+	ResourcePrefix string `json:"-" gorm:"index" yaml:"-"`
+	Wildcard       bool   `json:"-" gorm:"index" yaml:"-"`
 }
 
+const ManagedByConfig = "config"
+
+// ACLVersion is incremented on every ACI write so that cached decisions of other instances can be invalidated
+type ACLVersion struct {
+	Id      uint `gorm:"primaryKey"`
+	Version int64
+}
+
+type Effect string
+
+const (
+	EffectAllow Effect = "allow"
+	EffectDeny  Effect = "deny"
+)
+
+// IsDeny reports whether the item denies access
+func (a *ACI) IsDeny() bool {
+	return a.Effect == EffectDeny
+}
+
+// Attributes is the request context conditions are evaluated against. In a condition they are
+// available as user (the claims of the token), resource, request.ip and request.time
+// (hour, minute, weekday, unix). Missing attributes evaluate to nil.
+type Attributes struct {
+	User     map[string]interface{}
+	Resource map[string]interface{}
+	ClientIP string
+	// Time is the current time when zero
+	Time time.Time
+}
+
+// CombiningAlgorithm decides how the effects of several matching items are combined
+type CombiningAlgorithm string
+
+const (
+	// DenyOverrides denies when any matching item denies, otherwise allows when any matching item allows
+	DenyOverrides CombiningAlgorithm = "deny-overrides"
+	// FirstApplicable takes the effect of the first matching item, user items before role items,
+	// most specific first
+	FirstApplicable CombiningAlgorithm = "first-applicable"
+)
+
 type ACIRepository interface {
 	Create(ctx context.Context, aci *ACI) error
 	GetById(ctx context.Context, id string) (*ACI, error)
@@ -25,6 +84,21 @@ type ACIRepository interface {
 	GetByUserId(ctx context.Context, userId string) ([]*ACI, error)
 	CheckByRoleId(ctx context.Context, roleId string, resource string, payload string) (bool, error)
 	CheckByUserId(ctx context.Context, userId string, resource string, payload string) (bool, error)
+	// GetMatching returns the items of the user and of the role matching resource and payload,
+	// user items first and most specific first within each subject
+	GetMatching(ctx context.Context, userId string, roleId string, resource string, payload string) ([]*ACI, error)
+	// GetMatchingMany is GetMatching for every request using a single query
+	GetMatchingMany(ctx context.Context, userId string, roleId string, requests []*ResourcePayload) ([][]*ACI, error)
+	// GetMatchingResource returns the items of the user and of the role matching resource with any payload
+	GetMatchingResource(ctx context.Context, userId string, roleId string, resource string) ([]*ACI, error)
+	// GetVersion returns the ACL version, it changes whenever an item is created, updated or deleted
+	GetVersion(ctx context.Context) (int64, error)
+	// GetForSync returns, across tenants and including deleted items, the items managed by the
+	// config and the items with one of ids
+	GetForSync(ctx context.Context, ids []string) ([]*ACI, error)
+	// ApplySync applies every change of plan in a single transaction
+	ApplySync(ctx context.Context, plan *SyncPlan) error
+	GetAll(ctx context.Context) ([]*ACI, error)
 	List(ctx context.Context, query *common.QueryOpts) (*common.ListResult[*ACI], error)
 	Update(ctx context.Context, aci *ACI) error
 	Delete(ctx context.Context, id string) error
@@ -44,10 +118,164 @@ type ACIUseCase interface {
 	List(ctx context.Context, query *common.QueryOpts) (*common.ListResult[*ACI], error)
 	Update(ctx context.Context, aci *ACI) error
 	Delete(ctx context.Context, id string) error
+	// CheckPermission checks the matching items, attrs may be nil when no request context is available
+	CheckPermission(ctx context.Context, userId string, roleId string, resource string, payload string, attrs *Attributes) error
+	CheckPermissions(ctx context.Context, userId string, roleId string, requests []*ResourcePayload, attrs *Attributes) ([]*Decision, error)
+	// ListAllowedPayloads returns the payloads, or payload patterns, of resource the user may access
+	ListAllowedPayloads(ctx context.Context, userId string, roleId string, resource string, attrs *Attributes) (*AllowedPayloads, error)
+	// Explain traces how every item of the user and of the role is evaluated for resource and payload
+	Explain(ctx context.Context, userId string, roleId string, resource string, payload string, attrs *Attributes) (*Explanation, error)
+	// PlanSync diffs the declared items against the items managed by the config
+	PlanSync(ctx context.Context, declared []*ACI) (*SyncPlan, error)
+	ApplySync(ctx context.Context, plan *SyncPlan) error
+	// PlanImport plans importing items into the tenant of ctx, config managed items are never changed
+	PlanImport(ctx context.Context, items []*ACI, mode ImportMode) (*SyncPlan, error)
+	GetAll(ctx context.Context) ([]*ACI, error)
+}
+
+// ImportMode decides what happens to the existing items on import
+type ImportMode string
+
+const (
+	// ImportMerge creates new items and updates existing ones
+	ImportMerge ImportMode = "merge"
+	// ImportReplace also deletes the existing items missing from the import
+	ImportReplace ImportMode = "replace"
+	// ImportFailOnConflict only creates items and fails when one already exists
+	ImportFailOnConflict ImportMode = "fail-on-conflict"
+)
+
+type ACLFormat string
+
+const (
+	FormatYAML ACLFormat = "yaml"
+	FormatJSON ACLFormat = "json"
+	// FormatCSV only carries the acl
+	FormatCSV ACLFormat = "csv"
+)
+
+// ACLDocument is the exported acl, its yaml form matches the runway_auth config
+type ACLDocument struct {
+	ACL []*ACI `json:"acl" yaml:"acl"`
+	// StaticUsers are exported without password, they are only read from the config
+	StaticUsers []*Auth `json:"static_users,omitempty" yaml:"static_users,omitempty"`
+	// Roles are the role ids referenced by the acl and the static users
+	Roles []string `json:"roles,omitempty" yaml:"roles,omitempty"`
+}
+
+type SyncAction string
+
+const (
+	SyncCreate SyncAction = "create"
+	SyncUpdate SyncAction = "update"
+	SyncDelete SyncAction = "delete"
+)
+
+// SyncChange changes Current, nil for SyncCreate, into Desired, nil for SyncDelete
+type SyncChange struct {
+	Action  SyncAction `json:"action"`
+	Current *ACI       `json:"current,omitempty"`
+	Desired *ACI       `json:"desired,omitempty"`
+}
+
+type SyncPlan struct {
+	Changes []*SyncChange `json:"changes"`
+	// Notes report what was left out of the plan, such as the sections of an imported document which
+	// are not imported
+	Notes []string `json:"notes,omitempty"`
+}
+
+func (p *SyncPlan) Empty() bool {
+	return len(p.Changes) == 0
+}
+
+// String lists the changes one per line
+func (p *SyncPlan) String() string {
+	lines := make([]string, 0, len(p.Changes))
+	for _, change := range p.Changes {
+		aci := change.Desired
+		if aci == nil {
+			aci = change.Current
+		}
+		lines = append(lines, fmt.Sprintf("%s aci %s: %s %s", change.Action, aci.Id, aci.Resource, aci.Payload))
+	}
+	for _, note := range p.Notes {
+		lines = append(lines, "note: "+note)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// AllowedPayloads are the payloads of a resource a user may access
+type AllowedPayloads struct {
+	// Payloads are payloads or payload patterns, such as "chapter-*"
+	Payloads []string `json:"payloads"`
+	// Except are the payloads, or payload patterns, denied although a pattern of Payloads matches them
+	Except []string `json:"except"`
+}
+
+type ResourcePayload struct {
+	Resource string `json:"resource"`
+	Payload  string `json:"payload"`
+}
+
+type Decision struct {
+	Resource string `json:"resource"`
+	Payload  string `json:"payload"`
+	Allowed  bool   `json:"allowed"`
+	// Rule is the item which decided, nil when no item matched
+	Rule *ACI `json:"rule,omitempty"`
+}
+
+// PermissionDeniedError is returned when access is denied, Rule is the item which denied access
+// or nil when no item matched
+type PermissionDeniedError struct {
+	Rule *ACI
+}
+
+func (e *PermissionDeniedError) Error() string {
+	if e.Rule == nil {
+		return ErrPermissionDenied.Error()
+	}
+	return fmt.Sprintf("%s by aci %s", ErrPermissionDenied.Error(), e.Rule.Id)
+}
+
+func (e *PermissionDeniedError) Unwrap() error {
+	return ErrPermissionDenied
+}
+
+// Explanation is the trace of a permission check
+type Explanation struct {
+	Resource   string `json:"resource"`
+	Payload    string `json:"payload"`
+	TokenValid bool   `json:"token_valid"`
+	TokenError string `json:"token_error,omitempty"`
+	UserId     string `json:"user_id,omitempty"`
+	RoleId     string `json:"role_id,omitempty"`
+	TenantId   string `json:"tenant_id,omitempty"`
+	// StaticUser is true when the user bypasses the ACL, Rules are not evaluated then
+	StaticUser bool               `json:"static_user"`
+	Combining  CombiningAlgorithm `json:"combining,omitempty"`
+	Rules      []*RuleTrace       `json:"rules"`
+	Allowed    bool               `json:"allowed"`
+	// DecidingRule is the item which decided, nil when no item applied
+	DecidingRule *ACI   `json:"deciding_rule,omitempty"`
+	Reason       string `json:"reason"`
+}
+
+// RuleTrace is the evaluation of one item, in evaluation order
+type RuleTrace struct {
+	Rule *ACI `json:"rule"`
+	// Subject is "user" or "role", depending on how the item was found
+	Subject string `json:"subject"`
+	Applies bool   `json:"applies"`
+	Reason  string `json:"reason"`
 }
 
 var (
 	ErrACINotFound      = errors.New("aci not found")
 	ErrPermissionDenied = errors.New("permission denied")
 	ErrInvalidACI       = errors.New("invalid aci")
+	ErrInvalidCondition = errors.New("invalid condition")
+	ErrACIConflict      = errors.New("aci already exists")
+	ErrInvalidFormat    = errors.New("invalid acl format")
 )
@@ -0,0 +1,59 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"gorm.io/gorm"
+	"time"
+)
+
+// APIKey is a long lived secret acting as its owner, limited to Resources
+type APIKey struct {
+	gorm.Model
+	TenantId string `json:"tenant_id" gorm:"index"`
+	Id       string `json:"id" gorm:"uniqueIndex"`
+	UserId   string `json:"user_id" gorm:"index"`
+	Name     string `json:"name"`
+	// KeyHash is the sha256 of the key, keys are only shown when created
+	KeyHash string `json:"-" gorm:"uniqueIndex"`
+	// Hint is the start of the key, its prefix and its id, to tell keys apart
+	Hint string `json:"hint"`
+	// Resources are resource patterns limiting the key, the acl of the owner applies alone when empty
+	Resources  []string   `json:"resources" gorm:"serializer:json"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+}
+
+// Active reports whether the key is neither revoked nor expired at now
+func (k *APIKey) Active(now time.Time) bool {
+	return k.RevokedAt == nil && (k.ExpiresAt == nil || now.Before(*k.ExpiresAt))
+}
+
+type APIKeyRepository interface {
+	Create(ctx context.Context, key *APIKey) error
+	GetById(ctx context.Context, id string) (*APIKey, error)
+	GetByHash(ctx context.Context, keyHash string) (*APIKey, error)
+	ListByUserId(ctx context.Context, userId string) ([]*APIKey, error)
+	Revoke(ctx context.Context, id string, at time.Time) error
+	Touch(ctx context.Context, id string, at time.Time) error
+}
+
+type APIKeyUseCase interface {
+	// Create generates a key of the user and returns it, only its hash is stored
+	Create(ctx context.Context, userId string, name string, resources []string, expiresAt *time.Time) (key string, created *APIKey, err error)
+	List(ctx context.Context, userId string) ([]*APIKey, error)
+	// Revoke revokes the key id of the user
+	Revoke(ctx context.Context, userId string, id string) error
+	// IsKey reports whether token has the prefix of api keys
+	IsKey(token string) bool
+	// Verify returns the owner of an active key and records its use
+	Verify(ctx context.Context, key string) (*Auth, *APIKey, error)
+	// Lookup returns the owner of an active key without recording its use
+	Lookup(ctx context.Context, key string) (*Auth, *APIKey, error)
+}
+
+var (
+	ErrAPIKeyNotFound = errors.New("api key not found")
+	ErrInvalidAPIKey  = errors.New("invalid api key")
+)
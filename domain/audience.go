@@ -0,0 +1,37 @@
+package domain
+
+import (
+	"context"
+	"errors"
+)
+
+type audienceKey struct{}
+
+// WithAudience returns a copy of ctx whose sign ins generate tokens for audience, the aud claim of
+// the token. The audience must be configured in runway_auth.jwt.audiences.
+func WithAudience(ctx context.Context, audience string) context.Context {
+	return context.WithValue(ctx, audienceKey{}, audience)
+}
+
+// AudienceFromContext returns the audience set by WithAudience, "" when tokens are not audience restricted
+func AudienceFromContext(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	audience, _ := ctx.Value(audienceKey{}).(string)
+	return audience
+}
+
+// AudienceConfig configures the tokens generated for an audience
+type AudienceConfig struct {
+	// Exp is the lifetime of the tokens in seconds, jwt.exp when 0
+	Exp int64 `json:"exp" yaml:"exp" mapstructure:"exp"`
+	// Claims are the private claims released to the audience besides the user ones (id, username,
+	// role_id and tenant_id), every claim is released when empty
+	Claims []string `json:"claims" yaml:"claims" mapstructure:"claims"`
+}
+
+var (
+	ErrUnknownAudience = errors.New("unknown audience")
+	ErrInvalidAudience = errors.New("invalid audience")
+)
@@ -0,0 +1,40 @@
+package domain
+
+import (
+	"context"
+	"gorm.io/gorm"
+)
+
+// AuditEvent records a sensitive action, by whom and on whom, allowed or not
+type AuditEvent struct {
+	gorm.Model
+	TenantId  string `json:"tenant_id" gorm:"index"`
+	Action    string `json:"action" gorm:"index"`
+	ActorId   string `json:"actor_id" gorm:"index"`
+	SubjectId string `json:"subject_id" gorm:"index"`
+	Reason    string `json:"reason"`
+	Allowed   bool   `json:"allowed"`
+	// Error is the reason of a denial
+	Error string `json:"error,omitempty"`
+}
+
+const AuditImpersonate = "impersonate"
+
+// AuditFilter selects events, empty fields match every event, Limit defaults to 100
+type AuditFilter struct {
+	Action    string
+	ActorId   string
+	SubjectId string
+	Limit     int
+}
+
+type AuditRepository interface {
+	Create(ctx context.Context, event *AuditEvent) error
+	// List returns the events of the tenant of ctx matching filter, the most recent first
+	List(ctx context.Context, filter *AuditFilter) ([]*AuditEvent, error)
+}
+
+type AuditUseCase interface {
+	Record(ctx context.Context, event *AuditEvent) error
+	List(ctx context.Context, filter *AuditFilter) ([]*AuditEvent, error)
+}
@@ -3,24 +3,30 @@ package domain
 import (
 	"context"
 	"errors"
+	"fmt"
 	"github.com/Runway-Club/auth_lib/common"
 	"gorm.io/gorm"
 )
 
 type Auth struct {
 	gorm.Model
+	// TenantId scopes the username, ids stay unique across tenants
+	TenantId  string `json:"tenant_id" gorm:"uniqueIndex:idx_auths_tenant_username" mapstructure:"tenant_id"`
 	Id        string `json:"id" gorm:"uniqueIndex" mapstructure:"id"`
-	Username  string `json:"username" gorm:"uniqueIndex"`
+	Username  string `json:"username" gorm:"uniqueIndex:idx_auths_tenant_username"`
 	Password  string `json:"password" gorm:"-"`
 	Hpassword string `json:"hpassword"`
 	RoleId    string `json:"role_id" mapstructure:"role_id"`
+	// Impersonator is the id of the user impersonating this one, it is only set on the user of a token
+	Impersonator string `json:"impersonator,omitempty" gorm:"-" mapstructure:"impersonator"`
 }
 
 type Token struct {
-	Jwt    string `json:"jwt"`
-	Id     string `json:"id"`
-	UserId string `json:"user_id"`
-	RoleId string `json:"role_id"`
+	Jwt      string `json:"jwt"`
+	Id       string `json:"id"`
+	UserId   string `json:"user_id"`
+	RoleId   string `json:"role_id"`
+	TenantId string `json:"tenant_id"`
 }
 
 type StaticUserList struct {
@@ -46,9 +52,14 @@ type AuthUseCase interface {
 	CheckAuth(ctx context.Context, uid string) (existed bool, err error)
 	CheckAuthWithProvider(ctx context.Context, provider Provider, token string) (existed bool, err error)
 	ChangePassword(ctx context.Context, uid, oldPassword, newPassword string) error
+	// Impersonate generates a short lived token of targetUid naming admin as its impersonator, the
+	// permission of admin is checked by the caller
+	Impersonate(ctx context.Context, admin *Auth, targetUid string) (token *Token, err error)
 	ChangeRole(ctx context.Context, uid, roleId string) error
 	Delete(ctx context.Context, id string) error
 	Verify(ctx context.Context, token string) (auth *Auth, err error)
+	// VerifyForAudience is Verify for a service of audience, see JwtGenerator.VerifyTokenForAudience
+	VerifyForAudience(ctx context.Context, token, audience string) (auth *Auth, err error)
 	List(ctx context.Context, opt *common.QueryOpts) (*common.ListResult[*Auth], error)
 	GetByUsername(ctx context.Context, username string) (*Auth, error)
 	GetById(ctx context.Context, id string) (*Auth, error)
@@ -62,4 +73,9 @@ var (
 	ErrPasswordNotMatch      = errors.New("password not match")
 	ErrInternal              = errors.New("internal error")
 	ErrInvalidPasswordPolicy = errors.New("invalid password policy")
+	ErrReasonRequired        = errors.New("reason required")
+	// ErrReservedUserId rejects user ids of the client subjects, see ClientSubjectPrefix
+	ErrReservedUserId = errors.New("user id is reserved")
+	// ErrImpersonationForbidden denies impersonating a static user, oneself or a user of a higher role
+	ErrImpersonationForbidden = fmt.Errorf("%w: impersonation forbidden", ErrPermissionDenied)
 )
@@ -1,10 +1,41 @@
 package domain
 
-import "errors"
+import (
+	"errors"
+	"time"
+)
 
 type JwtGenerator interface {
 	GenerateToken(auth *Auth, payload map[string]interface{}) (string, error)
+	// GenerateTokenWithLifetime is GenerateToken for a token expiring after lifetime instead of the configured one
+	GenerateTokenWithLifetime(auth *Auth, payload map[string]interface{}, lifetime time.Duration) (string, error)
+	// GenerateTokenForAudience is GenerateToken for a token of audience, with the lifetime and the claims
+	// configured for it
+	GenerateTokenForAudience(auth *Auth, payload map[string]interface{}, audience string) (string, error)
+	// VerifyToken verifies a token without audience or of the configured runway_auth.jwt.audience, tokens
+	// restricted to another audience are rejected with ErrInvalidAudience
 	VerifyToken(token string) (*Auth, map[string]interface{}, error)
+	// VerifyTokenForAudience is VerifyToken for a service of audience, tokens of other audiences and
+	// tokens without audience are rejected with ErrInvalidAudience
+	VerifyTokenForAudience(token string, audience string) (*Auth, map[string]interface{}, error)
+	// VerifyTokenOfAnyAudience is VerifyToken accepting every audience, for the authorization server
+	// itself when it exchanges, introspects or inspects tokens issued to services
+	VerifyTokenOfAnyAudience(token string) (*Auth, map[string]interface{}, error)
+	// Inspect verifies the signature of token and returns its registered claims, whether it expired or not
+	Inspect(token string) (*RegisteredClaims, error)
+}
+
+// RegisteredClaims are the claims of a jwt describing the token rather than its user, RFC 7519. Legacy
+// tokens have no Subject, Audience, NotBefore nor Id.
+type RegisteredClaims struct {
+	Issuer    string
+	Subject   string
+	Audience  []string
+	IssuedAt  time.Time
+	NotBefore time.Time
+	ExpiresAt time.Time
+	// Id is the jti of the token
+	Id string
 }
 
 var (
@@ -0,0 +1,366 @@
+package domain
+
+import (
+	"context"
+	"fmt"
+	"gorm.io/gorm"
+	"strings"
+	"time"
+)
+
+// OAuthClient is an application registered to obtain tokens from the authorization server
+type OAuthClient struct {
+	gorm.Model
+	TenantId string `json:"tenant_id" gorm:"index"`
+	Id       string `json:"client_id" gorm:"uniqueIndex"`
+	Name     string `json:"client_name"`
+	// SecretHash is empty for public clients, such as native and single page apps, which must use PKCE
+	SecretHash   string   `json:"-"`
+	RedirectURIs []string `json:"redirect_uris" gorm:"serializer:json"`
+	// Scopes are the scopes the client may request, all of them are granted when a request names none
+	Scopes []string `json:"scopes" gorm:"serializer:json"`
+	// Trusted clients are first party apps, their requests are granted without asking for consent
+	Trusted bool `json:"trusted"`
+	// PostLogoutRedirectURIs are the uris the user may be sent back to after logging out
+	PostLogoutRedirectURIs []string `json:"post_logout_redirect_uris" gorm:"serializer:json"`
+	// GrantTypes are the grants the client may use, the authorization code and refresh token grants when empty
+	GrantTypes []string `json:"grant_types" gorm:"serializer:json"`
+	// RoleId is the role of the tokens of the client credentials grant, whose user is ClientSubject(Id)
+	RoleId string `json:"role_id"`
+	// ResourceServer clients may introspect the refresh tokens of every client, others only their own
+	ResourceServer bool `json:"resource_server"`
+}
+
+// Public reports whether the client has no secret
+func (c *OAuthClient) Public() bool {
+	return c.SecretHash == ""
+}
+
+// AllowsGrant reports whether the client may use grantType
+func (c *OAuthClient) AllowsGrant(grantType string) bool {
+	if len(c.GrantTypes) == 0 {
+		return grantType == GrantAuthorizationCode || grantType == GrantRefreshToken
+	}
+	for _, allowed := range c.GrantTypes {
+		if allowed == grantType {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientSubjectPrefix prefixes the user id of the tokens issued to a client for itself, an aci
+// with the user id "client:<client id>" applies to the client. Users may not have such ids.
+const ClientSubjectPrefix = "client:"
+
+func ClientSubject(clientId string) string {
+	return ClientSubjectPrefix + clientId
+}
+
+// IsClientSubject reports whether id is reserved to the client subjects
+func IsClientSubject(id string) bool {
+	return strings.HasPrefix(id, ClientSubjectPrefix)
+}
+
+// Actors returns the actors of the act claim of a delegated token, the last one to act first, RFC 8693.
+// Each actor is a client subject with the role of the client, a check of the token must allow them all.
+func Actors(claims map[string]interface{}) []*Auth {
+	actors := make([]*Auth, 0)
+	tenantId, _ := claims["tenant_id"].(string)
+	act, _ := claims["act"].(map[string]interface{})
+	for act != nil {
+		actor := &Auth{TenantId: tenantId}
+		actor.Id, _ = act["sub"].(string)
+		actor.Username, _ = act["client_id"].(string)
+		actor.RoleId, _ = act["role_id"].(string)
+		actors = append(actors, actor)
+		act, _ = act["act"].(map[string]interface{})
+	}
+	return actors
+}
+
+// AuthorizationCode is issued by the authorization endpoint and exchanged once at the token endpoint
+type AuthorizationCode struct {
+	gorm.Model
+	TenantId string `gorm:"index"`
+	// CodeHash is the sha256 of the code, codes are never stored
+	CodeHash            string `gorm:"uniqueIndex"`
+	ClientId            string `gorm:"index"`
+	UserId              string
+	RedirectURI         string
+	Scope               string
+	CodeChallenge       string
+	CodeChallengeMethod string
+	// Nonce, AuthTime and AMR are copied to the id token
+	Nonce     string
+	AuthTime  time.Time
+	AMR       []string `gorm:"serializer:json"`
+	ExpiresAt time.Time
+	Used      bool
+	// RedirectURIRequired is set when the authorization request had a redirect_uri, the token request must
+	// then repeat it, RFC 6749 4.1.3
+	RedirectURIRequired bool
+}
+
+// RefreshToken is an opaque token exchanged for a new access token, it is rotated on every use
+type RefreshToken struct {
+	gorm.Model
+	TenantId string `gorm:"index"`
+	// TokenHash is the sha256 of the token, tokens are never stored
+	TokenHash string `gorm:"uniqueIndex"`
+	ClientId  string `gorm:"index"`
+	UserId    string `gorm:"index"`
+	Scope     string
+	// AuthTime and AMR describe the sign in of the user, id tokens of a refresh keep them
+	AuthTime  time.Time
+	AMR       []string `gorm:"serializer:json"`
+	ExpiresAt time.Time
+	Revoked   bool
+}
+
+// DeviceCode is a pending authorization of the device grant, the device polls the token endpoint with
+// its device code while the user approves its user code at the verification endpoint
+type DeviceCode struct {
+	gorm.Model
+	TenantId string `gorm:"index"`
+	// DeviceCodeHash is the sha256 of the device code, device codes are never stored
+	DeviceCodeHash string `gorm:"uniqueIndex"`
+	// UserCode is normalized, without its dash
+	UserCode  string `gorm:"uniqueIndex"`
+	ClientId  string `gorm:"index"`
+	Scope     string
+	ExpiresAt time.Time
+	// Interval is the minimum number of seconds between two polls, it grows on every slow_down
+	Interval     int64
+	LastPolledAt *time.Time
+	Status       string
+	// UserId, AuthTime and AMR are set on approval
+	UserId   string
+	AuthTime time.Time
+	AMR      []string `gorm:"serializer:json"`
+}
+
+const (
+	DeviceCodePending  = "pending"
+	DeviceCodeApproved = "approved"
+	DeviceCodeDenied   = "denied"
+	DeviceCodeConsumed = "consumed"
+)
+
+// DeviceAuthorization is the response of the device authorization endpoint, RFC 8628
+type DeviceAuthorization struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int64  `json:"expires_in"`
+	Interval                int64  `json:"interval"`
+}
+
+// IntrospectionRequest holds the parameters of the introspection endpoint, the client is the resource
+// server asking
+type IntrospectionRequest struct {
+	ClientId     string
+	ClientSecret string
+	Token        string
+	// TokenTypeHint is informative, the type of a token is known from its format
+	TokenTypeHint string
+}
+
+// Introspection is the state of a token, RFC 7662, only Active is set for inactive tokens. Times are in
+// seconds since the epoch.
+type Introspection struct {
+	Active   bool   `json:"active"`
+	Sub      string `json:"sub,omitempty"`
+	Username string `json:"username,omitempty"`
+	RoleId   string `json:"role_id,omitempty"`
+	TenantId string `json:"tenant_id,omitempty"`
+	Scope    string `json:"scope,omitempty"`
+	ClientId string `json:"client_id,omitempty"`
+	// TokenType is one of TokenTypeAccessToken, TokenTypeRefreshToken and TokenTypeAPIKey
+	TokenType string `json:"token_type,omitempty"`
+	Exp       int64  `json:"exp,omitempty"`
+	Iat       int64  `json:"iat,omitempty"`
+	Iss       string `json:"iss,omitempty"`
+	// Aud lists the audiences of an access token restricted to them
+	Aud []string `json:"aud,omitempty"`
+	// Impersonator is the admin behind an impersonation token, also once it was exchanged
+	Impersonator string `json:"impersonator,omitempty"`
+}
+
+const (
+	TokenTypeAccessToken  = "access_token"
+	TokenTypeRefreshToken = "refresh_token"
+	TokenTypeAPIKey       = "api_key"
+)
+
+// ScopeConfig maps an oauth scope onto the resource patterns of the acl it covers
+type ScopeConfig struct {
+	Name        string   `json:"name" yaml:"name" mapstructure:"name"`
+	Description string   `json:"description" yaml:"description" mapstructure:"description"`
+	Resources   []string `json:"resources" yaml:"resources" mapstructure:"resources"`
+}
+
+// AuthorizeRequest holds the parameters of the authorization endpoint
+type AuthorizeRequest struct {
+	ResponseType        string
+	ClientId            string
+	RedirectURI         string
+	Scope               string
+	State               string
+	CodeChallenge       string
+	CodeChallengeMethod string
+	Nonce               string
+	// Prompt "none" fails instead of asking the user to sign in or to consent
+	Prompt string
+	// RedirectURIDefaulted is set by ValidateAuthorize when RedirectURI was omitted and the only registered
+	// redirect uri of the client is used
+	RedirectURIDefaulted bool
+}
+
+// TokenRequest holds the parameters of the token endpoint, ClientSecret is empty for public clients
+type TokenRequest struct {
+	GrantType    string
+	ClientId     string
+	ClientSecret string
+	Code         string
+	RedirectURI  string
+	CodeVerifier string
+	RefreshToken string
+	Scope        string
+	DeviceCode   string
+	// SubjectToken is the token exchanged, Resources and Audience narrow the token issued for it
+	SubjectToken     string
+	SubjectTokenType string
+	Resources        []string
+	Audience         string
+}
+
+type TokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+	// IdToken is issued when the openid scope is granted
+	IdToken string `json:"id_token,omitempty"`
+	// IssuedTokenType is set by the token exchange grant
+	IssuedTokenType string `json:"issued_token_type,omitempty"`
+}
+
+const (
+	GrantAuthorizationCode = "authorization_code"
+	GrantRefreshToken      = "refresh_token"
+	GrantClientCredentials = "client_credentials"
+	GrantDeviceCode        = "urn:ietf:params:oauth:grant-type:device_code"
+	GrantTokenExchange     = "urn:ietf:params:oauth:grant-type:token-exchange"
+	// TokenTypeURNAccessToken and TokenTypeURNJWT are the token types of the token exchange grant
+	TokenTypeURNAccessToken = "urn:ietf:params:oauth:token-type:access_token"
+	TokenTypeURNJWT         = "urn:ietf:params:oauth:token-type:jwt"
+	CodeChallengeS256       = "S256"
+)
+
+type OAuthRepository interface {
+	CreateClient(ctx context.Context, client *OAuthClient) error
+	GetClient(ctx context.Context, id string) (*OAuthClient, error)
+	DeleteClient(ctx context.Context, id string) error
+	CreateCode(ctx context.Context, code *AuthorizationCode) error
+	// ConsumeCode marks the code as used and returns it, ErrOAuthInvalidGrant when it was already used
+	ConsumeCode(ctx context.Context, codeHash string) (*AuthorizationCode, error)
+	CreateRefreshToken(ctx context.Context, token *RefreshToken) error
+	// RevokeRefreshToken revokes the token and returns it, ErrOAuthInvalidGrant when it was already revoked
+	RevokeRefreshToken(ctx context.Context, tokenHash string) (*RefreshToken, error)
+	GetRefreshToken(ctx context.Context, tokenHash string) (*RefreshToken, error)
+	CreateDeviceCode(ctx context.Context, code *DeviceCode) error
+	GetDeviceCode(ctx context.Context, deviceCodeHash string) (*DeviceCode, error)
+	GetDeviceCodeByUserCode(ctx context.Context, userCode string) (*DeviceCode, error)
+	// PollDeviceCode records a poll at polledAt and the interval of the next one
+	PollDeviceCode(ctx context.Context, deviceCodeHash string, polledAt time.Time, interval int64) error
+	// DecideDeviceCode updates a pending code to its decision, ErrOAuthInvalidGrant when it is not pending
+	DecideDeviceCode(ctx context.Context, code *DeviceCode) error
+	// ConsumeDeviceCode marks an approved code as consumed, ErrOAuthInvalidGrant when it was already consumed
+	ConsumeDeviceCode(ctx context.Context, deviceCodeHash string) error
+}
+
+type OAuthUseCase interface {
+	// RegisterClient stores client and returns its secret, confidential clients get a generated secret
+	RegisterClient(ctx context.Context, client *OAuthClient, confidential bool) (secret string, err error)
+	GetClient(ctx context.Context, id string) (*OAuthClient, error)
+	DeleteClient(ctx context.Context, id string) error
+	// ValidateAuthorize validates an authorization request and returns its client and the scopes requested
+	ValidateAuthorize(ctx context.Context, req *AuthorizeRequest) (client *OAuthClient, scopes []string, err error)
+	// IssueCode issues an authorization code to user for a request validated by ValidateAuthorize
+	IssueCode(ctx context.Context, req *AuthorizeRequest, user *Auth, authn *Authentication, scopes []string) (code string, err error)
+	// Token serves the token endpoint
+	Token(ctx context.Context, req *TokenRequest) (*TokenResponse, error)
+	// AuthorizeDevice serves the device authorization endpoint, the client then polls Token with the device code
+	AuthorizeDevice(ctx context.Context, req *TokenRequest) (*DeviceAuthorization, error)
+	// GetDeviceRequest returns the pending request of a user code, its client and the scopes requested
+	GetDeviceRequest(ctx context.Context, userCode string) (*DeviceCode, *OAuthClient, error)
+	// ApproveDevice approves a user code for user, the scopes granted are a subset of the requested ones
+	ApproveDevice(ctx context.Context, userCode string, user *Auth, authn *Authentication, scopes []string) error
+	DenyDevice(ctx context.Context, userCode string) error
+	// PollDeviceToken polls the device grant and returns the token of the approving user
+	PollDeviceToken(ctx context.Context, req *TokenRequest) (*Token, error)
+	// AuthenticateClient authenticates a confidential client, such as a resource server introspecting tokens
+	AuthenticateClient(ctx context.Context, id, secret string) (*OAuthClient, error)
+	// IntrospectRefreshToken returns the state of a refresh token for client, inactive when it is unknown
+	// or issued to another client and client is not a resource server
+	IntrospectRefreshToken(ctx context.Context, client *OAuthClient, token string) (*Introspection, error)
+	// ScopeResources returns the resource patterns covered by scopes
+	ScopeResources(scopes []string) []string
+	// UserInfo returns the claims of user released by the scopes of an access token
+	UserInfo(ctx context.Context, userId string, scopes []string) (map[string]interface{}, error)
+	// ValidateLogout validates a logout request and returns where to send the user, "" when nowhere
+	ValidateLogout(ctx context.Context, req *LogoutRequest) (redirectURI string, err error)
+	// Metadata returns the OpenID provider metadata served for discovery
+	Metadata() *ProviderMetadata
+	JWKS() *JWKS
+}
+
+// OAuthError is an error of the authorization server, Code is the error code of RFC 6749
+type OAuthError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+func (e *OAuthError) Error() string {
+	if e.Description == "" {
+		return e.Code
+	}
+	return e.Code + ": " + e.Description
+}
+
+// Is matches errors by code so that errors.Is(err, ErrOAuthInvalidGrant) holds whatever the description
+func (e *OAuthError) Is(target error) bool {
+	t, ok := target.(*OAuthError)
+	return ok && t.Code == e.Code
+}
+
+// With returns a copy of e with a description
+func (e *OAuthError) With(description string) *OAuthError {
+	return &OAuthError{Code: e.Code, Description: description}
+}
+
+var (
+	ErrOAuthInvalidRequest          = &OAuthError{Code: "invalid_request"}
+	ErrOAuthInvalidClient           = &OAuthError{Code: "invalid_client"}
+	ErrOAuthInvalidGrant            = &OAuthError{Code: "invalid_grant"}
+	ErrOAuthUnauthorizedClient      = &OAuthError{Code: "unauthorized_client"}
+	ErrOAuthUnsupportedGrantType    = &OAuthError{Code: "unsupported_grant_type"}
+	ErrOAuthUnsupportedResponseType = &OAuthError{Code: "unsupported_response_type"}
+	ErrOAuthInvalidScope            = &OAuthError{Code: "invalid_scope"}
+	ErrOAuthAccessDenied            = &OAuthError{Code: "access_denied"}
+	ErrOAuthLoginRequired           = &OAuthError{Code: "login_required"}
+	ErrOAuthInvalidRedirectURI      = &OAuthError{Code: "invalid_redirect_uri"}
+	ErrOAuthInvalidClientMetadata   = &OAuthError{Code: "invalid_client_metadata"}
+	ErrOAuthConsentRequired         = &OAuthError{Code: "consent_required"}
+	ErrOAuthInvalidToken            = &OAuthError{Code: "invalid_token"}
+	ErrOAuthInsufficientScope       = &OAuthError{Code: "insufficient_scope"}
+	ErrOAuthAuthorizationPending    = &OAuthError{Code: "authorization_pending"}
+	ErrOAuthSlowDown                = &OAuthError{Code: "slow_down"}
+	ErrOAuthExpiredToken            = &OAuthError{Code: "expired_token"}
+	ErrOAuthInvalidTarget           = &OAuthError{Code: "invalid_target"}
+	// ErrInsufficientScope denies a resource not covered by the scopes of an oauth token
+	ErrInsufficientScope = fmt.Errorf("%w: insufficient scope", ErrPermissionDenied)
+)
@@ -0,0 +1,68 @@
+package domain
+
+import "time"
+
+// standard scopes of OpenID Connect, every client may request them and they cover no resource
+const (
+	ScopeOpenId  = "openid"
+	ScopeProfile = "profile"
+	ScopeEmail   = "email"
+)
+
+// Authentication describes how the user of an authorization request signed in, it is read from the session
+type Authentication struct {
+	Time time.Time
+	// Methods are the amr values of RFC 8176, "pwd" for a password
+	Methods []string
+}
+
+// LogoutRequest holds the parameters of the RP-initiated logout endpoint
+type LogoutRequest struct {
+	IdTokenHint           string
+	ClientId              string
+	PostLogoutRedirectURI string
+	State                 string
+}
+
+// JWK is a public key of a JSON Web Key Set
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+type JWKS struct {
+	Keys []*JWK `json:"keys"`
+}
+
+// IdTokenSigner signs the id tokens of OpenID Connect with a key published as a JWKS
+type IdTokenSigner interface {
+	Sign(claims map[string]interface{}) (string, error)
+	// Verify checks the signature of an id token issued by Sign and returns its claims, the expiration
+	// is not checked so that expired id tokens can be used as id_token_hint
+	Verify(token string) (map[string]interface{}, error)
+	JWKS() *JWKS
+}
+
+// ProviderMetadata is the discovery document of OpenID Connect
+type ProviderMetadata struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	UserinfoEndpoint                  string   `json:"userinfo_endpoint"`
+	JwksURI                           string   `json:"jwks_uri"`
+	EndSessionEndpoint                string   `json:"end_session_endpoint"`
+	DeviceAuthorizationEndpoint       string   `json:"device_authorization_endpoint"`
+	IntrospectionEndpoint             string   `json:"introspection_endpoint"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IdTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+	ClaimsSupported                   []string `json:"claims_supported"`
+}
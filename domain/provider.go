@@ -6,3 +6,20 @@ type Provider interface {
 	VerifyToken(ctx context.Context, token string) (uid string, claims map[string]interface{}, err error)
 	Delete(ctx context.Context, uid string) error
 }
+
+type verifiedProviderKey struct{}
+
+// WithVerifiedProvider returns a copy of ctx whose provider sign ups and sign ins return the error of
+// Provider.VerifyToken, instead of falling back to the unverified claims of the token
+func WithVerifiedProvider(ctx context.Context) context.Context {
+	return context.WithValue(ctx, verifiedProviderKey{}, true)
+}
+
+// VerifiedProviderFromContext reports whether WithVerifiedProvider was set
+func VerifiedProviderFromContext(ctx context.Context) bool {
+	if ctx == nil {
+		return false
+	}
+	verified, _ := ctx.Value(verifiedProviderKey{}).(bool)
+	return verified
+}
@@ -0,0 +1,74 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"gorm.io/gorm"
+)
+
+// RelationTuple is object#relation@subject. Object is "namespace:id", Subject is either an
+// object ("user:alice", "folder:root") or a userset "namespace:id#relation" (all subjects having
+// relation on that object).
+type RelationTuple struct {
+	gorm.Model
+	Object   string `json:"object" gorm:"uniqueIndex:idx_relation_tuple;index:idx_relation_tuple_object"`
+	Relation string `json:"relation" gorm:"uniqueIndex:idx_relation_tuple;index:idx_relation_tuple_object"`
+	Subject  string `json:"subject" gorm:"uniqueIndex:idx_relation_tuple;index"`
+}
+
+// NamespaceConfig defines the relations of a namespace
+type NamespaceConfig struct {
+	Name      string            `json:"name" yaml:"name" mapstructure:"name"`
+	Relations []*RelationConfig `json:"relations" yaml:"relations" mapstructure:"relations"`
+}
+
+// RelationConfig defines a relation as the union of its direct tuples, the computed usersets
+// of the same object and the relations inherited through a tupleset
+type RelationConfig struct {
+	Name string `json:"name" yaml:"name" mapstructure:"name"`
+	// Computed lists relations of the same object implying this one, e.g. editor is computed from owner
+	Computed []string `json:"computed" yaml:"computed" mapstructure:"computed"`
+	// Inherit lists relations of the objects related through a tupleset, e.g. viewer of parent
+	Inherit []*InheritConfig `json:"inherit" yaml:"inherit" mapstructure:"inherit"`
+}
+
+// InheritConfig is a tuple-to-userset rewrite: subjects having Relation on the objects of
+// Tupleset (e.g. parent) have the defining relation too
+type InheritConfig struct {
+	Tupleset string `json:"tupleset" yaml:"tupleset" mapstructure:"tupleset"`
+	Relation string `json:"relation" yaml:"relation" mapstructure:"relation"`
+}
+
+// SubjectTree is the expansion of object#relation
+type SubjectTree struct {
+	Object   string `json:"object"`
+	Relation string `json:"relation"`
+	// Subjects are the direct subjects, usersets are expanded into Children
+	Subjects []string       `json:"subjects"`
+	Children []*SubjectTree `json:"children"`
+}
+
+type RelationRepository interface {
+	Create(ctx context.Context, tuple *RelationTuple) error
+	Delete(ctx context.Context, tuple *RelationTuple) error
+	GetByObjectAndRelation(ctx context.Context, object string, relation string) ([]*RelationTuple, error)
+	GetBySubject(ctx context.Context, subject string) ([]*RelationTuple, error)
+	GetByRelationAndSubject(ctx context.Context, relation string, subject string) ([]*RelationTuple, error)
+}
+
+type RelationUseCase interface {
+	Write(ctx context.Context, tuple *RelationTuple) error
+	Delete(ctx context.Context, tuple *RelationTuple) error
+	Check(ctx context.Context, object string, relation string, subject string) (bool, error)
+	Expand(ctx context.Context, object string, relation string) (*SubjectTree, error)
+	ListObjects(ctx context.Context, namespace string, relation string, subject string) ([]string, error)
+	ListSubjects(ctx context.Context, object string, relation string) ([]string, error)
+}
+
+var (
+	ErrInvalidTuple     = errors.New("invalid relation tuple")
+	ErrTupleNotFound    = errors.New("relation tuple not found")
+	ErrUnknownRelation  = errors.New("unknown relation")
+	ErrRelationTooDeep  = errors.New("relation resolution too deep")
+	ErrInvalidNamespace = errors.New("invalid namespace config")
+)
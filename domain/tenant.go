@@ -0,0 +1,36 @@
+package domain
+
+import (
+	"context"
+	"errors"
+)
+
+type tenantKey struct{}
+
+// WithTenant scopes ctx to a tenant, repositories only see the rows of the tenant of ctx.
+// The empty tenant is the default one used when no tenant is set.
+func WithTenant(ctx context.Context, tenantId string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenantId)
+}
+
+// TenantFromContext returns the tenant ctx is scoped to
+func TenantFromContext(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	tenantId, _ := ctx.Value(tenantKey{}).(string)
+	return tenantId
+}
+
+// TenantConfig overrides the global config for a tenant, empty values fall back to the global config
+type TenantConfig struct {
+	DefaultRoleId string `json:"default_role_id" yaml:"default_role_id" mapstructure:"default_role_id"`
+	Password      struct {
+		Policy string `json:"policy" yaml:"policy" mapstructure:"policy"`
+		Cost   string `json:"cost" yaml:"cost" mapstructure:"cost"`
+	} `json:"password" yaml:"password" mapstructure:"password"`
+}
+
+var (
+	ErrTenantMismatch = errors.New("token issued for another tenant")
+)
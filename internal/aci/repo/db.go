@@ -4,9 +4,11 @@ import (
 	"context"
 	"github.com/Runway-Club/auth_lib/common"
 	"github.com/Runway-Club/auth_lib/domain"
-	"github.com/spf13/viper"
+	"github.com/Runway-Club/auth_lib/utils"
 	"gorm.io/gorm"
 	"math"
+	"sort"
+	"strings"
 )
 
 type ACIRepository struct {
@@ -15,7 +17,7 @@ type ACIRepository struct {
 
 func (a *ACIRepository) GetResourcesByUserIdAndResource(ctx context.Context, userId string, resource string) ([]*domain.ACI, error) {
 	found := make([]*domain.ACI, 0)
-	tx := a.db.WithContext(ctx).Where("user_id = ? AND resource = ?", userId, resource).Find(&found)
+	tx := a.scoped(ctx).Where("user_id = ? AND resource = ?", userId, resource).Find(&found)
 	if tx.Error != nil {
 		return found, tx.Error
 	}
@@ -24,7 +26,7 @@ func (a *ACIRepository) GetResourcesByUserIdAndResource(ctx context.Context, use
 
 func (a *ACIRepository) GetResourcesByUserIdAndPayload(ctx context.Context, userId string, payload string) ([]*domain.ACI, error) {
 	found := make([]*domain.ACI, 0)
-	tx := a.db.WithContext(ctx).Where("user_id = ? AND payload = ?", userId, payload).Find(&found)
+	tx := a.scoped(ctx).Where("user_id = ? AND payload = ?", userId, payload).Find(&found)
 	if tx.Error != nil {
 		return found, tx.Error
 	}
@@ -32,37 +34,46 @@ func (a *ACIRepository) GetResourcesByUserIdAndPayload(ctx context.Context, user
 }
 
 func (a *ACIRepository) Update(ctx context.Context, aci *domain.ACI) error {
-	tx := a.db.WithContext(ctx).Save(aci)
-	if tx.Error != nil {
-		return tx.Error
-	}
-	if tx.RowsAffected == 0 {
+	indexResource(aci)
+	// Save would move or create the row in another tenant
+	if aci.TenantId != domain.TenantFromContext(ctx) {
 		return domain.ErrACINotFound
 	}
-	return nil
+	return a.db.WithContext(ctx).Transaction(func(db *gorm.DB) error {
+		tx := save(db, aci)
+		if tx.Error != nil {
+			return tx.Error
+		}
+		if tx.RowsAffected == 0 {
+			return domain.ErrACINotFound
+		}
+		return incrementVersion(db)
+	})
 }
 
 func (a *ACIRepository) Delete(ctx context.Context, id string) error {
-	tx := a.db.WithContext(ctx).Where("id = ?", id).Delete(&domain.ACI{})
-	if tx.Error != nil {
-		return tx.Error
-	}
-	if tx.RowsAffected == 0 {
-		return domain.ErrACINotFound
-	}
-	return nil
+	return a.db.WithContext(ctx).Transaction(func(db *gorm.DB) error {
+		tx := db.Where("tenant_id = ? AND id = ?", domain.TenantFromContext(ctx), id).Delete(&domain.ACI{})
+		if tx.Error != nil {
+			return tx.Error
+		}
+		if tx.RowsAffected == 0 {
+			return domain.ErrACINotFound
+		}
+		return incrementVersion(db)
+	})
 }
 
 func (a *ACIRepository) List(ctx context.Context, query *common.QueryOpts) (*common.ListResult[*domain.ACI], error) {
 	acl := make([]*domain.ACI, 0)
 	offset := (query.Page - 1) * query.Size
-	tx := a.db.WithContext(ctx).Offset(offset).Limit(query.Size).Find(&acl)
+	tx := a.scoped(ctx).Offset(offset).Limit(query.Size).Find(&acl)
 	if tx.Error != nil {
 		return nil, tx.Error
 	}
 	count := int64(0)
 	// count all row
-	a.db.WithContext(ctx).Find(&domain.ACI{}).Count(&count)
+	a.scoped(ctx).Model(&domain.ACI{}).Count(&count)
 	numOfPage := int(math.Ceil(float64(count) / float64(query.Size)))
 
 	return &common.ListResult[*domain.ACI]{
@@ -71,39 +82,163 @@ func (a *ACIRepository) List(ctx context.Context, query *common.QueryOpts) (*com
 	}, nil
 }
 
-type defaultACL struct {
-	ACL []domain.ACI `json:"acl" yaml:"acl"`
-}
-
 func NewACIRepository(dialector gorm.Dialector) *ACIRepository {
 	db, err := gorm.Open(dialector)
 	if err != nil {
 		panic(err)
 	}
 	// migrate schema
-	err = db.AutoMigrate(&domain.ACI{})
-	// init default aci
-	acl := defaultACL{}
-	viper.UnmarshalKey("runway_auth", &acl)
-	for _, item := range acl.ACL {
-		db.Create(&item)
+	err = db.AutoMigrate(&domain.ACI{}, &domain.ACLVersion{})
+	if err != nil {
+		panic(err)
+	}
+	err = migrateTenantKey(db)
+	if err != nil {
+		panic(err)
 	}
 	return &ACIRepository{
 		db: db,
 	}
 }
 
+// save updates every field of aci, Save would insert the items of the default tenant since their
+// tenant_id, a part of the primary key, is zero
+func save(db *gorm.DB, aci *domain.ACI) *gorm.DB {
+	return db.Model(&domain.ACI{}).Where("tenant_id = ? AND id = ?", aci.TenantId, aci.Id).Select("*").Updates(aci)
+}
+
+// migrateTenantKey moves the items of a table keyed by id alone, ids used to be unique across tenants,
+// to a table keyed by tenant and id
+func migrateTenantKey(db *gorm.DB) error {
+	columns, err := db.Migrator().ColumnTypes(&domain.ACI{})
+	if err != nil {
+		return err
+	}
+	for _, column := range columns {
+		if primary, ok := column.PrimaryKey(); column.Name() == "tenant_id" && (primary || !ok) {
+			return nil
+		}
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Migrator().RenameTable("acis", "acis_single_key"); err != nil {
+			return err
+		}
+		// index names are global in some databases
+		for _, index := range []string{"idx_acis_id", "idx_acis_tenant_id", "idx_acis_resource", "idx_acis_role_id",
+			"idx_acis_user_id", "idx_acis_managed_by", "idx_acis_resource_prefix", "idx_acis_wildcard", "idx_acis_deleted_at"} {
+			if tx.Migrator().HasIndex("acis_single_key", index) {
+				if err := tx.Migrator().DropIndex("acis_single_key", index); err != nil {
+					return err
+				}
+			}
+		}
+		if err := tx.Migrator().CreateTable(&domain.ACI{}); err != nil {
+			return err
+		}
+		names := []string{"tenant_id", "id", "created_at", "updated_at", "deleted_at", "resource", "payload", "role_id",
+			"user_id", "effect", "condition", "managed_by", "resource_prefix", "wildcard"}
+		quoted := make([]string, len(names))
+		for i, name := range names {
+			quoted[i] = tx.Statement.Quote(name)
+		}
+		columns := strings.Join(quoted, ", ")
+		if err := tx.Exec("INSERT INTO acis (" + columns + ") SELECT " + columns + " FROM acis_single_key").Error; err != nil {
+			return err
+		}
+		return tx.Migrator().DropTable("acis_single_key")
+	})
+}
+
+// scoped returns a session limited to the tenant of ctx
+func (a *ACIRepository) scoped(ctx context.Context) *gorm.DB {
+	return a.db.WithContext(ctx).Where("tenant_id = ?", domain.TenantFromContext(ctx))
+}
+
 func (a *ACIRepository) Create(ctx context.Context, aci *domain.ACI) error {
-	tx := a.db.WithContext(ctx).Create(aci)
+	aci.TenantId = domain.TenantFromContext(ctx)
+	indexResource(aci)
+	return a.db.WithContext(ctx).Transaction(func(db *gorm.DB) error {
+		tx := db.Create(aci)
+		if tx.Error != nil {
+			return tx.Error
+		}
+		return incrementVersion(db)
+	})
+}
+
+func (a *ACIRepository) GetForSync(ctx context.Context, ids []string) ([]*domain.ACI, error) {
+	found := make([]*domain.ACI, 0)
+	tx := a.db.WithContext(ctx).Unscoped().Where("managed_by = ?", domain.ManagedByConfig).Or("id IN ?", ids).Find(&found)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	return found, nil
+}
+
+func (a *ACIRepository) ApplySync(ctx context.Context, plan *domain.SyncPlan) error {
+	if plan.Empty() {
+		return nil
+	}
+	return a.db.WithContext(ctx).Transaction(func(db *gorm.DB) error {
+		for _, change := range plan.Changes {
+			var tx *gorm.DB
+			switch change.Action {
+			case domain.SyncCreate:
+				indexResource(change.Desired)
+				tx = db.Create(change.Desired)
+			case domain.SyncUpdate:
+				// also restores a deleted item
+				change.Desired.Model = change.Current.Model
+				change.Desired.DeletedAt = gorm.DeletedAt{}
+				indexResource(change.Desired)
+				tx = save(db.Unscoped(), change.Desired)
+			case domain.SyncDelete:
+				// deleted permanently so that the id can be declared again
+				tx = db.Unscoped().Where("tenant_id = ? AND id = ?", change.Current.TenantId, change.Current.Id).Delete(&domain.ACI{})
+			}
+			if tx.Error != nil {
+				return tx.Error
+			}
+		}
+		return incrementVersion(db)
+	})
+}
+
+func (a *ACIRepository) GetAll(ctx context.Context) ([]*domain.ACI, error) {
+	found := make([]*domain.ACI, 0)
+	tx := a.scoped(ctx).Order("id").Find(&found)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	return found, nil
+}
+
+func (a *ACIRepository) GetVersion(ctx context.Context) (int64, error) {
+	version := &domain.ACLVersion{}
+	tx := a.db.WithContext(ctx).Where("id = ?", aclVersionId).Find(version)
+	if tx.Error != nil {
+		return 0, tx.Error
+	}
+	return version.Version, nil
+}
+
+// aclVersionId is the id of the single domain.ACLVersion row
+const aclVersionId = 1
+
+func incrementVersion(db *gorm.DB) error {
+	tx := db.Model(&domain.ACLVersion{}).Where("id = ?", aclVersionId).Update("version", gorm.Expr("version + 1"))
 	if tx.Error != nil {
 		return tx.Error
 	}
+	if tx.RowsAffected == 0 {
+		return db.Create(&domain.ACLVersion{Id: aclVersionId, Version: 1}).Error
+	}
 	return nil
 }
 
 func (a *ACIRepository) GetById(ctx context.Context, id string) (*domain.ACI, error) {
 	found := &domain.ACI{}
-	tx := a.db.WithContext(ctx).Where("id = ?", id).First(&found)
+	tx := a.scoped(ctx).Where("id = ?", id).First(&found)
 	if tx.Error != nil {
 		return nil, tx.Error
 	}
@@ -112,7 +247,7 @@ func (a *ACIRepository) GetById(ctx context.Context, id string) (*domain.ACI, er
 
 func (a *ACIRepository) GetByResource(ctx context.Context, resource string) ([]*domain.ACI, error) {
 	found := make([]*domain.ACI, 0)
-	tx := a.db.WithContext(ctx).Where("resource = ?", resource).Find(&found)
+	tx := a.scoped(ctx).Where("resource = ?", resource).Find(&found)
 	if tx.Error != nil {
 		return found, tx.Error
 	}
@@ -121,7 +256,7 @@ func (a *ACIRepository) GetByResource(ctx context.Context, resource string) ([]*
 
 func (a *ACIRepository) GetByRoleId(ctx context.Context, roleId string) ([]*domain.ACI, error) {
 	found := make([]*domain.ACI, 0)
-	tx := a.db.WithContext(ctx).Where("role_id = ?", roleId).Find(&found)
+	tx := a.scoped(ctx).Where("role_id = ?", roleId).Find(&found)
 	if tx.Error != nil {
 		return found, tx.Error
 	}
@@ -133,7 +268,7 @@ func (a *ACIRepository) GetByRoleId(ctx context.Context, roleId string) ([]*doma
 
 func (a *ACIRepository) GetByPayload(ctx context.Context, payload string) ([]*domain.ACI, error) {
 	found := make([]*domain.ACI, 0)
-	tx := a.db.WithContext(ctx).Where("payload = ?", payload).Find(&found)
+	tx := a.scoped(ctx).Where("payload = ?", payload).Find(&found)
 	if tx.Error != nil {
 		return found, tx.Error
 	}
@@ -145,7 +280,7 @@ func (a *ACIRepository) GetByPayload(ctx context.Context, payload string) ([]*do
 
 func (a *ACIRepository) GetByUserId(ctx context.Context, userId string) ([]*domain.ACI, error) {
 	found := make([]*domain.ACI, 0)
-	tx := a.db.WithContext(ctx).Where("user_id = ?", userId).Find(&found)
+	tx := a.scoped(ctx).Where("user_id = ?", userId).Find(&found)
 	if tx.Error != nil {
 		return found, tx.Error
 	}
@@ -156,25 +291,142 @@ func (a *ACIRepository) GetByUserId(ctx context.Context, userId string) ([]*doma
 }
 
 func (a *ACIRepository) CheckByRoleId(ctx context.Context, roleId string, resource string, payload string) (bool, error) {
-	found := &domain.ACI{}
-	tx := a.db.WithContext(ctx).Where("role_id = ? AND resource = ? AND payload = ?", roleId, resource, payload).First(&found)
-	if tx.Error != nil {
-		return false, tx.Error
+	found, err := a.GetMatching(ctx, "", roleId, resource, payload)
+	if err != nil {
+		return false, err
 	}
-	if tx.RowsAffected == 0 {
+	return allowed(found)
+}
+
+func (a *ACIRepository) CheckByUserId(ctx context.Context, userId string, resource string, payload string) (bool, error) {
+	found, err := a.GetMatching(ctx, userId, "", resource, payload)
+	if err != nil {
+		return false, err
+	}
+	return allowed(found)
+}
+
+func (a *ACIRepository) GetMatching(ctx context.Context, userId string, roleId string, resource string, payload string) ([]*domain.ACI, error) {
+	found, err := a.GetMatchingMany(ctx, userId, roleId, []*domain.ResourcePayload{{Resource: resource, Payload: payload}})
+	if err != nil {
+		return nil, err
+	}
+	return found[0], nil
+}
+
+func (a *ACIRepository) GetMatchingMany(ctx context.Context, userId string, roleId string, requests []*domain.ResourcePayload) ([][]*domain.ACI, error) {
+	resources := make([]string, 0, len(requests))
+	for _, request := range requests {
+		resources = append(resources, request.Resource)
+	}
+	candidates, err := a.findCandidates(ctx, userId, roleId, resources)
+	if err != nil {
+		return nil, err
+	}
+	found := make([][]*domain.ACI, len(requests))
+	for i, request := range requests {
+		payload := request.Payload
+		found[i] = matchCandidates(candidates, userId, request.Resource, func(pattern string) bool {
+			return utils.MatchPayload(pattern, payload)
+		})
+	}
+	return found, nil
+}
+
+func (a *ACIRepository) GetMatchingResource(ctx context.Context, userId string, roleId string, resource string) ([]*domain.ACI, error) {
+	candidates, err := a.findCandidates(ctx, userId, roleId, []string{resource})
+	if err != nil {
+		return nil, err
+	}
+	return matchCandidates(candidates, userId, resource, func(string) bool {
+		return true
+	}), nil
+}
+
+// allowed reports whether at least one of the matching items allows and none denies.
+// There is no request context here, so conditional items never allow but always deny.
+func allowed(found []*domain.ACI) (bool, error) {
+	result := false
+	for _, aci := range found {
+		if aci.IsDeny() {
+			return false, &domain.PermissionDeniedError{Rule: aci}
+		}
+		if aci.Condition == "" {
+			result = true
+		}
+	}
+	if !result {
 		return false, domain.ErrPermissionDenied
 	}
 	return true, nil
 }
 
-func (a *ACIRepository) CheckByUserId(ctx context.Context, userId string, resource string, payload string) (bool, error) {
-	found := &domain.ACI{}
-	tx := a.db.WithContext(ctx).Where("user_id = ? AND resource = ? AND payload = ?", userId, resource, payload).First(&found)
+// findCandidates returns the items of the user or the role which may match one of resources in a
+// single query. Candidates are looked up by the exact resource or by the indexed literal prefix of
+// resource patterns, they still have to be matched in memory.
+func (a *ACIRepository) findCandidates(ctx context.Context, userId string, roleId string, resources []string) ([]*domain.ACI, error) {
+	candidates := make([]*domain.ACI, 0)
+	var subjects *gorm.DB
+	switch {
+	case userId != "" && roleId != "":
+		subjects = a.db.Where("user_id = ?", userId).Or("role_id = ?", roleId)
+	case userId != "":
+		subjects = a.db.Where("user_id = ?", userId)
+	case roleId != "":
+		subjects = a.db.Where("role_id = ?", roleId)
+	default:
+		return candidates, nil
+	}
+	prefixes := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, resource := range resources {
+		for _, prefix := range utils.ResourcePrefixes(resource) {
+			if !seen[prefix] {
+				seen[prefix] = true
+				prefixes = append(prefixes, prefix)
+			}
+		}
+	}
+	tx := a.scoped(ctx).
+		Where(subjects).
+		Where(a.db.Where("resource IN ?", resources).Or("wildcard = ? AND resource_prefix IN ?", true, prefixes)).
+		Find(&candidates)
 	if tx.Error != nil {
-		return false, tx.Error
+		return nil, tx.Error
 	}
-	if tx.RowsAffected == 0 {
-		return false, domain.ErrPermissionDenied
+	return candidates, nil
+}
+
+// matchCandidates returns the candidates matching resource and payload, the items of the user
+// first and the most specific first within each subject
+func matchCandidates(candidates []*domain.ACI, userId string, resource string, matchPayload func(pattern string) bool) []*domain.ACI {
+	userFound := make([]*domain.ACI, 0)
+	roleFound := make([]*domain.ACI, 0)
+	for _, candidate := range candidates {
+		if !utils.MatchResource(candidate.Resource, resource) || !matchPayload(candidate.Payload) {
+			continue
+		}
+		if userId != "" && candidate.UserId == userId {
+			userFound = append(userFound, candidate)
+		} else {
+			roleFound = append(roleFound, candidate)
+		}
+	}
+	bySpecificity := func(found []*domain.ACI) {
+		sort.SliceStable(found, func(i, j int) bool {
+			return utils.CompareSpecificity(found[i].Resource, found[i].Payload, found[j].Resource, found[j].Payload) < 0
+		})
+	}
+	bySpecificity(userFound)
+	bySpecificity(roleFound)
+	return append(userFound, roleFound...)
+}
+
+// indexResource fills the lookup columns derived from aci.Resource
+func indexResource(aci *domain.ACI) {
+	aci.Wildcard = utils.IsResourcePattern(aci.Resource)
+	aci.ResourcePrefix = ""
+	if aci.Wildcard {
+		aci.ResourcePrefix = utils.ResourcePatternPrefix(aci.Resource)
 	}
-	return true, nil
 }
@@ -7,6 +7,7 @@ import (
 	"github.com/Runway-Club/auth_lib/internal/aci/repo"
 	"github.com/spf13/viper"
 	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
 	"testing"
 )
 
@@ -38,4 +39,94 @@ func TestACIRepository(t *testing.T) {
 			t.Error("invalid result")
 		}
 	})
+	t.Run("check with resource patterns", func(t *testing.T) {
+		for _, aci := range []*domain.ACI{
+			{Id: "200", Resource: "v2/course.*", RoleId: "editor", Payload: "*"},
+			{Id: "201", Resource: "v2/**", RoleId: "owner", Payload: "*"},
+			{Id: "202", Resource: "v2/*/lesson.GET", UserId: "u1", Payload: "course-*"},
+		} {
+			err := aciRepo.Create(context.Background(), aci)
+			if err != nil {
+				t.Error(err)
+			}
+		}
+		cases := []struct {
+			check    func(ctx context.Context, subject, resource, payload string) (bool, error)
+			subject  string
+			resource string
+			payload  string
+			expected bool
+		}{
+			{aciRepo.CheckByRoleId, "editor", "v2/course.PUT", "demo", true},
+			{aciRepo.CheckByRoleId, "editor", "v2/course/lesson.PUT", "demo", false},
+			{aciRepo.CheckByRoleId, "owner", "v2/course/lesson.DELETE", "", true},
+			{aciRepo.CheckByRoleId, "owner", "v3/course.GET", "", false},
+			{aciRepo.CheckByUserId, "u1", "v2/course/lesson.GET", "course-1", true},
+			{aciRepo.CheckByUserId, "u1", "v2/course/lesson.GET", "demo", false},
+		}
+		for _, c := range cases {
+			result, _ := c.check(context.Background(), c.subject, c.resource, c.payload)
+			if result != c.expected {
+				t.Errorf("%s on %s/%s: expected %v, got %v", c.subject, c.resource, c.payload, c.expected, result)
+			}
+		}
+	})
+	t.Run("ids are unique within a tenant", func(t *testing.T) {
+		tenantCtx := domain.WithTenant(context.Background(), "club-a")
+		err := aciRepo.Create(tenantCtx, &domain.ACI{Id: "200", Resource: "v2/course.GET", Payload: "*"})
+		if err != nil {
+			t.Errorf("expected an id of another tenant to be usable, got %v", err)
+		}
+		err = aciRepo.Create(tenantCtx, &domain.ACI{Id: "200", Resource: "v2/course.PUT", Payload: "*"})
+		if err == nil {
+			t.Error("expected a duplicate id in a tenant to be rejected")
+		}
+	})
+	t.Run("version changes on write", func(t *testing.T) {
+		before, err := aciRepo.GetVersion(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+		err = aciRepo.Delete(context.Background(), "100")
+		if err != nil {
+			t.Error(err)
+		}
+		after, err := aciRepo.GetVersion(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+		if after <= before {
+			t.Errorf("expected version after %d, got %d", before, after)
+		}
+	})
+}
+
+func TestACIRepositoryMigratesTenantKey(t *testing.T) {
+	dsn := "file:aci_migration?mode=memory&cache=shared"
+	db, err := gorm.Open(sqlite.Open(dsn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the table of the items keyed by id alone
+	err = db.Exec("CREATE TABLE `acis` (`id` text,`created_at` datetime,`updated_at` datetime,`deleted_at` datetime," +
+		"`tenant_id` text,`resource` text,`payload` text,`role_id` text,`user_id` text,`effect` text,`condition` text," +
+		"`managed_by` text,`resource_prefix` text,`wildcard` numeric,PRIMARY KEY (`id`))").Error
+	if err == nil {
+		err = db.Exec("CREATE INDEX `idx_acis_resource` ON `acis`(`resource`)").Error
+	}
+	if err == nil {
+		err = db.Exec("INSERT INTO `acis` (`id`, `tenant_id`, `resource`, `payload`) VALUES ('1', '', 'v1/course.GET', '*')").Error
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	aciRepo := repo.NewACIRepository(sqlite.Open(dsn))
+	found, err := aciRepo.GetById(context.Background(), "1")
+	if err != nil || found.Resource != "v1/course.GET" {
+		t.Fatalf("expected the item to be migrated, got %v %v", found, err)
+	}
+	err = aciRepo.Create(domain.WithTenant(context.Background(), "club-a"), &domain.ACI{Id: "1", Resource: "v1/course.PUT"})
+	if err != nil {
+		t.Errorf("expected an id of another tenant to be usable, got %v", err)
+	}
 }
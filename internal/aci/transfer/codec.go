@@ -0,0 +1,172 @@
+package transfer
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"github.com/Runway-Club/auth_lib/domain"
+	"gopkg.in/yaml.v3"
+	"io"
+	"strings"
+)
+
+// item is the exported form of domain.ACI, its yaml keys match the runway_auth.acl config
+type item struct {
+	Id        string `json:"id" yaml:"id"`
+	TenantId  string `json:"tenant_id,omitempty" yaml:"tenantId,omitempty"`
+	Resource  string `json:"resource" yaml:"resource"`
+	Payload   string `json:"payload,omitempty" yaml:"payload,omitempty"`
+	RoleId    string `json:"role_id,omitempty" yaml:"roleId,omitempty"`
+	UserId    string `json:"user_id,omitempty" yaml:"userId,omitempty"`
+	Effect    string `json:"effect,omitempty" yaml:"effect,omitempty"`
+	Condition string `json:"condition,omitempty" yaml:"condition,omitempty"`
+}
+
+// user is the exported form of a static domain.Auth, without password
+type user struct {
+	Id       string `json:"id" yaml:"id"`
+	TenantId string `json:"tenant_id,omitempty" yaml:"tenant_id,omitempty"`
+	Username string `json:"username" yaml:"username"`
+	RoleId   string `json:"role_id" yaml:"role_id"`
+}
+
+type document struct {
+	ACL         []*item  `json:"acl" yaml:"acl"`
+	StaticUsers []*user  `json:"static_users,omitempty" yaml:"static_users,omitempty"`
+	Roles       []string `json:"roles,omitempty" yaml:"roles,omitempty"`
+}
+
+var csvHeader = []string{"id", "tenant_id", "resource", "payload", "role_id", "user_id", "effect", "condition"}
+
+func toItem(aci *domain.ACI) *item {
+	return &item{
+		Id:        aci.Id,
+		TenantId:  aci.TenantId,
+		Resource:  aci.Resource,
+		Payload:   aci.Payload,
+		RoleId:    aci.RoleId,
+		UserId:    aci.UserId,
+		Effect:    string(aci.Effect),
+		Condition: aci.Condition,
+	}
+}
+
+func (i *item) toACI() *domain.ACI {
+	return &domain.ACI{
+		Id:        i.Id,
+		TenantId:  i.TenantId,
+		Resource:  i.Resource,
+		Payload:   i.Payload,
+		RoleId:    i.RoleId,
+		UserId:    i.UserId,
+		Effect:    domain.Effect(i.Effect),
+		Condition: i.Condition,
+	}
+}
+
+func toDocument(acl *domain.ACLDocument) *document {
+	doc := &document{ACL: make([]*item, 0, len(acl.ACL)), Roles: acl.Roles}
+	for _, aci := range acl.ACL {
+		doc.ACL = append(doc.ACL, toItem(aci))
+	}
+	for _, auth := range acl.StaticUsers {
+		doc.StaticUsers = append(doc.StaticUsers, &user{Id: auth.Id, TenantId: auth.TenantId, Username: auth.Username, RoleId: auth.RoleId})
+	}
+	return doc
+}
+
+func (d *document) toACLDocument() *domain.ACLDocument {
+	acl := &domain.ACLDocument{ACL: make([]*domain.ACI, 0, len(d.ACL)), Roles: d.Roles}
+	for _, item := range d.ACL {
+		acl.ACL = append(acl.ACL, item.toACI())
+	}
+	for _, user := range d.StaticUsers {
+		acl.StaticUsers = append(acl.StaticUsers, &domain.Auth{Id: user.Id, TenantId: user.TenantId, Username: user.Username, RoleId: user.RoleId})
+	}
+	return acl
+}
+
+func Encode(w io.Writer, acl *domain.ACLDocument, format domain.ACLFormat) error {
+	doc := toDocument(acl)
+	switch format {
+	case domain.FormatYAML:
+		encoder := yaml.NewEncoder(w)
+		encoder.SetIndent(2)
+		err := encoder.Encode(doc)
+		if err != nil {
+			return err
+		}
+		return encoder.Close()
+	case domain.FormatJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(doc)
+	case domain.FormatCSV:
+		writer := csv.NewWriter(w)
+		err := writer.Write(csvHeader)
+		if err != nil {
+			return err
+		}
+		for _, item := range doc.ACL {
+			err = writer.Write([]string{item.Id, item.TenantId, item.Resource, item.Payload, item.RoleId, item.UserId, item.Effect, item.Condition})
+			if err != nil {
+				return err
+			}
+		}
+		writer.Flush()
+		return writer.Error()
+	}
+	return domain.ErrInvalidFormat
+}
+
+func Decode(r io.Reader, format domain.ACLFormat) (*domain.ACLDocument, error) {
+	doc := &document{}
+	switch format {
+	case domain.FormatYAML:
+		err := yaml.NewDecoder(r).Decode(doc)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+	case domain.FormatJSON:
+		err := json.NewDecoder(r).Decode(doc)
+		if err != nil {
+			return nil, err
+		}
+	case domain.FormatCSV:
+		records, err := csv.NewReader(r).ReadAll()
+		if err != nil {
+			return nil, err
+		}
+		if len(records) == 0 {
+			return nil, domain.ErrInvalidFormat
+		}
+		// columns are matched by header so that they can be reordered or omitted
+		columns := make(map[string]int)
+		for i, name := range records[0] {
+			columns[strings.TrimSpace(name)] = i
+		}
+		if _, ok := columns["resource"]; !ok {
+			return nil, domain.ErrInvalidFormat
+		}
+		value := func(record []string, name string) string {
+			if i, ok := columns[name]; ok && i < len(record) {
+				return record[i]
+			}
+			return ""
+		}
+		for _, record := range records[1:] {
+			doc.ACL = append(doc.ACL, &item{
+				Id:        value(record, "id"),
+				TenantId:  value(record, "tenant_id"),
+				Resource:  value(record, "resource"),
+				Payload:   value(record, "payload"),
+				RoleId:    value(record, "role_id"),
+				UserId:    value(record, "user_id"),
+				Effect:    value(record, "effect"),
+				Condition: value(record, "condition"),
+			})
+		}
+	default:
+		return nil, domain.ErrInvalidFormat
+	}
+	return doc.toACLDocument(), nil
+}
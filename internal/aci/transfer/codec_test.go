@@ -0,0 +1,58 @@
+package transfer_test
+
+import (
+	"bytes"
+	"github.com/Runway-Club/auth_lib/domain"
+	"github.com/Runway-Club/auth_lib/internal/aci/transfer"
+	"strings"
+	"testing"
+)
+
+func TestCodec(t *testing.T) {
+	doc := &domain.ACLDocument{
+		ACL: []*domain.ACI{
+			{Id: "1", Resource: "v1/course.*", RoleId: "admin"},
+			{Id: "2", Resource: "v1/course.GET", UserId: "u1", Payload: "demo", Effect: domain.EffectDeny, Condition: `request.ip != ""`},
+		},
+		StaticUsers: []*domain.Auth{{Id: "admin", Username: "admin", Password: "secret", RoleId: "admin"}},
+		Roles:       []string{"admin"},
+	}
+	for _, format := range []domain.ACLFormat{domain.FormatYAML, domain.FormatJSON, domain.FormatCSV} {
+		t.Run("round trip "+string(format), func(t *testing.T) {
+			buffer := &bytes.Buffer{}
+			err := transfer.Encode(buffer, doc, format)
+			if err != nil {
+				t.Error(err)
+			}
+			if strings.Contains(buffer.String(), "secret") {
+				t.Error("password must not be exported")
+			}
+			decoded, err := transfer.Decode(buffer, format)
+			if err != nil {
+				t.Error(err)
+			}
+			if len(decoded.ACL) != 2 {
+				t.Fatalf("expected 2 items, got %d", len(decoded.ACL))
+			}
+			second := decoded.ACL[1]
+			if second.Id != "2" || second.UserId != "u1" || second.Payload != "demo" || second.Effect != domain.EffectDeny || second.Condition != `request.ip != ""` {
+				t.Errorf("unexpected item %+v", second)
+			}
+		})
+	}
+	t.Run("yaml matches the config schema", func(t *testing.T) {
+		decoded, err := transfer.Decode(strings.NewReader("acl:\n  - id: \"1\"\n    resource: \"v1/course.PUT\"\n    roleId: \"admin\"\n"), domain.FormatYAML)
+		if err != nil {
+			t.Error(err)
+		}
+		if len(decoded.ACL) != 1 || decoded.ACL[0].RoleId != "admin" {
+			t.Errorf("unexpected acl %+v", decoded.ACL)
+		}
+	})
+	t.Run("csv requires a resource column", func(t *testing.T) {
+		_, err := transfer.Decode(strings.NewReader("id,role_id\n1,admin\n"), domain.FormatCSV)
+		if err != domain.ErrInvalidFormat {
+			t.Errorf("expected invalid format, got %v", err)
+		}
+	})
+}
@@ -2,14 +2,516 @@ package usecase
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/Runway-Club/auth_lib/common"
 	"github.com/Runway-Club/auth_lib/domain"
+	"github.com/Runway-Club/auth_lib/internal/cache"
+	"github.com/Runway-Club/auth_lib/utils"
+	"github.com/spf13/viper"
+	"log"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 )
 
 type ACIUseCase struct {
-	aciRepo domain.ACIRepository
+	aciRepo   domain.ACIRepository
+	combining domain.CombiningAlgorithm
+	// matching items by matchKey, nil when the cache is disabled
+	cache        *cache.LRU[matchKey, []*domain.ACI]
+	pollInterval time.Duration
+	versionMu    sync.Mutex
+	version      int64
+	polledAt     time.Time
+}
+
+type matchKey struct {
+	tenantId string
+	userId   string
+	roleId   string
+	resource string
+	payload  string
+}
+
+// getMatching caches the matching items rather than decisions, conditions are evaluated on every check
+func (a *ACIUseCase) getMatching(ctx context.Context, userId string, roleId string, resource string, payload string) ([]*domain.ACI, error) {
+	if a.cache == nil {
+		return a.aciRepo.GetMatching(ctx, userId, roleId, resource, payload)
+	}
+	a.pollVersion(ctx)
+	key := matchKey{domain.TenantFromContext(ctx), userId, roleId, resource, payload}
+	if found, ok := a.cache.Get(key); ok {
+		return found, nil
+	}
+	found, err := a.aciRepo.GetMatching(ctx, userId, roleId, resource, payload)
+	if err != nil {
+		return nil, err
+	}
+	a.cache.Set(key, found)
+	return found, nil
+}
+
+// pollVersion purges the cache when another instance changed the ACL since the last poll. A single
+// check per interval queries the version, the others keep serving from the cache meanwhile.
+func (a *ACIUseCase) pollVersion(ctx context.Context) {
+	a.versionMu.Lock()
+	if time.Since(a.polledAt) < a.pollInterval {
+		a.versionMu.Unlock()
+		return
+	}
+	// a failed poll is not retried before the next interval either
+	a.polledAt = time.Now()
+	a.versionMu.Unlock()
+	version, err := a.aciRepo.GetVersion(ctx)
+	if err != nil {
+		// keep serving from the cache, entries still expire after the ttl
+		log.Print(err)
+		return
+	}
+	a.versionMu.Lock()
+	defer a.versionMu.Unlock()
+	if version != a.version {
+		a.version = version
+		a.cache.Purge()
+	}
+}
+
+// invalidate purges the cache after a write of this instance
+func (a *ACIUseCase) invalidate() {
+	if a.cache != nil {
+		a.cache.Purge()
+	}
+}
+
+func (a *ACIUseCase) CheckPermission(ctx context.Context, userId string, roleId string, resource string, payload string, attrs *domain.Attributes) error {
+	matching, err := a.getMatching(ctx, userId, roleId, resource, payload)
+	if err != nil {
+		return err
+	}
+	rule, allowed := a.decide(applicable(matching, attrs))
+	if !allowed {
+		return &domain.PermissionDeniedError{Rule: rule}
+	}
+	return nil
+}
+
+func (a *ACIUseCase) CheckPermissions(ctx context.Context, userId string, roleId string, requests []*domain.ResourcePayload, attrs *domain.Attributes) ([]*domain.Decision, error) {
+	matching := make([][]*domain.ACI, len(requests))
+	// look up the requests missing from the cache in a single query
+	missing := make([]*domain.ResourcePayload, 0, len(requests))
+	missingIndexes := make([]int, 0, len(requests))
+	if a.cache != nil {
+		a.pollVersion(ctx)
+	}
+	for i, request := range requests {
+		if a.cache != nil {
+			if found, ok := a.cache.Get(matchKey{domain.TenantFromContext(ctx), userId, roleId, request.Resource, request.Payload}); ok {
+				matching[i] = found
+				continue
+			}
+		}
+		missing = append(missing, request)
+		missingIndexes = append(missingIndexes, i)
+	}
+	if len(missing) > 0 {
+		found, err := a.aciRepo.GetMatchingMany(ctx, userId, roleId, missing)
+		if err != nil {
+			return nil, err
+		}
+		for i, index := range missingIndexes {
+			matching[index] = found[i]
+			if a.cache != nil {
+				a.cache.Set(matchKey{domain.TenantFromContext(ctx), userId, roleId, missing[i].Resource, missing[i].Payload}, found[i])
+			}
+		}
+	}
+	decisions := make([]*domain.Decision, len(requests))
+	for i, request := range requests {
+		rule, allowed := a.decide(applicable(matching[i], attrs))
+		decisions[i] = &domain.Decision{
+			Resource: request.Resource,
+			Payload:  request.Payload,
+			Allowed:  allowed,
+			Rule:     rule,
+		}
+	}
+	return decisions, nil
+}
+
+func (a *ACIUseCase) ListAllowedPayloads(ctx context.Context, userId string, roleId string, resource string, attrs *domain.Attributes) (*domain.AllowedPayloads, error) {
+	matching, err := a.aciRepo.GetMatchingResource(ctx, userId, roleId, resource)
+	if err != nil {
+		return nil, err
+	}
+	found := applicable(matching, attrs)
+	seen := make(map[string]bool)
+	allowed := &domain.AllowedPayloads{Payloads: make([]string, 0), Except: make([]string, 0)}
+	for _, aci := range found {
+		if aci.IsDeny() || seen[aci.Payload] {
+			continue
+		}
+		seen[aci.Payload] = true
+		if !a.decidePayload(found, aci.Payload) {
+			continue
+		}
+		allowed.Payloads = append(allowed.Payloads, aci.Payload)
+		// the deny items within the pattern are exceptions unless an allow item still wins for them
+		for _, other := range found {
+			if other.IsDeny() && !seen[other.Payload] && utils.PayloadsOverlap(aci.Payload, other.Payload) &&
+				!a.decidePayload(found, other.Payload) {
+				seen[other.Payload] = true
+				allowed.Except = append(allowed.Except, other.Payload)
+			}
+		}
+	}
+	sort.Strings(allowed.Payloads)
+	sort.Strings(allowed.Except)
+	return allowed, nil
+}
+
+// decidePayload decides the items of found as if payload, possibly a pattern, was requested
+func (a *ACIUseCase) decidePayload(found []*domain.ACI, payload string) bool {
+	payloadFound := make([]*domain.ACI, 0, len(found))
+	for _, aci := range found {
+		if utils.MatchPayload(aci.Payload, payload) {
+			payloadFound = append(payloadFound, aci)
+		}
+	}
+	_, allowed := a.decide(payloadFound)
+	return allowed
+}
+
+func (a *ACIUseCase) Explain(ctx context.Context, userId string, roleId string, resource string, payload string, attrs *domain.Attributes) (*domain.Explanation, error) {
+	explanation := &domain.Explanation{
+		Resource:   resource,
+		Payload:    payload,
+		TokenValid: true,
+		UserId:     userId,
+		RoleId:     roleId,
+		TenantId:   domain.TenantFromContext(ctx),
+		Combining:  a.combining,
+		Rules:      make([]*domain.RuleTrace, 0),
+	}
+	seen := make(map[string]bool)
+	for _, subject := range []struct {
+		name  string
+		id    string
+		getBy func(ctx context.Context, id string) ([]*domain.ACI, error)
+	}{
+		{"user", userId, a.aciRepo.GetByUserId},
+		{"role", roleId, a.aciRepo.GetByRoleId},
+	} {
+		if subject.id == "" {
+			continue
+		}
+		found, err := subject.getBy(ctx, subject.id)
+		if err != nil && !errors.Is(err, domain.ErrACINotFound) {
+			return nil, err
+		}
+		sort.SliceStable(found, func(i, j int) bool {
+			return utils.CompareSpecificity(found[i].Resource, found[i].Payload, found[j].Resource, found[j].Payload) < 0
+		})
+		for _, aci := range found {
+			if seen[aci.Id] {
+				continue
+			}
+			seen[aci.Id] = true
+			explanation.Rules = append(explanation.Rules, traceRule(aci, subject.name, resource, payload, attrs))
+		}
+	}
+	applied := make([]*domain.ACI, 0)
+	for _, trace := range explanation.Rules {
+		if trace.Applies {
+			applied = append(applied, trace.Rule)
+		}
+	}
+	explanation.DecidingRule, explanation.Allowed = a.decide(applied)
+	switch {
+	case explanation.DecidingRule == nil:
+		explanation.Reason = "no aci applies"
+	case explanation.Allowed:
+		explanation.Reason = fmt.Sprintf("allowed by aci %s (%s)", explanation.DecidingRule.Id, a.combining)
+	default:
+		explanation.Reason = fmt.Sprintf("denied by aci %s (%s)", explanation.DecidingRule.Id, a.combining)
+	}
+	return explanation, nil
+}
+
+func traceRule(aci *domain.ACI, subject string, resource string, payload string, attrs *domain.Attributes) *domain.RuleTrace {
+	trace := &domain.RuleTrace{Rule: aci, Subject: subject}
+	if !utils.MatchResource(aci.Resource, resource) {
+		trace.Reason = fmt.Sprintf("resource %q does not match %q", resource, aci.Resource)
+		return trace
+	}
+	if !utils.MatchPayload(aci.Payload, payload) {
+		trace.Reason = fmt.Sprintf("payload %q does not match %q", payload, aci.Payload)
+		return trace
+	}
+	if aci.Condition != "" {
+		ok, err := utils.EvaluateCondition(aci.Condition, attrs)
+		if err != nil {
+			// see applicable
+			trace.Applies = aci.IsDeny()
+			trace.Reason = fmt.Sprintf("condition failed to evaluate: %v", err)
+			return trace
+		}
+		if !ok {
+			trace.Reason = "condition is false"
+			return trace
+		}
+	}
+	trace.Applies = true
+	trace.Reason = "matches"
+	if aci.IsDeny() {
+		trace.Reason = "matches, denies"
+	}
+	return trace
+}
+
+// LoadDeclaredACL returns the items declared in runway_auth.acl
+func LoadDeclaredACL() ([]*domain.ACI, error) {
+	declared := make([]*domain.ACI, 0)
+	err := viper.UnmarshalKey("runway_auth.acl", &declared)
+	if err != nil {
+		return nil, err
+	}
+	return declared, nil
+}
+
+// keyOf identifies an item across tenants, ids are unique within a tenant
+func keyOf(aci *domain.ACI) string {
+	return aci.TenantId + "/" + aci.Id
+}
+
+func (a *ACIUseCase) PlanSync(ctx context.Context, declared []*domain.ACI) (*domain.SyncPlan, error) {
+	ids := make([]string, 0, len(declared))
+	keys := make([]string, 0, len(declared))
+	desired := make(map[string]*domain.ACI)
+	for _, aci := range declared {
+		if aci.Id == "" || aci.Resource == "" || !validEffect(aci.Effect) || desired[keyOf(aci)] != nil {
+			return nil, domain.ErrInvalidACI
+		}
+		if err := utils.ValidateCondition(aci.Condition); err != nil {
+			return nil, err
+		}
+		item := *aci
+		item.ManagedBy = domain.ManagedByConfig
+		desired[keyOf(aci)] = &item
+		ids = append(ids, aci.Id)
+		keys = append(keys, keyOf(aci))
+	}
+	found, err := a.aciRepo.GetForSync(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	current := make(map[string]*domain.ACI)
+	for _, aci := range found {
+		current[keyOf(aci)] = aci
+	}
+	plan := &domain.SyncPlan{Changes: make([]*domain.SyncChange, 0)}
+	for _, key := range keys {
+		existing, ok := current[key]
+		switch {
+		case !ok:
+			plan.Changes = append(plan.Changes, &domain.SyncChange{Action: domain.SyncCreate, Desired: desired[key]})
+		case existing.DeletedAt.Valid || !sameRule(existing, desired[key]):
+			// an item created through the api with a declared id is taken over by the config
+			plan.Changes = append(plan.Changes, &domain.SyncChange{Action: domain.SyncUpdate, Current: existing, Desired: desired[key]})
+		}
+	}
+	for _, aci := range found {
+		if aci.ManagedBy == domain.ManagedByConfig && desired[keyOf(aci)] == nil && !aci.DeletedAt.Valid {
+			plan.Changes = append(plan.Changes, &domain.SyncChange{Action: domain.SyncDelete, Current: aci})
+		}
+	}
+	return plan, nil
+}
+
+func (a *ACIUseCase) ApplySync(ctx context.Context, plan *domain.SyncPlan) error {
+	defer a.invalidate()
+	err := a.aciRepo.ApplySync(ctx, plan)
+	if err != nil && a.converged(ctx, plan) {
+		// replicas starting together apply the same plan, the one losing the race finds it applied
+		return nil
+	}
+	return err
+}
+
+// converged reports whether the changes of plan are already applied
+func (a *ACIUseCase) converged(ctx context.Context, plan *domain.SyncPlan) bool {
+	ids := make([]string, 0, len(plan.Changes))
+	for _, change := range plan.Changes {
+		if change.Desired != nil {
+			ids = append(ids, change.Desired.Id)
+		} else {
+			ids = append(ids, change.Current.Id)
+		}
+	}
+	found, err := a.aciRepo.GetForSync(ctx, ids)
+	if err != nil {
+		return false
+	}
+	current := make(map[string]*domain.ACI)
+	for _, aci := range found {
+		if !aci.DeletedAt.Valid {
+			current[keyOf(aci)] = aci
+		}
+	}
+	for _, change := range plan.Changes {
+		if change.Action == domain.SyncDelete {
+			if current[keyOf(change.Current)] != nil {
+				return false
+			}
+			continue
+		}
+		if existing := current[keyOf(change.Desired)]; existing == nil || !sameRule(existing, change.Desired) {
+			return false
+		}
+	}
+	return true
+}
+
+func (a *ACIUseCase) PlanImport(ctx context.Context, items []*domain.ACI, mode domain.ImportMode) (*domain.SyncPlan, error) {
+	if mode != domain.ImportMerge && mode != domain.ImportReplace && mode != domain.ImportFailOnConflict {
+		return nil, domain.ErrInvalidFormat
+	}
+	tenantId := domain.TenantFromContext(ctx)
+	ids := make([]string, 0, len(items))
+	imported := make(map[string]*domain.ACI)
+	importedRules := make(map[string]string)
+	for i, aci := range items {
+		if aci.Id == "" || aci.Resource == "" || !validEffect(aci.Effect) {
+			return nil, fmt.Errorf("%w: item %d", domain.ErrInvalidACI, i+1)
+		}
+		if aci.TenantId != "" && aci.TenantId != tenantId {
+			return nil, fmt.Errorf("%w: item %d belongs to tenant %s", domain.ErrInvalidACI, i+1, aci.TenantId)
+		}
+		if imported[aci.Id] != nil {
+			return nil, fmt.Errorf("%w: duplicate id %s", domain.ErrInvalidACI, aci.Id)
+		}
+		if err := utils.ValidateCondition(aci.Condition); err != nil {
+			return nil, fmt.Errorf("%w: item %d", err, i+1)
+		}
+		if id, ok := importedRules[ruleOf(aci)]; ok {
+			return nil, fmt.Errorf("%w: %s duplicates the rule of %s", domain.ErrInvalidACI, aci.Id, id)
+		}
+		importedRules[ruleOf(aci)] = aci.Id
+		item := *aci
+		item.TenantId = tenantId
+		item.ManagedBy = ""
+		imported[aci.Id] = &item
+		ids = append(ids, aci.Id)
+	}
+	found, err := a.aciRepo.GetForSync(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	existing := make(map[string]*domain.ACI)
+	for _, aci := range found {
+		if aci.TenantId != tenantId || imported[aci.Id] == nil {
+			continue
+		}
+		// config managed items belong to the sync
+		if aci.ManagedBy == domain.ManagedByConfig || (!aci.DeletedAt.Valid && mode == domain.ImportFailOnConflict) {
+			return nil, fmt.Errorf("%w: %s", domain.ErrACIConflict, aci.Id)
+		}
+		existing[aci.Id] = aci
+	}
+	all, err := a.aciRepo.GetAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// the items of the tenant with the rule of an imported item under another id
+	duplicates := make(map[string]*domain.ACI)
+	for _, aci := range all {
+		id, ok := importedRules[ruleOf(aci)]
+		// replaced items are deleted unless the config manages them
+		if !ok || id == aci.Id || (mode == domain.ImportReplace && aci.ManagedBy != domain.ManagedByConfig) {
+			continue
+		}
+		if mode == domain.ImportFailOnConflict {
+			return nil, fmt.Errorf("%w: %s duplicates the rule of %s", domain.ErrACIConflict, id, aci.Id)
+		}
+		duplicates[id] = aci
+	}
+	plan := &domain.SyncPlan{Changes: make([]*domain.SyncChange, 0)}
+	for _, id := range ids {
+		current, ok := existing[id]
+		switch {
+		case duplicates[id] != nil && !ok:
+			plan.Notes = append(plan.Notes, fmt.Sprintf("aci %s is not imported, aci %s has the same rule", id, duplicates[id].Id))
+		case !ok:
+			plan.Changes = append(plan.Changes, &domain.SyncChange{Action: domain.SyncCreate, Desired: imported[id]})
+		case current.DeletedAt.Valid || !sameRule(current, imported[id]):
+			plan.Changes = append(plan.Changes, &domain.SyncChange{Action: domain.SyncUpdate, Current: current, Desired: imported[id]})
+		}
+	}
+	if mode == domain.ImportReplace {
+		for _, aci := range all {
+			if imported[aci.Id] == nil && aci.ManagedBy != domain.ManagedByConfig {
+				plan.Changes = append(plan.Changes, &domain.SyncChange{Action: domain.SyncDelete, Current: aci})
+			}
+		}
+	}
+	return plan, nil
+}
+
+func (a *ACIUseCase) GetAll(ctx context.Context) ([]*domain.ACI, error) {
+	return a.aciRepo.GetAll(ctx)
+}
+
+func sameRule(current *domain.ACI, desired *domain.ACI) bool {
+	return current.TenantId == desired.TenantId &&
+		ruleOf(current) == ruleOf(desired) &&
+		current.ManagedBy == desired.ManagedBy
+}
+
+// ruleOf returns what an item grants or denies to whom, items with the same rule are duplicates
+func ruleOf(aci *domain.ACI) string {
+	effect := aci.Effect
+	if effect == "" {
+		effect = domain.EffectAllow
+	}
+	return strings.Join([]string{aci.Resource, aci.Payload, aci.RoleId, aci.UserId, string(effect), aci.Condition}, "\x00")
+}
+
+// decide combines the applicable items, rule is the item which decided or nil when none applies
+func (a *ACIUseCase) decide(found []*domain.ACI) (rule *domain.ACI, allowed bool) {
+	if len(found) == 0 {
+		return nil, false
+	}
+	if a.combining == domain.FirstApplicable {
+		return found[0], !found[0].IsDeny()
+	}
+	// deny overrides
+	for _, aci := range found {
+		if aci.IsDeny() {
+			return aci, false
+		}
+	}
+	return found[0], true
+}
+
+// applicable filters out items whose condition does not hold. A condition failing to evaluate
+// never grants access but still denies.
+func applicable(found []*domain.ACI, attrs *domain.Attributes) []*domain.ACI {
+	result := make([]*domain.ACI, 0, len(found))
+	for _, aci := range found {
+		ok, err := utils.EvaluateCondition(aci.Condition, attrs)
+		if err != nil {
+			ok = aci.IsDeny()
+		}
+		if ok {
+			result = append(result, aci)
+		}
+	}
+	return result
+}
+
+func validEffect(effect domain.Effect) bool {
+	return effect == "" || effect == domain.EffectAllow || effect == domain.EffectDeny
 }
 
 func (a *ACIUseCase) GetResourcesByUserIdAndResource(ctx context.Context, userId string, resource string) ([]*domain.ACI, error) {
@@ -21,19 +523,28 @@ func (a *ACIUseCase) GetResourcesByUserIdAndPayload(ctx context.Context, userId
 }
 
 func (a *ACIUseCase) Update(ctx context.Context, aci *domain.ACI) error {
-	if aci.Id == "" {
+	if aci.Id == "" || !validEffect(aci.Effect) {
 		return domain.ErrInvalidACI
 	}
+	if err := utils.ValidateCondition(aci.Condition); err != nil {
+		return err
+	}
 	// check if aci exist
 	foundACI, err := a.aciRepo.GetById(ctx, aci.Id)
 	if err != nil || foundACI == nil {
 		return domain.ErrACINotFound
 	}
+	aci.Model = foundACI.Model
+	aci.TenantId = foundACI.TenantId
+	// an item managed by the config stays managed, the next sync restores its declared rule
+	aci.ManagedBy = foundACI.ManagedBy
 
+	defer a.invalidate()
 	return a.aciRepo.Update(ctx, aci)
 }
 
 func (a *ACIUseCase) Delete(ctx context.Context, id string) error {
+	defer a.invalidate()
 	return a.aciRepo.Delete(ctx, id)
 }
 
@@ -42,13 +553,17 @@ func (a *ACIUseCase) List(ctx context.Context, query *common.QueryOpts) (*common
 }
 
 func (a *ACIUseCase) Create(ctx context.Context, aci *domain.ACI) error {
-	if aci.Resource == "" {
+	if aci.Resource == "" || !validEffect(aci.Effect) {
 		return domain.ErrInvalidACI
 	}
+	if err := utils.ValidateCondition(aci.Condition); err != nil {
+		return err
+	}
 	// create random id if aci.id is empty
 	if aci.Id == "" {
 		aci.Id = fmt.Sprintf("%d", time.Now().UnixMilli())
 	}
+	defer a.invalidate()
 	return a.aciRepo.Create(ctx, aci)
 }
 
@@ -73,7 +588,29 @@ func (a *ACIUseCase) GetByUserId(ctx context.Context, userId string) ([]*domain.
 }
 
 func NewACIUseCase(aciRepo domain.ACIRepository) *ACIUseCase {
-	return &ACIUseCase{
-		aciRepo: aciRepo,
+	combining := domain.CombiningAlgorithm(viper.GetString("runway_auth.acl_combining"))
+	if combining == "" {
+		combining = domain.DenyOverrides
+	}
+	if combining != domain.DenyOverrides && combining != domain.FirstApplicable {
+		panic("[invalid config] acl_combining")
+	}
+	usecase := &ACIUseCase{
+		aciRepo:   aciRepo,
+		combining: combining,
+	}
+	// cache is disabled unless a size is set
+	if size := viper.GetInt("runway_auth.acl_cache.size"); size > 0 {
+		ttl := viper.GetInt64("runway_auth.acl_cache.ttl")
+		if ttl == 0 {
+			panic("[required config] acl_cache.ttl")
+		}
+		usecase.cache = cache.NewLRU[matchKey, []*domain.ACI](size, time.Duration(ttl)*time.Second)
+		pollInterval := viper.GetInt64("runway_auth.acl_cache.poll_interval")
+		if pollInterval == 0 {
+			pollInterval = 5
+		}
+		usecase.pollInterval = time.Duration(pollInterval) * time.Second
 	}
+	return usecase
 }
@@ -0,0 +1,157 @@
+package usecase_test
+
+import (
+	"context"
+	"errors"
+	"github.com/Runway-Club/auth_lib/common"
+	"github.com/Runway-Club/auth_lib/domain"
+	"github.com/Runway-Club/auth_lib/internal/aci/repo"
+	"github.com/Runway-Club/auth_lib/internal/aci/usecase"
+	"github.com/spf13/viper"
+	"gorm.io/driver/sqlite"
+	"testing"
+)
+
+func TestACIUseCase(t *testing.T) {
+	viper.SetConfigFile("../../../configs/dev.yaml")
+	err := viper.ReadInConfig()
+	if err != nil {
+		panic(err)
+	}
+	aciRepo := repo.NewACIRepository(sqlite.Open(":memory:"))
+	aciUseCase := usecase.NewACIUseCase(aciRepo)
+	ctx := context.Background()
+
+	t.Run("sync declared acl", func(t *testing.T) {
+		err := aciUseCase.Create(ctx, &domain.ACI{Id: "api", Resource: "v1/note.GET", RoleId: "default"})
+		if err != nil {
+			t.Error(err)
+		}
+		plan, err := aciUseCase.PlanSync(ctx, []*domain.ACI{
+			{Id: "a", Resource: "v1/course.GET", RoleId: "default"},
+			{Id: "b", Resource: "v1/course.PUT", RoleId: "admin"},
+		})
+		if err != nil {
+			t.Error(err)
+		}
+		if len(plan.Changes) != 2 || plan.Changes[0].Action != domain.SyncCreate {
+			t.Errorf("expected 2 creates, got %s", plan)
+		}
+		err = aciUseCase.ApplySync(ctx, plan)
+		if err != nil {
+			t.Error(err)
+		}
+		plan, err = aciUseCase.PlanSync(ctx, []*domain.ACI{
+			{Id: "a", Resource: "v1/course.GET", RoleId: "default"},
+		})
+		if err != nil {
+			t.Error(err)
+		}
+		if len(plan.Changes) != 1 || plan.Changes[0].Action != domain.SyncDelete || plan.Changes[0].Current.Id != "b" {
+			t.Errorf("expected to delete b only, got %s", plan)
+		}
+	})
+	t.Run("update changed items", func(t *testing.T) {
+		plan, err := aciUseCase.PlanSync(ctx, []*domain.ACI{
+			{Id: "a", Resource: "v1/course.*", RoleId: "default"},
+			{Id: "b", Resource: "v1/course.PUT", RoleId: "admin"},
+		})
+		if err != nil {
+			t.Error(err)
+		}
+		if len(plan.Changes) != 1 || plan.Changes[0].Action != domain.SyncUpdate {
+			t.Errorf("expected to update a only, got %s", plan)
+		}
+		err = aciUseCase.ApplySync(ctx, plan)
+		if err != nil {
+			t.Error(err)
+		}
+		found, err := aciUseCase.GetById(ctx, "a")
+		if err != nil {
+			t.Error(err)
+		}
+		if found.Resource != "v1/course.*" {
+			t.Errorf("expected v1/course.*, got %s", found.Resource)
+		}
+		result, err := aciUseCase.List(ctx, &common.QueryOpts{Page: 1, Size: 10})
+		if err != nil {
+			t.Error(err)
+		}
+		if len(result.Data) != 3 {
+			t.Errorf("expected 3 items, got %d", len(result.Data))
+		}
+	})
+	t.Run("concurrent sync converges", func(t *testing.T) {
+		declared := []*domain.ACI{
+			{Id: "a", Resource: "v1/course.*", RoleId: "default"},
+			{Id: "b", Resource: "v1/course.PUT", RoleId: "admin"},
+			{Id: "c", Resource: "v1/lesson.GET", RoleId: "default"},
+		}
+		replica := usecase.NewACIUseCase(aciRepo)
+		plan, err := aciUseCase.PlanSync(ctx, declared)
+		if err != nil {
+			t.Fatal(err)
+		}
+		replicaPlan, err := replica.PlanSync(ctx, declared)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = aciUseCase.ApplySync(ctx, plan); err != nil {
+			t.Fatal(err)
+		}
+		if err = replica.ApplySync(ctx, replicaPlan); err != nil {
+			t.Errorf("expected the plan applied by another replica to converge, got %v", err)
+		}
+	})
+	t.Run("update keeps config managed items", func(t *testing.T) {
+		err := aciUseCase.Update(ctx, &domain.ACI{Id: "c", Resource: "v1/lesson.*", RoleId: "default"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		found, err := aciUseCase.GetById(ctx, "c")
+		if err != nil || found.ManagedBy != domain.ManagedByConfig {
+			t.Errorf("expected c to stay managed by the config, got %+v %v", found, err)
+		}
+	})
+	t.Run("reject duplicate ids", func(t *testing.T) {
+		_, err := aciUseCase.PlanSync(ctx, []*domain.ACI{
+			{Id: "a", Resource: "v1/course.GET"},
+			{Id: "a", Resource: "v1/course.PUT"},
+		})
+		if err != domain.ErrInvalidACI {
+			t.Errorf("expected invalid aci, got %v", err)
+		}
+	})
+}
+
+// pollingRepository counts the polls of the acl version
+type pollingRepository struct {
+	domain.ACIRepository
+	polls int
+	err   error
+}
+
+func (p *pollingRepository) GetVersion(ctx context.Context) (int64, error) {
+	p.polls++
+	return 1, p.err
+}
+
+func TestACIUseCasePollsVersion(t *testing.T) {
+	viper.SetConfigFile("../../../configs/dev.yaml")
+	err := viper.ReadInConfig()
+	if err != nil {
+		panic(err)
+	}
+	viper.Set("runway_auth.acl_cache.poll_interval", 0)
+	defer viper.Set("runway_auth.acl_cache.poll_interval", 5)
+	for _, pollErr := range []error{nil, errors.New("database is down")} {
+		aciRepo := &pollingRepository{ACIRepository: repo.NewACIRepository(sqlite.Open(":memory:")), err: pollErr}
+		aciUseCase := usecase.NewACIUseCase(aciRepo)
+		for i := 0; i < 10; i++ {
+			_ = aciUseCase.CheckPermission(context.Background(), "u1", "default", "v1/course.GET", "", nil)
+		}
+		if aciRepo.polls != 1 {
+			t.Errorf("expected a single poll per interval when the poll fails with %v, got %d", pollErr, aciRepo.polls)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package repo
+
+import (
+	"context"
+	"github.com/Runway-Club/auth_lib/domain"
+	"gorm.io/gorm"
+	"time"
+)
+
+type APIKeyRepository struct {
+	db *gorm.DB
+}
+
+func NewAPIKeyRepository(dialector gorm.Dialector) *APIKeyRepository {
+	db, err := gorm.Open(dialector)
+	if err != nil {
+		panic(err)
+	}
+	// migrate schema
+	err = db.AutoMigrate(&domain.APIKey{})
+	if err != nil {
+		panic(err)
+	}
+	return &APIKeyRepository{db: db}
+}
+
+// scoped returns a session limited to the tenant of ctx
+func (a *APIKeyRepository) scoped(ctx context.Context) *gorm.DB {
+	return a.db.WithContext(ctx).Where("tenant_id = ?", domain.TenantFromContext(ctx))
+}
+
+func (a *APIKeyRepository) Create(ctx context.Context, key *domain.APIKey) error {
+	key.TenantId = domain.TenantFromContext(ctx)
+	tx := a.db.WithContext(ctx).Create(key)
+	if tx.Error != nil {
+		return tx.Error
+	}
+	return nil
+}
+
+func (a *APIKeyRepository) GetById(ctx context.Context, id string) (*domain.APIKey, error) {
+	found := &domain.APIKey{}
+	tx := a.scoped(ctx).Where("id = ?", id).First(found)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	return found, nil
+}
+
+func (a *APIKeyRepository) GetByHash(ctx context.Context, keyHash string) (*domain.APIKey, error) {
+	found := &domain.APIKey{}
+	tx := a.scoped(ctx).Where("key_hash = ?", keyHash).First(found)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	return found, nil
+}
+
+func (a *APIKeyRepository) ListByUserId(ctx context.Context, userId string) ([]*domain.APIKey, error) {
+	found := make([]*domain.APIKey, 0)
+	tx := a.scoped(ctx).Where("user_id = ?", userId).Order("created_at").Find(&found)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	return found, nil
+}
+
+func (a *APIKeyRepository) Revoke(ctx context.Context, id string, at time.Time) error {
+	tx := a.scoped(ctx).Model(&domain.APIKey{}).Where("id = ? AND revoked_at IS NULL", id).Update("revoked_at", at)
+	if tx.Error != nil {
+		return tx.Error
+	}
+	if tx.RowsAffected == 0 {
+		return domain.ErrAPIKeyNotFound
+	}
+	return nil
+}
+
+func (a *APIKeyRepository) Touch(ctx context.Context, id string, at time.Time) error {
+	tx := a.scoped(ctx).Model(&domain.APIKey{}).Where("id = ?", id).Update("last_used_at", at)
+	if tx.Error != nil {
+		return tx.Error
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package usecase
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/Runway-Club/auth_lib/domain"
+	"github.com/Runway-Club/auth_lib/utils"
+	"github.com/spf13/viper"
+	"log"
+	"strings"
+	"time"
+)
+
+type APIKeyUseCase struct {
+	repo     domain.APIKeyRepository
+	authRepo domain.AuthRepository
+	aciRepo  domain.ACIRepository
+	// prefix starts every key, so that keys are told apart from jwts and found by secret scanners
+	prefix string
+	// touchInterval throttles the writes of the last use of a key
+	touchInterval time.Duration
+}
+
+func (a *APIKeyUseCase) Create(ctx context.Context, userId string, name string, resources []string, expiresAt *time.Time) (string, *domain.APIKey, error) {
+	owner, err := a.authRepo.GetById(ctx, userId)
+	if err != nil {
+		return "", nil, domain.ErrAuthNotFound
+	}
+	if expiresAt != nil && !expiresAt.After(time.Now()) {
+		return "", nil, fmt.Errorf("%w: expiry in the past", domain.ErrInvalidAPIKey)
+	}
+	err = a.checkResources(ctx, owner, resources)
+	if err != nil {
+		return "", nil, err
+	}
+	// the id is drawn apart from the secret, it is shown in the key to tell keys apart
+	id := make([]byte, 8)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return "", nil, err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return "", nil, err
+	}
+	hint := a.prefix + hex.EncodeToString(id)
+	key := hint + "_" + base64.RawURLEncoding.EncodeToString(secret)
+	created := &domain.APIKey{
+		Id:        hex.EncodeToString(id),
+		UserId:    owner.Id,
+		Name:      name,
+		KeyHash:   hash(key),
+		Hint:      hint,
+		Resources: resources,
+		ExpiresAt: expiresAt,
+	}
+	err = a.repo.Create(ctx, created)
+	if err != nil {
+		return "", nil, err
+	}
+	return key, created, nil
+}
+
+// checkResources checks that every resource, or resource pattern, is covered by an allowing aci of the owner or its role,
+// static users bypass the acl and may limit their keys to any resource
+func (a *APIKeyUseCase) checkResources(ctx context.Context, owner *domain.Auth, resources []string) error {
+	if len(resources) == 0 {
+		return nil
+	}
+	if user, ok := a.authRepo.GetStaticUserMap(ctx)[owner.Id]; ok && user.TenantId == owner.TenantId {
+		return nil
+	}
+	// the repository returns ErrACINotFound for a subject without acis
+	owned, err := a.aciRepo.GetByUserId(ctx, owner.Id)
+	if err != nil && !errors.Is(err, domain.ErrACINotFound) {
+		return err
+	}
+	if owner.RoleId != "" {
+		byRole, err := a.aciRepo.GetByRoleId(ctx, owner.RoleId)
+		if err != nil && !errors.Is(err, domain.ErrACINotFound) {
+			return err
+		}
+		owned = append(owned, byRole...)
+	}
+	for _, resource := range resources {
+		covered := false
+		for _, aci := range owned {
+			if aci.Effect != domain.EffectDeny && utils.CoversResource(aci.Resource, resource) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			return fmt.Errorf("%w: the owner has no aci for %s", domain.ErrInvalidAPIKey, resource)
+		}
+	}
+	return nil
+}
+
+func (a *APIKeyUseCase) List(ctx context.Context, userId string) ([]*domain.APIKey, error) {
+	return a.repo.ListByUserId(ctx, userId)
+}
+
+func (a *APIKeyUseCase) Revoke(ctx context.Context, userId string, id string) error {
+	found, err := a.repo.GetById(ctx, id)
+	if err != nil || found.UserId != userId {
+		return domain.ErrAPIKeyNotFound
+	}
+	return a.repo.Revoke(ctx, id, time.Now())
+}
+
+func (a *APIKeyUseCase) IsKey(token string) bool {
+	return strings.HasPrefix(token, a.prefix)
+}
+
+func (a *APIKeyUseCase) Verify(ctx context.Context, key string) (*domain.Auth, *domain.APIKey, error) {
+	owner, found, err := a.Lookup(ctx, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	if found.LastUsedAt == nil || now.Sub(*found.LastUsedAt) >= a.touchInterval {
+		// the last use is informative, failing to record it does not reject a valid key
+		err = a.repo.Touch(ctx, found.Id, now)
+		if err != nil {
+			log.Printf("api key %s: recording its use: %v", found.Id, err)
+		} else {
+			found.LastUsedAt = &now
+		}
+	}
+	return owner, found, nil
+}
+
+func (a *APIKeyUseCase) Lookup(ctx context.Context, key string) (*domain.Auth, *domain.APIKey, error) {
+	found, err := a.repo.GetByHash(ctx, hash(key))
+	if err != nil {
+		return nil, nil, domain.ErrInvalidToken
+	}
+	if found.RevokedAt != nil {
+		return nil, nil, domain.ErrInvalidToken
+	}
+	if !found.Active(time.Now()) {
+		return nil, nil, domain.ErrExpiredToken
+	}
+	owner, err := a.authRepo.GetById(ctx, found.UserId)
+	if err != nil {
+		return nil, nil, domain.ErrInvalidToken
+	}
+	return owner, found, nil
+}
+
+// hash returns the sha256 of a key as stored, keys are random enough not to need a slow hash
+func hash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func NewAPIKeyUseCase(repo domain.APIKeyRepository, authRepo domain.AuthRepository, aciRepo domain.ACIRepository) *APIKeyUseCase {
+	prefix := viper.GetString("runway_auth.api_keys.prefix")
+	if prefix == "" {
+		prefix = "rw_live_"
+	}
+	touchInterval := viper.GetInt64("runway_auth.api_keys.touch_interval")
+	if touchInterval == 0 {
+		touchInterval = 60
+	}
+	return &APIKeyUseCase{
+		repo:          repo,
+		authRepo:      authRepo,
+		aciRepo:       aciRepo,
+		prefix:        prefix,
+		touchInterval: time.Duration(touchInterval) * time.Second,
+	}
+}
@@ -0,0 +1,146 @@
+package usecase_test
+
+import (
+	"context"
+	"errors"
+	"github.com/Runway-Club/auth_lib/domain"
+	aciRepoPkg "github.com/Runway-Club/auth_lib/internal/aci/repo"
+	"github.com/Runway-Club/auth_lib/internal/apikey/repo"
+	"github.com/Runway-Club/auth_lib/internal/apikey/usecase"
+	authRepoPkg "github.com/Runway-Club/auth_lib/internal/auth/repo"
+	"github.com/spf13/viper"
+	"gorm.io/driver/sqlite"
+	"strings"
+	"testing"
+	"time"
+)
+
+// failingTouchRepository fails to record the use of keys
+type failingTouchRepository struct {
+	domain.APIKeyRepository
+}
+
+func (f *failingTouchRepository) Touch(ctx context.Context, id string, at time.Time) error {
+	return errors.New("database is locked")
+}
+
+func TestAPIKeyUseCase(t *testing.T) {
+	viper.SetConfigFile("../../../configs/dev.yaml")
+	err := viper.ReadInConfig()
+	if err != nil {
+		panic(err)
+	}
+	authRepo := authRepoPkg.NewAuthRepository(sqlite.Open(":memory:"))
+	aciRepo := aciRepoPkg.NewACIRepository(sqlite.Open(":memory:"))
+	apiKeyRepo := repo.NewAPIKeyRepository(sqlite.Open(":memory:"))
+	apiKeyUseCase := usecase.NewAPIKeyUseCase(apiKeyRepo, authRepo, aciRepo)
+	ctx := context.Background()
+	err = authRepo.Create(ctx, &domain.Auth{Id: "u1", Username: "user01", RoleId: "default"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = aciRepo.Create(ctx, &domain.ACI{Id: "report", Resource: "v1/report.*", Payload: "*", UserId: "u1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var key string
+	var created *domain.APIKey
+	t.Run("create", func(t *testing.T) {
+		_, _, err := apiKeyUseCase.Create(ctx, "u1", "ci", []string{"v1/admin.GET"}, nil)
+		if !errors.Is(err, domain.ErrInvalidAPIKey) {
+			t.Errorf("expected a resource without aci to be rejected, got %v", err)
+		}
+		past := time.Now().Add(-time.Hour)
+		_, _, err = apiKeyUseCase.Create(ctx, "u1", "ci", nil, &past)
+		if !errors.Is(err, domain.ErrInvalidAPIKey) {
+			t.Errorf("expected an expiry in the past to be rejected, got %v", err)
+		}
+		key, created, err = apiKeyUseCase.Create(ctx, "u1", "ci", []string{"v1/report.GET"}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(key, "rw_live_") || !apiKeyUseCase.IsKey(key) || created.KeyHash == key || !strings.HasPrefix(key, created.Hint+"_") {
+			t.Errorf("unexpected key %s %+v", key, created)
+		}
+		// the hint is not drawn from the secret
+		if created.Hint != "rw_live_"+created.Id {
+			t.Errorf("unexpected id %s and hint %s of %s", created.Id, created.Hint, key)
+		}
+	})
+	t.Run("lookup", func(t *testing.T) {
+		owner, found, err := apiKeyUseCase.Lookup(ctx, key)
+		if err != nil || owner.Id != "u1" || found.Id != created.Id {
+			t.Fatalf("expected the owner of the key, got %v %v %v", owner, found, err)
+		}
+		keys, _ := apiKeyUseCase.List(ctx, "u1")
+		if len(keys) != 1 || keys[0].LastUsedAt != nil {
+			t.Errorf("expected a lookup not to record a use, got %+v", keys)
+		}
+	})
+	t.Run("verify", func(t *testing.T) {
+		owner, found, err := apiKeyUseCase.Verify(ctx, key)
+		if err != nil || owner.Id != "u1" || found.Id != created.Id {
+			t.Fatalf("expected the owner of the key, got %v %v %v", owner, found, err)
+		}
+		keys, _ := apiKeyUseCase.List(ctx, "u1")
+		if len(keys) != 1 || keys[0].LastUsedAt == nil {
+			t.Errorf("expected the use of the key to be recorded, got %+v", keys)
+		}
+		_, _, err = apiKeyUseCase.Verify(ctx, key+"x")
+		if !errors.Is(err, domain.ErrInvalidToken) {
+			t.Errorf("expected invalid token, got %v", err)
+		}
+	})
+	t.Run("verify when the use is not recorded", func(t *testing.T) {
+		failing := usecase.NewAPIKeyUseCase(&failingTouchRepository{APIKeyRepository: apiKeyRepo}, authRepo, aciRepo)
+		fresh, _, err := failing.Create(ctx, "u1", "", nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		owner, found, err := failing.Verify(ctx, fresh)
+		if err != nil || owner.Id != "u1" || found.LastUsedAt != nil {
+			t.Errorf("expected the key to be valid without a recorded use, got %v %v", found, err)
+		}
+	})
+	t.Run("expired", func(t *testing.T) {
+		soon := time.Now().Add(50 * time.Millisecond)
+		expiring, _, err := apiKeyUseCase.Create(ctx, "u1", "", nil, &soon)
+		if err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(100 * time.Millisecond)
+		_, _, err = apiKeyUseCase.Verify(ctx, expiring)
+		if !errors.Is(err, domain.ErrExpiredToken) {
+			t.Errorf("expected expired token, got %v", err)
+		}
+	})
+	t.Run("revoke", func(t *testing.T) {
+		err := apiKeyUseCase.Revoke(ctx, "u2", created.Id)
+		if !errors.Is(err, domain.ErrAPIKeyNotFound) {
+			t.Errorf("expected the key of another user not to be found, got %v", err)
+		}
+		err = apiKeyUseCase.Revoke(ctx, "u1", created.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, err = apiKeyUseCase.Verify(ctx, key)
+		if !errors.Is(err, domain.ErrInvalidToken) {
+			t.Errorf("expected a revoked key to be invalid, got %v", err)
+		}
+	})
+	t.Run("resource patterns", func(t *testing.T) {
+		err := aciRepo.Create(ctx, &domain.ACI{Id: "lessons", Resource: "v2/*", Payload: "*", UserId: "u1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, err = apiKeyUseCase.Create(ctx, "u1", "wide", []string{"v2/**"}, nil)
+		if !errors.Is(err, domain.ErrInvalidAPIKey) {
+			t.Errorf("expected a pattern wider than the acl to be rejected, got %v", err)
+		}
+		_, _, err = apiKeyUseCase.Create(ctx, "u1", "narrow", []string{"v2/*", "v1/report.GET"}, nil)
+		if err != nil {
+			t.Errorf("expected patterns within the acl to be accepted, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,52 @@
+package repo
+
+import (
+	"context"
+	"github.com/Runway-Club/auth_lib/domain"
+	"gorm.io/gorm"
+)
+
+type AuditRepository struct {
+	db *gorm.DB
+}
+
+func NewAuditRepository(dialector gorm.Dialector) *AuditRepository {
+	db, err := gorm.Open(dialector)
+	if err != nil {
+		panic(err)
+	}
+	// migrate schema
+	err = db.AutoMigrate(&domain.AuditEvent{})
+	if err != nil {
+		panic(err)
+	}
+	return &AuditRepository{db: db}
+}
+
+func (a *AuditRepository) Create(ctx context.Context, event *domain.AuditEvent) error {
+	event.TenantId = domain.TenantFromContext(ctx)
+	tx := a.db.WithContext(ctx).Create(event)
+	if tx.Error != nil {
+		return tx.Error
+	}
+	return nil
+}
+
+func (a *AuditRepository) List(ctx context.Context, filter *domain.AuditFilter) ([]*domain.AuditEvent, error) {
+	query := a.db.WithContext(ctx).Where("tenant_id = ?", domain.TenantFromContext(ctx))
+	if filter.Action != "" {
+		query = query.Where("action = ?", filter.Action)
+	}
+	if filter.ActorId != "" {
+		query = query.Where("actor_id = ?", filter.ActorId)
+	}
+	if filter.SubjectId != "" {
+		query = query.Where("subject_id = ?", filter.SubjectId)
+	}
+	events := make([]*domain.AuditEvent, 0)
+	tx := query.Order("created_at DESC, id DESC").Limit(filter.Limit).Find(&events)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	return events, nil
+}
@@ -0,0 +1,28 @@
+package usecase
+
+import (
+	"context"
+	"github.com/Runway-Club/auth_lib/domain"
+)
+
+type AuditUseCase struct {
+	repo domain.AuditRepository
+}
+
+func (a *AuditUseCase) Record(ctx context.Context, event *domain.AuditEvent) error {
+	return a.repo.Create(ctx, event)
+}
+
+func (a *AuditUseCase) List(ctx context.Context, filter *domain.AuditFilter) ([]*domain.AuditEvent, error) {
+	if filter == nil {
+		filter = &domain.AuditFilter{}
+	}
+	if filter.Limit <= 0 {
+		filter.Limit = 100
+	}
+	return a.repo.List(ctx, filter)
+}
+
+func NewAuditUseCase(repo domain.AuditRepository) *AuditUseCase {
+	return &AuditUseCase{repo: repo}
+}
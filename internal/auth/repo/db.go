@@ -17,7 +17,7 @@ type AuthRepository struct {
 
 func (a *AuthRepository) List(ctx context.Context, opt *common.QueryOpts) (*common.ListResult[*domain.Auth], error) {
 	var auths []*domain.Auth
-	tx := a.db.WithContext(ctx)
+	tx := a.scoped(ctx)
 	offset := opt.Size * (opt.Page - 1)
 	if opt != nil {
 		tx = tx.Limit(opt.Size).Offset(offset)
@@ -27,7 +27,7 @@ func (a *AuthRepository) List(ctx context.Context, opt *common.QueryOpts) (*comm
 		return nil, tx.Error
 	}
 	count := int64(0)
-	tx = a.db.WithContext(ctx).Model(&domain.Auth{}).Count(&count)
+	tx = a.scoped(ctx).Model(&domain.Auth{}).Count(&count)
 	if tx.Error != nil {
 		return nil, tx.Error
 	}
@@ -53,6 +53,13 @@ func NewAuthRepository(dialector gorm.Dialector) *AuthRepository {
 	if err != nil {
 		panic(err)
 	}
+	// usernames used to be unique across tenants
+	if db.Migrator().HasIndex(&domain.Auth{}, "idx_auths_username") {
+		err = db.Migrator().DropIndex(&domain.Auth{}, "idx_auths_username")
+		if err != nil {
+			panic(err)
+		}
+	}
 	// migrate schema
 	err = db.AutoMigrate(&domain.Auth{})
 	if err != nil {
@@ -65,7 +72,13 @@ func NewAuthRepository(dialector gorm.Dialector) *AuthRepository {
 	return &AuthRepository{db: db, StaticUsers: staticUsers, UserIdMap: userIdMap}
 }
 
+// scoped returns a session limited to the tenant of ctx
+func (a *AuthRepository) scoped(ctx context.Context) *gorm.DB {
+	return a.db.WithContext(ctx).Where("tenant_id = ?", domain.TenantFromContext(ctx))
+}
+
 func (a *AuthRepository) Create(ctx context.Context, auth *domain.Auth) error {
+	auth.TenantId = domain.TenantFromContext(ctx)
 	tx := a.db.WithContext(ctx).Create(auth)
 	if tx.Error != nil {
 		return tx.Error
@@ -75,7 +88,7 @@ func (a *AuthRepository) Create(ctx context.Context, auth *domain.Auth) error {
 
 func (a *AuthRepository) GetById(ctx context.Context, id string) (*domain.Auth, error) {
 	found := &domain.Auth{}
-	tx := a.db.WithContext(ctx).Where("id = ?", id).First(found)
+	tx := a.scoped(ctx).Where("id = ?", id).First(found)
 	if tx.Error != nil {
 		return nil, tx.Error
 	}
@@ -88,7 +101,7 @@ func (a *AuthRepository) GetStaticUserMap(ctx context.Context) map[string]*domai
 
 func (a *AuthRepository) GetByUsernameAndHpassword(ctx context.Context, username, hpassword string) (*domain.Auth, error) {
 	found := &domain.Auth{}
-	tx := a.db.WithContext(ctx).Where("username = ? AND hpassword = ?", username, hpassword).First(found)
+	tx := a.scoped(ctx).Where("username = ? AND hpassword = ?", username, hpassword).First(found)
 	if tx.Error != nil {
 		return nil, tx.Error
 	}
@@ -97,7 +110,7 @@ func (a *AuthRepository) GetByUsernameAndHpassword(ctx context.Context, username
 
 func (a *AuthRepository) GetByUsername(ctx context.Context, username string) (*domain.Auth, error) {
 	found := &domain.Auth{}
-	tx := a.db.WithContext(ctx).Where("username = ?", username).First(found)
+	tx := a.scoped(ctx).Where("username = ?", username).First(found)
 	if tx.Error != nil {
 		return nil, tx.Error
 	}
@@ -105,6 +118,10 @@ func (a *AuthRepository) GetByUsername(ctx context.Context, username string) (*d
 }
 
 func (a *AuthRepository) Update(ctx context.Context, auth *domain.Auth) error {
+	// Save would move or create the row in another tenant
+	if auth.TenantId != domain.TenantFromContext(ctx) {
+		return domain.ErrAuthNotFound
+	}
 	tx := a.db.WithContext(ctx).Save(auth)
 	if tx.Error != nil {
 		return tx.Error
@@ -113,7 +130,7 @@ func (a *AuthRepository) Update(ctx context.Context, auth *domain.Auth) error {
 }
 
 func (a *AuthRepository) Delete(ctx context.Context, id string) error {
-	tx := a.db.WithContext(ctx).Where("id = ?", id).Delete(&domain.Auth{})
+	tx := a.scoped(ctx).Where("id = ?", id).Delete(&domain.Auth{})
 	if tx.Error != nil {
 		return tx.Error
 	}
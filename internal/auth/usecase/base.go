@@ -10,6 +10,7 @@ import (
 	"github.com/spf13/viper"
 	"golang.org/x/crypto/bcrypt"
 	"log"
+	"strings"
 	"time"
 )
 
@@ -20,6 +21,38 @@ type AuthUseCase struct {
 	jwt            domain.JwtGenerator
 	defaultRoleId  string
 	projectId      string
+	tenants        map[string]*domain.TenantConfig
+	// impersonationTTL is the lifetime of impersonation tokens, roleLevels the privilege levels of roles
+	impersonationTTL time.Duration
+	roleLevels       map[string]int
+}
+
+func (a *AuthUseCase) tenantConfig(ctx context.Context) *domain.TenantConfig {
+	if config, ok := a.tenants[domain.TenantFromContext(ctx)]; ok {
+		return config
+	}
+	return &domain.TenantConfig{}
+}
+
+func (a *AuthUseCase) passwordPolicyOf(ctx context.Context) string {
+	if policy := a.tenantConfig(ctx).Password.Policy; policy != "" {
+		return policy
+	}
+	return a.passwordPolicy
+}
+
+func (a *AuthUseCase) hashCostOf(ctx context.Context) string {
+	if cost := a.tenantConfig(ctx).Password.Cost; cost != "" {
+		return cost
+	}
+	return a.hashCost
+}
+
+func (a *AuthUseCase) defaultRoleIdOf(ctx context.Context) string {
+	if roleId := a.tenantConfig(ctx).DefaultRoleId; roleId != "" {
+		return roleId
+	}
+	return a.defaultRoleId
 }
 
 func (a *AuthUseCase) GetStaticUserList(ctx context.Context) (list *domain.StaticUserList, err error) {
@@ -40,7 +73,7 @@ func (a *AuthUseCase) ChangePassword(ctx context.Context, uid, oldPassword, newP
 	}
 
 	// check password
-	errPasswordPolicy := utils.CheckPasswordPolicy(newPassword, a.passwordPolicy)
+	errPasswordPolicy := utils.CheckPasswordPolicy(newPassword, a.passwordPolicyOf(ctx))
 	if errPasswordPolicy != nil {
 		return errPasswordPolicy
 	}
@@ -50,7 +83,7 @@ func (a *AuthUseCase) ChangePassword(ctx context.Context, uid, oldPassword, newP
 		return domain.ErrPasswordNotMatch
 	}
 	// hash password
-	hashedPassword, err := utils.GeneratePassword(newPassword, a.hashCost)
+	hashedPassword, err := utils.GeneratePassword(newPassword, a.hashCostOf(ctx))
 	if err != nil {
 		return err
 	}
@@ -97,6 +130,20 @@ func (a *AuthUseCase) Verify(ctx context.Context, token string) (auth *domain.Au
 	if err != nil {
 		return nil, err
 	}
+	if auth.TenantId != domain.TenantFromContext(ctx) {
+		return nil, domain.ErrTenantMismatch
+	}
+	return auth, nil
+}
+
+func (a *AuthUseCase) VerifyForAudience(ctx context.Context, token, audience string) (auth *domain.Auth, err error) {
+	auth, _, err = a.jwt.VerifyTokenForAudience(strings.TrimPrefix(token, "Bearer "), audience)
+	if err != nil {
+		return nil, err
+	}
+	if auth.TenantId != domain.TenantFromContext(ctx) {
+		return nil, domain.ErrTenantMismatch
+	}
 	return auth, nil
 }
 
@@ -106,7 +153,7 @@ func (a *AuthUseCase) Update(ctx context.Context, auth *domain.Auth) error {
 
 func (a *AuthUseCase) Delete(ctx context.Context, id string) error {
 	// prevent delete static user
-	if _, ok := a.repo.GetStaticUserMap(ctx)[id]; ok {
+	if user, ok := a.repo.GetStaticUserMap(ctx)[id]; ok && user.TenantId == domain.TenantFromContext(ctx) {
 		return domain.ErrPermissionDenied
 	}
 	return a.repo.Delete(ctx, id)
@@ -200,6 +247,9 @@ func (a *AuthUseCase) SignUpWithProvider(ctx context.Context, provider domain.Pr
 		token = token[7:]
 	}
 	uid, _, err := provider.VerifyToken(ctx, token)
+	if err != nil && domain.VerifiedProviderFromContext(ctx) {
+		return err
+	}
 	if err != nil {
 		// second chance for custom verify token
 		uid, _, err = a.customVerifyToken(ctx, token)
@@ -207,6 +257,9 @@ func (a *AuthUseCase) SignUpWithProvider(ctx context.Context, provider domain.Pr
 			return err
 		}
 	}
+	if domain.IsClientSubject(uid) {
+		return domain.ErrReservedUserId
+	}
 	// look for existing username
 	found, err := a.repo.GetById(ctx, uid)
 	if err == nil || found != nil {
@@ -216,7 +269,7 @@ func (a *AuthUseCase) SignUpWithProvider(ctx context.Context, provider domain.Pr
 	auth := &domain.Auth{
 		Id:       uid,
 		Username: uid,
-		RoleId:   a.defaultRoleId,
+		RoleId:   a.defaultRoleIdOf(ctx),
 	}
 	err = a.repo.Create(ctx, auth)
 	if err != nil {
@@ -231,6 +284,9 @@ func (a *AuthUseCase) SignInWithProvider(ctx context.Context, provider domain.Pr
 		token = token[7:]
 	}
 	uid, claims, err := provider.VerifyToken(ctx, token)
+	if err != nil && domain.VerifiedProviderFromContext(ctx) {
+		return nil, err
+	}
 	if err != nil {
 		// second chance for custom verify token
 		uid, claims, err = a.customVerifyToken(ctx, token)
@@ -243,23 +299,34 @@ func (a *AuthUseCase) SignInWithProvider(ctx context.Context, provider domain.Pr
 	if err != nil {
 		return nil, domain.ErrAuthNotFound
 	}
+	if claims == nil {
+		claims = make(map[string]interface{})
+	}
+	// the registered claims of the provider token describe that token, not ours
+	for _, name := range []string{"iss", "sub", "aud", "exp", "nbf", "iat", "jti"} {
+		delete(claims, name)
+	}
+	// federated sign in, see newToken
+	claims["auth_time"] = time.Now().Unix()
+	claims["amr"] = []string{"fed"}
 	// generate token
-	generatedToken, err := a.jwt.GenerateToken(user, claims)
+	generatedToken, err := a.generateToken(ctx, user, claims)
 	if err != nil {
 		return nil, err
 	}
 	if user.RoleId == "" {
-		user.RoleId = a.defaultRoleId
+		user.RoleId = a.defaultRoleIdOf(ctx)
 		err = a.repo.Update(ctx, user)
 		if err != nil {
 			return nil, err
 		}
 	}
 	return &domain.Token{
-		Jwt:    generatedToken,
-		Id:     user.Id,
-		UserId: user.Id,
-		RoleId: user.RoleId,
+		Jwt:      generatedToken,
+		Id:       user.Id,
+		UserId:   user.Id,
+		RoleId:   user.RoleId,
+		TenantId: user.TenantId,
 	}, nil
 }
 
@@ -268,8 +335,11 @@ func (a *AuthUseCase) SignUp(ctx context.Context, auth *domain.Auth) error {
 	if auth.Id == "" {
 		auth.Id = fmt.Sprintf("%d", time.Now().UnixMilli())
 	}
+	if domain.IsClientSubject(auth.Id) {
+		return domain.ErrReservedUserId
+	}
 
-	passwordPolicyErr := utils.CheckPasswordPolicy(auth.Password, a.passwordPolicy)
+	passwordPolicyErr := utils.CheckPasswordPolicy(auth.Password, a.passwordPolicyOf(ctx))
 	if passwordPolicyErr != nil {
 		return passwordPolicyErr
 	}
@@ -278,13 +348,13 @@ func (a *AuthUseCase) SignUp(ctx context.Context, auth *domain.Auth) error {
 	if err == nil || found != nil {
 		return domain.ErrUsernameExist
 	}
-	hashedPassword, err := utils.GeneratePassword(auth.Password, a.hashCost)
+	hashedPassword, err := utils.GeneratePassword(auth.Password, a.hashCostOf(ctx))
 	if err != nil {
 		return err
 	}
 	auth.Hpassword = hashedPassword
 
-	auth.RoleId = a.defaultRoleId
+	auth.RoleId = a.defaultRoleIdOf(ctx)
 
 	// create new auth
 	err = a.repo.Create(ctx, auth)
@@ -302,7 +372,7 @@ func (a *AuthUseCase) SignIn(ctx context.Context, username, password string) (to
 		return nil, domain.ErrAuthNotFound
 	}
 	if user.RoleId == "" {
-		user.RoleId = a.defaultRoleId
+		user.RoleId = a.defaultRoleIdOf(ctx)
 		err = a.repo.Update(ctx, user)
 		if err != nil {
 			return nil, err
@@ -312,23 +382,113 @@ func (a *AuthUseCase) SignIn(ctx context.Context, username, password string) (to
 	if err != nil {
 		return nil, domain.ErrPasswordNotMatch
 	}
-	// generate token
-	generatedToken, err := a.jwt.GenerateToken(user, map[string]interface{}{
-		"username": user.Username,
-		"id":       user.Id,
-		"role_id":  user.RoleId,
-	})
+	return a.newToken(ctx, user, "pwd")
+}
+
+// newToken generates the token of a user signed in with the amr methods, RFC 8176. The sign in
+// is recorded in the auth_time and amr claims, they are copied to the id tokens of OpenID Connect.
+func (a *AuthUseCase) newToken(ctx context.Context, user *domain.Auth, methods ...string) (*domain.Token, error) {
+	payload := map[string]interface{}{
+		"username":  user.Username,
+		"id":        user.Id,
+		"role_id":   user.RoleId,
+		"auth_time": time.Now().Unix(),
+	}
+	if len(methods) > 0 {
+		payload["amr"] = methods
+	}
+	generatedToken, err := a.generateToken(ctx, user, payload)
+	if err != nil {
+		return nil, err
+	}
+	return &domain.Token{
+		Jwt:      generatedToken,
+		Id:       user.Id,
+		UserId:   user.Id,
+		RoleId:   user.RoleId,
+		TenantId: user.TenantId,
+	}, nil
+}
+
+// generateToken generates the token of user for the audience of ctx, see domain.WithAudience
+func (a *AuthUseCase) generateToken(ctx context.Context, user *domain.Auth, payload map[string]interface{}) (string, error) {
+	if audience := domain.AudienceFromContext(ctx); audience != "" {
+		return a.jwt.GenerateTokenForAudience(user, payload, audience)
+	}
+	return a.jwt.GenerateToken(user, payload)
+}
+
+// roleLevel returns the privilege level of a role and whether it is configured. Config keys are lower
+// cased by viper.
+func (a *AuthUseCase) roleLevel(roleId string) (int, bool) {
+	level, ok := a.roleLevels[strings.ToLower(roleId)]
+	return level, ok
+}
+
+func (a *AuthUseCase) Impersonate(ctx context.Context, admin *domain.Auth, targetUid string) (*domain.Token, error) {
+	if admin.Id == targetUid || admin.Impersonator != "" {
+		return nil, domain.ErrImpersonationForbidden
+	}
+	if user, ok := a.repo.GetStaticUserMap(ctx)[targetUid]; ok && user.TenantId == domain.TenantFromContext(ctx) {
+		return nil, domain.ErrImpersonationForbidden
+	}
+	target, err := a.repo.GetById(ctx, targetUid)
+	if err != nil {
+		return nil, domain.ErrAuthNotFound
+	}
+	// the admin must be above the target, roles without a level can be neither compared nor impersonated
+	targetLevel, targetOk := a.roleLevel(target.RoleId)
+	adminLevel, adminOk := a.roleLevel(admin.RoleId)
+	if !targetOk || !adminOk || targetLevel >= adminLevel {
+		return nil, domain.ErrImpersonationForbidden
+	}
+	generatedToken, err := a.jwt.GenerateTokenWithLifetime(target, map[string]interface{}{
+		"username":     target.Username,
+		"id":           target.Id,
+		"role_id":      target.RoleId,
+		"auth_time":    time.Now().Unix(),
+		"impersonator": admin.Id,
+	}, a.impersonationTTL)
 	if err != nil {
 		return nil, err
 	}
 	return &domain.Token{
-		Jwt:    generatedToken,
-		Id:     user.Id,
-		UserId: user.Id,
-		RoleId: user.RoleId,
+		Jwt:      generatedToken,
+		Id:       target.Id,
+		UserId:   target.Id,
+		RoleId:   target.RoleId,
+		TenantId: target.TenantId,
 	}, nil
 }
 
+// IssueToken generates a token for a user without credentials. It is not a method of AuthUseCase so that it stays out of
+// domain.AuthUseCase, it is meant for the administration tools of this module only.
+func IssueToken(ctx context.Context, a *AuthUseCase, uid string) (*domain.Token, error) {
+	user, err := a.repo.GetById(ctx, uid)
+	if err != nil {
+		return nil, domain.ErrAuthNotFound
+	}
+	return a.newToken(ctx, user)
+}
+
+// ResetPassword sets a new password without the old one, like IssueToken it is meant for the administration tools
+func ResetPassword(ctx context.Context, a *AuthUseCase, uid, newPassword string) error {
+	user, err := a.repo.GetById(ctx, uid)
+	if err != nil {
+		return domain.ErrAuthNotFound
+	}
+	err = utils.CheckPasswordPolicy(newPassword, a.passwordPolicyOf(ctx))
+	if err != nil {
+		return err
+	}
+	hashedPassword, err := utils.GeneratePassword(newPassword, a.hashCostOf(ctx))
+	if err != nil {
+		return err
+	}
+	user.Hpassword = hashedPassword
+	return a.repo.Update(ctx, user)
+}
+
 func NewAuthUseCase(repo domain.AuthRepository, jwt domain.JwtGenerator) *AuthUseCase {
 	usecase := &AuthUseCase{
 		repo:           repo,
@@ -337,10 +497,25 @@ func NewAuthUseCase(repo domain.AuthRepository, jwt domain.JwtGenerator) *AuthUs
 		defaultRoleId:  viper.GetString("runway_auth.default_role_id"),
 		projectId:      viper.GetString("runway_auth.projectid"),
 		jwt:            jwt,
+		tenants:        make(map[string]*domain.TenantConfig),
+		roleLevels:     make(map[string]int),
+	}
+	err := viper.UnmarshalKey("runway_auth.tenants", &usecase.tenants)
+	if err != nil {
+		panic(err)
+	}
+	err = viper.UnmarshalKey("runway_auth.impersonation.role_levels", &usecase.roleLevels)
+	if err != nil {
+		panic(err)
+	}
+	impersonationTTL := viper.GetInt64("runway_auth.impersonation.ttl")
+	if impersonationTTL == 0 {
+		impersonationTTL = 900
 	}
+	usecase.impersonationTTL = time.Duration(impersonationTTL) * time.Second
 	// init static users, omit error because it's okay if it's already exist
 	for _, user := range repo.GetStaticUserMap(context.Background()) {
-		err := usecase.SignUp(context.Background(), user)
+		err := usecase.SignUp(domain.WithTenant(context.Background(), user.TenantId), user)
 		if err != nil {
 			log.Print(err)
 		}
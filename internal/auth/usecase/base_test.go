@@ -9,9 +9,12 @@ import (
 	"github.com/Runway-Club/auth_lib/internal/auth/usecase"
 	"github.com/Runway-Club/auth_lib/internal/jwt"
 	"github.com/Runway-Club/auth_lib/internal/providers"
+	jwtlib "github.com/golang-jwt/jwt/v5"
 	"github.com/spf13/viper"
 	"gorm.io/driver/sqlite"
+	"reflect"
 	"testing"
+	"time"
 )
 
 func TestAuthUseCase(t *testing.T) {
@@ -36,6 +39,24 @@ func TestAuthUseCase(t *testing.T) {
 			t.Error(err)
 		}
 	})
+	t.Run("sign up with a client subject id", func(t *testing.T) {
+		err := authUseCase.SignUp(context.Background(), &domain.Auth{
+			Id:       domain.ClientSubject("app"),
+			Username: "client-app",
+			Password: "test12345678",
+		})
+		if !errors.Is(err, domain.ErrReservedUserId) {
+			t.Error("expected error reserved user id")
+		}
+		token, err := dummyJwtGenerator.GenerateToken(&domain.Auth{Id: domain.ClientSubject("app")}, map[string]interface{}{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = authUseCase.SignUpWithProvider(context.Background(), provider, token)
+		if !errors.Is(err, domain.ErrReservedUserId) {
+			t.Error("expected error reserved user id")
+		}
+	})
 	t.Run("sign up with existing username", func(t *testing.T) {
 		err := authUseCase.SignUp(context.Background(), &domain.Auth{
 			Id:       "2",
@@ -72,9 +93,30 @@ func TestAuthUseCase(t *testing.T) {
 			t.Error(err)
 		}
 		if token == nil {
-			t.Error("token is empty")
+			t.Fatal("token is empty")
 		}
 		fmt.Println(token)
+		_, payload, err := jwt.NewJwtGenerator().VerifyToken(token.Jwt)
+		if err != nil || payload["auth_time"] == nil || !reflect.DeepEqual(payload["amr"], []interface{}{"pwd"}) {
+			t.Errorf("expected the sign in to be recorded, got %v %v", payload, err)
+		}
+	})
+	t.Run("sign in for an audience", func(t *testing.T) {
+		ctx := domain.WithAudience(context.Background(), "mobile")
+		token, err := authUseCase.SignIn(ctx, "test", "test12345678")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = authUseCase.VerifyForAudience(context.Background(), token.Jwt, "mobile"); err != nil {
+			t.Error(err)
+		}
+		if _, err = authUseCase.VerifyForAudience(context.Background(), token.Jwt, "admin"); !errors.Is(err, domain.ErrInvalidAudience) {
+			t.Errorf("expected a mobile token to be rejected by admin, got %v", err)
+		}
+		_, err = authUseCase.SignIn(domain.WithAudience(context.Background(), "unknown"), "test", "test12345678")
+		if !errors.Is(err, domain.ErrUnknownAudience) {
+			t.Errorf("expected an unknown audience, got %v", err)
+		}
 	})
 
 	t.Run("Sign up with provider", func(t *testing.T) {
@@ -123,6 +165,25 @@ func TestAuthUseCase(t *testing.T) {
 		}
 	})
 
+	t.Run("verified provider", func(t *testing.T) {
+		// a token of another signer carrying the claims read by the fallback
+		forged, err := jwtlib.NewWithClaims(jwtlib.SigningMethodHS256, jwtlib.MapClaims{
+			"sub": "0002", "email": "forged@test.com", "exp": time.Now().Add(time.Hour).Unix(),
+		}).SignedString([]byte("forged"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx := domain.WithVerifiedProvider(context.Background())
+		_, err = authUseCase.SignInWithProvider(ctx, provider, forged)
+		if !errors.Is(err, domain.ErrInvalidToken) {
+			t.Errorf("expected the error of the provider, got %v", err)
+		}
+		err = authUseCase.SignUpWithProvider(ctx, provider, forged)
+		if !errors.Is(err, domain.ErrInvalidToken) {
+			t.Errorf("expected the error of the provider, got %v", err)
+		}
+	})
+
 	t.Run("Check if auth existed", func(t *testing.T) {
 		token, err := dummyJwtGenerator.GenerateToken(&domain.Auth{
 			Id:     "0002",
@@ -141,4 +202,33 @@ func TestAuthUseCase(t *testing.T) {
 
 	})
 
+	t.Run("reset password and issue token", func(t *testing.T) {
+		err := usecase.ResetPassword(context.Background(), authUseCase, "1", "short")
+		if !errors.Is(err, domain.ErrInvalidPassword) {
+			t.Error("expected error invalid password")
+		}
+		err = usecase.ResetPassword(context.Background(), authUseCase, "1", "resetpassword1")
+		if err != nil {
+			t.Error(err)
+		}
+		_, err = authUseCase.SignIn(context.Background(), "test", "resetpassword1")
+		if err != nil {
+			t.Error(err)
+		}
+		token, err := usecase.IssueToken(context.Background(), authUseCase, "1")
+		if err != nil {
+			t.Error(err)
+		}
+		auth, err := authUseCase.Verify(context.Background(), token.Jwt)
+		if err != nil {
+			t.Error(err)
+		}
+		if auth.Id != "1" {
+			t.Error("auth id is not 1")
+		}
+		_, err = usecase.IssueToken(context.Background(), authUseCase, "missing")
+		if !errors.Is(err, domain.ErrAuthNotFound) {
+			t.Error("expected error auth not found")
+		}
+	})
 }
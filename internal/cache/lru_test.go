@@ -0,0 +1,42 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLRU(t *testing.T) {
+	now := time.Now()
+	lru := NewLRU[string, int](2, time.Minute)
+	lru.nowFunc = func() time.Time { return now }
+	t.Run("evict least recently used", func(t *testing.T) {
+		lru.Set("a", 1)
+		lru.Set("b", 2)
+		if _, ok := lru.Get("a"); !ok {
+			t.Error("expected a")
+		}
+		lru.Set("c", 3)
+		if _, ok := lru.Get("b"); ok {
+			t.Error("expected b to be evicted")
+		}
+		if value, ok := lru.Get("c"); !ok || value != 3 {
+			t.Errorf("expected 3, got %d", value)
+		}
+	})
+	t.Run("expire after ttl", func(t *testing.T) {
+		now = now.Add(2 * time.Minute)
+		if _, ok := lru.Get("a"); ok {
+			t.Error("expected a to be expired")
+		}
+		if lru.Len() != 1 {
+			t.Errorf("expected 1 entry, got %d", lru.Len())
+		}
+	})
+	t.Run("purge", func(t *testing.T) {
+		lru.Set("a", 1)
+		lru.Purge()
+		if lru.Len() != 0 {
+			t.Errorf("expected no entry, got %d", lru.Len())
+		}
+	})
+}
@@ -14,12 +14,17 @@ type DummyJwtGenerator struct {
 }
 
 func (d DummyJwtGenerator) GenerateToken(auth *domain.Auth, payload map[string]interface{}) (string, error) {
+	return d.GenerateTokenWithLifetime(auth, payload, time.Duration(d.exp)*time.Millisecond)
+}
+
+func (d DummyJwtGenerator) GenerateTokenWithLifetime(auth *domain.Auth, payload map[string]interface{}, lifetime time.Duration) (string, error) {
 	payload["id"] = auth.Id
 	payload["username"] = auth.Username
 	payload["role_id"] = auth.RoleId
+	payload["tenant_id"] = auth.TenantId
 	token := jwtlib.NewWithClaims(jwtlib.SigningMethodHS256, jwtlib.MapClaims{
 		"payload": payload,
-		"exp":     time.Now().UnixMilli() + d.exp,
+		"exp":     time.Now().UnixMilli() + lifetime.Milliseconds(),
 		"iat":     time.Now().UnixMilli(),
 		"iss":     d.issuer,
 	})
@@ -30,7 +35,25 @@ func (d DummyJwtGenerator) GenerateToken(auth *domain.Auth, payload map[string]i
 	return tokenString, nil
 }
 
+// GenerateTokenForAudience accepts every audience, with the default lifetime and every claim
+func (d DummyJwtGenerator) GenerateTokenForAudience(auth *domain.Auth, payload map[string]interface{}, audience string) (string, error) {
+	payload["aud"] = audience
+	return d.GenerateToken(auth, payload)
+}
+
+// VerifyToken rejects the tokens of every audience, the dummy generator has no configured one
 func (d DummyJwtGenerator) VerifyToken(token string) (*domain.Auth, map[string]interface{}, error) {
+	auth, payload, err := d.VerifyTokenOfAnyAudience(token)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, ok := payload["aud"]; ok {
+		return nil, nil, domain.ErrInvalidAudience
+	}
+	return auth, payload, nil
+}
+
+func (d DummyJwtGenerator) VerifyTokenOfAnyAudience(token string) (*domain.Auth, map[string]interface{}, error) {
 	parsedToken, err := jwtlib.Parse(token, func(token *jwtlib.Token) (interface{}, error) {
 		return d.secret, nil
 	})
@@ -51,9 +74,30 @@ func (d DummyJwtGenerator) VerifyToken(token string) (*domain.Auth, map[string]i
 		Username: payload["username"].(string),
 		RoleId:   payload["role_id"].(string),
 	}
+	auth.TenantId, _ = payload["tenant_id"].(string)
+	auth.Impersonator, _ = payload["impersonator"].(string)
 	return auth, payload, nil
 }
 
+func (d DummyJwtGenerator) VerifyTokenForAudience(token string, audience string) (*domain.Auth, map[string]interface{}, error) {
+	auth, payload, err := d.VerifyTokenOfAnyAudience(token)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !hasAudience(payload, audience) {
+		return nil, nil, domain.ErrInvalidAudience
+	}
+	return auth, payload, nil
+}
+
+func (d DummyJwtGenerator) Inspect(token string) (*domain.RegisteredClaims, error) {
+	claims, err := parse(token, d.secret)
+	if err != nil {
+		return nil, err
+	}
+	return registeredClaims(claims), nil
+}
+
 func NewDummyJwtGenerator(issuer string, exp int64, secret string) *DummyJwtGenerator {
 	return &DummyJwtGenerator{
 		issuer: issuer,
@@ -1,18 +1,37 @@
 package jwt
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"github.com/Runway-Club/auth_lib/domain"
+	"github.com/Runway-Club/auth_lib/utils"
 	jwtlib "github.com/golang-jwt/jwt/v5"
 	"github.com/mitchellh/mapstructure"
-	_ "github.com/mitchellh/mapstructure"
 	"github.com/spf13/viper"
+	"strings"
 	"time"
 )
 
+const (
+	// FormatRFC7519 tokens carry their claims at the top level with NumericDate times in seconds
+	FormatRFC7519 = "rfc7519"
+	// FormatLegacy tokens nest their claims in a payload claim, with exp and iat in milliseconds
+	FormatLegacy = "legacy"
+)
+
 type JwtGenerator struct {
 	secret []byte
 	exp    int64
 	issuer string
+	// audience is the aud of generated tokens, none when empty, and the only aud accepted by VerifyToken
+	audience string
+	// legacy generates legacy tokens, acceptLegacy verifies them
+	legacy       bool
+	acceptLegacy bool
+	// leeway is the clock skew tolerated when checking exp, nbf and iat
+	leeway time.Duration
+	// audiences of GenerateTokenForAudience, by lower cased name
+	audiences map[string]*domain.AudienceConfig
 }
 
 func NewJwtGenerator() *JwtGenerator {
@@ -25,50 +44,195 @@ func NewJwtGenerator() *JwtGenerator {
 		panic("[required config] jwt.exp")
 	}
 	issuer := viper.GetString("runway_auth.jwt.issuer")
+	format := viper.GetString("runway_auth.jwt.format")
+	if format != "" && format != FormatRFC7519 && format != FormatLegacy {
+		panic("[invalid config] jwt.format " + format)
+	}
+	audiences := make(map[string]*domain.AudienceConfig)
+	err := viper.UnmarshalKey("runway_auth.jwt.audiences", &audiences)
+	if err != nil {
+		panic(err)
+	}
 	return &JwtGenerator{
-		secret: []byte(secret),
-		exp:    exp,
-		issuer: issuer,
+		secret:   []byte(secret),
+		exp:      exp,
+		issuer:   issuer,
+		audience: viper.GetString("runway_auth.jwt.audience"),
+		legacy:   format == FormatLegacy,
+		// legacy tokens are accepted unless disabled, so that the tokens issued before an upgrade stay valid
+		acceptLegacy: !viper.IsSet("runway_auth.jwt.accept_legacy") || viper.GetBool("runway_auth.jwt.accept_legacy"),
+		leeway:       time.Duration(viper.GetInt64("runway_auth.jwt.leeway")) * time.Second,
+		audiences:    audiences,
 	}
 }
 
 func (j JwtGenerator) GenerateToken(auth *domain.Auth, payload map[string]interface{}) (string, error) {
+	return j.GenerateTokenWithLifetime(auth, payload, time.Duration(j.exp)*time.Second)
+}
+
+func (j JwtGenerator) GenerateTokenWithLifetime(auth *domain.Auth, payload map[string]interface{}, lifetime time.Duration) (string, error) {
 	payload["id"] = auth.Id
 	payload["username"] = auth.Username
 	payload["role_id"] = auth.RoleId
-	token := jwtlib.NewWithClaims(jwtlib.SigningMethodHS256, jwtlib.MapClaims{
-		"payload": payload,
-		"exp":     j.exp*1000 + time.Now().UnixMilli(),
-		"iat":     time.Now().UnixMilli(),
-		"iss":     j.issuer,
-	})
-	tokenString, err := token.SignedString(j.secret)
+	payload["tenant_id"] = auth.TenantId
+	now := time.Now()
+	if j.legacy {
+		return j.sign(jwtlib.MapClaims{
+			"payload": payload,
+			"exp":     lifetime.Milliseconds() + now.UnixMilli(),
+			"iat":     now.UnixMilli(),
+			"iss":     j.issuer,
+		})
+	}
+	jti, err := newJti()
+	if err != nil {
+		return "", err
+	}
+	claims := jwtlib.MapClaims{}
+	for name, value := range payload {
+		claims[name] = value
+	}
+	// an audience of the payload, such as the one of an exchanged token, takes precedence
+	if _, ok := claims["aud"]; !ok && j.audience != "" {
+		claims["aud"] = j.audience
+	}
+	claims["sub"] = auth.Id
+	claims["iss"] = j.issuer
+	claims["iat"] = now.Unix()
+	claims["nbf"] = now.Unix()
+	claims["exp"] = now.Add(lifetime).Unix()
+	claims["jti"] = jti
+	return j.sign(claims)
+}
+
+func (j JwtGenerator) GenerateTokenForAudience(auth *domain.Auth, payload map[string]interface{}, audience string) (string, error) {
+	// config keys are lower cased by viper
+	config, ok := j.audiences[strings.ToLower(audience)]
+	if !ok || config == nil {
+		return "", domain.ErrUnknownAudience
+	}
+	lifetime := time.Duration(j.exp) * time.Second
+	if config.Exp != 0 {
+		lifetime = time.Duration(config.Exp) * time.Second
+	}
+	if len(config.Claims) > 0 {
+		payload = releasedClaims(payload, config.Claims)
+	}
+	payload["aud"] = audience
+	return j.GenerateTokenWithLifetime(auth, payload, lifetime)
+}
+
+// releasedClaims returns the claims of payload named in names, the user claims are set by GenerateTokenWithLifetime
+func releasedClaims(payload map[string]interface{}, names []string) map[string]interface{} {
+	released := make(map[string]interface{}, len(names))
+	for _, name := range names {
+		if value, ok := payload[name]; ok {
+			released[name] = value
+		}
+	}
+	return released
+}
+
+func (j JwtGenerator) sign(claims jwtlib.MapClaims) (string, error) {
+	tokenString, err := jwtlib.NewWithClaims(jwtlib.SigningMethodHS256, claims).SignedString(j.secret)
 	if err != nil {
 		return "", err
 	}
 	return tokenString, nil
 }
 
+// newJti returns a random id of a token
+func newJti() (string, error) {
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(raw), nil
+}
+
+func (j JwtGenerator) Inspect(token string) (*domain.RegisteredClaims, error) {
+	claims, err := parse(token, j.secret)
+	if err != nil {
+		return nil, err
+	}
+	return registeredClaims(claims), nil
+}
+
+// parse verifies the signature of token and returns its claims, they are validated by the caller
+func parse(token string, secret []byte) (jwtlib.MapClaims, error) {
+	token = strings.TrimPrefix(token, "Bearer ")
+	claims := jwtlib.MapClaims{}
+	_, err := jwtlib.ParseWithClaims(token, claims, func(token *jwtlib.Token) (interface{}, error) {
+		return secret, nil
+	}, jwtlib.WithoutClaimsValidation(), jwtlib.WithValidMethods([]string{jwtlib.SigningMethodHS256.Alg()}))
+	if err != nil {
+		return nil, domain.ErrInvalidToken
+	}
+	return claims, nil
+}
+
+// isLegacy reports whether claims are those of a legacy token
+func isLegacy(claims jwtlib.MapClaims) bool {
+	_, ok := claims["payload"].(map[string]interface{})
+	return ok
+}
+
+// registeredClaims returns the registered claims of a token of either format
+func registeredClaims(claims jwtlib.MapClaims) *domain.RegisteredClaims {
+	registered := &domain.RegisteredClaims{}
+	registered.Issuer, _ = claims["iss"].(string)
+	registered.Subject, _ = claims["sub"].(string)
+	registered.Id, _ = claims["jti"].(string)
+	registered.Audience, _ = claims.GetAudience()
+	issuedAt, _ := claims["iat"].(float64)
+	expiresAt, _ := claims["exp"].(float64)
+	notBefore, _ := claims["nbf"].(float64)
+	if isLegacy(claims) {
+		registered.IssuedAt = time.UnixMilli(int64(issuedAt))
+		registered.ExpiresAt = time.UnixMilli(int64(expiresAt))
+		return registered
+	}
+	registered.IssuedAt = time.Unix(int64(issuedAt), 0)
+	registered.ExpiresAt = time.Unix(int64(expiresAt), 0)
+	if notBefore != 0 {
+		registered.NotBefore = time.Unix(int64(notBefore), 0)
+	}
+	return registered
+}
+
+// VerifyToken verifies a token without audience or of the configured audience, the tokens restricted to
+// another audience are rejected with domain.ErrInvalidAudience
 func (j JwtGenerator) VerifyToken(token string) (*domain.Auth, map[string]interface{}, error) {
-	// Bearer process
-	if len(token) > 7 && token[0:7] == "Bearer " {
-		token = token[7:]
-	}
-	parsedToken, err := jwtlib.Parse(token, func(token *jwtlib.Token) (interface{}, error) {
-		return j.secret, nil
-	})
-	if parsedToken == nil {
-		return nil, nil, domain.ErrInvalidToken
+	auth, claims, err := j.verify(token)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, ok := claims["aud"]; ok && (j.audience == "" || !hasAudience(claims, j.audience)) {
+		return nil, nil, domain.ErrInvalidAudience
 	}
+	return auth, claims, nil
+}
+
+func (j JwtGenerator) VerifyTokenForAudience(token string, audience string) (*domain.Auth, map[string]interface{}, error) {
+	auth, claims, err := j.verify(token)
 	if err != nil {
-		return nil, nil, domain.ErrInvalidToken
+		return nil, nil, err
 	}
-	if !parsedToken.Valid {
-		return nil, nil, domain.ErrInvalidToken
+	if !hasAudience(claims, audience) {
+		return nil, nil, domain.ErrInvalidAudience
 	}
-	claims, ok := parsedToken.Claims.(jwtlib.MapClaims)
-	if !ok {
-		return nil, nil, domain.ErrInvalidToken
+	return auth, claims, nil
+}
+
+func (j JwtGenerator) VerifyTokenOfAnyAudience(token string) (*domain.Auth, map[string]interface{}, error) {
+	return j.verify(token)
+}
+
+// verify verifies the signature, the issuer and the times of token and returns its user and claims
+func (j JwtGenerator) verify(token string) (*domain.Auth, map[string]interface{}, error) {
+	claims, err := parse(token, j.secret)
+	if err != nil {
+		return nil, nil, err
 	}
 	// check issuer
 	issuer, ok := claims["iss"].(string)
@@ -79,22 +243,33 @@ func (j JwtGenerator) VerifyToken(token string) (*domain.Auth, map[string]interf
 		return nil, nil, domain.ErrInvalidIssuer
 	}
 	// check expiration
-	exp, ok := claims["exp"].(float64)
-	if !ok {
+	if _, ok := claims["exp"].(float64); !ok {
+		return nil, nil, domain.ErrInvalidToken
+	}
+	legacy := isLegacy(claims)
+	if legacy && !j.acceptLegacy {
 		return nil, nil, domain.ErrInvalidToken
 	}
-	if exp < float64(time.Now().UnixMilli()) {
+	registered := registeredClaims(claims)
+	now := time.Now()
+	if now.After(registered.ExpiresAt.Add(j.leeway)) {
 		return nil, nil, domain.ErrExpiredToken
 	}
-	// get payload
-	payload, ok := claims["payload"].(map[string]interface{})
-	if !ok {
+	if now.Add(j.leeway).Before(registered.NotBefore) || now.Add(j.leeway).Before(registered.IssuedAt) {
 		return nil, nil, domain.ErrInvalidToken
 	}
+	// the claims of the user, nested in the payload of legacy tokens
+	payload := map[string]interface{}(claims)
+	if legacy {
+		payload = claims["payload"].(map[string]interface{})
+	}
 
 	parsedAuth := &domain.Auth{}
 	// map[string]interface{} to domain.Auth parse
-	mapstructure.Decode(claims["payload"], &parsedAuth)
+	mapstructure.Decode(payload, &parsedAuth)
+	if parsedAuth.Id == "" {
+		parsedAuth.Id = registered.Subject
+	}
 
 	if parsedAuth.Id == "" {
 		return nil, nil, domain.ErrInvalidToken
@@ -102,3 +277,17 @@ func (j JwtGenerator) VerifyToken(token string) (*domain.Auth, map[string]interf
 
 	return parsedAuth, payload, nil
 }
+
+// hasAudience reports whether the aud claim of claims, a string or a list, names audience
+func hasAudience(claims map[string]interface{}, audience string) bool {
+	if aud, ok := claims["aud"].(string); ok {
+		return aud == audience
+	}
+	audiences, _ := utils.ClaimStrings(claims, "aud")
+	for _, aud := range audiences {
+		if aud == audience {
+			return true
+		}
+	}
+	return false
+}
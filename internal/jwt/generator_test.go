@@ -1,11 +1,13 @@
 package jwt_test
 
 import (
+	"errors"
 	"fmt"
 	"github.com/Runway-Club/auth_lib/domain"
 	"github.com/Runway-Club/auth_lib/internal/jwt"
 	"github.com/spf13/viper"
 	"testing"
+	"time"
 )
 
 func TestJwtGenerator(t *testing.T) {
@@ -38,4 +40,176 @@ func TestJwtGenerator(t *testing.T) {
 			t.Errorf("expected name test, got %s", parsedData["name"])
 		}
 	})
+	t.Run("inspect", func(t *testing.T) {
+		token, err := generator.GenerateToken(&domain.Auth{Id: "1", Username: "test", RoleId: "1"}, map[string]interface{}{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		claims, err := generator.Inspect("Bearer " + token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if claims.Issuer != "runwayclub" || claims.ExpiresAt.Sub(claims.IssuedAt) != 1000*time.Second {
+			t.Errorf("unexpected claims %+v", claims)
+		}
+		_, err = jwt.NewDummyJwtGenerator("runwayclub", 1000, "another-secret").Inspect(token)
+		if !errors.Is(err, domain.ErrInvalidToken) {
+			t.Errorf("expected a token of another secret to be invalid, got %v", err)
+		}
+	})
+}
+
+func TestJwtGeneratorFormats(t *testing.T) {
+	viper.Set("runway_auth.jwt.secret", "this-is-a-secret")
+	viper.Set("runway_auth.jwt.exp", 1000)
+	viper.Set("runway_auth.jwt.issuer", "runwayclub")
+	viper.Set("runway_auth.jwt.audience", "runwayclub-api")
+	defer viper.Set("runway_auth.jwt.audience", "")
+	user := &domain.Auth{Id: "1", Username: "test", RoleId: "1"}
+	generator := jwt.NewJwtGenerator()
+	t.Run("registered claims", func(t *testing.T) {
+		token, err := generator.GenerateToken(user, map[string]interface{}{"scope": "profile"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		claims, err := generator.Inspect(token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if claims.Subject != "1" || claims.Id == "" || len(claims.Audience) != 1 || claims.Audience[0] != "runwayclub-api" {
+			t.Errorf("unexpected claims %+v", claims)
+		}
+		if claims.ExpiresAt.Sub(claims.IssuedAt) != 1000*time.Second || !claims.NotBefore.Equal(claims.IssuedAt) {
+			t.Errorf("expected times in seconds, got %+v", claims)
+		}
+		if time.Until(claims.ExpiresAt) > 1000*time.Second {
+			t.Errorf("expected exp in seconds, got %v", claims.ExpiresAt)
+		}
+		parsedUser, parsedClaims, err := generator.VerifyToken(token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parsedUser.Id != "1" || parsedUser.RoleId != "1" || parsedClaims["scope"] != "profile" || parsedClaims["sub"] != "1" {
+			t.Errorf("unexpected user %+v claims %v", parsedUser, parsedClaims)
+		}
+	})
+	t.Run("audience of the payload", func(t *testing.T) {
+		token, err := generator.GenerateToken(user, map[string]interface{}{"aud": "billing"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		claims, err := generator.Inspect(token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(claims.Audience) != 1 || claims.Audience[0] != "billing" {
+			t.Errorf("expected audience billing, got %v", claims.Audience)
+		}
+		if _, _, err = generator.VerifyToken(token); !errors.Is(err, domain.ErrInvalidAudience) {
+			t.Errorf("expected a token of another audience to be rejected, got %v", err)
+		}
+		if _, _, err = generator.VerifyTokenOfAnyAudience(token); err != nil {
+			t.Errorf("expected a token of any audience, got %v", err)
+		}
+	})
+	t.Run("leeway", func(t *testing.T) {
+		token, err := generator.GenerateTokenWithLifetime(user, map[string]interface{}{}, -10*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err = generator.VerifyToken(token); !errors.Is(err, domain.ErrExpiredToken) {
+			t.Errorf("expected an expired token, got %v", err)
+		}
+		viper.Set("runway_auth.jwt.leeway", 30)
+		defer viper.Set("runway_auth.jwt.leeway", 0)
+		if _, _, err = jwt.NewJwtGenerator().VerifyToken(token); err != nil {
+			t.Errorf("expected the token to be valid within the leeway, got %v", err)
+		}
+	})
+	t.Run("legacy", func(t *testing.T) {
+		viper.Set("runway_auth.jwt.format", jwt.FormatLegacy)
+		legacyToken, err := jwt.NewJwtGenerator().GenerateToken(user, map[string]interface{}{"name": "test"})
+		viper.Set("runway_auth.jwt.format", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		claims, err := generator.Inspect(legacyToken)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if claims.ExpiresAt.Sub(claims.IssuedAt) != 1000*time.Second || claims.Subject != "" {
+			t.Errorf("unexpected legacy claims %+v", claims)
+		}
+		parsedUser, parsedClaims, err := generator.VerifyToken(legacyToken)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parsedUser.Id != "1" || parsedClaims["name"] != "test" {
+			t.Errorf("unexpected user %+v claims %v", parsedUser, parsedClaims)
+		}
+		viper.Set("runway_auth.jwt.accept_legacy", false)
+		defer viper.Set("runway_auth.jwt.accept_legacy", true)
+		if _, _, err = jwt.NewJwtGenerator().VerifyToken(legacyToken); !errors.Is(err, domain.ErrInvalidToken) {
+			t.Errorf("expected legacy tokens to be rejected, got %v", err)
+		}
+	})
+}
+
+func TestJwtGeneratorAudiences(t *testing.T) {
+	viper.Set("runway_auth.jwt.secret", "this-is-a-secret")
+	viper.Set("runway_auth.jwt.exp", 1000)
+	viper.Set("runway_auth.jwt.issuer", "runwayclub")
+	viper.Set("runway_auth.jwt.audiences", map[string]interface{}{
+		"mobile": map[string]interface{}{"exp": 60, "claims": []string{"amr"}},
+		"admin":  map[string]interface{}{},
+	})
+	defer viper.Set("runway_auth.jwt.audiences", nil)
+	user := &domain.Auth{Id: "1", Username: "test", RoleId: "1"}
+	generator := jwt.NewJwtGenerator()
+	t.Run("lifetime and claims", func(t *testing.T) {
+		token, err := generator.GenerateTokenForAudience(user, map[string]interface{}{"amr": []string{"pwd"}, "name": "test"}, "mobile")
+		if err != nil {
+			t.Fatal(err)
+		}
+		claims, err := generator.Inspect(token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if claims.ExpiresAt.Sub(claims.IssuedAt) != 60*time.Second || len(claims.Audience) != 1 || claims.Audience[0] != "mobile" {
+			t.Errorf("unexpected claims %+v", claims)
+		}
+		parsedUser, parsedClaims, err := generator.VerifyTokenForAudience(token, "mobile")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parsedUser.Id != "1" || parsedClaims["amr"] == nil || parsedClaims["name"] != nil {
+			t.Errorf("expected only amr to be released, got %v", parsedClaims)
+		}
+	})
+	t.Run("other audiences", func(t *testing.T) {
+		token, err := generator.GenerateTokenForAudience(user, map[string]interface{}{"name": "test"}, "admin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, parsedClaims, err := generator.VerifyTokenForAudience(token, "admin")
+		if err != nil || parsedClaims["name"] != "test" {
+			t.Errorf("expected every claim to be released, got %v %v", parsedClaims, err)
+		}
+		if _, _, err = generator.VerifyTokenForAudience(token, "mobile"); !errors.Is(err, domain.ErrInvalidAudience) {
+			t.Errorf("expected an admin token to be rejected by mobile, got %v", err)
+		}
+		if _, _, err = generator.VerifyToken(token); !errors.Is(err, domain.ErrInvalidAudience) {
+			t.Errorf("expected an admin token to be rejected without audience, got %v", err)
+		}
+		token, err = generator.GenerateToken(user, map[string]interface{}{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err = generator.VerifyTokenForAudience(token, "admin"); !errors.Is(err, domain.ErrInvalidAudience) {
+			t.Errorf("expected a token without audience to be rejected, got %v", err)
+		}
+		if _, err = generator.GenerateTokenForAudience(user, map[string]interface{}{}, "web"); !errors.Is(err, domain.ErrUnknownAudience) {
+			t.Errorf("expected an unknown audience, got %v", err)
+		}
+	})
 }
@@ -0,0 +1,73 @@
+package jwt
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"github.com/Runway-Club/auth_lib/domain"
+	jwtlib "github.com/golang-jwt/jwt/v5"
+	"github.com/spf13/viper"
+	"math/big"
+	"os"
+)
+
+// RSASigner signs id tokens with RS256, its public key is published as a JWKS
+type RSASigner struct {
+	key *rsa.PrivateKey
+	// kid is the thumbprint of the public key, RFC 7638
+	kid string
+}
+
+func (s *RSASigner) Sign(claims map[string]interface{}) (string, error) {
+	token := jwtlib.NewWithClaims(jwtlib.SigningMethodRS256, jwtlib.MapClaims(claims))
+	token.Header["kid"] = s.kid
+	return token.SignedString(s.key)
+}
+
+func (s *RSASigner) Verify(token string) (map[string]interface{}, error) {
+	parsedToken, err := jwtlib.Parse(token, func(token *jwtlib.Token) (interface{}, error) {
+		return &s.key.PublicKey, nil
+	}, jwtlib.WithValidMethods([]string{jwtlib.SigningMethodRS256.Alg()}), jwtlib.WithoutClaimsValidation())
+	if err != nil || !parsedToken.Valid {
+		return nil, domain.ErrInvalidToken
+	}
+	return parsedToken.Claims.(jwtlib.MapClaims), nil
+}
+
+func (s *RSASigner) JWKS() *domain.JWKS {
+	return &domain.JWKS{Keys: []*domain.JWK{{
+		Kty: "RSA",
+		Use: "sig",
+		Alg: jwtlib.SigningMethodRS256.Alg(),
+		Kid: s.kid,
+		N:   base64.RawURLEncoding.EncodeToString(s.key.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(s.key.E)).Bytes()),
+	}}}
+}
+
+// NewRSASigner loads the pem key of runway_auth.oauth.signing_key, a key is generated when it is empty.
+// Id tokens signed by a generated key can not be verified by other instances nor after a restart.
+func NewRSASigner() *RSASigner {
+	var key *rsa.PrivateKey
+	var err error
+	path := viper.GetString("runway_auth.oauth.signing_key")
+	if path == "" {
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	} else {
+		var raw []byte
+		raw, err = os.ReadFile(path)
+		if err == nil {
+			key, err = jwtlib.ParseRSAPrivateKeyFromPEM(raw)
+		}
+	}
+	if err != nil {
+		panic(err)
+	}
+	s := &RSASigner{key: key}
+	jwk := s.JWKS().Keys[0]
+	// the members of the thumbprint are required and in lexicographic order
+	sum := sha256.Sum256([]byte(`{"e":"` + jwk.E + `","kty":"RSA","n":"` + jwk.N + `"}`))
+	s.kid = base64.RawURLEncoding.EncodeToString(sum[:])
+	return s
+}
@@ -0,0 +1,33 @@
+package jwt_test
+
+import (
+	"github.com/Runway-Club/auth_lib/internal/jwt"
+	"github.com/spf13/viper"
+	"testing"
+)
+
+func TestRSASigner(t *testing.T) {
+	viper.Set("runway_auth.oauth.signing_key", "")
+	signer := jwt.NewRSASigner()
+	t.Run("sign and verify", func(t *testing.T) {
+		token, err := signer.Sign(map[string]interface{}{"sub": "user01", "exp": 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// expired id tokens are still valid hints
+		claims, err := signer.Verify(token)
+		if err != nil || claims["sub"] != "user01" {
+			t.Errorf("expected the claims of the token, got %v %v", claims, err)
+		}
+		_, err = jwt.NewRSASigner().Verify(token)
+		if err == nil {
+			t.Error("expected a token of another key to be invalid")
+		}
+	})
+	t.Run("jwks", func(t *testing.T) {
+		jwks := signer.JWKS()
+		if len(jwks.Keys) != 1 || jwks.Keys[0].Kid == "" || jwks.Keys[0].E != "AQAB" {
+			t.Errorf("unexpected jwks %+v", jwks.Keys[0])
+		}
+	})
+}
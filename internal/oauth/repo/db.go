@@ -0,0 +1,198 @@
+package repo
+
+import (
+	"context"
+	"github.com/Runway-Club/auth_lib/domain"
+	"gorm.io/gorm"
+	"time"
+)
+
+type OAuthRepository struct {
+	db *gorm.DB
+}
+
+func NewOAuthRepository(dialector gorm.Dialector) *OAuthRepository {
+	db, err := gorm.Open(dialector)
+	if err != nil {
+		panic(err)
+	}
+	// migrate schema
+	err = db.AutoMigrate(&domain.OAuthClient{}, &domain.AuthorizationCode{}, &domain.RefreshToken{}, &domain.DeviceCode{})
+	if err != nil {
+		panic(err)
+	}
+	return &OAuthRepository{db: db}
+}
+
+// scoped returns a session limited to the tenant of ctx
+func (o *OAuthRepository) scoped(ctx context.Context) *gorm.DB {
+	return o.db.WithContext(ctx).Where("tenant_id = ?", domain.TenantFromContext(ctx))
+}
+
+func (o *OAuthRepository) CreateClient(ctx context.Context, client *domain.OAuthClient) error {
+	client.TenantId = domain.TenantFromContext(ctx)
+	tx := o.db.WithContext(ctx).Create(client)
+	if tx.Error != nil {
+		return tx.Error
+	}
+	return nil
+}
+
+func (o *OAuthRepository) GetClient(ctx context.Context, id string) (*domain.OAuthClient, error) {
+	found := &domain.OAuthClient{}
+	tx := o.scoped(ctx).Where("id = ?", id).First(found)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	return found, nil
+}
+
+func (o *OAuthRepository) DeleteClient(ctx context.Context, id string) error {
+	// clients are deleted permanently so that their id can be registered again
+	tx := o.scoped(ctx).Unscoped().Where("id = ?", id).Delete(&domain.OAuthClient{})
+	if tx.Error != nil {
+		return tx.Error
+	}
+	if tx.RowsAffected == 0 {
+		return domain.ErrOAuthInvalidClient.With("client not found")
+	}
+	return nil
+}
+
+func (o *OAuthRepository) CreateCode(ctx context.Context, code *domain.AuthorizationCode) error {
+	code.TenantId = domain.TenantFromContext(ctx)
+	tx := o.db.WithContext(ctx).Create(code)
+	if tx.Error != nil {
+		return tx.Error
+	}
+	return nil
+}
+
+func (o *OAuthRepository) ConsumeCode(ctx context.Context, codeHash string) (*domain.AuthorizationCode, error) {
+	found := &domain.AuthorizationCode{}
+	err := o.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// the update only succeeds once, concurrent exchanges of a code fail
+		result := tx.Model(&domain.AuthorizationCode{}).
+			Where("tenant_id = ? AND code_hash = ? AND used = ?", domain.TenantFromContext(ctx), codeHash, false).
+			Update("used", true)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return domain.ErrOAuthInvalidGrant.With("invalid authorization code")
+		}
+		return tx.Where("code_hash = ?", codeHash).First(found).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return found, nil
+}
+
+func (o *OAuthRepository) CreateRefreshToken(ctx context.Context, token *domain.RefreshToken) error {
+	token.TenantId = domain.TenantFromContext(ctx)
+	tx := o.db.WithContext(ctx).Create(token)
+	if tx.Error != nil {
+		return tx.Error
+	}
+	return nil
+}
+
+func (o *OAuthRepository) RevokeRefreshToken(ctx context.Context, tokenHash string) (*domain.RefreshToken, error) {
+	found := &domain.RefreshToken{}
+	err := o.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&domain.RefreshToken{}).
+			Where("tenant_id = ? AND token_hash = ? AND revoked = ?", domain.TenantFromContext(ctx), tokenHash, false).
+			Update("revoked", true)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return domain.ErrOAuthInvalidGrant.With("invalid refresh token")
+		}
+		return tx.Where("token_hash = ?", tokenHash).First(found).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return found, nil
+}
+
+func (o *OAuthRepository) GetRefreshToken(ctx context.Context, tokenHash string) (*domain.RefreshToken, error) {
+	found := &domain.RefreshToken{}
+	tx := o.scoped(ctx).Where("token_hash = ?", tokenHash).First(found)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	return found, nil
+}
+
+func (o *OAuthRepository) CreateDeviceCode(ctx context.Context, code *domain.DeviceCode) error {
+	code.TenantId = domain.TenantFromContext(ctx)
+	tx := o.db.WithContext(ctx).Create(code)
+	if tx.Error != nil {
+		return tx.Error
+	}
+	return nil
+}
+
+func (o *OAuthRepository) GetDeviceCode(ctx context.Context, deviceCodeHash string) (*domain.DeviceCode, error) {
+	found := &domain.DeviceCode{}
+	tx := o.scoped(ctx).Where("device_code_hash = ?", deviceCodeHash).First(found)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	return found, nil
+}
+
+func (o *OAuthRepository) GetDeviceCodeByUserCode(ctx context.Context, userCode string) (*domain.DeviceCode, error) {
+	found := &domain.DeviceCode{}
+	tx := o.scoped(ctx).Where("user_code = ?", userCode).First(found)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	return found, nil
+}
+
+func (o *OAuthRepository) PollDeviceCode(ctx context.Context, deviceCodeHash string, polledAt time.Time, interval int64) error {
+	tx := o.scoped(ctx).Model(&domain.DeviceCode{}).Where("device_code_hash = ?", deviceCodeHash).
+		Updates(map[string]interface{}{"last_polled_at": polledAt, "interval": interval})
+	if tx.Error != nil {
+		return tx.Error
+	}
+	return nil
+}
+
+func (o *OAuthRepository) DecideDeviceCode(ctx context.Context, code *domain.DeviceCode) error {
+	// the update only succeeds once, a code can not be approved after it was denied
+	tx := o.scoped(ctx).Model(&domain.DeviceCode{}).
+		Where("user_code = ? AND status = ?", code.UserCode, domain.DeviceCodePending).
+		Select("status", "user_id", "scope", "auth_time", "amr").
+		Updates(&domain.DeviceCode{
+			Status:   code.Status,
+			UserId:   code.UserId,
+			Scope:    code.Scope,
+			AuthTime: code.AuthTime,
+			AMR:      code.AMR,
+		})
+	if tx.Error != nil {
+		return tx.Error
+	}
+	if tx.RowsAffected == 0 {
+		return domain.ErrOAuthInvalidGrant.With("the user code was already used")
+	}
+	return nil
+}
+
+func (o *OAuthRepository) ConsumeDeviceCode(ctx context.Context, deviceCodeHash string) error {
+	tx := o.scoped(ctx).Model(&domain.DeviceCode{}).
+		Where("device_code_hash = ? AND status = ?", deviceCodeHash, domain.DeviceCodeApproved).
+		Update("status", domain.DeviceCodeConsumed)
+	if tx.Error != nil {
+		return tx.Error
+	}
+	if tx.RowsAffected == 0 {
+		return domain.ErrOAuthInvalidGrant.With("invalid device code")
+	}
+	return nil
+}
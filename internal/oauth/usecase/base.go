@@ -0,0 +1,913 @@
+package usecase
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"github.com/Runway-Club/auth_lib/domain"
+	"github.com/Runway-Club/auth_lib/utils"
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/bcrypt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type OAuthUseCase struct {
+	repo     domain.OAuthRepository
+	authRepo domain.AuthRepository
+	jwt      domain.JwtGenerator
+	signer   domain.IdTokenSigner
+	scopes   map[string]*domain.ScopeConfig
+	// issuer is the url of the authorization server, the iss of id tokens
+	issuer  string
+	codeTTL time.Duration
+	// refreshTTL is the lifetime of refresh tokens, they are rotated on every use
+	refreshTTL time.Duration
+	// accessTTL is the lifetime of access tokens in seconds, the expiration of the jwt generator
+	accessTTL int64
+	// deviceTTL is the lifetime of device codes, deviceInterval the seconds a device waits between polls
+	deviceTTL      time.Duration
+	deviceInterval int64
+	// exchangeTTL is the longest lifetime of exchanged tokens, they never outlive their subject token
+	exchangeTTL time.Duration
+}
+
+// LoadScopes returns the scopes declared in runway_auth.oauth.scopes by name
+func LoadScopes() (map[string]*domain.ScopeConfig, error) {
+	declared := make([]*domain.ScopeConfig, 0)
+	err := viper.UnmarshalKey("runway_auth.oauth.scopes", &declared)
+	if err != nil {
+		return nil, err
+	}
+	scopes := make(map[string]*domain.ScopeConfig)
+	for _, scope := range declared {
+		if scope.Name == "" || strings.ContainsAny(scope.Name, " \"\\") || scopes[scope.Name] != nil {
+			return nil, domain.ErrOAuthInvalidScope.With("invalid scope " + scope.Name)
+		}
+		scopes[scope.Name] = scope
+	}
+	return scopes, nil
+}
+
+// randomToken returns a random url safe token of 32 bytes
+func randomToken() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// hash returns the sha256 of a code or a token as stored
+func hash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (o *OAuthUseCase) RegisterClient(ctx context.Context, client *domain.OAuthClient, confidential bool) (string, error) {
+	for _, grantType := range client.GrantTypes {
+		if !contains(supportedGrants, grantType) {
+			return "", domain.ErrOAuthInvalidClientMetadata.With("unsupported grant type " + grantType)
+		}
+		// a public client can not authenticate as itself
+		if (grantType == domain.GrantClientCredentials || grantType == domain.GrantTokenExchange) && !confidential {
+			return "", domain.ErrOAuthInvalidClientMetadata.With("the " + grantType + " grant requires a confidential client")
+		}
+	}
+	if client.AllowsGrant(domain.GrantAuthorizationCode) && len(client.RedirectURIs) == 0 {
+		return "", domain.ErrOAuthInvalidRedirectURI.With("at least one redirect uri is required")
+	}
+	for _, redirectURI := range append(append([]string{}, client.RedirectURIs...), client.PostLogoutRedirectURIs...) {
+		parsed, err := url.Parse(redirectURI)
+		if err != nil || !parsed.IsAbs() || parsed.Fragment != "" {
+			return "", domain.ErrOAuthInvalidRedirectURI.With(redirectURI + " is not an absolute uri without fragment")
+		}
+	}
+	for _, scope := range client.Scopes {
+		if o.scopes[scope] == nil {
+			return "", domain.ErrOAuthInvalidClientMetadata.With("unknown scope " + scope)
+		}
+	}
+	if client.Id == "" {
+		id, err := randomToken()
+		if err != nil {
+			return "", err
+		}
+		client.Id = id[:22]
+	}
+	secret := ""
+	client.SecretHash = ""
+	if confidential {
+		var err error
+		secret, err = randomToken()
+		if err != nil {
+			return "", err
+		}
+		client.SecretHash, err = utils.GeneratePassword(secret, "")
+		if err != nil {
+			return "", err
+		}
+	}
+	err := o.repo.CreateClient(ctx, client)
+	if err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+func (o *OAuthUseCase) GetClient(ctx context.Context, id string) (*domain.OAuthClient, error) {
+	client, err := o.repo.GetClient(ctx, id)
+	if err != nil {
+		return nil, domain.ErrOAuthInvalidClient.With("client not found")
+	}
+	return client, nil
+}
+
+func (o *OAuthUseCase) DeleteClient(ctx context.Context, id string) error {
+	return o.repo.DeleteClient(ctx, id)
+}
+
+// ValidateAuthorize returns a nil client when the client or its redirect uri are invalid, the error
+// must then be shown to the user. Other errors are returned with the client and are redirected.
+func (o *OAuthUseCase) ValidateAuthorize(ctx context.Context, req *domain.AuthorizeRequest) (*domain.OAuthClient, []string, error) {
+	client, err := o.GetClient(ctx, req.ClientId)
+	if err != nil {
+		return nil, nil, err
+	}
+	if req.RedirectURI == "" && len(client.RedirectURIs) == 1 {
+		req.RedirectURI = client.RedirectURIs[0]
+		req.RedirectURIDefaulted = true
+	}
+	if !contains(client.RedirectURIs, req.RedirectURI) {
+		return nil, nil, domain.ErrOAuthInvalidRequest.With("redirect_uri is not registered")
+	}
+	if !client.AllowsGrant(domain.GrantAuthorizationCode) {
+		return client, nil, domain.ErrOAuthUnauthorizedClient.With("the client may not use the authorization code grant")
+	}
+	if req.ResponseType != "code" {
+		return client, nil, domain.ErrOAuthUnsupportedResponseType.With("only the code response type is supported")
+	}
+	if req.CodeChallenge == "" || req.CodeChallengeMethod != domain.CodeChallengeS256 {
+		return client, nil, domain.ErrOAuthInvalidRequest.With("a S256 code_challenge is required")
+	}
+	scopes, err := o.requestedScopes(client, req.Scope)
+	if err != nil {
+		return client, nil, err
+	}
+	return client, scopes, nil
+}
+
+// requestedScopes returns the scopes of scope, all the scopes of client when it is empty
+func (o *OAuthUseCase) requestedScopes(client *domain.OAuthClient, scope string) ([]string, error) {
+	scopes := strings.Fields(scope)
+	if len(scopes) == 0 {
+		return client.Scopes, nil
+	}
+	for _, name := range scopes {
+		if isStandardScope(name) {
+			continue
+		}
+		if o.scopes[name] == nil || !contains(client.Scopes, name) {
+			return nil, domain.ErrOAuthInvalidScope.With("scope " + name + " is not allowed")
+		}
+	}
+	return scopes, nil
+}
+
+// isStandardScope reports whether scope is a scope of OpenID Connect, which every client may request
+func isStandardScope(scope string) bool {
+	return scope == domain.ScopeOpenId || scope == domain.ScopeProfile || scope == domain.ScopeEmail
+}
+
+func (o *OAuthUseCase) IssueCode(ctx context.Context, req *domain.AuthorizeRequest, user *domain.Auth, authn *domain.Authentication, scopes []string) (string, error) {
+	code, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	err = o.repo.CreateCode(ctx, &domain.AuthorizationCode{
+		CodeHash:            hash(code),
+		ClientId:            req.ClientId,
+		UserId:              user.Id,
+		RedirectURI:         req.RedirectURI,
+		RedirectURIRequired: !req.RedirectURIDefaulted,
+		Scope:               strings.Join(scopes, " "),
+		CodeChallenge:       req.CodeChallenge,
+		CodeChallengeMethod: req.CodeChallengeMethod,
+		Nonce:               req.Nonce,
+		AuthTime:            authn.Time,
+		AMR:                 authn.Methods,
+		ExpiresAt:           time.Now().Add(o.codeTTL),
+	})
+	if err != nil {
+		return "", err
+	}
+	return code, nil
+}
+
+func (o *OAuthUseCase) Token(ctx context.Context, req *domain.TokenRequest) (*domain.TokenResponse, error) {
+	switch req.GrantType {
+	case domain.GrantAuthorizationCode:
+		return o.exchangeCode(ctx, req)
+	case domain.GrantRefreshToken:
+		return o.refresh(ctx, req)
+	case domain.GrantClientCredentials:
+		return o.clientCredentials(ctx, req)
+	case domain.GrantDeviceCode:
+		client, user, code, err := o.deviceGrant(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		return o.issue(ctx, client, user, code.Scope, &domain.Authentication{Time: code.AuthTime, Methods: code.AMR}, "")
+	case domain.GrantTokenExchange:
+		return o.exchangeToken(ctx, req)
+	case "":
+		return nil, domain.ErrOAuthInvalidRequest.With("grant_type is required")
+	}
+	return nil, domain.ErrOAuthUnsupportedGrantType.With(req.GrantType + " is not supported")
+}
+
+// supportedGrants are the grant types of the token endpoint, in the order of the discovery document
+var supportedGrants = []string{domain.GrantAuthorizationCode, domain.GrantRefreshToken, domain.GrantClientCredentials,
+	domain.GrantDeviceCode, domain.GrantTokenExchange}
+
+// authenticateClient checks the secret of confidential clients and that the client may use the grant
+func (o *OAuthUseCase) authenticateClient(ctx context.Context, req *domain.TokenRequest) (*domain.OAuthClient, error) {
+	client, err := o.repo.GetClient(ctx, req.ClientId)
+	if err != nil {
+		return nil, domain.ErrOAuthInvalidClient.With("client authentication failed")
+	}
+	if !client.Public() && bcrypt.CompareHashAndPassword([]byte(client.SecretHash), []byte(req.ClientSecret)) != nil {
+		return nil, domain.ErrOAuthInvalidClient.With("client authentication failed")
+	}
+	if !client.AllowsGrant(req.GrantType) {
+		return nil, domain.ErrOAuthUnauthorizedClient.With("the client may not use the " + req.GrantType + " grant")
+	}
+	return client, nil
+}
+
+// AuthenticateClient only authenticates confidential clients, a public client proves nothing by its id
+func (o *OAuthUseCase) AuthenticateClient(ctx context.Context, id, secret string) (*domain.OAuthClient, error) {
+	client, err := o.repo.GetClient(ctx, id)
+	if err != nil || client.Public() || bcrypt.CompareHashAndPassword([]byte(client.SecretHash), []byte(secret)) != nil {
+		return nil, domain.ErrOAuthInvalidClient.With("client authentication failed")
+	}
+	return client, nil
+}
+
+func (o *OAuthUseCase) IntrospectRefreshToken(ctx context.Context, client *domain.OAuthClient, token string) (*domain.Introspection, error) {
+	found, err := o.repo.GetRefreshToken(ctx, hash(token))
+	if err != nil || found.Revoked || time.Now().After(found.ExpiresAt) {
+		return &domain.Introspection{}, nil
+	}
+	if found.ClientId != client.Id && !client.ResourceServer {
+		return &domain.Introspection{}, nil
+	}
+	user, err := o.authRepo.GetById(ctx, found.UserId)
+	if err != nil {
+		return &domain.Introspection{}, nil
+	}
+	return &domain.Introspection{
+		Active:    true,
+		Sub:       user.Id,
+		Username:  user.Username,
+		RoleId:    user.RoleId,
+		TenantId:  user.TenantId,
+		Scope:     found.Scope,
+		ClientId:  found.ClientId,
+		TokenType: domain.TokenTypeRefreshToken,
+		Exp:       found.ExpiresAt.Unix(),
+		Iat:       found.CreatedAt.Unix(),
+		Iss:       o.issuer,
+	}, nil
+}
+
+// clientCredentials issues a token to a confidential client for itself, without refresh token. A client
+// without scopes is only limited by the acis of its subject and role.
+func (o *OAuthUseCase) clientCredentials(ctx context.Context, req *domain.TokenRequest) (*domain.TokenResponse, error) {
+	client, err := o.authenticateClient(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if client.Public() {
+		return nil, domain.ErrOAuthUnauthorizedClient.With("the client credentials grant requires a confidential client")
+	}
+	scopes, err := o.requestedScopes(client, req.Scope)
+	if err != nil {
+		return nil, err
+	}
+	payload := map[string]interface{}{"client_id": client.Id}
+	for _, name := range scopes {
+		// there is no user to release claims of
+		if isStandardScope(name) {
+			return nil, domain.ErrOAuthInvalidScope.With("scope " + name + " requires a user")
+		}
+	}
+	if len(scopes) > 0 {
+		payload["scope"] = strings.Join(scopes, " ")
+	}
+	accessToken, err := o.jwt.GenerateToken(&domain.Auth{
+		Id:       domain.ClientSubject(client.Id),
+		Username: client.Id,
+		RoleId:   client.RoleId,
+		TenantId: client.TenantId,
+	}, payload)
+	if err != nil {
+		return nil, err
+	}
+	return &domain.TokenResponse{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   o.accessTTL,
+		Scope:       strings.Join(scopes, " "),
+	}, nil
+}
+
+// exchangeToken issues a token of the user of a subject token to a confidential client calling another
+// service on its behalf, RFC 8693. The token is narrowed to the scope, resources and audience requested,
+// which must be within those of the subject token, and names the client in its act claim so that checks
+// also require the permissions of the client.
+func (o *OAuthUseCase) exchangeToken(ctx context.Context, req *domain.TokenRequest) (*domain.TokenResponse, error) {
+	client, err := o.authenticateClient(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if client.Public() {
+		return nil, domain.ErrOAuthUnauthorizedClient.With("the token exchange grant requires a confidential client")
+	}
+	if req.SubjectToken == "" {
+		return nil, domain.ErrOAuthInvalidRequest.With("subject_token is required")
+	}
+	if req.SubjectTokenType != domain.TokenTypeURNAccessToken && req.SubjectTokenType != domain.TokenTypeURNJWT {
+		return nil, domain.ErrOAuthInvalidRequest.With("unsupported subject_token_type")
+	}
+	// a token of an audience is exchanged for the same audience or narrowed further
+	subject, claims, err := o.jwt.VerifyTokenOfAnyAudience(req.SubjectToken)
+	if err != nil || subject.TenantId != domain.TenantFromContext(ctx) {
+		return nil, domain.ErrOAuthInvalidGrant.With("invalid subject token")
+	}
+	registered, err := o.jwt.Inspect(req.SubjectToken)
+	if err != nil {
+		return nil, domain.ErrOAuthInvalidGrant.With("invalid subject token")
+	}
+	payload := map[string]interface{}{"client_id": client.Id}
+	// an impersonation stays one, so that it is still audited and rejected where sessions are required
+	if impersonator, ok := claims["impersonator"]; ok {
+		payload["impersonator"] = impersonator
+	}
+	scope, scoped := claims["scope"].(string)
+	if req.Scope != "" {
+		for _, name := range strings.Fields(req.Scope) {
+			if o.scopes[name] == nil || (scoped && !contains(strings.Fields(scope), name)) {
+				return nil, domain.ErrOAuthInvalidScope.With("scope " + name + " is not granted to the subject token")
+			}
+		}
+		scope, scoped = strings.Join(strings.Fields(req.Scope), " "), true
+	}
+	if scoped {
+		payload["scope"] = scope
+	}
+	resources, limited := utils.ClaimStrings(claims, "resources")
+	if len(req.Resources) > 0 {
+		for _, resource := range req.Resources {
+			// the requested resources are patterns, each must be covered, not merely matched, by the subject token
+			if limited && !utils.CoversAnyResource(resources, resource) {
+				return nil, domain.ErrOAuthInvalidTarget.With("resource " + resource + " is not granted to the subject token")
+			}
+		}
+		resources, limited = req.Resources, true
+	}
+	if limited {
+		payload["resources"] = resources
+	}
+	audience, _ := claims["aud"].(string)
+	if req.Audience != "" {
+		if audience != "" && audience != req.Audience {
+			return nil, domain.ErrOAuthInvalidTarget.With("audience " + req.Audience + " is not granted to the subject token")
+		}
+		audience = req.Audience
+	}
+	if audience != "" {
+		payload["aud"] = audience
+	}
+	act := map[string]interface{}{"sub": domain.ClientSubject(client.Id), "client_id": client.Id, "role_id": client.RoleId}
+	// a token exchanged again keeps the chain of its actors
+	if previous, ok := claims["act"].(map[string]interface{}); ok {
+		act["act"] = previous
+	}
+	payload["act"] = act
+	lifetime := o.exchangeTTL
+	if remaining := time.Until(registered.ExpiresAt); remaining < lifetime {
+		lifetime = remaining
+	}
+	accessToken, err := o.jwt.GenerateTokenWithLifetime(subject, payload, lifetime)
+	if err != nil {
+		return nil, err
+	}
+	resp := &domain.TokenResponse{
+		AccessToken:     accessToken,
+		TokenType:       "Bearer",
+		ExpiresIn:       int64(lifetime / time.Second),
+		IssuedTokenType: domain.TokenTypeURNAccessToken,
+	}
+	if scoped {
+		resp.Scope = scope
+	}
+	return resp, nil
+}
+
+func (o *OAuthUseCase) exchangeCode(ctx context.Context, req *domain.TokenRequest) (*domain.TokenResponse, error) {
+	client, err := o.authenticateClient(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if req.Code == "" || req.CodeVerifier == "" {
+		return nil, domain.ErrOAuthInvalidRequest.With("code and code_verifier are required")
+	}
+	code, err := o.repo.ConsumeCode(ctx, hash(req.Code))
+	if err != nil {
+		return nil, err
+	}
+	if code.ClientId != client.Id || time.Now().After(code.ExpiresAt) {
+		return nil, domain.ErrOAuthInvalidGrant.With("invalid authorization code")
+	}
+	if (code.RedirectURIRequired || req.RedirectURI != "") && req.RedirectURI != code.RedirectURI {
+		return nil, domain.ErrOAuthInvalidGrant.With("redirect_uri does not match")
+	}
+	if !verifyChallenge(req.CodeVerifier, code.CodeChallenge) {
+		return nil, domain.ErrOAuthInvalidGrant.With("code_verifier does not match")
+	}
+	user, err := o.authRepo.GetById(ctx, code.UserId)
+	if err != nil {
+		return nil, domain.ErrOAuthInvalidGrant.With("user not found")
+	}
+	return o.issue(ctx, client, user, code.Scope, &domain.Authentication{Time: code.AuthTime, Methods: code.AMR}, code.Nonce)
+}
+
+// verifyChallenge checks a PKCE verifier against its S256 challenge
+func verifyChallenge(verifier, challenge string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	expected := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(challenge)) == 1
+}
+
+func (o *OAuthUseCase) refresh(ctx context.Context, req *domain.TokenRequest) (*domain.TokenResponse, error) {
+	client, err := o.authenticateClient(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if req.RefreshToken == "" {
+		return nil, domain.ErrOAuthInvalidRequest.With("refresh_token is required")
+	}
+	old, err := o.repo.RevokeRefreshToken(ctx, hash(req.RefreshToken))
+	if err != nil {
+		return nil, err
+	}
+	if old.ClientId != client.Id || time.Now().After(old.ExpiresAt) {
+		return nil, domain.ErrOAuthInvalidGrant.With("invalid refresh token")
+	}
+	// a refresh may narrow the scope but never widen it
+	scope := old.Scope
+	if req.Scope != "" {
+		granted := strings.Fields(old.Scope)
+		for _, name := range strings.Fields(req.Scope) {
+			if !contains(granted, name) {
+				return nil, domain.ErrOAuthInvalidScope.With("scope " + name + " was not granted")
+			}
+		}
+		scope = strings.Join(strings.Fields(req.Scope), " ")
+	}
+	user, err := o.authRepo.GetById(ctx, old.UserId)
+	if err != nil {
+		return nil, domain.ErrOAuthInvalidGrant.With("user not found")
+	}
+	return o.issue(ctx, client, user, scope, &domain.Authentication{Time: old.AuthTime, Methods: old.AMR}, "")
+}
+
+// accessToken generates an access token of user limited to scope
+func (o *OAuthUseCase) accessToken(client *domain.OAuthClient, user *domain.Auth, scope string) (string, error) {
+	return o.jwt.GenerateToken(user, map[string]interface{}{
+		"scope":     scope,
+		"client_id": client.Id,
+	})
+}
+
+// issue generates an access token limited to scope, a refresh token when the client may refresh it and
+// an id token for the openid scope
+func (o *OAuthUseCase) issue(ctx context.Context, client *domain.OAuthClient, user *domain.Auth, scope string, authn *domain.Authentication, nonce string) (*domain.TokenResponse, error) {
+	accessToken, err := o.accessToken(client, user, scope)
+	if err != nil {
+		return nil, err
+	}
+	resp := &domain.TokenResponse{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   o.accessTTL,
+		Scope:       scope,
+	}
+	if client.AllowsGrant(domain.GrantRefreshToken) {
+		resp.RefreshToken, err = o.newRefreshToken(ctx, client, user, scope, authn)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if contains(strings.Fields(scope), domain.ScopeOpenId) {
+		resp.IdToken, err = o.idToken(client, user, strings.Fields(scope), authn, nonce)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return resp, nil
+}
+
+func (o *OAuthUseCase) newRefreshToken(ctx context.Context, client *domain.OAuthClient, user *domain.Auth, scope string, authn *domain.Authentication) (string, error) {
+	refreshToken, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	err = o.repo.CreateRefreshToken(ctx, &domain.RefreshToken{
+		TokenHash: hash(refreshToken),
+		ClientId:  client.Id,
+		UserId:    user.Id,
+		Scope:     scope,
+		AuthTime:  authn.Time,
+		AMR:       authn.Methods,
+		ExpiresAt: time.Now().Add(o.refreshTTL),
+	})
+	if err != nil {
+		return "", err
+	}
+	return refreshToken, nil
+}
+
+// idToken generates the id token of user for client, with the claims of UserInfo
+func (o *OAuthUseCase) idToken(client *domain.OAuthClient, user *domain.Auth, scopes []string, authn *domain.Authentication, nonce string) (string, error) {
+	claims := userClaims(user, scopes)
+	now := time.Now()
+	claims["iss"] = o.issuer
+	claims["aud"] = client.Id
+	claims["azp"] = client.Id
+	claims["iat"] = now.Unix()
+	claims["exp"] = now.Unix() + o.accessTTL
+	if !authn.Time.IsZero() {
+		claims["auth_time"] = authn.Time.Unix()
+	}
+	if len(authn.Methods) > 0 {
+		claims["amr"] = authn.Methods
+	}
+	if nonce != "" {
+		claims["nonce"] = nonce
+	}
+	return o.signer.Sign(claims)
+}
+
+// userClaims returns the claims of user released by scopes, the username is the email when it is one
+func userClaims(user *domain.Auth, scopes []string) map[string]interface{} {
+	claims := map[string]interface{}{"sub": user.Id}
+	if contains(scopes, domain.ScopeProfile) {
+		claims["name"] = user.Username
+		claims["preferred_username"] = user.Username
+		claims["updated_at"] = user.UpdatedAt.Unix()
+	}
+	if contains(scopes, domain.ScopeEmail) && strings.Contains(user.Username, "@") {
+		claims["email"] = user.Username
+		claims["email_verified"] = false
+	}
+	return claims
+}
+
+func (o *OAuthUseCase) UserInfo(ctx context.Context, userId string, scopes []string) (map[string]interface{}, error) {
+	if !contains(scopes, domain.ScopeOpenId) {
+		return nil, domain.ErrOAuthInsufficientScope.With("the openid scope is required")
+	}
+	user, err := o.authRepo.GetById(ctx, userId)
+	if err != nil {
+		return nil, domain.ErrOAuthInvalidToken.With("user not found")
+	}
+	return userClaims(user, scopes), nil
+}
+
+func (o *OAuthUseCase) ValidateLogout(ctx context.Context, req *domain.LogoutRequest) (string, error) {
+	if req.IdTokenHint != "" {
+		claims, err := o.signer.Verify(req.IdTokenHint)
+		if err != nil || claims["iss"] != o.issuer {
+			return "", domain.ErrOAuthInvalidRequest.With("invalid id_token_hint")
+		}
+		audience, _ := claims["aud"].(string)
+		if req.ClientId != "" && req.ClientId != audience {
+			return "", domain.ErrOAuthInvalidRequest.With("client_id does not match id_token_hint")
+		}
+		req.ClientId = audience
+	}
+	if req.PostLogoutRedirectURI == "" {
+		return "", nil
+	}
+	// without a client the redirect uri can not be validated
+	if req.ClientId == "" {
+		return "", domain.ErrOAuthInvalidRequest.With("post_logout_redirect_uri requires id_token_hint or client_id")
+	}
+	client, err := o.GetClient(ctx, req.ClientId)
+	if err != nil {
+		return "", err
+	}
+	if !contains(client.PostLogoutRedirectURIs, req.PostLogoutRedirectURI) {
+		return "", domain.ErrOAuthInvalidRequest.With("post_logout_redirect_uri is not registered")
+	}
+	return req.PostLogoutRedirectURI, nil
+}
+
+func (o *OAuthUseCase) Metadata() *domain.ProviderMetadata {
+	scopes := []string{domain.ScopeOpenId, domain.ScopeProfile, domain.ScopeEmail}
+	for name := range o.scopes {
+		scopes = append(scopes, name)
+	}
+	sort.Strings(scopes[3:])
+	return &domain.ProviderMetadata{
+		Issuer:                            o.issuer,
+		AuthorizationEndpoint:             o.issuer + "/authorize",
+		TokenEndpoint:                     o.issuer + "/token",
+		UserinfoEndpoint:                  o.issuer + "/userinfo",
+		JwksURI:                           o.issuer + "/jwks.json",
+		EndSessionEndpoint:                o.issuer + "/logout",
+		DeviceAuthorizationEndpoint:       o.issuer + "/device_authorization",
+		IntrospectionEndpoint:             o.issuer + "/introspect",
+		ScopesSupported:                   scopes,
+		ResponseTypesSupported:            []string{"code"},
+		GrantTypesSupported:               supportedGrants,
+		SubjectTypesSupported:             []string{"public"},
+		IdTokenSigningAlgValuesSupported:  []string{"RS256"},
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post", "none"},
+		CodeChallengeMethodsSupported:     []string{domain.CodeChallengeS256},
+		ClaimsSupported: []string{"sub", "iss", "aud", "exp", "iat", "auth_time", "nonce", "amr", "azp",
+			"name", "preferred_username", "updated_at", "email", "email_verified"},
+	}
+}
+
+func (o *OAuthUseCase) JWKS() *domain.JWKS {
+	return o.signer.JWKS()
+}
+
+// userCodeAlphabet has no vowels, so that user codes spell no words, and no characters easily confused
+const userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+
+// newUserCode returns a random user code of 8 characters, normalized
+func newUserCode() (string, error) {
+	code := make([]byte, 0, 8)
+	raw := make([]byte, 16)
+	for len(code) < 8 {
+		if _, err := rand.Read(raw); err != nil {
+			return "", err
+		}
+		for _, b := range raw {
+			// bytes above the last multiple of the alphabet size would bias the code
+			if int(b) < 256-256%len(userCodeAlphabet) && len(code) < 8 {
+				code = append(code, userCodeAlphabet[int(b)%len(userCodeAlphabet)])
+			}
+		}
+	}
+	return string(code), nil
+}
+
+// normalizeUserCode drops the dash, spaces and case the user may have typed
+func normalizeUserCode(userCode string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' {
+			r -= 'a' - 'A'
+		}
+		if strings.ContainsRune(userCodeAlphabet, r) {
+			return r
+		}
+		return -1
+	}, userCode)
+}
+
+// formatUserCode returns a normalized user code as shown to the user, XXXX-XXXX
+func formatUserCode(userCode string) string {
+	return userCode[:4] + "-" + userCode[4:]
+}
+
+func (o *OAuthUseCase) AuthorizeDevice(ctx context.Context, req *domain.TokenRequest) (*domain.DeviceAuthorization, error) {
+	req.GrantType = domain.GrantDeviceCode
+	client, err := o.authenticateClient(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	scopes, err := o.requestedScopes(client, req.Scope)
+	if err != nil {
+		return nil, err
+	}
+	deviceCode, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	userCode, err := newUserCode()
+	if err != nil {
+		return nil, err
+	}
+	err = o.repo.CreateDeviceCode(ctx, &domain.DeviceCode{
+		DeviceCodeHash: hash(deviceCode),
+		UserCode:       userCode,
+		ClientId:       client.Id,
+		Scope:          strings.Join(scopes, " "),
+		ExpiresAt:      time.Now().Add(o.deviceTTL),
+		Interval:       o.deviceInterval,
+		Status:         domain.DeviceCodePending,
+	})
+	if err != nil {
+		return nil, err
+	}
+	verificationURI := o.issuer + "/device"
+	return &domain.DeviceAuthorization{
+		DeviceCode:              deviceCode,
+		UserCode:                formatUserCode(userCode),
+		VerificationURI:         verificationURI,
+		VerificationURIComplete: verificationURI + "?" + url.Values{"user_code": {formatUserCode(userCode)}}.Encode(),
+		ExpiresIn:               int64(o.deviceTTL / time.Second),
+		Interval:                o.deviceInterval,
+	}, nil
+}
+
+// GetDeviceRequest only returns codes waiting for the decision of a user
+func (o *OAuthUseCase) GetDeviceRequest(ctx context.Context, userCode string) (*domain.DeviceCode, *domain.OAuthClient, error) {
+	code, err := o.repo.GetDeviceCodeByUserCode(ctx, normalizeUserCode(userCode))
+	if err != nil || code.Status != domain.DeviceCodePending || time.Now().After(code.ExpiresAt) {
+		return nil, nil, domain.ErrOAuthInvalidRequest.With("invalid or expired user code")
+	}
+	client, err := o.GetClient(ctx, code.ClientId)
+	if err != nil {
+		return nil, nil, err
+	}
+	return code, client, nil
+}
+
+func (o *OAuthUseCase) ApproveDevice(ctx context.Context, userCode string, user *domain.Auth, authn *domain.Authentication, scopes []string) error {
+	code, _, err := o.GetDeviceRequest(ctx, userCode)
+	if err != nil {
+		return err
+	}
+	requested := strings.Fields(code.Scope)
+	for _, name := range scopes {
+		if !contains(requested, name) {
+			return domain.ErrOAuthInvalidScope.With("scope " + name + " was not requested")
+		}
+	}
+	code.Status = domain.DeviceCodeApproved
+	code.UserId = user.Id
+	code.Scope = strings.Join(scopes, " ")
+	code.AuthTime = authn.Time
+	code.AMR = authn.Methods
+	return o.repo.DecideDeviceCode(ctx, code)
+}
+
+func (o *OAuthUseCase) DenyDevice(ctx context.Context, userCode string) error {
+	code, _, err := o.GetDeviceRequest(ctx, userCode)
+	if err != nil {
+		return err
+	}
+	code.Status = domain.DeviceCodeDenied
+	return o.repo.DecideDeviceCode(ctx, code)
+}
+
+// deviceGrant polls a device code, it returns the approved code and its user once, authorization_pending
+// before the user decides and slow_down when the device polls faster than its interval, which then grows
+func (o *OAuthUseCase) deviceGrant(ctx context.Context, req *domain.TokenRequest) (*domain.OAuthClient, *domain.Auth, *domain.DeviceCode, error) {
+	client, err := o.authenticateClient(ctx, req)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if req.DeviceCode == "" {
+		return nil, nil, nil, domain.ErrOAuthInvalidRequest.With("device_code is required")
+	}
+	deviceCodeHash := hash(req.DeviceCode)
+	code, err := o.repo.GetDeviceCode(ctx, deviceCodeHash)
+	if err != nil || code.ClientId != client.Id {
+		return nil, nil, nil, domain.ErrOAuthInvalidGrant.With("invalid device code")
+	}
+	now := time.Now()
+	if now.After(code.ExpiresAt) {
+		return nil, nil, nil, domain.ErrOAuthExpiredToken.With("the device code expired")
+	}
+	switch code.Status {
+	case domain.DeviceCodeDenied:
+		return nil, nil, nil, domain.ErrOAuthAccessDenied.With("the user denied the request")
+	case domain.DeviceCodeConsumed:
+		return nil, nil, nil, domain.ErrOAuthInvalidGrant.With("invalid device code")
+	}
+	interval := code.Interval
+	tooFast := code.LastPolledAt != nil && now.Sub(*code.LastPolledAt) < time.Duration(interval)*time.Second
+	if tooFast {
+		// RFC 8628 3.5, the interval grows by 5 seconds
+		interval += 5
+	}
+	err = o.repo.PollDeviceCode(ctx, deviceCodeHash, now, interval)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if tooFast {
+		return nil, nil, nil, domain.ErrOAuthSlowDown.With("poll at most every " + strconv.FormatInt(interval, 10) + " seconds")
+	}
+	if code.Status == domain.DeviceCodePending {
+		return nil, nil, nil, domain.ErrOAuthAuthorizationPending
+	}
+	err = o.repo.ConsumeDeviceCode(ctx, deviceCodeHash)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	user, err := o.authRepo.GetById(ctx, code.UserId)
+	if err != nil {
+		return nil, nil, nil, domain.ErrOAuthInvalidGrant.With("user not found")
+	}
+	return client, user, code, nil
+}
+
+func (o *OAuthUseCase) PollDeviceToken(ctx context.Context, req *domain.TokenRequest) (*domain.Token, error) {
+	req.GrantType = domain.GrantDeviceCode
+	client, user, code, err := o.deviceGrant(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	accessToken, err := o.accessToken(client, user, code.Scope)
+	if err != nil {
+		return nil, err
+	}
+	return &domain.Token{
+		Jwt:      accessToken,
+		Id:       user.Id,
+		UserId:   user.Id,
+		RoleId:   user.RoleId,
+		TenantId: user.TenantId,
+	}, nil
+}
+
+func (o *OAuthUseCase) ScopeResources(scopes []string) []string {
+	resources := make([]string, 0)
+	for _, name := range scopes {
+		if scope := o.scopes[name]; scope != nil {
+			resources = append(resources, scope.Resources...)
+		}
+	}
+	return resources
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func NewOAuthUseCase(repo domain.OAuthRepository, authRepo domain.AuthRepository, jwt domain.JwtGenerator, signer domain.IdTokenSigner) *OAuthUseCase {
+	scopes, err := LoadScopes()
+	if err != nil {
+		panic(err)
+	}
+	codeTTL := viper.GetInt64("runway_auth.oauth.code_ttl")
+	if codeTTL == 0 {
+		codeTTL = 60
+	}
+	refreshTTL := viper.GetInt64("runway_auth.oauth.refresh_ttl")
+	if refreshTTL == 0 {
+		refreshTTL = 30 * 24 * 3600
+	}
+	deviceTTL := viper.GetInt64("runway_auth.oauth.device_code_ttl")
+	if deviceTTL == 0 {
+		deviceTTL = 600
+	}
+	deviceInterval := viper.GetInt64("runway_auth.oauth.device_interval")
+	if deviceInterval == 0 {
+		deviceInterval = 5
+	}
+	exchangeTTL := viper.GetInt64("runway_auth.oauth.exchange_ttl")
+	if exchangeTTL == 0 {
+		exchangeTTL = 300
+	}
+	// the handler of package oauth must be served at the issuer url
+	issuer := strings.TrimSuffix(viper.GetString("runway_auth.oauth.issuer"), "/")
+	if issuer == "" {
+		issuer = viper.GetString("runway_auth.jwt.issuer")
+	}
+	return &OAuthUseCase{
+		repo:           repo,
+		authRepo:       authRepo,
+		jwt:            jwt,
+		signer:         signer,
+		scopes:         scopes,
+		issuer:         issuer,
+		codeTTL:        time.Duration(codeTTL) * time.Second,
+		refreshTTL:     time.Duration(refreshTTL) * time.Second,
+		accessTTL:      viper.GetInt64("runway_auth.jwt.exp"),
+		deviceTTL:      time.Duration(deviceTTL) * time.Second,
+		deviceInterval: deviceInterval,
+		exchangeTTL:    time.Duration(exchangeTTL) * time.Second,
+	}
+}
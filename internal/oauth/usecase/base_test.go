@@ -0,0 +1,408 @@
+package usecase_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"github.com/Runway-Club/auth_lib/domain"
+	authRepoPkg "github.com/Runway-Club/auth_lib/internal/auth/repo"
+	"github.com/Runway-Club/auth_lib/internal/jwt"
+	"github.com/Runway-Club/auth_lib/internal/oauth/repo"
+	"github.com/Runway-Club/auth_lib/internal/oauth/usecase"
+	"github.com/spf13/viper"
+	"gorm.io/driver/sqlite"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOAuthUseCase(t *testing.T) {
+	viper.SetConfigFile("../../../configs/dev.yaml")
+	err := viper.ReadInConfig()
+	if err != nil {
+		panic(err)
+	}
+	authRepo := authRepoPkg.NewAuthRepository(sqlite.Open(":memory:"))
+	jwtGenerator := jwt.NewJwtGenerator()
+	signer := jwt.NewRSASigner()
+	oauthUseCase := usecase.NewOAuthUseCase(repo.NewOAuthRepository(sqlite.Open(":memory:")), authRepo, jwtGenerator, signer)
+	ctx := context.Background()
+	user := &domain.Auth{Id: "u1", Username: "user01", Password: "x", RoleId: "default"}
+	err = authRepo.Create(ctx, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier := strings.Repeat("v", 43)
+	sum := sha256.Sum256([]byte(verifier))
+	challenge := base64.RawURLEncoding.EncodeToString(sum[:])
+
+	var secret string
+	t.Run("register client", func(t *testing.T) {
+		_, err := oauthUseCase.RegisterClient(ctx, &domain.OAuthClient{Id: "bad", RedirectURIs: []string{"/callback"}}, false)
+		if !errors.Is(err, domain.ErrOAuthInvalidRedirectURI) {
+			t.Errorf("expected invalid redirect uri, got %v", err)
+		}
+		_, err = oauthUseCase.RegisterClient(ctx, &domain.OAuthClient{Id: "bad", RedirectURIs: []string{"https://app.dev/cb"}, Scopes: []string{"unknown"}}, false)
+		if !errors.Is(err, domain.ErrOAuthInvalidClientMetadata) {
+			t.Errorf("expected invalid client metadata, got %v", err)
+		}
+		secret, err = oauthUseCase.RegisterClient(ctx, &domain.OAuthClient{
+			Id: "app", RedirectURIs: []string{"https://app.dev/cb"}, Scopes: []string{"courses.read", "courses.write"},
+		}, true)
+		if err != nil || secret == "" {
+			t.Fatalf("expected a secret, got %q %v", secret, err)
+		}
+	})
+	t.Run("validate authorize", func(t *testing.T) {
+		req := &domain.AuthorizeRequest{ResponseType: "code", ClientId: "app", RedirectURI: "https://evil.dev/cb",
+			CodeChallenge: challenge, CodeChallengeMethod: domain.CodeChallengeS256}
+		client, _, err := oauthUseCase.ValidateAuthorize(ctx, req)
+		if client != nil || !errors.Is(err, domain.ErrOAuthInvalidRequest) {
+			t.Errorf("expected an unredirectable invalid request, got %v %v", client, err)
+		}
+		req.RedirectURI = "https://app.dev/cb"
+		req.CodeChallengeMethod = "plain"
+		client, _, err = oauthUseCase.ValidateAuthorize(ctx, req)
+		if client == nil || !errors.Is(err, domain.ErrOAuthInvalidRequest) {
+			t.Errorf("expected a redirectable invalid request, got %v %v", client, err)
+		}
+		req.CodeChallengeMethod = domain.CodeChallengeS256
+		req.Scope = "admin"
+		_, _, err = oauthUseCase.ValidateAuthorize(ctx, req)
+		if !errors.Is(err, domain.ErrOAuthInvalidScope) {
+			t.Errorf("expected invalid scope, got %v", err)
+		}
+		req.Scope = ""
+		_, scopes, err := oauthUseCase.ValidateAuthorize(ctx, req)
+		if err != nil || !reflect.DeepEqual(scopes, []string{"courses.read", "courses.write"}) {
+			t.Errorf("expected all the client scopes, got %v %v", scopes, err)
+		}
+	})
+	var refreshToken string
+	t.Run("exchange code", func(t *testing.T) {
+		req := &domain.AuthorizeRequest{ResponseType: "code", ClientId: "app", RedirectURI: "https://app.dev/cb",
+			CodeChallenge: challenge, CodeChallengeMethod: domain.CodeChallengeS256}
+		code, err := oauthUseCase.IssueCode(ctx, req, user, &domain.Authentication{}, []string{"courses.read"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokenReq := &domain.TokenRequest{GrantType: domain.GrantAuthorizationCode, ClientId: "app", ClientSecret: "wrong",
+			Code: code, CodeVerifier: verifier, RedirectURI: "https://app.dev/cb"}
+		_, err = oauthUseCase.Token(ctx, tokenReq)
+		if !errors.Is(err, domain.ErrOAuthInvalidClient) {
+			t.Errorf("expected invalid client, got %v", err)
+		}
+		tokenReq.ClientSecret = secret
+		tokenReq.CodeVerifier = strings.Repeat("w", 43)
+		_, err = oauthUseCase.Token(ctx, tokenReq)
+		if !errors.Is(err, domain.ErrOAuthInvalidGrant) {
+			t.Errorf("expected invalid grant, got %v", err)
+		}
+		// the code was consumed by the failed exchange
+		tokenReq.CodeVerifier = verifier
+		_, err = oauthUseCase.Token(ctx, tokenReq)
+		if !errors.Is(err, domain.ErrOAuthInvalidGrant) {
+			t.Errorf("expected invalid grant for a used code, got %v", err)
+		}
+		// the redirect uri of the authorization request must be repeated
+		code, _ = oauthUseCase.IssueCode(ctx, req, user, &domain.Authentication{}, []string{"courses.read"})
+		tokenReq.Code = code
+		tokenReq.RedirectURI = ""
+		_, err = oauthUseCase.Token(ctx, tokenReq)
+		if !errors.Is(err, domain.ErrOAuthInvalidGrant) {
+			t.Errorf("expected invalid grant without redirect uri, got %v", err)
+		}
+		code, _ = oauthUseCase.IssueCode(ctx, req, user, &domain.Authentication{}, []string{"courses.read"})
+		tokenReq.Code = code
+		tokenReq.RedirectURI = "https://app.dev/cb"
+		resp, err := oauthUseCase.Token(ctx, tokenReq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Scope != "courses.read" || resp.RefreshToken == "" || resp.TokenType != "Bearer" {
+			t.Errorf("unexpected token response %+v", resp)
+		}
+		_, claims, err := jwtGenerator.VerifyToken(resp.AccessToken)
+		if err != nil || claims["scope"] != "courses.read" || claims["client_id"] != "app" {
+			t.Errorf("unexpected claims %v %v", claims, err)
+		}
+		refreshToken = resp.RefreshToken
+	})
+	t.Run("refresh", func(t *testing.T) {
+		tokenReq := &domain.TokenRequest{GrantType: domain.GrantRefreshToken, ClientId: "app", ClientSecret: secret,
+			RefreshToken: refreshToken, Scope: "courses.write"}
+		_, err := oauthUseCase.Token(ctx, tokenReq)
+		if !errors.Is(err, domain.ErrOAuthInvalidScope) {
+			t.Errorf("expected invalid scope, got %v", err)
+		}
+		// the rejected refresh revoked the token
+		tokenReq.Scope = ""
+		_, err = oauthUseCase.Token(ctx, tokenReq)
+		if !errors.Is(err, domain.ErrOAuthInvalidGrant) {
+			t.Errorf("expected invalid grant for a revoked token, got %v", err)
+		}
+	})
+	t.Run("introspect refresh token", func(t *testing.T) {
+		_, err := oauthUseCase.AuthenticateClient(ctx, "app", "wrong")
+		if !errors.Is(err, domain.ErrOAuthInvalidClient) {
+			t.Errorf("expected invalid client for a wrong secret, got %v", err)
+		}
+		client, err := oauthUseCase.AuthenticateClient(ctx, "app", secret)
+		if err != nil || client.Id != "app" {
+			t.Errorf("expected the client, got %v %v", client, err)
+		}
+		introspection, err := oauthUseCase.IntrospectRefreshToken(ctx, client, refreshToken)
+		if err != nil || introspection.Active {
+			t.Errorf("expected a revoked token to be inactive, got %+v %v", introspection, err)
+		}
+	})
+	t.Run("id token", func(t *testing.T) {
+		req := &domain.AuthorizeRequest{ResponseType: "code", ClientId: "app", RedirectURI: "https://app.dev/cb",
+			CodeChallenge: challenge, CodeChallengeMethod: domain.CodeChallengeS256, Nonce: "n-0S6"}
+		authTime := time.Now().Add(-time.Minute).Truncate(time.Second)
+		code, err := oauthUseCase.IssueCode(ctx, req, user, &domain.Authentication{Time: authTime, Methods: []string{"pwd"}},
+			[]string{"openid", "profile"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := oauthUseCase.Token(ctx, &domain.TokenRequest{GrantType: domain.GrantAuthorizationCode, ClientId: "app",
+			ClientSecret: secret, Code: code, CodeVerifier: verifier, RedirectURI: "https://app.dev/cb"})
+		if err != nil || resp.IdToken == "" {
+			t.Fatalf("expected an id token, got %+v %v", resp, err)
+		}
+		claims, err := signer.Verify(resp.IdToken)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if claims["sub"] != "u1" || claims["aud"] != "app" || claims["nonce"] != "n-0S6" ||
+			claims["auth_time"] != float64(authTime.Unix()) || claims["preferred_username"] != "user01" {
+			t.Errorf("unexpected id token claims %v", claims)
+		}
+		refreshed, err := oauthUseCase.Token(ctx, &domain.TokenRequest{GrantType: domain.GrantRefreshToken, ClientId: "app",
+			ClientSecret: secret, RefreshToken: resp.RefreshToken})
+		if err != nil {
+			t.Fatal(err)
+		}
+		claims, _ = signer.Verify(refreshed.IdToken)
+		if claims["nonce"] != nil || claims["auth_time"] != float64(authTime.Unix()) {
+			t.Errorf("expected the refreshed id token to keep auth_time without nonce, got %v", claims)
+		}
+		hint := resp.IdToken
+		t.Run("logout", func(t *testing.T) {
+			_, err := oauthUseCase.ValidateLogout(ctx, &domain.LogoutRequest{IdTokenHint: hint, PostLogoutRedirectURI: "https://app.dev/bye"})
+			if !errors.Is(err, domain.ErrOAuthInvalidRequest) {
+				t.Errorf("expected an unregistered uri to be rejected, got %v", err)
+			}
+			redirectURI, err := oauthUseCase.ValidateLogout(ctx, &domain.LogoutRequest{IdTokenHint: hint})
+			if err != nil || redirectURI != "" {
+				t.Errorf("expected no redirect, got %q %v", redirectURI, err)
+			}
+		})
+	})
+	t.Run("user info", func(t *testing.T) {
+		_, err := oauthUseCase.UserInfo(ctx, "u1", []string{"profile"})
+		if !errors.Is(err, domain.ErrOAuthInsufficientScope) {
+			t.Errorf("expected insufficient scope, got %v", err)
+		}
+		info, err := oauthUseCase.UserInfo(ctx, "u1", []string{"openid"})
+		if err != nil || !reflect.DeepEqual(info, map[string]interface{}{"sub": "u1"}) {
+			t.Errorf("expected only sub, got %v %v", info, err)
+		}
+	})
+	t.Run("client credentials", func(t *testing.T) {
+		_, err := oauthUseCase.RegisterClient(ctx, &domain.OAuthClient{Id: "public-svc", GrantTypes: []string{domain.GrantClientCredentials}}, false)
+		if !errors.Is(err, domain.ErrOAuthInvalidClientMetadata) {
+			t.Errorf("expected a public service client to be rejected, got %v", err)
+		}
+		svcSecret, err := oauthUseCase.RegisterClient(ctx, &domain.OAuthClient{
+			Id: "svc", GrantTypes: []string{domain.GrantClientCredentials}, Scopes: []string{"courses.read"}, RoleId: "service",
+		}, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = oauthUseCase.Token(ctx, &domain.TokenRequest{GrantType: domain.GrantClientCredentials, ClientId: "app", ClientSecret: secret})
+		if !errors.Is(err, domain.ErrOAuthUnauthorizedClient) {
+			t.Errorf("expected unauthorized client for a client without the grant, got %v", err)
+		}
+		_, err = oauthUseCase.Token(ctx, &domain.TokenRequest{GrantType: domain.GrantClientCredentials, ClientId: "svc", ClientSecret: svcSecret, Scope: "openid"})
+		if !errors.Is(err, domain.ErrOAuthInvalidScope) {
+			t.Errorf("expected invalid scope for openid, got %v", err)
+		}
+		resp, err := oauthUseCase.Token(ctx, &domain.TokenRequest{GrantType: domain.GrantClientCredentials, ClientId: "svc", ClientSecret: svcSecret})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.RefreshToken != "" || resp.Scope != "courses.read" {
+			t.Errorf("expected a token without refresh token, got %+v", resp)
+		}
+		subject, claims, err := jwtGenerator.VerifyToken(resp.AccessToken)
+		if err != nil || subject.Id != "client:svc" || subject.RoleId != "service" || claims["client_id"] != "svc" {
+			t.Errorf("expected the client as subject, got %+v %v %v", subject, claims, err)
+		}
+	})
+	t.Run("device code", func(t *testing.T) {
+		_, err := oauthUseCase.RegisterClient(ctx, &domain.OAuthClient{
+			Id: "cli", GrantTypes: []string{domain.GrantDeviceCode}, Trusted: true,
+		}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = oauthUseCase.AuthorizeDevice(ctx, &domain.TokenRequest{ClientId: "app", ClientSecret: secret})
+		if !errors.Is(err, domain.ErrOAuthUnauthorizedClient) {
+			t.Errorf("expected unauthorized client for a client without the grant, got %v", err)
+		}
+		authz, err := oauthUseCase.AuthorizeDevice(ctx, &domain.TokenRequest{ClientId: "cli"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(authz.UserCode) != 9 || authz.UserCode[4] != '-' || authz.Interval != 5 ||
+			authz.VerificationURI != "http://localhost:8080/oauth/device" {
+			t.Errorf("unexpected device authorization %+v", authz)
+		}
+		poll := &domain.TokenRequest{GrantType: domain.GrantDeviceCode, ClientId: "cli", DeviceCode: authz.DeviceCode}
+		_, err = oauthUseCase.Token(ctx, poll)
+		if !errors.Is(err, domain.ErrOAuthAuthorizationPending) {
+			t.Errorf("expected authorization pending, got %v", err)
+		}
+		_, err = oauthUseCase.Token(ctx, poll)
+		if !errors.Is(err, domain.ErrOAuthSlowDown) {
+			t.Errorf("expected slow down, got %v", err)
+		}
+		// the user may type the code in lower case and without dash
+		code, client, err := oauthUseCase.GetDeviceRequest(ctx, strings.ToLower(strings.Replace(authz.UserCode, "-", "", 1)))
+		if err != nil || client.Id != "cli" || code.Status != domain.DeviceCodePending {
+			t.Fatalf("expected the pending request, got %v %v %v", code, client, err)
+		}
+		err = oauthUseCase.DenyDevice(ctx, authz.UserCode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = oauthUseCase.ApproveDevice(ctx, authz.UserCode, user, &domain.Authentication{}, nil)
+		if !errors.Is(err, domain.ErrOAuthInvalidRequest) {
+			t.Errorf("expected a denied code not to be approved, got %v", err)
+		}
+
+		authz, err = oauthUseCase.AuthorizeDevice(ctx, &domain.TokenRequest{ClientId: "cli"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = oauthUseCase.ApproveDevice(ctx, authz.UserCode, user, &domain.Authentication{Time: time.Now(), Methods: []string{"pwd"}}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		token, err := oauthUseCase.PollDeviceToken(ctx, &domain.TokenRequest{ClientId: "cli", DeviceCode: authz.DeviceCode})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token.UserId != "u1" || token.RoleId != "default" {
+			t.Errorf("expected the token of the approving user, got %+v", token)
+		}
+		subject, claims, err := jwtGenerator.VerifyToken(token.Jwt)
+		if err != nil || subject.Id != "u1" || claims["client_id"] != "cli" {
+			t.Errorf("expected a token of the user, got %+v %v %v", subject, claims, err)
+		}
+		if claims["scope"] != "" {
+			t.Errorf("expected an empty scope claim, got %v", claims["scope"])
+		}
+		_, err = oauthUseCase.PollDeviceToken(ctx, &domain.TokenRequest{ClientId: "cli", DeviceCode: authz.DeviceCode})
+		if !errors.Is(err, domain.ErrOAuthInvalidGrant) {
+			t.Errorf("expected a device code to be used once, got %v", err)
+		}
+	})
+	t.Run("token exchange", func(t *testing.T) {
+		_, err := oauthUseCase.RegisterClient(ctx, &domain.OAuthClient{Id: "public-gw", GrantTypes: []string{domain.GrantTokenExchange}}, false)
+		if !errors.Is(err, domain.ErrOAuthInvalidClientMetadata) {
+			t.Errorf("expected a public exchanging client to be rejected, got %v", err)
+		}
+		gwSecret, err := oauthUseCase.RegisterClient(ctx, &domain.OAuthClient{
+			Id: "gw", GrantTypes: []string{domain.GrantTokenExchange}, RoleId: "service",
+		}, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		session, err := jwtGenerator.GenerateToken(user, map[string]interface{}{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		exchange := &domain.TokenRequest{GrantType: domain.GrantTokenExchange, ClientId: "gw", ClientSecret: gwSecret,
+			SubjectToken: session, SubjectTokenType: domain.TokenTypeURNAccessToken, Resources: []string{"v1/course.*"}, Audience: "courses"}
+		resp, err := oauthUseCase.Token(ctx, exchange)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.IssuedTokenType != domain.TokenTypeURNAccessToken || resp.ExpiresIn > 300 || resp.RefreshToken != "" {
+			t.Errorf("unexpected exchange response %+v", resp)
+		}
+		if _, _, err = jwtGenerator.VerifyToken(resp.AccessToken); !errors.Is(err, domain.ErrInvalidAudience) {
+			t.Errorf("expected the exchanged token to be restricted to its audience, got %v", err)
+		}
+		subject, claims, err := jwtGenerator.VerifyTokenForAudience(resp.AccessToken, "courses")
+		if err != nil || subject.Id != "u1" || claims["aud"] != "courses" || claims["client_id"] != "gw" {
+			t.Fatalf("expected a token of the user, got %+v %v %v", subject, claims, err)
+		}
+		actors := domain.Actors(claims)
+		if len(actors) != 1 || actors[0].Id != "client:gw" || actors[0].RoleId != "service" {
+			t.Errorf("expected gw to act, got %+v", actors)
+		}
+		registered, err := jwtGenerator.Inspect(resp.AccessToken)
+		if err != nil || time.Until(registered.ExpiresAt) > 300*time.Second {
+			t.Errorf("expected a short lifetime, got %+v %v", registered, err)
+		}
+
+		// an exchanged token is only narrowed further
+		narrower := *exchange
+		narrower.SubjectToken = resp.AccessToken
+		narrower.Resources = []string{"v1/lesson.GET"}
+		_, err = oauthUseCase.Token(ctx, &narrower)
+		if !errors.Is(err, domain.ErrOAuthInvalidTarget) {
+			t.Errorf("expected invalid target for a wider resource, got %v", err)
+		}
+		// "v1/course.*" matches the literal "v1/course.**" but does not cover the pattern
+		narrower.Resources = []string{"v1/course.**"}
+		_, err = oauthUseCase.Token(ctx, &narrower)
+		if !errors.Is(err, domain.ErrOAuthInvalidTarget) {
+			t.Errorf("expected invalid target for a wider resource pattern, got %v", err)
+		}
+		narrower.Resources = []string{"v1/course.GET"}
+		narrower.Audience = "admin"
+		_, err = oauthUseCase.Token(ctx, &narrower)
+		if !errors.Is(err, domain.ErrOAuthInvalidTarget) {
+			t.Errorf("expected invalid target for another audience, got %v", err)
+		}
+		narrower.Audience = ""
+		resp, err = oauthUseCase.Token(ctx, &narrower)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, claims, _ = jwtGenerator.VerifyTokenForAudience(resp.AccessToken, "courses")
+		if len(domain.Actors(claims)) != 2 || claims["aud"] != "courses" {
+			t.Errorf("expected the chain of actors and the audience to be kept, got %v", claims)
+		}
+		impersonation, err := jwtGenerator.GenerateToken(user, map[string]interface{}{"impersonator": "support01"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		exchange.SubjectToken = impersonation
+		resp, err = oauthUseCase.Token(ctx, exchange)
+		if err != nil {
+			t.Fatal(err)
+		}
+		subject, claims, err = jwtGenerator.VerifyTokenForAudience(resp.AccessToken, "courses")
+		if err != nil || subject.Impersonator != "support01" || claims["impersonator"] != "support01" {
+			t.Errorf("expected the impersonation to be kept, got %+v %v %v", subject, claims, err)
+		}
+		exchange.SubjectToken = "invalid"
+		_, err = oauthUseCase.Token(ctx, exchange)
+		if !errors.Is(err, domain.ErrOAuthInvalidGrant) {
+			t.Errorf("expected invalid grant for an invalid subject token, got %v", err)
+		}
+	})
+	t.Run("unsupported grant", func(t *testing.T) {
+		_, err := oauthUseCase.Token(ctx, &domain.TokenRequest{GrantType: "password", ClientId: "app"})
+		if !errors.Is(err, domain.ErrOAuthUnsupportedGrantType) {
+			t.Errorf("expected unsupported grant type, got %v", err)
+		}
+	})
+}
@@ -20,3 +20,7 @@ func (d DummyProvider) VerifyToken(ctx context.Context, token string) (uid strin
 	}
 	return auth.Id, claims, nil
 }
+
+func (d DummyProvider) Delete(ctx context.Context, uid string) error {
+	return nil
+}
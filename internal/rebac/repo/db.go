@@ -0,0 +1,73 @@
+package repo
+
+import (
+	"context"
+	"github.com/Runway-Club/auth_lib/domain"
+	"gorm.io/gorm"
+)
+
+type RelationRepository struct {
+	db *gorm.DB
+}
+
+func NewRelationRepository(dialector gorm.Dialector) *RelationRepository {
+	db, err := gorm.Open(dialector)
+	if err != nil {
+		panic(err)
+	}
+	// migrate schema
+	err = db.AutoMigrate(&domain.RelationTuple{})
+	if err != nil {
+		panic(err)
+	}
+	return &RelationRepository{db: db}
+}
+
+func (r *RelationRepository) Create(ctx context.Context, tuple *domain.RelationTuple) error {
+	tx := r.db.WithContext(ctx).Create(tuple)
+	if tx.Error != nil {
+		return tx.Error
+	}
+	return nil
+}
+
+func (r *RelationRepository) Delete(ctx context.Context, tuple *domain.RelationTuple) error {
+	// tuples are deleted permanently so that they can be written again
+	tx := r.db.WithContext(ctx).Unscoped().
+		Where("object = ? AND relation = ? AND subject = ?", tuple.Object, tuple.Relation, tuple.Subject).
+		Delete(&domain.RelationTuple{})
+	if tx.Error != nil {
+		return tx.Error
+	}
+	if tx.RowsAffected == 0 {
+		return domain.ErrTupleNotFound
+	}
+	return nil
+}
+
+func (r *RelationRepository) GetByObjectAndRelation(ctx context.Context, object string, relation string) ([]*domain.RelationTuple, error) {
+	found := make([]*domain.RelationTuple, 0)
+	tx := r.db.WithContext(ctx).Where("object = ? AND relation = ?", object, relation).Find(&found)
+	if tx.Error != nil {
+		return found, tx.Error
+	}
+	return found, nil
+}
+
+func (r *RelationRepository) GetBySubject(ctx context.Context, subject string) ([]*domain.RelationTuple, error) {
+	found := make([]*domain.RelationTuple, 0)
+	tx := r.db.WithContext(ctx).Where("subject = ?", subject).Find(&found)
+	if tx.Error != nil {
+		return found, tx.Error
+	}
+	return found, nil
+}
+
+func (r *RelationRepository) GetByRelationAndSubject(ctx context.Context, relation string, subject string) ([]*domain.RelationTuple, error) {
+	found := make([]*domain.RelationTuple, 0)
+	tx := r.db.WithContext(ctx).Where("relation = ? AND subject = ?", relation, subject).Find(&found)
+	if tx.Error != nil {
+		return found, tx.Error
+	}
+	return found, nil
+}
@@ -0,0 +1,342 @@
+package usecase
+
+import (
+	"context"
+	"github.com/Runway-Club/auth_lib/domain"
+	"github.com/spf13/viper"
+	"sort"
+	"strings"
+)
+
+// maxDepth bounds the number of nested usersets and inherited relations followed by Check
+const maxDepth = 32
+
+type inheritedBy struct {
+	namespace string
+	relation  string
+	tupleset  string
+}
+
+type RelationUseCase struct {
+	repo       domain.RelationRepository
+	namespaces map[string]map[string]*domain.RelationConfig
+	// reverse indexes of the schema used by ListObjects
+	computedBy  map[string]map[string][]string
+	inheritedBy map[string][]inheritedBy
+}
+
+func NewRelationUseCase(repo domain.RelationRepository) *RelationUseCase {
+	namespaces := make([]*domain.NamespaceConfig, 0)
+	err := viper.UnmarshalKey("runway_auth.rebac.namespaces", &namespaces)
+	if err != nil {
+		panic(err)
+	}
+	usecase, err := NewRelationUseCaseWithSchema(repo, namespaces)
+	if err != nil {
+		panic(err)
+	}
+	return usecase
+}
+
+func NewRelationUseCaseWithSchema(repo domain.RelationRepository, namespaces []*domain.NamespaceConfig) (*RelationUseCase, error) {
+	usecase := &RelationUseCase{
+		repo:        repo,
+		namespaces:  make(map[string]map[string]*domain.RelationConfig),
+		computedBy:  make(map[string]map[string][]string),
+		inheritedBy: make(map[string][]inheritedBy),
+	}
+	for _, namespace := range namespaces {
+		if namespace.Name == "" {
+			return nil, domain.ErrInvalidNamespace
+		}
+		relations := make(map[string]*domain.RelationConfig)
+		for _, relation := range namespace.Relations {
+			relations[relation.Name] = relation
+		}
+		usecase.namespaces[namespace.Name] = relations
+		usecase.computedBy[namespace.Name] = make(map[string][]string)
+	}
+	for name, relations := range usecase.namespaces {
+		for _, relation := range relations {
+			for _, computed := range relation.Computed {
+				if _, ok := relations[computed]; !ok {
+					return nil, domain.ErrInvalidNamespace
+				}
+				usecase.computedBy[name][computed] = append(usecase.computedBy[name][computed], relation.Name)
+			}
+			for _, inherit := range relation.Inherit {
+				if _, ok := relations[inherit.Tupleset]; !ok {
+					return nil, domain.ErrInvalidNamespace
+				}
+				usecase.inheritedBy[inherit.Relation] = append(usecase.inheritedBy[inherit.Relation], inheritedBy{
+					namespace: name,
+					relation:  relation.Name,
+					tupleset:  inherit.Tupleset,
+				})
+			}
+		}
+	}
+	return usecase, nil
+}
+
+// namespaceOf returns the namespace of an object "namespace:id"
+func namespaceOf(object string) string {
+	namespace, _, _ := strings.Cut(object, ":")
+	return namespace
+}
+
+func validObject(object string) bool {
+	namespace, id, ok := strings.Cut(object, ":")
+	return ok && namespace != "" && id != "" && !strings.Contains(object, "#")
+}
+
+// userset splits a subject "namespace:id#relation", ok is false for direct subjects
+func userset(subject string) (object string, relation string, ok bool) {
+	return strings.Cut(subject, "#")
+}
+
+func (r *RelationUseCase) relation(object string, relation string) (*domain.RelationConfig, error) {
+	config, ok := r.namespaces[namespaceOf(object)][relation]
+	if !ok {
+		return nil, domain.ErrUnknownRelation
+	}
+	return config, nil
+}
+
+func (r *RelationUseCase) validate(tuple *domain.RelationTuple) error {
+	if !validObject(tuple.Object) || tuple.Subject == "" {
+		return domain.ErrInvalidTuple
+	}
+	if _, err := r.relation(tuple.Object, tuple.Relation); err != nil {
+		return err
+	}
+	object, relation, ok := userset(tuple.Subject)
+	if !validObject(object) {
+		return domain.ErrInvalidTuple
+	}
+	if ok {
+		if _, err := r.relation(object, relation); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *RelationUseCase) Write(ctx context.Context, tuple *domain.RelationTuple) error {
+	if err := r.validate(tuple); err != nil {
+		return err
+	}
+	return r.repo.Create(ctx, tuple)
+}
+
+func (r *RelationUseCase) Delete(ctx context.Context, tuple *domain.RelationTuple) error {
+	return r.repo.Delete(ctx, tuple)
+}
+
+func (r *RelationUseCase) Check(ctx context.Context, object string, relation string, subject string) (bool, error) {
+	return r.check(ctx, object, relation, subject, 0, make(map[string]bool))
+}
+
+func (r *RelationUseCase) check(ctx context.Context, object string, relation string, subject string, depth int, visited map[string]bool) (bool, error) {
+	if depth > maxDepth {
+		return false, domain.ErrRelationTooDeep
+	}
+	key := object + "#" + relation
+	if visited[key] {
+		return false, nil
+	}
+	visited[key] = true
+	if key == subject {
+		return true, nil
+	}
+	config, err := r.relation(object, relation)
+	if err != nil {
+		return false, err
+	}
+	// direct tuples and usersets
+	tuples, err := r.repo.GetByObjectAndRelation(ctx, object, relation)
+	if err != nil {
+		return false, err
+	}
+	for _, tuple := range tuples {
+		if tuple.Subject == subject {
+			return true, nil
+		}
+	}
+	for _, tuple := range tuples {
+		if setObject, setRelation, ok := userset(tuple.Subject); ok {
+			found, err := r.check(ctx, setObject, setRelation, subject, depth+1, visited)
+			if err != nil || found {
+				return found, err
+			}
+		}
+	}
+	// computed usersets
+	for _, computed := range config.Computed {
+		found, err := r.check(ctx, object, computed, subject, depth+1, visited)
+		if err != nil || found {
+			return found, err
+		}
+	}
+	// tuple to userset
+	for _, inherit := range config.Inherit {
+		parents, err := r.repo.GetByObjectAndRelation(ctx, object, inherit.Tupleset)
+		if err != nil {
+			return false, err
+		}
+		for _, parent := range parents {
+			if _, err := r.relation(parent.Subject, inherit.Relation); err != nil {
+				continue
+			}
+			found, err := r.check(ctx, parent.Subject, inherit.Relation, subject, depth+1, visited)
+			if err != nil || found {
+				return found, err
+			}
+		}
+	}
+	return false, nil
+}
+
+func (r *RelationUseCase) Expand(ctx context.Context, object string, relation string) (*domain.SubjectTree, error) {
+	return r.expand(ctx, object, relation, make(map[string]bool))
+}
+
+func (r *RelationUseCase) expand(ctx context.Context, object string, relation string, visited map[string]bool) (*domain.SubjectTree, error) {
+	tree := &domain.SubjectTree{
+		Object:   object,
+		Relation: relation,
+		Subjects: make([]string, 0),
+		Children: make([]*domain.SubjectTree, 0),
+	}
+	// a relation already expanded higher in the tree is left as a leaf
+	key := object + "#" + relation
+	if visited[key] {
+		return tree, nil
+	}
+	visited[key] = true
+	config, err := r.relation(object, relation)
+	if err != nil {
+		return nil, err
+	}
+	tuples, err := r.repo.GetByObjectAndRelation(ctx, object, relation)
+	if err != nil {
+		return nil, err
+	}
+	for _, tuple := range tuples {
+		setObject, setRelation, ok := userset(tuple.Subject)
+		if !ok {
+			tree.Subjects = append(tree.Subjects, tuple.Subject)
+			continue
+		}
+		child, err := r.expand(ctx, setObject, setRelation, visited)
+		if err != nil {
+			return nil, err
+		}
+		tree.Children = append(tree.Children, child)
+	}
+	for _, computed := range config.Computed {
+		child, err := r.expand(ctx, object, computed, visited)
+		if err != nil {
+			return nil, err
+		}
+		tree.Children = append(tree.Children, child)
+	}
+	for _, inherit := range config.Inherit {
+		parents, err := r.repo.GetByObjectAndRelation(ctx, object, inherit.Tupleset)
+		if err != nil {
+			return nil, err
+		}
+		for _, parent := range parents {
+			if _, err := r.relation(parent.Subject, inherit.Relation); err != nil {
+				continue
+			}
+			child, err := r.expand(ctx, parent.Subject, inherit.Relation, visited)
+			if err != nil {
+				return nil, err
+			}
+			tree.Children = append(tree.Children, child)
+		}
+	}
+	return tree, nil
+}
+
+// ListObjects walks the relations reachable from subject backwards: from the tuples naming the
+// subject, through usersets, computed relations and inherited relations
+func (r *RelationUseCase) ListObjects(ctx context.Context, namespace string, relation string, subject string) ([]string, error) {
+	if _, ok := r.namespaces[namespace][relation]; !ok {
+		return nil, domain.ErrUnknownRelation
+	}
+	type reached struct {
+		object   string
+		relation string
+	}
+	queue := make([]reached, 0)
+	tuples, err := r.repo.GetBySubject(ctx, subject)
+	if err != nil {
+		return nil, err
+	}
+	for _, tuple := range tuples {
+		queue = append(queue, reached{tuple.Object, tuple.Relation})
+	}
+	visited := make(map[reached]bool)
+	objects := make([]string, 0)
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		if visited[current] {
+			continue
+		}
+		visited[current] = true
+		currentNamespace := namespaceOf(current.object)
+		if currentNamespace == namespace && current.relation == relation {
+			objects = append(objects, current.object)
+		}
+		for _, implied := range r.computedBy[currentNamespace][current.relation] {
+			queue = append(queue, reached{current.object, implied})
+		}
+		tuples, err := r.repo.GetBySubject(ctx, current.object+"#"+current.relation)
+		if err != nil {
+			return nil, err
+		}
+		for _, tuple := range tuples {
+			queue = append(queue, reached{tuple.Object, tuple.Relation})
+		}
+		for _, inherit := range r.inheritedBy[current.relation] {
+			children, err := r.repo.GetByRelationAndSubject(ctx, inherit.tupleset, current.object)
+			if err != nil {
+				return nil, err
+			}
+			for _, child := range children {
+				if namespaceOf(child.Object) == inherit.namespace {
+					queue = append(queue, reached{child.Object, inherit.relation})
+				}
+			}
+		}
+	}
+	sort.Strings(objects)
+	return objects, nil
+}
+
+func (r *RelationUseCase) ListSubjects(ctx context.Context, object string, relation string) ([]string, error) {
+	tree, err := r.Expand(ctx, object, relation)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	subjects := make([]string, 0)
+	var collect func(tree *domain.SubjectTree)
+	collect = func(tree *domain.SubjectTree) {
+		for _, subject := range tree.Subjects {
+			if !seen[subject] {
+				seen[subject] = true
+				subjects = append(subjects, subject)
+			}
+		}
+		for _, child := range tree.Children {
+			collect(child)
+		}
+	}
+	collect(tree)
+	sort.Strings(subjects)
+	return subjects, nil
+}
@@ -0,0 +1,112 @@
+package usecase_test
+
+import (
+	"context"
+	"errors"
+	"github.com/Runway-Club/auth_lib/domain"
+	"github.com/Runway-Club/auth_lib/internal/rebac/repo"
+	"github.com/Runway-Club/auth_lib/internal/rebac/usecase"
+	"github.com/spf13/viper"
+	"gorm.io/driver/sqlite"
+	"reflect"
+	"testing"
+)
+
+func TestRelationUseCase(t *testing.T) {
+	viper.SetConfigFile("../../../configs/dev.yaml")
+	err := viper.ReadInConfig()
+	if err != nil {
+		panic(err)
+	}
+	relationRepo := repo.NewRelationRepository(sqlite.Open(":memory:"))
+	relationUseCase := usecase.NewRelationUseCase(relationRepo)
+	ctx := context.Background()
+
+	t.Run("write tuples", func(t *testing.T) {
+		for _, tuple := range []*domain.RelationTuple{
+			{Object: "org:runway", Relation: "admin", Subject: "user:alice"},
+			{Object: "org:runway", Relation: "member", Subject: "user:bob"},
+			{Object: "course:go", Relation: "org", Subject: "org:runway"},
+			{Object: "course:go", Relation: "owner", Subject: "user:carol"},
+			{Object: "folder:root", Relation: "viewer", Subject: "user:dave"},
+			{Object: "course:go", Relation: "parent", Subject: "folder:root"},
+		} {
+			err := relationUseCase.Write(ctx, tuple)
+			if err != nil {
+				t.Error(err)
+			}
+		}
+	})
+	t.Run("write invalid tuple", func(t *testing.T) {
+		err := relationUseCase.Write(ctx, &domain.RelationTuple{Object: "course:go", Relation: "unknown", Subject: "user:alice"})
+		if !errors.Is(err, domain.ErrUnknownRelation) {
+			t.Errorf("expected unknown relation, got %v", err)
+		}
+		err = relationUseCase.Write(ctx, &domain.RelationTuple{Object: "go", Relation: "owner", Subject: "user:alice"})
+		if !errors.Is(err, domain.ErrInvalidTuple) {
+			t.Errorf("expected invalid tuple, got %v", err)
+		}
+	})
+	t.Run("check", func(t *testing.T) {
+		cases := []struct {
+			relation string
+			subject  string
+			expected bool
+		}{
+			{"editor", "user:alice", true},
+			{"editor", "user:bob", true},
+			{"viewer", "user:carol", true},
+			{"viewer", "user:dave", true},
+			{"editor", "user:dave", false},
+			{"owner", "user:bob", false},
+		}
+		for _, c := range cases {
+			result, err := relationUseCase.Check(ctx, "course:go", c.relation, c.subject)
+			if err != nil {
+				t.Error(err)
+			}
+			if result != c.expected {
+				t.Errorf("course:go#%s@%s: expected %v, got %v", c.relation, c.subject, c.expected, result)
+			}
+		}
+	})
+	t.Run("list subjects", func(t *testing.T) {
+		subjects, err := relationUseCase.ListSubjects(ctx, "course:go", "viewer")
+		if err != nil {
+			t.Error(err)
+		}
+		expected := []string{"user:alice", "user:bob", "user:carol", "user:dave"}
+		if !reflect.DeepEqual(subjects, expected) {
+			t.Errorf("expected %v, got %v", expected, subjects)
+		}
+	})
+	t.Run("list objects", func(t *testing.T) {
+		objects, err := relationUseCase.ListObjects(ctx, "course", "editor", "user:alice")
+		if err != nil {
+			t.Error(err)
+		}
+		if !reflect.DeepEqual(objects, []string{"course:go"}) {
+			t.Errorf("expected [course:go], got %v", objects)
+		}
+		objects, err = relationUseCase.ListObjects(ctx, "course", "editor", "user:dave")
+		if err != nil {
+			t.Error(err)
+		}
+		if len(objects) != 0 {
+			t.Errorf("expected no objects, got %v", objects)
+		}
+	})
+	t.Run("delete tuple", func(t *testing.T) {
+		err := relationUseCase.Delete(ctx, &domain.RelationTuple{Object: "org:runway", Relation: "member", Subject: "user:bob"})
+		if err != nil {
+			t.Error(err)
+		}
+		result, err := relationUseCase.Check(ctx, "course:go", "editor", "user:bob")
+		if err != nil {
+			t.Error(err)
+		}
+		if result {
+			t.Error("expected bob to lose editor")
+		}
+	})
+}
@@ -0,0 +1,64 @@
+// Package chiauth adapts the runway_auth middleware to chi. It is the module
+// github.com/Runway-Club/auth_lib/middleware/chiauth, apart from runway_auth.
+package chiauth
+
+import (
+	auth "github.com/Runway-Club/auth_lib"
+	"github.com/Runway-Club/auth_lib/domain"
+	"github.com/Runway-Club/auth_lib/middleware"
+	"github.com/go-chi/chi/v5"
+	"net/http"
+)
+
+// New authenticates requests and checks the permission of their route pattern, such as
+// "/v1/course/{id}". It can be registered with Router.Use, before chi has routed the request,
+// the route is then resolved from the routes of the router. Requests matching no route are not
+// authorized, chi answers them with 404 or 405.
+func New(opts middleware.Options) func(http.Handler) http.Handler {
+	authenticator := middleware.New(opts)
+	errorHandler := opts.ErrorHandler
+	if errorHandler == nil {
+		errorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+			middleware.WriteError(w, err)
+		}
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			route, routeCtx := resolve(r)
+			if routeCtx == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			ctx, err := authenticator.Authorize(r, route, routeCtx.URLParam)
+			if err != nil {
+				errorHandler(w, r, err)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// resolve returns the route pattern of r and the route context holding its parameters, no context when the
+// router has no route of r
+func resolve(r *http.Request) (string, *chi.Context) {
+	routeCtx := chi.RouteContext(r.Context())
+	if routeCtx == nil || routeCtx.Routes == nil {
+		return r.URL.Path, chi.NewRouteContext()
+	}
+	path := r.URL.RawPath
+	if path == "" {
+		path = r.URL.Path
+	}
+	// Routes is the root router, matching the whole path resolves the routers mounted below it
+	matched := chi.NewRouteContext()
+	if !routeCtx.Routes.Match(matched, r.Method, path) {
+		return "", nil
+	}
+	return matched.RoutePattern(), matched
+}
+
+// FromContext returns the user authenticated by New, nil when the request is not authenticated
+func FromContext(r *http.Request) *domain.Auth {
+	return auth.FromContext(r.Context())
+}
@@ -0,0 +1,44 @@
+// Package echoauth adapts the runway_auth middleware to echo. It is the module
+// github.com/Runway-Club/auth_lib/middleware/echoauth, apart from runway_auth.
+package echoauth
+
+import (
+	auth "github.com/Runway-Club/auth_lib"
+	"github.com/Runway-Club/auth_lib/domain"
+	"github.com/Runway-Club/auth_lib/middleware"
+	"github.com/labstack/echo/v4"
+)
+
+// authKey is the echo context key of the authenticated user
+const authKey = "runway_auth"
+
+// New authenticates requests and checks the permission of their route template, such as
+// "/v1/course/:id". It must be registered with Echo.Use or on a group, not with Echo.Pre which
+// runs before routing. Errors are returned as *echo.HTTPError carrying middleware.Body. Requests
+// matching no route are not authorized, echo answers them with 404.
+func New(opts middleware.Options) echo.MiddlewareFunc {
+	authenticator := middleware.New(opts)
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if c.Path() == "" {
+				return next(c)
+			}
+			ctx, err := authenticator.Authorize(c.Request(), c.Path(), c.Param)
+			if err != nil {
+				if header := middleware.Challenge(err); header != "" {
+					c.Response().Header().Set("WWW-Authenticate", header)
+				}
+				return echo.NewHTTPError(middleware.Status(err), middleware.Body(err)).SetInternal(err)
+			}
+			c.SetRequest(c.Request().WithContext(ctx))
+			c.Set(authKey, auth.FromContext(ctx))
+			return next(c)
+		}
+	}
+}
+
+// FromContext returns the user authenticated by New, nil when the request is not authenticated
+func FromContext(c echo.Context) *domain.Auth {
+	found, _ := c.Get(authKey).(*domain.Auth)
+	return found
+}
@@ -0,0 +1,59 @@
+package echoauth_test
+
+import (
+	"errors"
+	"github.com/Runway-Club/auth_lib/middleware"
+	"github.com/Runway-Club/auth_lib/middleware/echoauth"
+	"github.com/Runway-Club/auth_lib/middleware/internal/middlewaretest"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"testing"
+)
+
+func newEcho(opts middleware.Options) *echo.Echo {
+	e := echo.New()
+	e.Use(echoauth.New(opts))
+	e.Group("/v1").GET("/lesson/:id", func(c echo.Context) error {
+		return c.String(http.StatusOK, echoauth.FromContext(c).Id)
+	})
+	return e
+}
+
+func TestEcho(t *testing.T) {
+	token := middlewaretest.Setup(t, "../../configs/dev.yaml", "echoauth")
+	middlewaretest.CheckLesson(t, newEcho(middleware.Options{PayloadParam: "id"}), token)
+
+	t.Run("route template", func(t *testing.T) {
+		route := ""
+		e := newEcho(middleware.Options{Resource: func(r, method string) string {
+			route = r
+			return ""
+		}})
+		middlewaretest.Serve(e, http.MethodGet, "/v1/lesson/intro", token)
+		if route != "/v1/lesson/:id" {
+			t.Errorf("expected /v1/lesson/:id, got %s", route)
+		}
+	})
+	t.Run("unmatched route", func(t *testing.T) {
+		e := newEcho(middleware.Options{PayloadParam: "id"})
+		if w := middlewaretest.Serve(e, http.MethodGet, "/v1/unknown", ""); w.Code != http.StatusNotFound {
+			t.Errorf("expected 404, got %d", w.Code)
+		}
+	})
+	t.Run("error handler", func(t *testing.T) {
+		// errors go to the error handler of echo
+		var handled error
+		e := newEcho(middleware.Options{PayloadParam: "id"})
+		e.HTTPErrorHandler = func(err error, c echo.Context) {
+			handled = err
+			_ = c.NoContent(http.StatusTeapot)
+		}
+		if w := middlewaretest.Serve(e, http.MethodGet, "/v1/lesson/intro", ""); w.Code != http.StatusTeapot {
+			t.Errorf("expected 418, got %d", w.Code)
+		}
+		var httpErr *echo.HTTPError
+		if !errors.As(handled, &httpErr) || !errors.Is(httpErr.Internal, middleware.ErrMissingToken) {
+			t.Errorf("expected an http error of a missing token, got %v", handled)
+		}
+	})
+}
@@ -0,0 +1,93 @@
+// Package fiberauth adapts the runway_auth middleware to fiber. It is the module
+// github.com/Runway-Club/auth_lib/middleware/fiberauth, apart from runway_auth.
+package fiberauth
+
+import (
+	auth "github.com/Runway-Club/auth_lib"
+	"github.com/Runway-Club/auth_lib/domain"
+	"github.com/Runway-Club/auth_lib/middleware"
+	"github.com/gofiber/fiber/v2"
+	"net/http"
+	"net/url"
+)
+
+// authKey is the fiber locals key of the authenticated user
+const authKey = "runway_auth"
+
+// New authenticates requests and checks the permission of their route, such as "/v1/course/:id".
+// Fiber only knows the route of a handler registered on it, so New must be passed to the route,
+// app.Get("/v1/course/:id", fiberauth.New(opts), handler), not to App.Use. Errors are written by
+// Options.ErrorHandler when set, with middleware.Body otherwise.
+func New(opts middleware.Options) fiber.Handler {
+	authenticator := middleware.New(opts)
+	return func(c *fiber.Ctx) error {
+		r := request(c)
+		ctx, err := authenticator.Authorize(r, c.Route().Path, func(name string) string {
+			return c.Params(name)
+		})
+		if err != nil && opts.ErrorHandler != nil {
+			opts.ErrorHandler(&responseWriter{c: c, header: make(http.Header)}, r, err)
+			return nil
+		}
+		if err != nil {
+			if header := middleware.Challenge(err); header != "" {
+				c.Set("WWW-Authenticate", header)
+			}
+			return c.Status(middleware.Status(err)).JSON(middleware.Body(err))
+		}
+		c.SetUserContext(ctx)
+		c.Locals(authKey, auth.FromContext(ctx))
+		return c.Next()
+	}
+}
+
+// request returns the method, url, headers and remote address of the request of c, the parts read by
+// middleware.Authorize, without copying its body
+func request(c *fiber.Ctx) *http.Request {
+	r := &http.Request{
+		Method:     c.Method(),
+		URL:        &url.URL{Path: c.Path(), RawQuery: string(c.Request().URI().QueryString())},
+		Host:       c.Hostname(),
+		Header:     make(http.Header),
+		RemoteAddr: c.Context().RemoteAddr().String(),
+	}
+	c.Request().Header.VisitAll(func(key, value []byte) {
+		r.Header.Add(string(key), string(value))
+	})
+	return r.WithContext(c.UserContext())
+}
+
+// responseWriter writes the response of Options.ErrorHandler to c
+type responseWriter struct {
+	c           *fiber.Ctx
+	header      http.Header
+	wroteHeader bool
+}
+
+func (w *responseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	for name, values := range w.header {
+		for _, value := range values {
+			w.c.Response().Header.Add(name, value)
+		}
+	}
+	w.c.Status(status)
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.c.Write(b)
+}
+
+// FromContext returns the user authenticated by New, nil when the request is not authenticated
+func FromContext(c *fiber.Ctx) *domain.Auth {
+	found, _ := c.Locals(authKey).(*domain.Auth)
+	return found
+}
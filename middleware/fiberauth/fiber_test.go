@@ -0,0 +1,71 @@
+package fiberauth_test
+
+import (
+	"github.com/Runway-Club/auth_lib/middleware"
+	"github.com/Runway-Club/auth_lib/middleware/fiberauth"
+	"github.com/Runway-Club/auth_lib/middleware/internal/middlewaretest"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newApp(opts middleware.Options) http.Handler {
+	app := fiber.New()
+	app.Group("/v1").Get("/lesson/:id", fiberauth.New(opts), func(c *fiber.Ctx) error {
+		return c.SendString(fiberauth.FromContext(c).Id)
+	})
+	return adaptor.FiberApp(app)
+}
+
+func TestFiber(t *testing.T) {
+	token := middlewaretest.Setup(t, "../../configs/dev.yaml", "fiberauth")
+	middlewaretest.CheckLesson(t, newApp(middleware.Options{PayloadParam: "id"}), token)
+
+	t.Run("route template", func(t *testing.T) {
+		route := ""
+		app := newApp(middleware.Options{Resource: func(r, method string) string {
+			route = r
+			return ""
+		}})
+		middlewaretest.Serve(app, http.MethodGet, "/v1/lesson/intro", token)
+		if route != "/v1/lesson/:id" {
+			t.Errorf("expected /v1/lesson/:id, got %s", route)
+		}
+	})
+	t.Run("unmatched route", func(t *testing.T) {
+		app := newApp(middleware.Options{PayloadParam: "id"})
+		if w := middlewaretest.Serve(app, http.MethodGet, "/v1/unknown", ""); w.Code != http.StatusNotFound {
+			t.Errorf("expected 404, got %d", w.Code)
+		}
+	})
+	t.Run("error handler", func(t *testing.T) {
+		app := newApp(middleware.Options{PayloadParam: "id", ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			w.Header().Set("X-Error", err.Error())
+			middlewaretest.ErrorHandler(w, r, err)
+		}})
+		w := middlewaretest.Serve(app, http.MethodGet, "/v1/lesson/intro", "")
+		if w.Code != http.StatusTeapot {
+			t.Errorf("expected 418, got %d", w.Code)
+		}
+		if w.Header().Get("X-Error") != middleware.ErrMissingToken.Error() {
+			t.Errorf("expected the header of the error handler, got %q", w.Header().Get("X-Error"))
+		}
+	})
+	t.Run("query and cookie tokens", func(t *testing.T) {
+		app := newApp(middleware.Options{PayloadParam: "id", TokenSources: []middleware.TokenSource{
+			middleware.Query("access_token"), middleware.Cookie("token"),
+		}})
+		if w := middlewaretest.Serve(app, http.MethodGet, "/v1/lesson/intro?access_token="+token, ""); w.Code != http.StatusOK {
+			t.Errorf("expected 200, got %d", w.Code)
+		}
+		r := httptest.NewRequest(http.MethodGet, "/v1/lesson/intro", nil)
+		r.AddCookie(&http.Cookie{Name: "token", Value: token})
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Errorf("expected 200, got %d", w.Code)
+		}
+	})
+}
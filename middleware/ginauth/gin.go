@@ -0,0 +1,53 @@
+// Package ginauth adapts the runway_auth middleware to gin. It is the module
+// github.com/Runway-Club/auth_lib/middleware/ginauth, apart from runway_auth.
+package ginauth
+
+import (
+	auth "github.com/Runway-Club/auth_lib"
+	"github.com/Runway-Club/auth_lib/domain"
+	"github.com/Runway-Club/auth_lib/middleware"
+	"github.com/gin-gonic/gin"
+)
+
+// authKey is the gin context key of the authenticated user
+const authKey = "runway_auth"
+
+// New authenticates requests and checks the permission of their route template, such as
+// "/v1/course/:id". Errors abort the request, they are written by Options.ErrorHandler when set.
+// Requests matching no route are not authorized, gin answers them with 404.
+func New(opts middleware.Options) gin.HandlerFunc {
+	authenticator := middleware.New(opts)
+	return func(c *gin.Context) {
+		if c.FullPath() == "" {
+			c.Next()
+			return
+		}
+		ctx, err := authenticator.Authorize(c.Request, c.FullPath(), c.Param)
+		if err != nil && opts.ErrorHandler != nil {
+			opts.ErrorHandler(c.Writer, c.Request, err)
+			c.Abort()
+			return
+		}
+		if err != nil {
+			abort(c, err)
+			return
+		}
+		c.Request = c.Request.WithContext(ctx)
+		c.Set(authKey, auth.FromContext(ctx))
+		c.Next()
+	}
+}
+
+func abort(c *gin.Context, err error) {
+	if header := middleware.Challenge(err); header != "" {
+		c.Header("WWW-Authenticate", header)
+	}
+	c.AbortWithStatusJSON(middleware.Status(err), middleware.Body(err))
+}
+
+// FromContext returns the user authenticated by New, nil when the request is not authenticated
+func FromContext(c *gin.Context) *domain.Auth {
+	user, _ := c.Get(authKey)
+	found, _ := user.(*domain.Auth)
+	return found
+}
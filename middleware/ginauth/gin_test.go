@@ -0,0 +1,49 @@
+package ginauth_test
+
+import (
+	"github.com/Runway-Club/auth_lib/middleware"
+	"github.com/Runway-Club/auth_lib/middleware/ginauth"
+	"github.com/Runway-Club/auth_lib/middleware/internal/middlewaretest"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"testing"
+)
+
+func newRouter(opts middleware.Options) *gin.Engine {
+	router := gin.New()
+	router.Use(ginauth.New(opts))
+	router.Group("/v1").GET("/lesson/:id", func(c *gin.Context) {
+		c.String(http.StatusOK, ginauth.FromContext(c).Id)
+	})
+	return router
+}
+
+func TestGin(t *testing.T) {
+	token := middlewaretest.Setup(t, "../../configs/dev.yaml", "ginauth")
+	gin.SetMode(gin.TestMode)
+	middlewaretest.CheckLesson(t, newRouter(middleware.Options{PayloadParam: "id"}), token)
+
+	t.Run("route template", func(t *testing.T) {
+		route := ""
+		router := newRouter(middleware.Options{Resource: func(r, method string) string {
+			route = r
+			return ""
+		}})
+		middlewaretest.Serve(router, http.MethodGet, "/v1/lesson/intro", token)
+		if route != "/v1/lesson/:id" {
+			t.Errorf("expected /v1/lesson/:id, got %s", route)
+		}
+	})
+	t.Run("unmatched route", func(t *testing.T) {
+		router := newRouter(middleware.Options{PayloadParam: "id"})
+		if w := middlewaretest.Serve(router, http.MethodGet, "/v1/unknown", ""); w.Code != http.StatusNotFound {
+			t.Errorf("expected 404, got %d", w.Code)
+		}
+	})
+	t.Run("error handler", func(t *testing.T) {
+		router := newRouter(middleware.Options{PayloadParam: "id", ErrorHandler: middlewaretest.ErrorHandler})
+		if w := middlewaretest.Serve(router, http.MethodGet, "/v1/lesson/intro", ""); w.Code != http.StatusTeapot {
+			t.Errorf("expected 418, got %d", w.Code)
+		}
+	})
+}
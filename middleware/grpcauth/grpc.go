@@ -0,0 +1,243 @@
+// Package grpcauth authenticates grpc calls and checks their permission with runway_auth. It is the module
+// github.com/Runway-Club/auth_lib/middleware/grpcauth, apart from runway_auth.
+//
+// Calls are mapped to an ACI resource from their full method name, "/pkg.Service/Method" checks
+// the resource "pkg.Service/Method", so that "pkg.Service/*" or "pkg.**" grant whole services.
+package grpcauth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	auth "github.com/Runway-Club/auth_lib"
+	"github.com/Runway-Club/auth_lib/domain"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"log"
+	"net"
+	"strings"
+)
+
+type Options struct {
+	// MetadataKey is the metadata key of the token, "authorization" by default, a "Bearer " prefix is dropped
+	MetadataKey string
+	// TenantMetadataKey is the metadata key of the tenant, the tenant of the context is kept when unset
+	TenantMetadataKey string
+	// Resource maps full method names to resources, DefaultResource by default, "" only authenticates the call
+	Resource func(fullMethod string) string
+	// PayloadFields maps full method names to the field path of the payload in their request, such as
+	// "course.id", methods without a field path are checked with an empty payload
+	PayloadFields map[string]string
+	// Audience is the audience of the service, only its tokens are accepted when set and tokens restricted
+	// to an audience are rejected when unset, see auth.AuthenticateForAudience
+	Audience string
+}
+
+// DefaultResource drops the leading slash of fullMethod
+func DefaultResource(fullMethod string) string {
+	return strings.TrimPrefix(fullMethod, "/")
+}
+
+// errInvalidPayload is returned when the payload field of a request can not be read
+var errInvalidPayload = errors.New("invalid payload")
+
+type authenticator struct {
+	opts Options
+}
+
+func newAuthenticator(opts Options) *authenticator {
+	if opts.MetadataKey == "" {
+		opts.MetadataKey = "authorization"
+	}
+	if opts.Resource == nil {
+		opts.Resource = DefaultResource
+	}
+	return &authenticator{opts: opts}
+}
+
+// authenticate verifies the token of the call and returns the context carrying the user
+func (a *authenticator) authenticate(ctx context.Context) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if a.opts.TenantMetadataKey != "" {
+		ctx = domain.WithTenant(ctx, first(md.Get(a.opts.TenantMetadataKey)))
+	}
+	token := first(md.Get(a.opts.MetadataKey))
+	if len(token) > 7 && strings.EqualFold(token[:7], "Bearer ") {
+		token = token[7:]
+	}
+	if token == "" {
+		return nil, status.Error(codes.Unauthenticated, "missing token")
+	}
+	var user *domain.Auth
+	var claims map[string]interface{}
+	var err error
+	if a.opts.Audience != "" {
+		user, claims, err = auth.AuthenticateForAudience(ctx, token, a.opts.Audience)
+	} else {
+		user, claims, err = auth.Authenticate(ctx, token)
+	}
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return auth.WithAuth(ctx, user, claims), nil
+}
+
+// authorize checks the permission of the user of ctx to call fullMethod with req
+func (a *authenticator) authorize(ctx context.Context, fullMethod string, req interface{}) error {
+	resource := a.opts.Resource(fullMethod)
+	if resource == "" {
+		return nil
+	}
+	payload := ""
+	if path, ok := a.opts.PayloadFields[fullMethod]; ok {
+		var err error
+		payload, err = fieldValue(req, path)
+		if err != nil {
+			// the field path is not returned to the caller
+			log.Printf("grpcauth: payload of %s: %v", fullMethod, err)
+			return toStatus(errInvalidPayload)
+		}
+	}
+	err := auth.Authorize(ctx, auth.FromContext(ctx), auth.ClaimsFromContext(ctx), resource, payload, attributesOf(ctx))
+	if err != nil {
+		return toStatus(err)
+	}
+	return nil
+}
+
+// UnaryServerInterceptor authenticates unary calls and checks their permission
+func UnaryServerInterceptor(opts Options) grpc.UnaryServerInterceptor {
+	a := newAuthenticator(opts)
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, err := a.authenticate(ctx)
+		if err != nil {
+			return nil, err
+		}
+		err = a.authorize(ctx, info.FullMethod, req)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor authenticates streaming calls and checks their permission. Methods with a
+// payload field are checked against the first request message, when the handler receives it.
+func StreamServerInterceptor(opts Options) grpc.StreamServerInterceptor {
+	a := newAuthenticator(opts)
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := a.authenticate(ss.Context())
+		if err != nil {
+			return err
+		}
+		stream := &serverStream{ServerStream: ss, ctx: ctx}
+		if _, ok := a.opts.PayloadFields[info.FullMethod]; ok {
+			stream.check = func(req interface{}) error {
+				return a.authorize(ctx, info.FullMethod, req)
+			}
+		} else if err = a.authorize(ctx, info.FullMethod, nil); err != nil {
+			return err
+		}
+		return handler(srv, stream)
+	}
+}
+
+// serverStream carries the authenticated context and checks the first received message
+type serverStream struct {
+	grpc.ServerStream
+	ctx   context.Context
+	check func(req interface{}) error
+}
+
+func (s *serverStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *serverStream) RecvMsg(m interface{}) error {
+	err := s.ServerStream.RecvMsg(m)
+	if err != nil || s.check == nil {
+		return err
+	}
+	check := s.check
+	s.check = nil
+	return check(m)
+}
+
+// attributesOf returns the call attributes evaluated by aci conditions
+func attributesOf(ctx context.Context) *domain.Attributes {
+	attrs := &domain.Attributes{}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		ip, _, err := net.SplitHostPort(p.Addr.String())
+		if err != nil {
+			ip = p.Addr.String()
+		}
+		attrs.ClientIP = ip
+	}
+	return attrs
+}
+
+// toStatus returns the grpc status of an authentication or permission error
+func toStatus(err error) error {
+	switch {
+	case errors.Is(err, domain.ErrInvalidToken), errors.Is(err, domain.ErrExpiredToken),
+		errors.Is(err, domain.ErrInvalidIssuer), errors.Is(err, domain.ErrTenantMismatch), errors.Is(err, domain.ErrInvalidAudience):
+		return status.Error(codes.Unauthenticated, err.Error())
+	case errors.Is(err, domain.ErrPermissionDenied):
+		return status.Error(codes.PermissionDenied, err.Error())
+	case errors.Is(err, errInvalidPayload):
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	return status.Error(codes.Internal, codes.Internal.String())
+}
+
+// fieldValue reads the scalar field at path, proto field names separated by dots, from req
+func fieldValue(req interface{}, path string) (string, error) {
+	msg, ok := req.(proto.Message)
+	if !ok {
+		return "", fmt.Errorf("%T is not a proto message", req)
+	}
+	m := msg.ProtoReflect()
+	names := strings.Split(path, ".")
+	for i, name := range names {
+		field := m.Descriptor().Fields().ByName(protoreflect.Name(name))
+		if field == nil {
+			return "", fmt.Errorf("unknown field %s", path)
+		}
+		if field.IsList() || field.IsMap() {
+			return "", fmt.Errorf("field %s is not a scalar", path)
+		}
+		value := m.Get(field)
+		if i < len(names)-1 {
+			if field.Message() == nil {
+				return "", fmt.Errorf("field %s is not a message", name)
+			}
+			m = value.Message()
+			continue
+		}
+		switch field.Kind() {
+		case protoreflect.MessageKind, protoreflect.GroupKind:
+			return "", fmt.Errorf("field %s is not a scalar", path)
+		case protoreflect.EnumKind:
+			if enum := field.Enum().Values().ByNumber(value.Enum()); enum != nil {
+				return string(enum.Name()), nil
+			}
+			return fmt.Sprint(value.Enum()), nil
+		case protoreflect.BytesKind:
+			return string(value.Bytes()), nil
+		}
+		return fmt.Sprint(value.Interface()), nil
+	}
+	return "", fmt.Errorf("empty field path")
+}
+
+func first(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
@@ -0,0 +1,162 @@
+package grpcauth_test
+
+import (
+	"context"
+	auth "github.com/Runway-Club/auth_lib"
+	"github.com/Runway-Club/auth_lib/domain"
+	"github.com/Runway-Club/auth_lib/middleware/grpcauth"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/apipb"
+	"google.golang.org/protobuf/types/known/sourcecontextpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"testing"
+)
+
+type testStream struct {
+	grpc.ServerStream
+	ctx  context.Context
+	recv []interface{}
+}
+
+func (s *testStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *testStream) RecvMsg(m interface{}) error {
+	m.(*wrapperspb.StringValue).Value = s.recv[0].(*wrapperspb.StringValue).Value
+	s.recv = s.recv[1:]
+	return nil
+}
+
+func TestInterceptors(t *testing.T) {
+	auth.Initialize("../../configs/dev.yaml", func() gorm.Dialector {
+		return sqlite.Open("file:grpcauth?mode=memory&cache=shared")
+	}, func() gorm.Dialector {
+		return sqlite.Open("file:grpcauth?mode=memory&cache=shared")
+	}, true)
+	err := auth.SignUp(context.Background(), &domain.Auth{Id: "u1", Username: "user01", Password: "Strong123456"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := auth.SignIn(context.Background(), "user01", "Strong123456")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = auth.GetACIUseCase().Create(context.Background(), &domain.ACI{
+		Id:       "100",
+		Resource: "course.v1.CourseService/*",
+		Payload:  "intro",
+		UserId:   "u1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := grpcauth.Options{PayloadFields: map[string]string{
+		"/course.v1.CourseService/GetCourse":   "value",
+		"/course.v1.CourseService/GetApi":      "source_context.file_name",
+		"/course.v1.CourseService/WatchCourse": "value",
+		"/course.v1.CourseService/GetLesson":   "lesson.id",
+	}}
+	unary := grpcauth.UnaryServerInterceptor(opts)
+	withToken := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer "+token.Jwt))
+	call := func(ctx context.Context, method string, req interface{}) (*domain.Auth, error) {
+		var seen *domain.Auth
+		_, err := unary(ctx, req, &grpc.UnaryServerInfo{FullMethod: method}, func(ctx context.Context, req interface{}) (interface{}, error) {
+			seen = auth.FromContext(ctx)
+			return nil, nil
+		})
+		return seen, err
+	}
+
+	t.Run("unary allowed", func(t *testing.T) {
+		seen, err := call(withToken, "/course.v1.CourseService/GetCourse", wrapperspb.String("intro"))
+		if err != nil {
+			t.Error(err)
+		}
+		if seen == nil || seen.Id != "u1" {
+			t.Error("expected the user in the context")
+		}
+		_, err = call(withToken, "/course.v1.CourseService/GetApi", &apipb.Api{SourceContext: &sourcecontextpb.SourceContext{FileName: "intro"}})
+		if err != nil {
+			t.Error(err)
+		}
+	})
+	t.Run("unary denied", func(t *testing.T) {
+		_, err := call(withToken, "/course.v1.CourseService/GetCourse", wrapperspb.String("advanced"))
+		if status.Code(err) != codes.PermissionDenied {
+			t.Errorf("expected permission denied, got %v", err)
+		}
+		_, err = call(withToken, "/course.v1.LessonService/GetLesson", wrapperspb.String("intro"))
+		if status.Code(err) != codes.PermissionDenied {
+			t.Errorf("expected permission denied, got %v", err)
+		}
+	})
+	t.Run("invalid payload", func(t *testing.T) {
+		_, err := call(withToken, "/course.v1.CourseService/GetLesson", wrapperspb.String("intro"))
+		if status.Code(err) != codes.InvalidArgument {
+			t.Errorf("expected invalid argument, got %v", err)
+		}
+		if status.Convert(err).Message() != "invalid payload" {
+			t.Errorf("expected no detail of the field path, got %v", err)
+		}
+	})
+	t.Run("unauthenticated", func(t *testing.T) {
+		_, err := call(context.Background(), "/course.v1.CourseService/GetCourse", wrapperspb.String("intro"))
+		if status.Code(err) != codes.Unauthenticated {
+			t.Errorf("expected unauthenticated, got %v", err)
+		}
+		invalid := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "invalid"))
+		_, err = call(invalid, "/course.v1.CourseService/GetCourse", wrapperspb.String("intro"))
+		if status.Code(err) != codes.Unauthenticated {
+			t.Errorf("expected unauthenticated, got %v", err)
+		}
+	})
+	t.Run("audience", func(t *testing.T) {
+		mobileToken, err := auth.SignIn(domain.WithAudience(context.Background(), "mobile"), "user01", "Strong123456")
+		if err != nil {
+			t.Fatal(err)
+		}
+		withMobileToken := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer "+mobileToken.Jwt))
+		_, err = call(withMobileToken, "/course.v1.CourseService/GetCourse", wrapperspb.String("intro"))
+		if status.Code(err) != codes.Unauthenticated {
+			t.Errorf("expected a mobile token to be rejected without audience, got %v", err)
+		}
+		mobileOpts := opts
+		mobileOpts.Audience = "mobile"
+		mobile := grpcauth.UnaryServerInterceptor(mobileOpts)
+		handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+			return nil, nil
+		}
+		info := &grpc.UnaryServerInfo{FullMethod: "/course.v1.CourseService/GetCourse"}
+		if _, err = mobile(withMobileToken, wrapperspb.String("intro"), info, handler); err != nil {
+			t.Errorf("expected a mobile token to be accepted by mobile, got %v", err)
+		}
+		if _, err = mobile(withToken, wrapperspb.String("intro"), info, handler); status.Code(err) != codes.Unauthenticated {
+			t.Errorf("expected a token without audience to be rejected by mobile, got %v", err)
+		}
+	})
+	t.Run("stream", func(t *testing.T) {
+		stream := grpcauth.StreamServerInterceptor(opts)
+		info := &grpc.StreamServerInfo{FullMethod: "/course.v1.CourseService/WatchCourse"}
+		watch := func(payload string) error {
+			ss := &testStream{ctx: withToken, recv: []interface{}{wrapperspb.String(payload)}}
+			return stream(nil, ss, info, func(srv interface{}, ss grpc.ServerStream) error {
+				if auth.FromContext(ss.Context()) == nil {
+					t.Error("expected the user in the context")
+				}
+				return ss.RecvMsg(&wrapperspb.StringValue{})
+			})
+		}
+		if err := watch("intro"); err != nil {
+			t.Error(err)
+		}
+		if err := watch("advanced"); status.Code(err) != codes.PermissionDenied {
+			t.Errorf("expected permission denied, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,258 @@
+// Package middleware authenticates requests and checks their permission with runway_auth.
+//
+// Requests are mapped to an ACI resource from their route template and method, so that
+// "GET /v1/course/{id}" checks the resource "v1/course.GET" with the payload read from the id parameter.
+//
+// The adapters ginauth, echoauth, chiauth and fiberauth, and the grpc interceptors of grpcauth, are
+// modules of their own, so that a framework is only required by the applications using it.
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	auth "github.com/Runway-Club/auth_lib"
+	"github.com/Runway-Club/auth_lib/domain"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// TokenSource reads the token of a request, "" when the request carries none
+type TokenSource func(r *http.Request) string
+
+// Header reads the token from header name, dropping a "Bearer " prefix
+func Header(name string) TokenSource {
+	return func(r *http.Request) string {
+		token := r.Header.Get(name)
+		if len(token) > 7 && strings.EqualFold(token[:7], "Bearer ") {
+			return token[7:]
+		}
+		return token
+	}
+}
+
+// Cookie reads the token from the cookie name
+func Cookie(name string) TokenSource {
+	return func(r *http.Request) string {
+		cookie, err := r.Cookie(name)
+		if err != nil {
+			return ""
+		}
+		return cookie.Value
+	}
+}
+
+// Query reads the token from the query parameter name
+func Query(name string) TokenSource {
+	return func(r *http.Request) string {
+		return r.URL.Query().Get(name)
+	}
+}
+
+// ResourceMapper maps the route template and the method of a request to an ACI resource,
+// "" only authenticates the request
+type ResourceMapper func(route, method string) string
+
+// DefaultResource drops the parameters and the surrounding slashes of route and appends the method,
+// "/v1/course/{id}" and GET map to "v1/course.GET"
+func DefaultResource(route, method string) string {
+	segments := make([]string, 0)
+	for _, segment := range strings.Split(route, "/") {
+		if segment == "" || isParam(segment) {
+			continue
+		}
+		segments = append(segments, segment)
+	}
+	return strings.Join(segments, "/") + "." + method
+}
+
+// isParam reports whether a route segment is a parameter, {id}, :id or *path
+func isParam(segment string) bool {
+	return strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") ||
+		strings.HasPrefix(segment, ":") || strings.HasPrefix(segment, "*")
+}
+
+// paramName returns the name of a parameter segment
+func paramName(segment string) string {
+	segment = strings.TrimSuffix(strings.TrimPrefix(segment, "{"), "}")
+	segment = strings.TrimSuffix(segment, "...")
+	return strings.TrimLeft(segment, ":*")
+}
+
+// PathParam reads the parameter name of route from path, "" when route has no such parameter
+func PathParam(route, path, name string) string {
+	routeSegments := strings.Split(strings.Trim(route, "/"), "/")
+	pathSegments := strings.Split(strings.Trim(path, "/"), "/")
+	for i, segment := range routeSegments {
+		if !isParam(segment) || paramName(segment) != name || i >= len(pathSegments) {
+			continue
+		}
+		// a catch-all parameter takes the rest of the path
+		if strings.HasPrefix(segment, "*") || strings.HasSuffix(segment, "...}") {
+			return strings.Join(pathSegments[i:], "/")
+		}
+		return pathSegments[i]
+	}
+	return ""
+}
+
+type Options struct {
+	// TokenSources are tried in order, Header("Authorization") by default
+	TokenSources []TokenSource
+	// Resource maps requests to resources, DefaultResource by default
+	Resource ResourceMapper
+	// PayloadParam is the route parameter holding the payload, requests are checked with an empty payload when unset
+	PayloadParam string
+	// Tenant returns the tenant of a request, the tenant of the request context is kept when unset
+	Tenant func(r *http.Request) string
+	// Audience is the audience of the protected service, only its tokens are accepted when set and tokens
+	// restricted to an audience are rejected when unset
+	Audience string
+	// ErrorHandler writes the errors of Authorize, WriteError by default
+	ErrorHandler func(w http.ResponseWriter, r *http.Request, err error)
+}
+
+type Authenticator struct {
+	opts Options
+}
+
+func New(opts Options) *Authenticator {
+	if len(opts.TokenSources) == 0 {
+		opts.TokenSources = []TokenSource{Header("Authorization")}
+	}
+	if opts.Resource == nil {
+		opts.Resource = DefaultResource
+	}
+	if opts.ErrorHandler == nil {
+		opts.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+			WriteError(w, err)
+		}
+	}
+	return &Authenticator{opts: opts}
+}
+
+// ErrMissingToken is returned when a request carries no token
+var ErrMissingToken = errors.New("missing token")
+
+// Authorize authenticates r and checks the permission of route, param reads the route parameters.
+// It returns the request context carrying the user, see runway_auth.FromContext.
+func (a *Authenticator) Authorize(r *http.Request, route string, param func(name string) string) (context.Context, error) {
+	ctx := r.Context()
+	if a.opts.Tenant != nil {
+		ctx = domain.WithTenant(ctx, a.opts.Tenant(r))
+	}
+	token := ""
+	for _, source := range a.opts.TokenSources {
+		if token = source(r); token != "" {
+			break
+		}
+	}
+	if token == "" {
+		return nil, ErrMissingToken
+	}
+	var user *domain.Auth
+	var claims map[string]interface{}
+	var err error
+	if a.opts.Audience != "" {
+		user, claims, err = auth.AuthenticateForAudience(ctx, token, a.opts.Audience)
+	} else {
+		user, claims, err = auth.Authenticate(ctx, token)
+	}
+	if err != nil {
+		return nil, err
+	}
+	resource := a.opts.Resource(route, r.Method)
+	if resource != "" {
+		payload := ""
+		if a.opts.PayloadParam != "" && param != nil {
+			payload = param(a.opts.PayloadParam)
+		}
+		err = auth.Authorize(ctx, user, claims, resource, payload, attributesOf(r))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return auth.WithAuth(ctx, user, claims), nil
+}
+
+// attributesOf returns the request attributes evaluated by aci conditions
+func attributesOf(r *http.Request) *domain.Attributes {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	return &domain.Attributes{ClientIP: ip}
+}
+
+// Route protects next, served at the route template, such as "/v1/course/{id}"
+func (a *Authenticator) Route(route string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, err := a.Authorize(r, route, func(name string) string {
+			return PathParam(route, r.URL.Path, name)
+		})
+		if err != nil {
+			a.opts.ErrorHandler(w, r, err)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// Handler protects next using the request path as the route, for handlers serving a single path
+func (a *Authenticator) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a.Route(r.URL.Path, next).ServeHTTP(w, r)
+	})
+}
+
+// Status returns the http status of an error of Authorize: 401 when the token is missing or
+// invalid, 403 when the permission is denied and 500 otherwise
+func Status(err error) int {
+	switch {
+	case errors.Is(err, ErrMissingToken), errors.Is(err, domain.ErrInvalidToken), errors.Is(err, domain.ErrExpiredToken),
+		errors.Is(err, domain.ErrInvalidIssuer), errors.Is(err, domain.ErrTenantMismatch), errors.Is(err, domain.ErrInvalidAudience):
+		return http.StatusUnauthorized
+	case errors.Is(err, domain.ErrPermissionDenied):
+		return http.StatusForbidden
+	}
+	return http.StatusInternalServerError
+}
+
+type errorBody struct {
+	Error   string `json:"error"`
+	Message string `json:"message"`
+}
+
+// Body returns the json body written by WriteError
+func Body(err error) interface{} {
+	status := Status(err)
+	message := err.Error()
+	if status == http.StatusInternalServerError {
+		// do not leak internal errors
+		message = http.StatusText(status)
+	}
+	return &errorBody{Error: strings.ToLower(strings.ReplaceAll(http.StatusText(status), " ", "_")), Message: message}
+}
+
+// Challenge returns the WWW-Authenticate header of an error of Authorize, "" unless its status is 401
+// or the token lacks a scope
+func Challenge(err error) string {
+	if errors.Is(err, domain.ErrInsufficientScope) {
+		return `Bearer realm="runway_auth", error="insufficient_scope"`
+	}
+	if Status(err) != http.StatusUnauthorized {
+		return ""
+	}
+	return `Bearer realm="runway_auth"`
+}
+
+// WriteError writes err as a json error with its status
+func WriteError(w http.ResponseWriter, err error) {
+	if header := Challenge(err); header != "" {
+		w.Header().Set("WWW-Authenticate", header)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(Status(err))
+	_ = json.NewEncoder(w).Encode(Body(err))
+}
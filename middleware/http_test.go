@@ -0,0 +1,138 @@
+package middleware_test
+
+import (
+	"context"
+	"encoding/json"
+	auth "github.com/Runway-Club/auth_lib"
+	"github.com/Runway-Club/auth_lib/domain"
+	"github.com/Runway-Club/auth_lib/middleware"
+	"github.com/Runway-Club/auth_lib/middleware/internal/middlewaretest"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMiddleware(t *testing.T) {
+	token := middlewaretest.Setup(t, "../configs/dev.yaml", "middleware")
+	err := auth.GetACIUseCase().Create(context.Background(), &domain.ACI{
+		Id:       "m101",
+		Resource: "v1/module.GET",
+		Payload:  "*",
+		RoleId:   "default",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var seen *domain.Auth
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = auth.FromContext(r.Context())
+	})
+	authenticator := middleware.New(middleware.Options{
+		TokenSources: []middleware.TokenSource{middleware.Header("Authorization"), middleware.Cookie("token")},
+		PayloadParam: "id",
+	})
+	serve := func(route string, r *http.Request) *httptest.ResponseRecorder {
+		seen = nil
+		w := httptest.NewRecorder()
+		authenticator.Route(route, handler).ServeHTTP(w, r)
+		return w
+	}
+
+	t.Run("resource", func(t *testing.T) {
+		if resource := middleware.DefaultResource("/v1/course/{id}", "GET"); resource != "v1/course.GET" {
+			t.Errorf("expected v1/course.GET, got %s", resource)
+		}
+		if resource := middleware.DefaultResource("/v1/:org/course/*path", "POST"); resource != "v1/course.POST" {
+			t.Errorf("expected v1/course.POST, got %s", resource)
+		}
+		if param := middleware.PathParam("/v1/course/{id}", "/v1/course/demo", "id"); param != "demo" {
+			t.Errorf("expected demo, got %s", param)
+		}
+		if param := middleware.PathParam("/files/{path...}", "/files/a/b", "path"); param != "a/b" {
+			t.Errorf("expected a/b, got %s", param)
+		}
+	})
+	t.Run("allowed", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/v1/module/demo", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := serve("/v1/module/{id}", r)
+		if w.Code != http.StatusOK {
+			t.Errorf("expected 200, got %d", w.Code)
+		}
+		if seen == nil || seen.Id != "u1" {
+			t.Error("expected the user in the request context")
+		}
+	})
+	t.Run("payload", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/v1/lesson/intro", nil)
+		r.AddCookie(&http.Cookie{Name: "token", Value: token})
+		if w := serve("/v1/lesson/{id}", r); w.Code != http.StatusOK {
+			t.Errorf("expected 200, got %d", w.Code)
+		}
+		r = httptest.NewRequest(http.MethodGet, "/v1/lesson/advanced", nil)
+		r.AddCookie(&http.Cookie{Name: "token", Value: token})
+		if w := serve("/v1/lesson/{id}", r); w.Code != http.StatusForbidden {
+			t.Errorf("expected 403, got %d", w.Code)
+		}
+	})
+	t.Run("forbidden", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodDelete, "/v1/course/demo", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := serve("/v1/course/{id}", r)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("expected 403, got %d", w.Code)
+		}
+		if seen != nil {
+			t.Error("handler should not be called")
+		}
+		body := map[string]string{}
+		_ = json.NewDecoder(w.Body).Decode(&body)
+		if body["error"] != "forbidden" {
+			t.Errorf("expected forbidden error, got %v", body)
+		}
+	})
+	t.Run("unauthorized", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/v1/course/demo", nil)
+		if w := serve("/v1/course/{id}", r); w.Code != http.StatusUnauthorized {
+			t.Errorf("expected 401, got %d", w.Code)
+		}
+		r = httptest.NewRequest(http.MethodGet, "/v1/course/demo?access_token=invalid", nil)
+		w := httptest.NewRecorder()
+		middleware.New(middleware.Options{TokenSources: []middleware.TokenSource{middleware.Query("access_token")}}).
+			Route("/v1/course/{id}", handler).ServeHTTP(w, r)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("expected 401, got %d", w.Code)
+		}
+		if w.Header().Get("WWW-Authenticate") == "" {
+			t.Error("expected WWW-Authenticate header")
+		}
+	})
+	t.Run("audience", func(t *testing.T) {
+		admin := middleware.New(middleware.Options{Audience: "admin", PayloadParam: "id"})
+		serveAdmin := func(token string) int {
+			r := httptest.NewRequest(http.MethodGet, "/v1/module/demo", nil)
+			r.Header.Set("Authorization", "Bearer "+token)
+			w := httptest.NewRecorder()
+			admin.Route("/v1/module/{id}", handler).ServeHTTP(w, r)
+			return w.Code
+		}
+		if code := serveAdmin(token); code != http.StatusUnauthorized {
+			t.Errorf("expected a token without audience to be rejected, got %d", code)
+		}
+		mobileToken, err := auth.SignIn(domain.WithAudience(context.Background(), "mobile"), "user01", "Strong123456")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code := serveAdmin(mobileToken.Jwt); code != http.StatusUnauthorized {
+			t.Errorf("expected a mobile token to be rejected, got %d", code)
+		}
+		adminToken, err := auth.SignIn(domain.WithAudience(context.Background(), "admin"), "user01", "Strong123456")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code := serveAdmin(adminToken.Jwt); code != http.StatusOK {
+			t.Errorf("expected an admin token to be accepted, got %d", code)
+		}
+	})
+}
@@ -0,0 +1,86 @@
+// Package middlewaretest holds the fixture shared by the tests of the middleware and of its adapters.
+package middlewaretest
+
+import (
+	"context"
+	auth "github.com/Runway-Club/auth_lib"
+	"github.com/Runway-Club/auth_lib/domain"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Setup initializes runway_auth on the in memory database name with the user u1, allowed "v1/lesson.GET" with
+// the payload intro, and returns a token of u1. config is the path of configs/dev.yaml from the test.
+func Setup(t *testing.T, config, name string) string {
+	t.Helper()
+	auth.Initialize(config, func() gorm.Dialector {
+		return sqlite.Open("file:" + name + "?mode=memory&cache=shared")
+	}, func() gorm.Dialector {
+		return sqlite.Open("file:" + name + "?mode=memory&cache=shared")
+	}, true)
+	err := auth.SignUp(context.Background(), &domain.Auth{Id: "u1", Username: "user01", Password: "Strong123456"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := auth.SignIn(context.Background(), "user01", "Strong123456")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = auth.GetACIUseCase().Create(context.Background(), &domain.ACI{
+		Id:       "100",
+		Resource: "v1/lesson.GET",
+		Payload:  "intro",
+		UserId:   "u1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token.Jwt
+}
+
+// Serve serves a request of method and path with handler, token is sent as a bearer token when set
+func Serve(handler http.Handler, method, path, token string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, nil)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+// CheckLesson runs the checks shared by the adapters. handler serves GET /v1/lesson/{id} with the id parameter
+// as payload, its route handler writes the id of the user authenticated by the adapter.
+func CheckLesson(t *testing.T, handler http.Handler, token string) {
+	t.Run("allowed", func(t *testing.T) {
+		w := Serve(handler, http.MethodGet, "/v1/lesson/intro", token)
+		if w.Code != http.StatusOK {
+			t.Errorf("expected 200, got %d", w.Code)
+		}
+		if w.Body.String() != "u1" {
+			t.Errorf("expected the user in the context, got %q", w.Body.String())
+		}
+	})
+	t.Run("forbidden", func(t *testing.T) {
+		w := Serve(handler, http.MethodGet, "/v1/lesson/advanced", token)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("expected 403, got %d", w.Code)
+		}
+		if w.Body.String() == "u1" {
+			t.Error("handler should not be called")
+		}
+	})
+	t.Run("unauthorized", func(t *testing.T) {
+		if w := Serve(handler, http.MethodGet, "/v1/lesson/intro", ""); w.Code != http.StatusUnauthorized {
+			t.Errorf("expected 401, got %d", w.Code)
+		}
+	})
+}
+
+// ErrorHandler is an Options.ErrorHandler answering 418, so that the tests see that it is used
+func ErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	w.WriteHeader(http.StatusTeapot)
+}
@@ -0,0 +1,562 @@
+// Package oauth serves the OAuth 2.0 authorization server and OpenID Connect provider of runway_auth.
+//
+// The Handler serves the authorization endpoint at /authorize and the token endpoint at /token, it is
+// mounted by the application after auth.InitOAuth, for example
+// http.Handle("/oauth/", http.StripPrefix("/oauth", oauth.New(oauth.Options{LoginURL: "/login"}))).
+// The authorization code grant with PKCE (S256), the refresh token grant and the client credentials
+// grant are supported. Client credentials tokens have the user domain.ClientSubject(client id) and the
+// role of the client, so that acis apply to services without making them static users.
+//
+// The device authorization grant of RFC 8628 serves clients without browser, such as the CLI on a
+// headless server. The client gets a device code and a user code at /device_authorization, the user signs
+// in elsewhere and confirms the user code at /device, while the client polls /token. The Go API
+// domain.OAuthUseCase.PollDeviceToken returns the domain.Token of the approving user instead.
+//
+// A service calling another one on behalf of a user exchanges the token of the user at /token with the
+// token exchange grant of RFC 8693 rather than forwarding it. The exchanged token is narrowed to the
+// scope, resource and audience parameters, expires sooner and names the service in its act claim, its
+// checks then require the permissions of both the user and the service.
+//
+// Resource servers which can not verify tokens themselves introspect them at /introspect, RFC 7662, as a
+// confidential client. Sessions, access tokens, api keys and refresh tokens are all introspected, refresh
+// tokens by their own client or a domain.OAuthClient.ResourceServer, the Go API is auth.Introspect.
+//
+// Access tokens carry the granted scopes, which limit them to the resources of the scopes declared in
+// runway_auth.oauth.scopes on top of the ACL.
+//
+// The openid scope adds an id token to the token response. The discovery document, the JWKS, the
+// userinfo endpoint and the RP-initiated logout endpoint are served at /.well-known/openid-configuration,
+// /jwks.json, /userinfo and /logout, the handler must be mounted at runway_auth.oauth.issuer for the
+// endpoints of the discovery document to resolve.
+package oauth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	auth "github.com/Runway-Club/auth_lib"
+	"github.com/Runway-Club/auth_lib/domain"
+	"github.com/Runway-Club/auth_lib/middleware"
+	"github.com/go-chi/chi/v5"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ConsentFunc asks user to grant scopes to client, it returns the scopes granted, a subset of scopes,
+// or domain.ErrOAuthAccessDenied. A hook rendering a consent page returns ErrConsentPending once the
+// page is written, the page then submits the decision back to the authorization endpoint.
+type ConsentFunc func(w http.ResponseWriter, r *http.Request, client *domain.OAuthClient, user *domain.Auth, scopes []string) ([]string, error)
+
+var (
+	ErrConsentPending = errors.New("consent pending")
+	errNotInitialized = errors.New("oauth not initialized")
+)
+
+type Options struct {
+	// TokenSources read the session of the signed in user, they are tried in order,
+	// middleware.Cookie("runway_auth_token") then middleware.Header("Authorization") by default
+	TokenSources []middleware.TokenSource
+	// LoginURL signs the user in and then redirects to its return_to parameter, the authorization
+	// request fails with login_required when it is empty
+	LoginURL string
+	// Consent is asked for clients which are not trusted, their requests are denied when it is nil
+	Consent ConsentFunc
+	// Logout ends the session of the signed in user, the runway_auth_token cookie is expired when it is nil
+	Logout func(w http.ResponseWriter, r *http.Request)
+	// Tenant returns the tenant of a request, the tenant of the request context is kept when unset
+	Tenant func(r *http.Request) string
+}
+
+type Handler struct {
+	router chi.Router
+	opts   Options
+}
+
+func New(opts Options) *Handler {
+	if len(opts.TokenSources) == 0 {
+		opts.TokenSources = []middleware.TokenSource{middleware.Cookie("runway_auth_token"), middleware.Header("Authorization")}
+	}
+	h := &Handler{router: chi.NewRouter(), opts: opts}
+	h.router.Get("/authorize", h.withUseCase(h.authorize))
+	h.router.Post("/authorize", h.withUseCase(h.authorize))
+	h.router.Post("/token", h.withUseCase(h.token))
+	h.router.Post("/introspect", h.withUseCase(h.introspect))
+	h.router.Post("/device_authorization", h.withUseCase(h.deviceAuthorization))
+	h.router.Get("/device", h.withUseCase(h.device))
+	h.router.Post("/device", h.withUseCase(h.device))
+	h.router.Get("/userinfo", h.withUseCase(h.userInfo))
+	h.router.Post("/userinfo", h.withUseCase(h.userInfo))
+	h.router.Get("/logout", h.withUseCase(h.logout))
+	h.router.Post("/logout", h.withUseCase(h.logout))
+	h.router.Get("/.well-known/openid-configuration", h.withUseCase(func(w http.ResponseWriter, r *http.Request, useCase domain.OAuthUseCase) {
+		writeJSON(w, http.StatusOK, useCase.Metadata())
+	}))
+	h.router.Get("/jwks.json", h.withUseCase(func(w http.ResponseWriter, r *http.Request, useCase domain.OAuthUseCase) {
+		writeJSON(w, http.StatusOK, useCase.JWKS())
+	}))
+	return h
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.opts.Tenant != nil {
+		r = r.WithContext(domain.WithTenant(r.Context(), h.opts.Tenant(r)))
+	}
+	h.router.ServeHTTP(w, r)
+}
+
+func (h *Handler) authorize(w http.ResponseWriter, r *http.Request, useCase domain.OAuthUseCase) {
+	if err := r.ParseForm(); err != nil {
+		writeError(w, domain.ErrOAuthInvalidRequest.With(err.Error()))
+		return
+	}
+	req := &domain.AuthorizeRequest{
+		ResponseType:        r.Form.Get("response_type"),
+		ClientId:            r.Form.Get("client_id"),
+		RedirectURI:         r.Form.Get("redirect_uri"),
+		Scope:               r.Form.Get("scope"),
+		State:               r.Form.Get("state"),
+		CodeChallenge:       r.Form.Get("code_challenge"),
+		CodeChallengeMethod: r.Form.Get("code_challenge_method"),
+		Nonce:               r.Form.Get("nonce"),
+		Prompt:              r.Form.Get("prompt"),
+	}
+	client, scopes, err := useCase.ValidateAuthorize(r.Context(), req)
+	if client == nil && err != nil {
+		// the redirect uri can not be trusted, the error is shown to the user
+		writeJSON(w, http.StatusBadRequest, errorOf(err))
+		return
+	}
+	if err != nil {
+		redirect(w, r, req, url.Values{"error": {errorOf(err).Code}, "error_description": {errorOf(err).Description}})
+		return
+	}
+	user, authn, err := h.user(r)
+	if err != nil {
+		if h.opts.LoginURL != "" && req.Prompt != "none" {
+			h.loginRedirect(w, r)
+			return
+		}
+		redirect(w, r, req, url.Values{"error": {domain.ErrOAuthLoginRequired.Code}})
+		return
+	}
+	granted := scopes
+	if !client.Trusted {
+		if req.Prompt == "none" {
+			// the consent hook may write a page, it is not asked
+			redirect(w, r, req, url.Values{"error": {domain.ErrOAuthConsentRequired.Code}})
+			return
+		}
+		granted, err = h.consent(w, r, client, user, scopes)
+		if errors.Is(err, ErrConsentPending) {
+			return
+		}
+		if err != nil {
+			redirect(w, r, req, url.Values{"error": {errorOf(err).Code}, "error_description": {errorOf(err).Description}})
+			return
+		}
+	}
+	code, err := useCase.IssueCode(r.Context(), req, user, authn, granted)
+	if err != nil {
+		redirect(w, r, req, url.Values{"error": {"server_error"}})
+		return
+	}
+	redirect(w, r, req, url.Values{"code": {code}})
+}
+
+// loginRedirect sends the user to the login page, which replays the request as a GET once the user has
+// signed in. The path is read from the request uri, r.URL.Path lacks the prefix removed by http.StripPrefix.
+func (h *Handler) loginRedirect(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path
+	if requestURI, err := url.ParseRequestURI(r.RequestURI); err == nil {
+		path = requestURI.Path
+	}
+	returnTo := &url.URL{Path: path, RawQuery: r.Form.Encode()}
+	http.Redirect(w, r, h.opts.LoginURL+"?"+url.Values{"return_to": {returnTo.String()}}.Encode(), http.StatusFound)
+}
+
+// user returns the signed in user and how it signed in, oauth access tokens, api keys and impersonation
+// tokens are not sessions and are rejected
+func (h *Handler) user(r *http.Request) (*domain.Auth, *domain.Authentication, error) {
+	for _, source := range h.opts.TokenSources {
+		token := source(r)
+		if token == "" {
+			continue
+		}
+		user, claims, err := auth.Authenticate(r.Context(), token)
+		if err != nil {
+			return nil, nil, err
+		}
+		if _, ok := claims["client_id"]; ok {
+			return nil, nil, domain.ErrInvalidToken
+		}
+		if _, ok := claims["api_key_id"]; ok {
+			return nil, nil, domain.ErrInvalidToken
+		}
+		// an impersonation must not outlive its token through the codes and refresh tokens of clients
+		if _, ok := claims["impersonator"]; ok {
+			return nil, nil, domain.ErrInvalidToken
+		}
+		authn := &domain.Authentication{}
+		if authTime, ok := claims["auth_time"].(float64); ok {
+			authn.Time = time.Unix(int64(authTime), 0)
+		}
+		methods, _ := claims["amr"].([]interface{})
+		for _, method := range methods {
+			if method, ok := method.(string); ok {
+				authn.Methods = append(authn.Methods, method)
+			}
+		}
+		return user, authn, nil
+	}
+	return nil, nil, middleware.ErrMissingToken
+}
+
+// consent asks the consent hook, the scopes granted must have been requested
+func (h *Handler) consent(w http.ResponseWriter, r *http.Request, client *domain.OAuthClient, user *domain.Auth, scopes []string) ([]string, error) {
+	if h.opts.Consent == nil {
+		return nil, domain.ErrOAuthAccessDenied.With("consent is required")
+	}
+	granted, err := h.opts.Consent(w, r, client, user, scopes)
+	if err != nil {
+		return nil, err
+	}
+	requested := make(map[string]bool, len(scopes))
+	for _, scope := range scopes {
+		requested[scope] = true
+	}
+	for _, scope := range granted {
+		if !requested[scope] {
+			return nil, domain.ErrOAuthInvalidScope.With("scope " + scope + " was not requested")
+		}
+	}
+	return granted, nil
+}
+
+// redirect sends the result of an authorization request back to the client with its state
+func redirect(w http.ResponseWriter, r *http.Request, req *domain.AuthorizeRequest, params url.Values) {
+	target, err := url.Parse(req.RedirectURI)
+	if err != nil {
+		writeError(w, domain.ErrOAuthInvalidRequest.With("invalid redirect_uri"))
+		return
+	}
+	query := target.Query()
+	for name, values := range params {
+		if values[0] != "" {
+			query.Set(name, values[0])
+		}
+	}
+	if req.State != "" {
+		query.Set("state", req.State)
+	}
+	target.RawQuery = query.Encode()
+	http.Redirect(w, r, target.String(), http.StatusFound)
+}
+
+func (h *Handler) token(w http.ResponseWriter, r *http.Request, useCase domain.OAuthUseCase) {
+	if err := r.ParseForm(); err != nil {
+		writeError(w, domain.ErrOAuthInvalidRequest.With(err.Error()))
+		return
+	}
+	req := &domain.TokenRequest{
+		GrantType:    r.PostForm.Get("grant_type"),
+		ClientId:     r.PostForm.Get("client_id"),
+		ClientSecret: r.PostForm.Get("client_secret"),
+		Code:         r.PostForm.Get("code"),
+		RedirectURI:  r.PostForm.Get("redirect_uri"),
+		CodeVerifier: r.PostForm.Get("code_verifier"),
+		RefreshToken: r.PostForm.Get("refresh_token"),
+		Scope:        r.PostForm.Get("scope"),
+		DeviceCode:   r.PostForm.Get("device_code"),
+		// the parameters of the token exchange grant, resource may be repeated
+		SubjectToken:     r.PostForm.Get("subject_token"),
+		SubjectTokenType: r.PostForm.Get("subject_token_type"),
+		Resources:        r.PostForm["resource"],
+		Audience:         r.PostForm.Get("audience"),
+	}
+	if err := clientAuth(r, req); err != nil {
+		writeError(w, err)
+		return
+	}
+	resp, err := useCase.Token(r.Context(), req)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// clientAuth sets the credentials of the client of req, client_secret_basic takes precedence over
+// client_secret_post, both parts are form encoded
+func clientAuth(r *http.Request, req *domain.TokenRequest) error {
+	if id, secret, ok := r.BasicAuth(); ok {
+		var err error
+		if req.ClientId, err = url.QueryUnescape(id); err == nil {
+			req.ClientSecret, err = url.QueryUnescape(secret)
+		}
+		if err != nil {
+			return domain.ErrOAuthInvalidClient.With("malformed basic credentials")
+		}
+	}
+	if req.ClientId == "" {
+		return domain.ErrOAuthInvalidRequest.With("client_id is required")
+	}
+	return nil
+}
+
+// introspect serves the state of a token to a resource server authenticated as a confidential client
+func (h *Handler) introspect(w http.ResponseWriter, r *http.Request, useCase domain.OAuthUseCase) {
+	if err := r.ParseForm(); err != nil {
+		writeError(w, domain.ErrOAuthInvalidRequest.With(err.Error()))
+		return
+	}
+	req := &domain.TokenRequest{
+		ClientId:     r.PostForm.Get("client_id"),
+		ClientSecret: r.PostForm.Get("client_secret"),
+	}
+	if err := clientAuth(r, req); err != nil {
+		writeError(w, err)
+		return
+	}
+	token := r.PostForm.Get("token")
+	if token == "" {
+		writeError(w, domain.ErrOAuthInvalidRequest.With("token is required"))
+		return
+	}
+	resp, err := auth.Introspect(r.Context(), &domain.IntrospectionRequest{
+		ClientId:      req.ClientId,
+		ClientSecret:  req.ClientSecret,
+		Token:         token,
+		TokenTypeHint: r.PostForm.Get("token_type_hint"),
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// deviceAuthorization issues the device and user codes of the device grant
+func (h *Handler) deviceAuthorization(w http.ResponseWriter, r *http.Request, useCase domain.OAuthUseCase) {
+	if err := r.ParseForm(); err != nil {
+		writeError(w, domain.ErrOAuthInvalidRequest.With(err.Error()))
+		return
+	}
+	req := &domain.TokenRequest{
+		ClientId:     r.PostForm.Get("client_id"),
+		ClientSecret: r.PostForm.Get("client_secret"),
+		Scope:        r.PostForm.Get("scope"),
+	}
+	if err := clientAuth(r, req); err != nil {
+		writeError(w, err)
+		return
+	}
+	resp, err := useCase.AuthorizeDevice(r.Context(), req)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// device is the verification endpoint of the device grant. A GET, or a POST without confirm, answers the
+// pending request of the user_code with a csrf_token, the application renders the page asking the signed
+// in user to confirm it. The page posts user_code, csrf_token and confirm, "approve" or "deny", back to
+// /device. The consent hook is asked once an untrusted client is approved, with the confirming request.
+func (h *Handler) device(w http.ResponseWriter, r *http.Request, useCase domain.OAuthUseCase) {
+	if err := r.ParseForm(); err != nil {
+		writeError(w, domain.ErrOAuthInvalidRequest.With(err.Error()))
+		return
+	}
+	userCode := r.Form.Get("user_code")
+	if userCode == "" {
+		writeError(w, domain.ErrOAuthInvalidRequest.With("user_code is required"))
+		return
+	}
+	code, client, err := useCase.GetDeviceRequest(r.Context(), userCode)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	user, authn, err := h.user(r)
+	if err != nil {
+		if h.opts.LoginURL != "" {
+			// the login page replays the request as a GET, which only asks for the confirmation
+			h.loginRedirect(w, r)
+			return
+		}
+		writeError(w, domain.ErrOAuthLoginRequired)
+		return
+	}
+	csrfToken := h.deviceCSRFToken(r, userCode)
+	confirm := r.PostForm.Get("confirm")
+	if r.Method != http.MethodPost || confirm == "" {
+		writeJSON(w, http.StatusOK, map[string]string{
+			"user_code":   userCode,
+			"client_id":   client.Id,
+			"client_name": client.Name,
+			"scope":       code.Scope,
+			"csrf_token":  csrfToken,
+		})
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(r.PostForm.Get("csrf_token")), []byte(csrfToken)) != 1 {
+		writeError(w, domain.ErrOAuthInvalidRequest.With("invalid csrf_token"))
+		return
+	}
+	granted := strings.Fields(code.Scope)
+	switch confirm {
+	case "approve":
+		if !client.Trusted {
+			granted, err = h.consent(w, r, client, user, granted)
+		}
+	case "deny":
+		err = domain.ErrOAuthAccessDenied
+	default:
+		err = domain.ErrOAuthInvalidRequest.With("confirm must be approve or deny")
+	}
+	if errors.Is(err, ErrConsentPending) {
+		return
+	}
+	if errors.Is(err, domain.ErrOAuthAccessDenied) {
+		if err := useCase.DenyDevice(r.Context(), userCode); err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"message": "device denied"})
+		return
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	err = useCase.ApproveDevice(r.Context(), userCode, user, authn, granted)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"message": "device approved"})
+}
+
+// deviceCSRFToken binds the confirmation of a user code to the session of the request, a page of another
+// origin can neither read the session nor derive the token from it
+func (h *Handler) deviceCSRFToken(r *http.Request, userCode string) string {
+	for _, source := range h.opts.TokenSources {
+		if token := source(r); token != "" {
+			sum := sha256.Sum256([]byte(userCode + "." + token))
+			return base64.RawURLEncoding.EncodeToString(sum[:])
+		}
+	}
+	return ""
+}
+
+// withUseCase serves a route once auth.InitOAuth was called
+func (h *Handler) withUseCase(serve func(w http.ResponseWriter, r *http.Request, useCase domain.OAuthUseCase)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		useCase := auth.GetOAuthUseCase()
+		if useCase == nil {
+			writeError(w, errNotInitialized)
+			return
+		}
+		serve(w, r, useCase)
+	}
+}
+
+// userInfo serves the claims of the user of an access token granted the openid scope
+func (h *Handler) userInfo(w http.ResponseWriter, r *http.Request, useCase domain.OAuthUseCase) {
+	token := middleware.Header("Authorization")(r)
+	if token == "" {
+		writeBearerError(w, domain.ErrOAuthInvalidToken.With("an access token is required"))
+		return
+	}
+	user, claims, err := auth.Authenticate(r.Context(), token)
+	if err != nil {
+		writeBearerError(w, domain.ErrOAuthInvalidToken.With(err.Error()))
+		return
+	}
+	scope, _ := claims["scope"].(string)
+	info, err := useCase.UserInfo(r.Context(), user.Id, strings.Fields(scope))
+	if err != nil {
+		writeBearerError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, info)
+}
+
+// logout ends the session and sends the user back to the client when it asks for it
+func (h *Handler) logout(w http.ResponseWriter, r *http.Request, useCase domain.OAuthUseCase) {
+	if err := r.ParseForm(); err != nil {
+		writeError(w, domain.ErrOAuthInvalidRequest.With(err.Error()))
+		return
+	}
+	req := &domain.LogoutRequest{
+		IdTokenHint:           r.Form.Get("id_token_hint"),
+		ClientId:              r.Form.Get("client_id"),
+		PostLogoutRedirectURI: r.Form.Get("post_logout_redirect_uri"),
+		State:                 r.Form.Get("state"),
+	}
+	redirectURI, err := useCase.ValidateLogout(r.Context(), req)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if h.opts.Logout != nil {
+		h.opts.Logout(w, r)
+	} else {
+		http.SetCookie(w, &http.Cookie{Name: "runway_auth_token", Value: "", Path: "/", MaxAge: -1, HttpOnly: true})
+	}
+	if redirectURI == "" {
+		writeJSON(w, http.StatusOK, map[string]string{"message": "signed out"})
+		return
+	}
+	redirect(w, r, &domain.AuthorizeRequest{RedirectURI: redirectURI, State: req.State}, url.Values{})
+}
+
+// errorOf returns the oauth error of err, unknown errors are not leaked
+func errorOf(err error) *domain.OAuthError {
+	oauthErr := &domain.OAuthError{}
+	if errors.As(err, &oauthErr) {
+		return oauthErr
+	}
+	return &domain.OAuthError{Code: "server_error"}
+}
+
+// writeError writes err as the error body of RFC 6749, failed client authentication is answered with 401
+func writeError(w http.ResponseWriter, err error) {
+	body := errorOf(err)
+	status := http.StatusBadRequest
+	switch body.Code {
+	case domain.ErrOAuthInvalidClient.Code:
+		status = http.StatusUnauthorized
+		w.Header().Set("WWW-Authenticate", `Basic realm="runway_auth"`)
+	case "server_error":
+		status = http.StatusInternalServerError
+	}
+	writeJSON(w, status, body)
+}
+
+// writeBearerError writes an error of a protected resource, RFC 6750
+func writeBearerError(w http.ResponseWriter, err error) {
+	body := errorOf(err)
+	status := http.StatusUnauthorized
+	if body.Code == domain.ErrOAuthInsufficientScope.Code {
+		status = http.StatusForbidden
+	} else if body.Code == "server_error" {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("WWW-Authenticate", `Bearer realm="runway_auth", error="`+body.Code+`"`)
+	writeJSON(w, status, body)
+}
+
+// writeJSON writes a token endpoint response, which must never be cached
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,513 @@
+package oauth_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	auth "github.com/Runway-Club/auth_lib"
+	"github.com/Runway-Club/auth_lib/domain"
+	"github.com/Runway-Club/auth_lib/oauth"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOAuth(t *testing.T) {
+	dialector := func() gorm.Dialector {
+		return sqlite.Open("file:oauth?mode=memory&cache=shared")
+	}
+	auth.Initialize("../configs/dev.yaml", dialector, dialector, true)
+	auth.InitOAuth(dialector)
+	auth.InitAPIKeys(dialector)
+	ctx := context.Background()
+	err := auth.SignUp(ctx, &domain.Auth{Id: "o1", Username: "oauth01", Password: "Strong123456"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := auth.SignIn(ctx, "oauth01", "Strong123456")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = auth.GetACIUseCase().Create(ctx, &domain.ACI{Id: "oauth-course", Resource: "v1/course.*", Payload: "*", UserId: "o1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = auth.GetOAuthUseCase().RegisterClient(ctx, &domain.OAuthClient{
+		Id: "spa", RedirectURIs: []string{"https://spa.dev/cb"}, Scopes: []string{"courses.read", "courses.write"},
+		PostLogoutRedirectURIs: []string{"https://spa.dev/bye"},
+	}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier := strings.Repeat("v", 43)
+	sum := sha256.Sum256([]byte(verifier))
+	authorizeQuery := url.Values{
+		"response_type": {"code"}, "client_id": {"spa"}, "scope": {"courses.read"}, "state": {"xyz"},
+		"code_challenge": {base64.RawURLEncoding.EncodeToString(sum[:])}, "code_challenge_method": {"S256"},
+	}
+	var consented []string
+	handler := oauth.New(oauth.Options{
+		LoginURL: "/login",
+		Consent: func(w http.ResponseWriter, r *http.Request, client *domain.OAuthClient, user *domain.Auth, scopes []string) ([]string, error) {
+			consented = scopes
+			return scopes, nil
+		},
+	})
+	authorize := func(query url.Values, token string) *url.URL {
+		r := httptest.NewRequest(http.MethodGet, "/authorize?"+query.Encode(), nil)
+		if token != "" {
+			r.AddCookie(&http.Cookie{Name: "runway_auth_token", Value: token})
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != http.StatusFound {
+			t.Fatalf("expected a redirect, got %d %s", w.Code, w.Body.String())
+		}
+		location, _ := url.Parse(w.Header().Get("Location"))
+		return location
+	}
+	exchange := func(form url.Values, out interface{}) int {
+		r := httptest.NewRequest(http.MethodPost, "/token", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Header().Get("Cache-Control") != "no-store" {
+			t.Errorf("expected the token response not to be cached")
+		}
+		_ = json.NewDecoder(w.Body).Decode(out)
+		return w.Code
+	}
+
+	t.Run("unknown client", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/authorize?client_id=unknown&redirect_uri=https://evil.dev", nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != http.StatusBadRequest || w.Header().Get("Location") != "" {
+			t.Errorf("expected 400 without redirect, got %d %s", w.Code, w.Header().Get("Location"))
+		}
+	})
+	t.Run("login required", func(t *testing.T) {
+		location := authorize(authorizeQuery, "")
+		if location.Path != "/login" || !strings.Contains(location.Query().Get("return_to"), "client_id=spa") {
+			t.Errorf("expected a redirect to the login page, got %s", location)
+		}
+	})
+	t.Run("login return_to keeps the mount prefix", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/oauth/authorize?"+authorizeQuery.Encode(), nil)
+		w := httptest.NewRecorder()
+		http.StripPrefix("/oauth", handler).ServeHTTP(w, r)
+		location, _ := url.Parse(w.Header().Get("Location"))
+		returnTo, _ := url.Parse(location.Query().Get("return_to"))
+		if returnTo == nil || returnTo.Path != "/oauth/authorize" {
+			t.Errorf("expected to return to /oauth/authorize, got %s", location)
+		}
+	})
+	t.Run("redirect_uri of the authorization request is required", func(t *testing.T) {
+		query := url.Values{}
+		for name, values := range authorizeQuery {
+			query[name] = values
+		}
+		query.Set("redirect_uri", "https://spa.dev/cb")
+		body := &domain.OAuthError{}
+		location := authorize(query, session.Jwt)
+		status := exchange(url.Values{"grant_type": {"authorization_code"}, "client_id": {"spa"}, "code": {location.Query().Get("code")}, "code_verifier": {verifier}}, body)
+		if status != http.StatusBadRequest || body.Code != "invalid_grant" {
+			t.Errorf("expected invalid_grant without redirect_uri, got %d %s", status, body.Code)
+		}
+		location = authorize(query, session.Jwt)
+		status = exchange(url.Values{"grant_type": {"authorization_code"}, "client_id": {"spa"}, "code": {location.Query().Get("code")}, "code_verifier": {verifier},
+			"redirect_uri": {"https://spa.dev/cb"}}, &domain.TokenResponse{})
+		if status != http.StatusOK {
+			t.Errorf("expected tokens with the redirect_uri, got %d", status)
+		}
+	})
+	t.Run("prompt none without consent", func(t *testing.T) {
+		query := url.Values{}
+		for name, values := range authorizeQuery {
+			query[name] = values
+		}
+		query.Set("prompt", "none")
+		consented = nil
+		location := authorize(query, session.Jwt)
+		if location.Query().Get("error") != "consent_required" || location.Query().Get("code") != "" {
+			t.Errorf("expected consent_required, got %s", location)
+		}
+		if consented != nil {
+			t.Error("the consent hook should not be asked")
+		}
+	})
+	var tokens domain.TokenResponse
+	t.Run("authorization code", func(t *testing.T) {
+		location := authorize(authorizeQuery, session.Jwt)
+		code := location.Query().Get("code")
+		if location.Host != "spa.dev" || code == "" || location.Query().Get("state") != "xyz" {
+			t.Fatalf("expected a code, got %s", location)
+		}
+		if len(consented) != 1 || consented[0] != "courses.read" {
+			t.Errorf("expected consent for courses.read, got %v", consented)
+		}
+		status := exchange(url.Values{"grant_type": {"authorization_code"}, "client_id": {"spa"}, "code": {code}, "code_verifier": {verifier}}, &tokens)
+		if status != http.StatusOK || tokens.AccessToken == "" {
+			t.Fatalf("expected tokens, got %d", status)
+		}
+		body := &domain.OAuthError{}
+		status = exchange(url.Values{"grant_type": {"authorization_code"}, "client_id": {"spa"}, "code": {code}, "code_verifier": {verifier}}, body)
+		if status != http.StatusBadRequest || body.Code != "invalid_grant" {
+			t.Errorf("expected invalid_grant for a reused code, got %d %s", status, body.Code)
+		}
+	})
+	t.Run("access token limited to its scopes", func(t *testing.T) {
+		err := auth.VerifyTokenAndPerm(ctx, tokens.AccessToken, "v1/course.GET", "demo")
+		if err != nil {
+			t.Errorf("expected courses.read to allow v1/course.GET, got %v", err)
+		}
+		err = auth.VerifyTokenAndPerm(ctx, tokens.AccessToken, "v1/course.PUT", "demo")
+		if !errors.Is(err, domain.ErrInsufficientScope) || !errors.Is(err, domain.ErrPermissionDenied) {
+			t.Errorf("expected insufficient scope, got %v", err)
+		}
+		err = auth.VerifyTokenAndPerm(ctx, session.Jwt, "v1/course.PUT", "demo")
+		if err != nil {
+			t.Errorf("expected the session to be unlimited, got %v", err)
+		}
+	})
+	t.Run("access token is not a session", func(t *testing.T) {
+		location := authorize(authorizeQuery, tokens.AccessToken)
+		if location.Path != "/login" {
+			t.Errorf("expected a redirect to the login page, got %s", location)
+		}
+	})
+	refreshed := &domain.TokenResponse{}
+	t.Run("refresh", func(t *testing.T) {
+		status := exchange(url.Values{"grant_type": {"refresh_token"}, "client_id": {"spa"}, "refresh_token": {tokens.RefreshToken}}, refreshed)
+		if status != http.StatusOK || refreshed.RefreshToken == tokens.RefreshToken || refreshed.Scope != "courses.read" {
+			t.Errorf("expected rotated tokens, got %d %+v", status, refreshed)
+		}
+	})
+	t.Run("openid connect", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/.well-known/openid-configuration", nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		metadata := &domain.ProviderMetadata{}
+		_ = json.NewDecoder(w.Body).Decode(metadata)
+		if metadata.Issuer != "http://localhost:8080/oauth" || metadata.JwksURI != metadata.Issuer+"/jwks.json" {
+			t.Errorf("unexpected metadata %+v", metadata)
+		}
+		query := url.Values{}
+		for name, values := range authorizeQuery {
+			query[name] = values
+		}
+		query.Set("scope", "openid profile")
+		query.Set("nonce", "n-0S6")
+		location := authorize(query, session.Jwt)
+		openIdTokens := &domain.TokenResponse{}
+		exchange(url.Values{"grant_type": {"authorization_code"}, "client_id": {"spa"}, "code": {location.Query().Get("code")}, "code_verifier": {verifier}}, openIdTokens)
+		if openIdTokens.IdToken == "" {
+			t.Fatal("expected an id token")
+		}
+		r = httptest.NewRequest(http.MethodGet, "/userinfo", nil)
+		r.Header.Set("Authorization", "Bearer "+openIdTokens.AccessToken)
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		info := map[string]interface{}{}
+		_ = json.NewDecoder(w.Body).Decode(&info)
+		if w.Code != http.StatusOK || info["sub"] != "o1" || info["preferred_username"] != "oauth01" {
+			t.Errorf("unexpected user info %d %v", w.Code, info)
+		}
+		r = httptest.NewRequest(http.MethodGet, "/userinfo", nil)
+		r.Header.Set("Authorization", "Bearer "+tokens.AccessToken)
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != http.StatusForbidden || !strings.Contains(w.Header().Get("WWW-Authenticate"), "insufficient_scope") {
+			t.Errorf("expected insufficient scope without openid, got %d", w.Code)
+		}
+		r = httptest.NewRequest(http.MethodGet, "/logout?"+url.Values{"id_token_hint": {openIdTokens.IdToken}, "post_logout_redirect_uri": {"https://spa.dev/bye"}, "state": {"s1"}}.Encode(), nil)
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != http.StatusFound || w.Header().Get("Location") != "https://spa.dev/bye?state=s1" {
+			t.Errorf("expected a redirect after logout, got %d %s", w.Code, w.Header().Get("Location"))
+		}
+		if cookie := w.Result().Cookies(); len(cookie) != 1 || cookie[0].MaxAge >= 0 {
+			t.Errorf("expected the session cookie to be expired, got %v", cookie)
+		}
+	})
+	t.Run("client credentials", func(t *testing.T) {
+		secret, err := auth.GetOAuthUseCase().RegisterClient(ctx, &domain.OAuthClient{
+			Id: "reporting", GrantTypes: []string{domain.GrantClientCredentials},
+		}, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = auth.GetACIUseCase().Create(ctx, &domain.ACI{Id: "oauth-reporting", Resource: "v1/report.GET", Payload: "*", UserId: domain.ClientSubject("reporting")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest(http.MethodPost, "/token", strings.NewReader("grant_type=client_credentials"))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.SetBasicAuth("reporting", "wrong")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("expected 401 for a wrong secret, got %d", w.Code)
+		}
+		r = httptest.NewRequest(http.MethodPost, "/token", strings.NewReader("grant_type=client_credentials"))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.SetBasicAuth("reporting", secret)
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		service := &domain.TokenResponse{}
+		_ = json.NewDecoder(w.Body).Decode(service)
+		if w.Code != http.StatusOK || service.AccessToken == "" {
+			t.Fatalf("expected a token, got %d", w.Code)
+		}
+		if err := auth.VerifyTokenAndPerm(ctx, service.AccessToken, "v1/report.GET", "daily"); err != nil {
+			t.Errorf("expected the client aci to apply, got %v", err)
+		}
+		if err := auth.VerifyTokenAndPerm(ctx, service.AccessToken, "v1/course.GET", "demo"); !errors.Is(err, domain.ErrPermissionDenied) {
+			t.Errorf("expected the client to be denied other resources, got %v", err)
+		}
+	})
+	t.Run("introspection", func(t *testing.T) {
+		rsSecret, err := auth.GetOAuthUseCase().RegisterClient(ctx, &domain.OAuthClient{
+			Id: "rs", GrantTypes: []string{domain.GrantClientCredentials}, ResourceServer: true,
+		}, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		introspect := func(clientId, clientSecret, token string) (int, *domain.Introspection) {
+			r := httptest.NewRequest(http.MethodPost, "/introspect", strings.NewReader(url.Values{"token": {token}}.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			r.SetBasicAuth(clientId, clientSecret)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			introspection := &domain.Introspection{}
+			_ = json.NewDecoder(w.Body).Decode(introspection)
+			return w.Code, introspection
+		}
+		if status, _ := introspect("spa", "", session.Jwt); status != http.StatusUnauthorized {
+			t.Errorf("expected a public client to be rejected, got %d", status)
+		}
+		status, session := introspect("rs", rsSecret, session.Jwt)
+		if status != http.StatusOK || !session.Active || session.Sub != "o1" || session.TokenType != domain.TokenTypeAccessToken ||
+			session.Scope != "" || session.Iss == "" || session.Exp <= session.Iat || session.Exp > time.Now().Add(24*time.Hour).Unix() {
+			t.Errorf("expected an active session, got %d %+v", status, session)
+		}
+		_, access := introspect("rs", rsSecret, tokens.AccessToken)
+		if !access.Active || access.Scope != "courses.read" || access.ClientId != "spa" {
+			t.Errorf("expected an access token of spa, got %+v", access)
+		}
+		_, refresh := introspect("rs", rsSecret, refreshed.RefreshToken)
+		if !refresh.Active || refresh.Sub != "o1" || refresh.TokenType != domain.TokenTypeRefreshToken || refresh.Scope != "courses.read" {
+			t.Errorf("expected an active refresh token, got %+v", refresh)
+		}
+		otherSecret, err := auth.GetOAuthUseCase().RegisterClient(ctx, &domain.OAuthClient{
+			Id: "other", GrantTypes: []string{domain.GrantClientCredentials},
+		}, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, other := introspect("other", otherSecret, refreshed.RefreshToken); other.Active || other.Sub != "" {
+			t.Errorf("expected the refresh token of another client to be inactive, got %+v", other)
+		}
+		if _, rotated := introspect("rs", rsSecret, tokens.RefreshToken); rotated.Active {
+			t.Errorf("expected a rotated refresh token to be inactive, got %+v", rotated)
+		}
+		key, _, err := auth.GetAPIKeyUseCase().Create(ctx, "o1", "ci", nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, apiKey := introspect("rs", rsSecret, key); !apiKey.Active || apiKey.TokenType != domain.TokenTypeAPIKey || apiKey.Exp != 0 {
+			t.Errorf("expected an api key without expiry, got %+v", apiKey)
+		}
+		mobile, err := auth.SignIn(domain.WithAudience(ctx, "mobile"), "oauth01", "Strong123456")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, restricted := introspect("rs", rsSecret, mobile.Jwt); !restricted.Active || len(restricted.Aud) != 1 || restricted.Aud[0] != "mobile" {
+			t.Errorf("expected an active token of the mobile audience, got %+v", restricted)
+		}
+		if _, garbage := introspect("rs", rsSecret, "not-a-token"); garbage.Active || garbage.Sub != "" {
+			t.Errorf("expected an unknown token to be inactive, got %+v", garbage)
+		}
+	})
+	t.Run("device code", func(t *testing.T) {
+		_, err := auth.GetOAuthUseCase().RegisterClient(ctx, &domain.OAuthClient{
+			Id: "tv", GrantTypes: []string{domain.GrantDeviceCode}, Scopes: []string{"courses.read"},
+		}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest(http.MethodPost, "/device_authorization", strings.NewReader("client_id=tv"))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		authz := &domain.DeviceAuthorization{}
+		_ = json.NewDecoder(w.Body).Decode(authz)
+		if w.Code != http.StatusOK || authz.DeviceCode == "" || authz.UserCode == "" {
+			t.Fatalf("expected a device authorization, got %d %+v", w.Code, authz)
+		}
+		verification, _ := url.Parse(authz.VerificationURIComplete)
+		r = httptest.NewRequest(http.MethodGet, "/device?"+verification.RawQuery, nil)
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		location, _ := url.Parse(w.Header().Get("Location"))
+		if w.Code != http.StatusFound || location.Path != "/login" || !strings.Contains(location.Query().Get("return_to"), "user_code=") {
+			t.Errorf("expected a redirect to the login page, got %d %s", w.Code, location)
+		}
+		confirm := func(method string, form url.Values) *httptest.ResponseRecorder {
+			r := httptest.NewRequest(method, "/device?"+form.Encode(), nil)
+			if method == http.MethodPost {
+				r = httptest.NewRequest(method, "/device", strings.NewReader(form.Encode()))
+				r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+			r.AddCookie(&http.Cookie{Name: "runway_auth_token", Value: session.Jwt})
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			return w
+		}
+		consented = nil
+		w = confirm(http.MethodGet, verification.Query())
+		request := map[string]string{}
+		_ = json.NewDecoder(w.Body).Decode(&request)
+		if w.Code != http.StatusOK || request["client_id"] != "tv" || request["scope"] != "courses.read" || request["csrf_token"] == "" {
+			t.Fatalf("expected the request to confirm, got %d %v", w.Code, request)
+		}
+		if _, _, err := auth.GetOAuthUseCase().GetDeviceRequest(ctx, authz.UserCode); err != nil || consented != nil {
+			t.Fatalf("expected a GET not to approve the device, got %v %v", err, consented)
+		}
+		form := url.Values{"user_code": {authz.UserCode}, "confirm": {"approve"}, "csrf_token": {request["csrf_token"]}}
+		if w = confirm(http.MethodGet, form); w.Code != http.StatusOK || consented != nil {
+			t.Fatalf("expected a confirming GET not to approve the device, got %d %s", w.Code, w.Body.String())
+		}
+		forged := url.Values{"user_code": {authz.UserCode}, "confirm": {"approve"}, "csrf_token": {"forged"}}
+		if w = confirm(http.MethodPost, forged); w.Code != http.StatusBadRequest || consented != nil {
+			t.Fatalf("expected a forged csrf_token to be rejected, got %d %s", w.Code, w.Body.String())
+		}
+		w = confirm(http.MethodPost, form)
+		if w.Code != http.StatusOK || len(consented) != 1 || consented[0] != "courses.read" {
+			t.Fatalf("expected the device to be approved with consent, got %d %s %v", w.Code, w.Body.String(), consented)
+		}
+		var device domain.TokenResponse
+		status := exchange(url.Values{"grant_type": {domain.GrantDeviceCode}, "client_id": {"tv"}, "device_code": {authz.DeviceCode}}, &device)
+		if status != http.StatusOK || device.AccessToken == "" || device.Scope != "courses.read" {
+			t.Fatalf("expected tokens, got %d %+v", status, device)
+		}
+		if err := auth.VerifyTokenAndPerm(ctx, device.AccessToken, "v1/course.GET", "demo"); err != nil {
+			t.Errorf("expected the device to act for the user, got %v", err)
+		}
+		body := &domain.OAuthError{}
+		status = exchange(url.Values{"grant_type": {domain.GrantDeviceCode}, "client_id": {"tv"}, "device_code": {authz.DeviceCode}}, body)
+		if status != http.StatusBadRequest || body.Code != "invalid_grant" {
+			t.Errorf("expected invalid_grant for a used device code, got %d %s", status, body.Code)
+		}
+
+		_, err = auth.GetOAuthUseCase().RegisterClient(ctx, &domain.OAuthClient{
+			Id: "trusted-tv", GrantTypes: []string{domain.GrantDeviceCode}, Trusted: true,
+		}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		trusted, err := auth.GetOAuthUseCase().AuthorizeDevice(ctx, &domain.TokenRequest{ClientId: "trusted-tv"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w = confirm(http.MethodGet, url.Values{"user_code": {trusted.UserCode}}); w.Code != http.StatusOK {
+			t.Fatalf("expected the request to confirm, got %d %s", w.Code, w.Body.String())
+		}
+		if _, _, err := auth.GetOAuthUseCase().GetDeviceRequest(ctx, trusted.UserCode); err != nil {
+			t.Errorf("expected a GET not to approve the device of a trusted client, got %v", err)
+		}
+	})
+	t.Run("token exchange", func(t *testing.T) {
+		gwSecret, err := auth.GetOAuthUseCase().RegisterClient(ctx, &domain.OAuthClient{
+			Id: "gateway", GrantTypes: []string{domain.GrantTokenExchange}, RoleId: "gateway",
+		}, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		exchanged := &domain.TokenResponse{}
+		status := exchange(url.Values{"grant_type": {domain.GrantTokenExchange}, "client_id": {"gateway"}, "client_secret": {gwSecret},
+			"subject_token": {session.Jwt}, "subject_token_type": {domain.TokenTypeURNAccessToken}, "resource": {"v1/course.GET"}}, exchanged)
+		if status != http.StatusOK || exchanged.AccessToken == "" {
+			t.Fatalf("expected an exchanged token, got %d", status)
+		}
+		// the user may access courses but the gateway may not yet
+		err = auth.VerifyTokenAndPerm(ctx, exchanged.AccessToken, "v1/course.GET", "demo")
+		if !errors.Is(err, domain.ErrPermissionDenied) {
+			t.Errorf("expected the gateway to be denied, got %v", err)
+		}
+		explanation, err := auth.Explain(ctx, exchanged.AccessToken, "v1/course.GET", "demo")
+		if err != nil || explanation.Allowed || !strings.HasPrefix(explanation.Reason, "actor client:gateway") {
+			t.Errorf("expected the denial of the actor to be explained, got %+v %v", explanation, err)
+		}
+		err = auth.GetACIUseCase().Create(ctx, &domain.ACI{Id: "gateway-course", Resource: "v1/course.*", Payload: "demo", UserId: "client:gateway"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := auth.VerifyTokenAndPerm(ctx, exchanged.AccessToken, "v1/course.GET", "demo"); err != nil {
+			t.Errorf("expected the user and the gateway to be allowed, got %v", err)
+		}
+		if err := auth.VerifyTokenAndPerm(ctx, exchanged.AccessToken, "v1/course.PUT", "demo"); !errors.Is(err, domain.ErrInsufficientScope) {
+			t.Errorf("expected the token to be limited to its resources, got %v", err)
+		}
+		payloads, err := auth.ListAllowedPayloads(ctx, exchanged.AccessToken, "v1/course.GET")
+		if err != nil || len(payloads.Payloads) != 1 || payloads.Payloads[0] != "demo" {
+			t.Errorf("expected the payloads allowed to both, got %v %v", payloads, err)
+		}
+		decisions, err := auth.CheckMany(ctx, exchanged.AccessToken, []*domain.ResourcePayload{
+			{Resource: "v1/course.GET", Payload: "demo"}, {Resource: "v1/course.GET", Payload: "other"},
+		})
+		if err != nil || !decisions[0].Allowed || decisions[1].Allowed {
+			t.Errorf("expected only demo to be allowed, got %v %v", decisions, err)
+		}
+	})
+	t.Run("exchanged impersonation", func(t *testing.T) {
+		secret, err := auth.GetOAuthUseCase().RegisterClient(ctx, &domain.OAuthClient{
+			Id: "support-gw", GrantTypes: []string{domain.GrantTokenExchange}, ResourceServer: true,
+		}, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		owner, err := auth.VerifyToken(ctx, session.Jwt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		impersonation, err := auth.GetJwtGenerator().GenerateToken(owner, map[string]interface{}{"impersonator": "support01"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		exchanged := &domain.TokenResponse{}
+		status := exchange(url.Values{"grant_type": {domain.GrantTokenExchange}, "client_id": {"support-gw"}, "client_secret": {secret},
+			"subject_token": {impersonation}, "subject_token_type": {domain.TokenTypeURNAccessToken}}, exchanged)
+		if status != http.StatusOK || exchanged.AccessToken == "" {
+			t.Fatalf("expected an exchanged token, got %d", status)
+		}
+		if user, err := auth.VerifyToken(ctx, exchanged.AccessToken); err != nil || user.Impersonator != "support01" {
+			t.Errorf("expected the exchanged token to stay an impersonation, got %+v %v", user, err)
+		}
+		introspection, err := auth.Introspect(ctx, &domain.IntrospectionRequest{ClientId: "support-gw", ClientSecret: secret, Token: exchanged.AccessToken})
+		if err != nil || !introspection.Active || introspection.Impersonator != "support01" {
+			t.Errorf("expected the impersonation to be introspected, got %+v %v", introspection, err)
+		}
+		if location := authorize(authorizeQuery, exchanged.AccessToken); location.Path != "/login" {
+			t.Errorf("expected the exchanged impersonation not to be a session, got %s", location)
+		}
+	})
+	t.Run("denied consent", func(t *testing.T) {
+		denying := oauth.New(oauth.Options{})
+		r := httptest.NewRequest(http.MethodGet, "/authorize?"+authorizeQuery.Encode(), nil)
+		r.Header.Set("Authorization", "Bearer "+session.Jwt)
+		w := httptest.NewRecorder()
+		denying.ServeHTTP(w, r)
+		location, _ := url.Parse(w.Header().Get("Location"))
+		if location.Query().Get("error") != "access_denied" || location.Query().Get("state") != "xyz" {
+			t.Errorf("expected access_denied, got %s", location)
+		}
+	})
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/Runway-Club/auth_lib/domain"
+	"github.com/Runway-Club/auth_lib/middleware"
+	"gorm.io/gorm"
+	"net/http"
+	"strings"
+)
+
+var (
+	errInvalidRequest   = errors.New("invalid request")
+	errNotFound         = errors.New("not found")
+	errMethodNotAllowed = errors.New("method not allowed")
+	errNoProvider       = errors.New("provider not initialized")
+	errNoAPIKeys        = errors.New("api keys not initialized")
+	// errInvalidCredentials answers a sign in with an unknown username or a wrong password alike
+	errInvalidCredentials = errors.New("invalid credentials")
+)
+
+// errorStatuses maps errors to their http status, in order
+var errorStatuses = []struct {
+	err    error
+	status int
+}{
+	{errInvalidRequest, http.StatusBadRequest},
+	{domain.ErrInvalidPassword, http.StatusBadRequest},
+	{domain.ErrReservedUserId, http.StatusBadRequest},
+	{domain.ErrInvalidACI, http.StatusBadRequest},
+	{domain.ErrInvalidCondition, http.StatusBadRequest},
+	{domain.ErrInvalidAPIKey, http.StatusBadRequest},
+	{domain.ErrUnknownAudience, http.StatusBadRequest},
+	{middleware.ErrMissingToken, http.StatusUnauthorized},
+	{domain.ErrInvalidToken, http.StatusUnauthorized},
+	{domain.ErrExpiredToken, http.StatusUnauthorized},
+	{domain.ErrInvalidIssuer, http.StatusUnauthorized},
+	{domain.ErrTenantMismatch, http.StatusUnauthorized},
+	{domain.ErrInvalidAudience, http.StatusUnauthorized},
+	{domain.ErrPasswordNotMatch, http.StatusUnauthorized},
+	{errInvalidCredentials, http.StatusUnauthorized},
+	{domain.ErrPermissionDenied, http.StatusForbidden},
+	{errNotFound, http.StatusNotFound},
+	{domain.ErrAuthNotFound, http.StatusNotFound},
+	{domain.ErrACINotFound, http.StatusNotFound},
+	{domain.ErrAPIKeyNotFound, http.StatusNotFound},
+	{gorm.ErrRecordNotFound, http.StatusNotFound},
+	{errMethodNotAllowed, http.StatusMethodNotAllowed},
+	{domain.ErrUsernameExist, http.StatusConflict},
+	{domain.ErrACIConflict, http.StatusConflict},
+	{errNoProvider, http.StatusNotImplemented},
+	{errNoAPIKeys, http.StatusNotImplemented},
+}
+
+// Error is the body of every error response, Code is the snake cased message of the domain error
+type Error struct {
+	Code    string `json:"error"`
+	Message string `json:"message"`
+}
+
+// errorOf returns the status and the body of err, unknown errors are not leaked
+func errorOf(err error) (int, *Error) {
+	for _, known := range errorStatuses {
+		if errors.Is(err, known.err) {
+			return known.status, &Error{Code: strings.ReplaceAll(known.err.Error(), " ", "_"), Message: err.Error()}
+		}
+	}
+	return http.StatusInternalServerError, &Error{Code: "internal_error", Message: domain.ErrInternal.Error()}
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	status, body := errorOf(err)
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="runway_auth"`)
+	}
+	writeJSON(w, status, body)
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
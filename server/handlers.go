@@ -0,0 +1,474 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	auth "github.com/Runway-Club/auth_lib"
+	"github.com/Runway-Club/auth_lib/common"
+	"github.com/Runway-Club/auth_lib/domain"
+	"github.com/go-chi/chi/v5"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// signUpRequest has no id, the ids of users signing up are generated
+type signUpRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type signInRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// Audience restricts the token to a configured audience, see domain.WithAudience
+	Audience string `json:"audience,omitempty"`
+}
+
+type providerRequest struct {
+	Token string `json:"token"`
+	// Audience is the audience of the sign in, ignored by the sign up
+	Audience string `json:"audience,omitempty"`
+}
+
+type changePasswordRequest struct {
+	OldPassword string `json:"old_password"`
+	NewPassword string `json:"new_password"`
+}
+
+type setRoleRequest struct {
+	RoleId string `json:"role_id"`
+}
+
+type apiKeyRequest struct {
+	Name string `json:"name"`
+	// Resources limit the key to resource patterns the user has an aci for, the key acts as the user when empty
+	Resources []string   `json:"resources,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// checkRequest checks the user, with its role, or the role alone when UserId is empty
+type checkRequest struct {
+	UserId   string `json:"user_id,omitempty"`
+	RoleId   string `json:"role_id,omitempty"`
+	Resource string `json:"resource"`
+	Payload  string `json:"payload"`
+	ClientIP string `json:"client_ip,omitempty"`
+}
+
+// user is an Auth without its password
+type user struct {
+	Id        string    `json:"id"`
+	Username  string    `json:"username"`
+	RoleId    string    `json:"role_id"`
+	TenantId  string    `json:"tenant_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type userList struct {
+	Data    []*user `json:"data"`
+	EndPage int     `json:"end_page"`
+}
+
+type apiKey struct {
+	Id         string     `json:"id"`
+	Name       string     `json:"name"`
+	Hint       string     `json:"hint"`
+	Resources  []string   `json:"resources"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+}
+
+type apiKeyList struct {
+	Data []*apiKey `json:"data"`
+}
+
+type createdAPIKey struct {
+	Key    string  `json:"key"`
+	APIKey *apiKey `json:"api_key"`
+}
+
+type aci struct {
+	// Id is generated when empty, it is taken from the path on updates
+	Id        string        `json:"id"`
+	Resource  string        `json:"resource"`
+	Payload   string        `json:"payload"`
+	RoleId    string        `json:"role_id"`
+	UserId    string        `json:"user_id"`
+	Effect    domain.Effect `json:"effect"`
+	Condition string        `json:"condition"`
+	ManagedBy string        `json:"managed_by,omitempty"`
+}
+
+type aciList struct {
+	Data    []*aci `json:"data"`
+	EndPage int    `json:"end_page"`
+}
+
+type decision struct {
+	Resource string `json:"resource"`
+	Payload  string `json:"payload"`
+	Allowed  bool   `json:"allowed"`
+	Rule     *aci   `json:"rule,omitempty"`
+}
+
+type ruleTrace struct {
+	Rule    *aci   `json:"rule"`
+	Subject string `json:"subject"`
+	Applies bool   `json:"applies"`
+	Reason  string `json:"reason"`
+}
+
+type explanation struct {
+	Resource     string                    `json:"resource"`
+	Payload      string                    `json:"payload"`
+	UserId       string                    `json:"user_id,omitempty"`
+	RoleId       string                    `json:"role_id,omitempty"`
+	Combining    domain.CombiningAlgorithm `json:"combining"`
+	Rules        []*ruleTrace              `json:"rules"`
+	Allowed      bool                      `json:"allowed"`
+	DecidingRule *aci                      `json:"deciding_rule,omitempty"`
+	Reason       string                    `json:"reason"`
+}
+
+func userOf(found *domain.Auth) *user {
+	return &user{Id: found.Id, Username: found.Username, RoleId: found.RoleId, TenantId: found.TenantId, CreatedAt: found.CreatedAt}
+}
+
+func apiKeyOf(found *domain.APIKey) *apiKey {
+	return &apiKey{Id: found.Id, Name: found.Name, Hint: found.Hint, Resources: found.Resources, CreatedAt: found.CreatedAt,
+		ExpiresAt: found.ExpiresAt, LastUsedAt: found.LastUsedAt, RevokedAt: found.RevokedAt}
+}
+
+func aciOf(found *domain.ACI) *aci {
+	if found == nil {
+		return nil
+	}
+	return &aci{Id: found.Id, Resource: found.Resource, Payload: found.Payload, RoleId: found.RoleId, UserId: found.UserId,
+		Effect: found.Effect, Condition: found.Condition, ManagedBy: found.ManagedBy}
+}
+
+func (a *aci) domain() *domain.ACI {
+	return &domain.ACI{Id: a.Id, Resource: a.Resource, Payload: a.Payload, RoleId: a.RoleId, UserId: a.UserId,
+		Effect: a.Effect, Condition: a.Condition}
+}
+
+// decode reads the json body of r into v
+func decode(r *http.Request, v interface{}) error {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return fmt.Errorf("%w: %v", errInvalidRequest, err)
+	}
+	return nil
+}
+
+// queryOpts reads the page and size query parameters
+func queryOpts(r *http.Request) (*common.QueryOpts, error) {
+	opts := &common.QueryOpts{Page: 1, Size: 50}
+	for name, value := range map[string]*int{"page": &opts.Page, "size": &opts.Size} {
+		if raw := r.URL.Query().Get(name); raw != "" {
+			parsed, err := strconv.Atoi(raw)
+			if err != nil || parsed < 1 {
+				return nil, fmt.Errorf("%w: invalid %s", errInvalidRequest, name)
+			}
+			*value = parsed
+		}
+	}
+	return opts, nil
+}
+
+func signUp(r *http.Request) (interface{}, error) {
+	req := &signUpRequest{}
+	if err := decode(r, req); err != nil {
+		return nil, err
+	}
+	if req.Username == "" || req.Password == "" {
+		return nil, fmt.Errorf("%w: username and password are required", errInvalidRequest)
+	}
+	created := &domain.Auth{Username: req.Username, Password: req.Password}
+	err := auth.SignUp(r.Context(), created)
+	if err != nil {
+		return nil, err
+	}
+	return userOf(created), nil
+}
+
+func signIn(r *http.Request) (interface{}, error) {
+	req := &signInRequest{}
+	if err := decode(r, req); err != nil {
+		return nil, err
+	}
+	token, err := auth.SignIn(withAudience(r, req.Audience), req.Username, req.Password)
+	// the response does not tell whether the username exists
+	if errors.Is(err, domain.ErrAuthNotFound) || errors.Is(err, domain.ErrPasswordNotMatch) {
+		return nil, errInvalidCredentials
+	}
+	return token, err
+}
+
+func signUpWithProvider(r *http.Request) (interface{}, error) {
+	req := &providerRequest{}
+	if err := decode(r, req); err != nil {
+		return nil, err
+	}
+	if !auth.HasProvider() {
+		return nil, errNoProvider
+	}
+	// only the tokens verified by the provider are accepted
+	return nil, auth.SignUpWithProvider(domain.WithVerifiedProvider(r.Context()), req.Token)
+}
+
+func signInWithProvider(r *http.Request) (interface{}, error) {
+	req := &providerRequest{}
+	if err := decode(r, req); err != nil {
+		return nil, err
+	}
+	if !auth.HasProvider() {
+		return nil, errNoProvider
+	}
+	return auth.SignInWithProvider(domain.WithVerifiedProvider(withAudience(r, req.Audience)), req.Token)
+}
+
+// withAudience returns the context of r, restricted to audience when it is set
+func withAudience(r *http.Request, audience string) context.Context {
+	if audience == "" {
+		return r.Context()
+	}
+	return domain.WithAudience(r.Context(), audience)
+}
+
+func me(r *http.Request) (interface{}, error) {
+	found, err := auth.GetAuthUseCase().GetById(r.Context(), auth.FromContext(r.Context()).Id)
+	if err != nil {
+		return nil, domain.ErrAuthNotFound
+	}
+	return userOf(found), nil
+}
+
+func changePassword(r *http.Request) (interface{}, error) {
+	req := &changePasswordRequest{}
+	if err := decode(r, req); err != nil {
+		return nil, err
+	}
+	if err := requireSession(r, "changing the password"); err != nil {
+		return nil, err
+	}
+	return nil, auth.GetAuthUseCase().ChangePassword(r.Context(), auth.FromContext(r.Context()).Id, req.OldPassword, req.NewPassword)
+}
+
+func listAPIKeys(r *http.Request) (interface{}, error) {
+	if auth.GetAPIKeyUseCase() == nil {
+		return nil, errNoAPIKeys
+	}
+	found, err := auth.GetAPIKeyUseCase().List(r.Context(), auth.FromContext(r.Context()).Id)
+	if err != nil {
+		return nil, err
+	}
+	list := &apiKeyList{Data: make([]*apiKey, 0, len(found))}
+	for _, key := range found {
+		list.Data = append(list.Data, apiKeyOf(key))
+	}
+	return list, nil
+}
+
+func createAPIKey(r *http.Request) (interface{}, error) {
+	req := &apiKeyRequest{}
+	if err := decode(r, req); err != nil {
+		return nil, err
+	}
+	if auth.GetAPIKeyUseCase() == nil {
+		return nil, errNoAPIKeys
+	}
+	if err := requireSession(r, "creating api keys"); err != nil {
+		return nil, err
+	}
+	key, created, err := auth.GetAPIKeyUseCase().Create(r.Context(), auth.FromContext(r.Context()).Id, req.Name, req.Resources, req.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	return &createdAPIKey{Key: key, APIKey: apiKeyOf(created)}, nil
+}
+
+// sessionLimits are the claims of the tokens which are not a session of their user: api keys, oauth access
+// tokens and their scopes, exchanged tokens and impersonations
+var sessionLimits = []string{"api_key_id", "impersonator", "scope", "resources", "client_id", "act"}
+
+// requireSession rejects the tokens limited or delegated on the routes minting credentials, the credential
+// would otherwise outlive the token and escape its limits
+func requireSession(r *http.Request, action string) error {
+	claims := auth.ClaimsFromContext(r.Context())
+	for _, claim := range sessionLimits {
+		if _, ok := claims[claim]; ok {
+			return fmt.Errorf("%w: %s requires a session, not a token with %s", domain.ErrPermissionDenied, action, claim)
+		}
+	}
+	return nil
+}
+
+func revokeAPIKey(r *http.Request) (interface{}, error) {
+	if auth.GetAPIKeyUseCase() == nil {
+		return nil, errNoAPIKeys
+	}
+	return nil, auth.GetAPIKeyUseCase().Revoke(r.Context(), auth.FromContext(r.Context()).Id, chi.URLParam(r, "id"))
+}
+
+func listUsers(r *http.Request) (interface{}, error) {
+	opts, err := queryOpts(r)
+	if err != nil {
+		return nil, err
+	}
+	result, err := auth.GetAuthUseCase().List(r.Context(), opts)
+	if err != nil {
+		return nil, err
+	}
+	list := &userList{Data: make([]*user, 0, len(result.Data)), EndPage: result.EndPage}
+	for _, found := range result.Data {
+		list.Data = append(list.Data, userOf(found))
+	}
+	return list, nil
+}
+
+func getUser(r *http.Request) (interface{}, error) {
+	found, err := auth.GetAuthUseCase().GetById(r.Context(), chi.URLParam(r, "id"))
+	if err != nil {
+		return nil, domain.ErrAuthNotFound
+	}
+	return userOf(found), nil
+}
+
+func deleteUser(r *http.Request) (interface{}, error) {
+	return nil, auth.DeleteAuth(r.Context(), chi.URLParam(r, "id"))
+}
+
+func setRole(r *http.Request) (interface{}, error) {
+	req := &setRoleRequest{}
+	if err := decode(r, req); err != nil {
+		return nil, err
+	}
+	return nil, auth.GetAuthUseCase().ChangeRole(r.Context(), chi.URLParam(r, "id"), req.RoleId)
+}
+
+func listACI(r *http.Request) (interface{}, error) {
+	opts, err := queryOpts(r)
+	if err != nil {
+		return nil, err
+	}
+	result, err := auth.GetACIUseCase().List(r.Context(), opts)
+	if err != nil {
+		return nil, err
+	}
+	list := &aciList{Data: make([]*aci, 0, len(result.Data)), EndPage: result.EndPage}
+	for _, found := range result.Data {
+		list.Data = append(list.Data, aciOf(found))
+	}
+	return list, nil
+}
+
+func createACI(r *http.Request) (interface{}, error) {
+	req := &aci{}
+	if err := decode(r, req); err != nil {
+		return nil, err
+	}
+	if req.Id != "" {
+		if _, err := auth.GetACIUseCase().GetById(r.Context(), req.Id); err == nil {
+			return nil, domain.ErrACIConflict
+		}
+	}
+	created := req.domain()
+	err := auth.GetACIUseCase().Create(r.Context(), created)
+	if err != nil {
+		return nil, err
+	}
+	return aciOf(created), nil
+}
+
+func getACI(r *http.Request) (interface{}, error) {
+	found, err := auth.GetACIUseCase().GetById(r.Context(), chi.URLParam(r, "id"))
+	if err != nil {
+		return nil, domain.ErrACINotFound
+	}
+	return aciOf(found), nil
+}
+
+func updateACI(r *http.Request) (interface{}, error) {
+	req := &aci{}
+	if err := decode(r, req); err != nil {
+		return nil, err
+	}
+	req.Id = chi.URLParam(r, "id")
+	updated := req.domain()
+	err := auth.GetACIUseCase().Update(r.Context(), updated)
+	if err != nil {
+		return nil, err
+	}
+	return aciOf(updated), nil
+}
+
+func deleteACI(r *http.Request) (interface{}, error) {
+	id := chi.URLParam(r, "id")
+	if _, err := auth.GetACIUseCase().GetById(r.Context(), id); err != nil {
+		return nil, domain.ErrACINotFound
+	}
+	return nil, auth.GetACIUseCase().Delete(r.Context(), id)
+}
+
+// subject resolves the user and the role of a check request
+func subject(r *http.Request, req *checkRequest) (userId, roleId string, attrs *domain.Attributes, err error) {
+	if req.Resource == "" || (req.UserId == "" && req.RoleId == "") {
+		return "", "", nil, fmt.Errorf("%w: resource and user_id or role_id are required", errInvalidRequest)
+	}
+	roleId = req.RoleId
+	if req.UserId != "" {
+		found, err := auth.GetAuthUseCase().GetById(r.Context(), req.UserId)
+		if err != nil {
+			return "", "", nil, domain.ErrAuthNotFound
+		}
+		roleId = found.RoleId
+	}
+	return req.UserId, roleId, &domain.Attributes{ClientIP: req.ClientIP}, nil
+}
+
+func check(r *http.Request) (interface{}, error) {
+	req := &checkRequest{}
+	if err := decode(r, req); err != nil {
+		return nil, err
+	}
+	userId, roleId, attrs, err := subject(r, req)
+	if err != nil {
+		return nil, err
+	}
+	decisions, err := auth.GetACIUseCase().CheckPermissions(r.Context(), userId, roleId,
+		[]*domain.ResourcePayload{{Resource: req.Resource, Payload: req.Payload}}, attrs)
+	if err != nil {
+		return nil, err
+	}
+	found := decisions[0]
+	return &decision{Resource: found.Resource, Payload: found.Payload, Allowed: found.Allowed, Rule: aciOf(found.Rule)}, nil
+}
+
+func explain(r *http.Request) (interface{}, error) {
+	req := &checkRequest{}
+	if err := decode(r, req); err != nil {
+		return nil, err
+	}
+	userId, roleId, attrs, err := subject(r, req)
+	if err != nil {
+		return nil, err
+	}
+	found, err := auth.GetACIUseCase().Explain(r.Context(), userId, roleId, req.Resource, req.Payload, attrs)
+	if err != nil {
+		return nil, err
+	}
+	result := &explanation{Resource: found.Resource, Payload: found.Payload, UserId: found.UserId, RoleId: found.RoleId,
+		Combining: found.Combining, Rules: make([]*ruleTrace, 0, len(found.Rules)), Allowed: found.Allowed,
+		DecidingRule: aciOf(found.DecidingRule), Reason: found.Reason}
+	for _, trace := range found.Rules {
+		result.Rules = append(result.Rules, &ruleTrace{Rule: aciOf(trace.Rule), Subject: trace.Subject, Applies: trace.Applies, Reason: trace.Reason})
+	}
+	return result, nil
+}
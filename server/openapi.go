@@ -0,0 +1,159 @@
+package server
+
+import (
+	"github.com/Runway-Club/auth_lib/middleware"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OpenAPI returns the OpenAPI 3 spec of the api, generated from the routes and the types of their bodies
+func (s *Server) OpenAPI() map[string]interface{} {
+	schemas := map[string]interface{}{}
+	paths := map[string]map[string]interface{}{}
+	errorBody := jsonContent(schemaOf(reflect.TypeOf(Error{}), schemas))
+	for _, rt := range s.routes {
+		parameters := make([]interface{}, 0)
+		for _, segment := range strings.Split(rt.path, "/") {
+			if strings.HasPrefix(segment, "{") {
+				parameters = append(parameters, map[string]interface{}{
+					"name": strings.Trim(segment, "{}"), "in": "path", "required": true, "schema": map[string]interface{}{"type": "string"},
+				})
+			}
+		}
+		for _, name := range rt.query {
+			parameters = append(parameters, map[string]interface{}{
+				"name": name, "in": "query", "schema": map[string]interface{}{"type": "integer", "minimum": 1},
+			})
+		}
+		success := map[string]interface{}{"description": http.StatusText(rt.status)}
+		if rt.response != nil {
+			success["content"] = jsonContent(schemaOf(reflect.TypeOf(rt.response), schemas))
+		}
+		responses := map[string]interface{}{strconv.Itoa(rt.status): success}
+		for _, status := range errorStatusesOf(rt) {
+			responses[strconv.Itoa(status)] = map[string]interface{}{"description": http.StatusText(status), "content": errorBody}
+		}
+		operation := map[string]interface{}{
+			"summary":   rt.summary,
+			"tags":      []string{rt.tag},
+			"responses": responses,
+		}
+		if len(parameters) > 0 {
+			operation["parameters"] = parameters
+		}
+		if rt.request != nil {
+			operation["requestBody"] = map[string]interface{}{
+				"required": true, "content": jsonContent(schemaOf(reflect.TypeOf(rt.request), schemas)),
+			}
+		}
+		if rt.access != public {
+			operation["security"] = []map[string][]string{{"bearerAuth": {}}}
+		}
+		if rt.access == admin {
+			operation["description"] = "Requires an aci allowing the resource " +
+				s.opts.ResourcePrefix + "/" + middleware.DefaultResource(rt.path, rt.method) + ", the payload is the id"
+		}
+		if paths[rt.path] == nil {
+			paths[rt.path] = map[string]interface{}{}
+		}
+		paths[rt.path][strings.ToLower(rt.method)] = operation
+	}
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info":    map[string]interface{}{"title": "runway_auth", "version": "v1"},
+		"paths":   paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				"bearerAuth": map[string]interface{}{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"},
+			},
+		},
+	}
+}
+
+// errorStatusesOf returns the error statuses a route may respond with
+func errorStatusesOf(rt *route) []int {
+	statuses := make([]int, 0)
+	if rt.request != nil || len(rt.query) > 0 {
+		statuses = append(statuses, http.StatusBadRequest)
+	}
+	if rt.access != public || rt.path == "/v1/auth/sign-in" {
+		statuses = append(statuses, http.StatusUnauthorized)
+	}
+	// api keys can not create api keys
+	if rt.access == admin || rt.path == "/v1/auth/api-keys" && rt.method == http.MethodPost {
+		statuses = append(statuses, http.StatusForbidden)
+	}
+	if strings.Contains(rt.path, "{id}") || rt.access == authenticated {
+		statuses = append(statuses, http.StatusNotFound)
+	}
+	if rt.method == http.MethodPost && rt.status == http.StatusCreated {
+		statuses = append(statuses, http.StatusConflict)
+	}
+	return append(statuses, http.StatusInternalServerError)
+}
+
+func jsonContent(schema interface{}) map[string]interface{} {
+	return map[string]interface{}{"application/json": map[string]interface{}{"schema": schema}}
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// schemaOf returns the schema of t, structs are added to schemas and referenced
+func schemaOf(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch {
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t.Kind() == reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case t.Kind() == reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case t.Kind() == reflect.Float32 || t.Kind() == reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case t.Kind() == reflect.Slice:
+		return map[string]interface{}{"type": "array", "items": schemaOf(t.Elem(), schemas)}
+	case t.Kind() == reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaOf(t.Elem(), schemas)}
+	case t.Kind() != reflect.Struct:
+		return map[string]interface{}{}
+	}
+	name := strings.ToUpper(t.Name()[:1]) + t.Name()[1:]
+	ref := map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	if _, ok := schemas[name]; ok {
+		return ref
+	}
+	// reserve the name before the fields, types may refer to themselves
+	schemas[name] = nil
+	properties := map[string]interface{}{}
+	required := make([]string, 0)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if !field.IsExported() || tag == "-" {
+			continue
+		}
+		options := strings.Split(tag, ",")
+		fieldName := options[0]
+		if fieldName == "" {
+			fieldName = field.Name
+		}
+		properties[fieldName] = schemaOf(field.Type, schemas)
+		if len(options) == 1 && field.Type.Kind() != reflect.Pointer {
+			required = append(required, fieldName)
+		}
+	}
+	schema := map[string]interface{}{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	schemas[name] = schema
+	return ref
+}
@@ -0,0 +1,192 @@
+// Package server exposes the runway_auth use cases as a versioned JSON API.
+//
+// The Server is an http.Handler to be mounted by the application, for example
+// http.Handle("/auth/", http.StripPrefix("/auth", server.New(server.Options{}))). Admin routes are
+// protected by the ACL itself: "GET /v1/users/{id}" checks the resource "runway_auth/v1/users.GET"
+// with the payload id, static users bypass the ACL as usual. The OpenAPI 3 spec of the routes is
+// served at /v1/openapi.json.
+package server
+
+import (
+	"github.com/Runway-Club/auth_lib/domain"
+	"github.com/Runway-Club/auth_lib/middleware"
+	"github.com/go-chi/chi/v5"
+	"net/http"
+)
+
+type Options struct {
+	// ResourcePrefix prefixes the resources of the admin routes, "runway_auth" by default
+	ResourcePrefix string
+	// TokenSources are tried in order, middleware.Header("Authorization") by default
+	TokenSources []middleware.TokenSource
+	// Tenant returns the tenant of a request, the tenant of the request context is kept when unset
+	Tenant func(r *http.Request) string
+	// Audience is the audience of the server, only its tokens are accepted when set and tokens restricted
+	// to an audience are rejected when unset, see middleware.Options.Audience
+	Audience string
+}
+
+// access is who may call a route
+type access int
+
+const (
+	public access = iota
+	// authenticated routes need a valid token
+	authenticated
+	// admin routes need a valid token and an allowing aci
+	admin
+)
+
+// handler serves a route, the returned value is written as json with the success status of the route
+type handler func(r *http.Request) (interface{}, error)
+
+type route struct {
+	method  string
+	path    string
+	summary string
+	tag     string
+	access  access
+	// request and response are zero values of the json bodies, nil without body
+	request  interface{}
+	response interface{}
+	// query lists the query parameters
+	query  []string
+	status int
+	handle handler
+}
+
+type Server struct {
+	router chi.Router
+	routes []*route
+	// admin authorizes admin routes, user only authenticates
+	admin *middleware.Authenticator
+	user  *middleware.Authenticator
+	opts  Options
+}
+
+func New(opts Options) *Server {
+	if opts.ResourcePrefix == "" {
+		opts.ResourcePrefix = "runway_auth"
+	}
+	s := &Server{
+		router: chi.NewRouter(),
+		opts:   opts,
+		admin: middleware.New(middleware.Options{
+			TokenSources: opts.TokenSources,
+			Audience:     opts.Audience,
+			Resource: func(route, method string) string {
+				return opts.ResourcePrefix + "/" + middleware.DefaultResource(route, method)
+			},
+			PayloadParam: "id",
+		}),
+		user: middleware.New(middleware.Options{
+			TokenSources: opts.TokenSources,
+			Audience:     opts.Audience,
+			Resource: func(route, method string) string {
+				return ""
+			},
+		}),
+	}
+	s.routes = s.table()
+	for _, r := range s.routes {
+		s.router.Method(r.method, r.path, s.serve(r))
+	}
+	s.router.Get("/v1/openapi.json", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, s.OpenAPI())
+	})
+	s.router.NotFound(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, errNotFound)
+	})
+	s.router.MethodNotAllowed(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, errMethodNotAllowed)
+	})
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.opts.Tenant != nil {
+		r = r.WithContext(domain.WithTenant(r.Context(), s.opts.Tenant(r)))
+	}
+	s.router.ServeHTTP(w, r)
+}
+
+// serve authorizes the route before calling its handler
+func (s *Server) serve(rt *route) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var authenticator *middleware.Authenticator
+		switch rt.access {
+		case admin:
+			authenticator = s.admin
+		case authenticated:
+			authenticator = s.user
+		}
+		if authenticator != nil {
+			ctx, err := authenticator.Authorize(r, rt.path, func(name string) string {
+				return chi.URLParam(r, name)
+			})
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			r = r.WithContext(ctx)
+		}
+		result, err := rt.handle(r)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if result == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		writeJSON(w, rt.status, result)
+	}
+}
+
+// table lists the routes of the api
+func (s *Server) table() []*route {
+	return []*route{
+		{method: http.MethodPost, path: "/v1/auth/sign-up", summary: "Sign up with a username and a password", tag: "auth",
+			access: public, request: signUpRequest{}, response: user{}, status: http.StatusCreated, handle: signUp},
+		{method: http.MethodPost, path: "/v1/auth/sign-in", summary: "Sign in with a username and a password", tag: "auth",
+			access: public, request: signInRequest{}, response: domain.Token{}, status: http.StatusOK, handle: signIn},
+		{method: http.MethodPost, path: "/v1/auth/provider/sign-up", summary: "Sign up with a token of the identity provider", tag: "auth",
+			access: public, request: providerRequest{}, status: http.StatusNoContent, handle: signUpWithProvider},
+		{method: http.MethodPost, path: "/v1/auth/provider/sign-in", summary: "Sign in with a token of the identity provider", tag: "auth",
+			access: public, request: providerRequest{}, response: domain.Token{}, status: http.StatusOK, handle: signInWithProvider},
+		{method: http.MethodGet, path: "/v1/auth/me", summary: "Get the authenticated user", tag: "auth",
+			access: authenticated, response: user{}, status: http.StatusOK, handle: me},
+		{method: http.MethodPost, path: "/v1/auth/password", summary: "Change the password of the authenticated user", tag: "auth",
+			access: authenticated, request: changePasswordRequest{}, status: http.StatusNoContent, handle: changePassword},
+		{method: http.MethodGet, path: "/v1/auth/api-keys", summary: "List the api keys of the authenticated user", tag: "auth",
+			access: authenticated, response: apiKeyList{}, status: http.StatusOK, handle: listAPIKeys},
+		{method: http.MethodPost, path: "/v1/auth/api-keys", summary: "Create an api key of the authenticated user, the key is only returned once", tag: "auth",
+			access: authenticated, request: apiKeyRequest{}, response: createdAPIKey{}, status: http.StatusCreated, handle: createAPIKey},
+		{method: http.MethodDelete, path: "/v1/auth/api-keys/{id}", summary: "Revoke an api key of the authenticated user", tag: "auth",
+			access: authenticated, status: http.StatusNoContent, handle: revokeAPIKey},
+
+		{method: http.MethodGet, path: "/v1/users", summary: "List users", tag: "users",
+			access: admin, query: []string{"page", "size"}, response: userList{}, status: http.StatusOK, handle: listUsers},
+		{method: http.MethodGet, path: "/v1/users/{id}", summary: "Get a user", tag: "users",
+			access: admin, response: user{}, status: http.StatusOK, handle: getUser},
+		{method: http.MethodDelete, path: "/v1/users/{id}", summary: "Delete a user", tag: "users",
+			access: admin, status: http.StatusNoContent, handle: deleteUser},
+		{method: http.MethodPut, path: "/v1/users/{id}/role", summary: "Set the role of a user", tag: "users",
+			access: admin, request: setRoleRequest{}, status: http.StatusNoContent, handle: setRole},
+
+		{method: http.MethodGet, path: "/v1/acl", summary: "List acl items", tag: "acl",
+			access: admin, query: []string{"page", "size"}, response: aciList{}, status: http.StatusOK, handle: listACI},
+		{method: http.MethodPost, path: "/v1/acl", summary: "Create an acl item", tag: "acl",
+			access: admin, request: aci{}, response: aci{}, status: http.StatusCreated, handle: createACI},
+		{method: http.MethodGet, path: "/v1/acl/{id}", summary: "Get an acl item", tag: "acl",
+			access: admin, response: aci{}, status: http.StatusOK, handle: getACI},
+		{method: http.MethodPut, path: "/v1/acl/{id}", summary: "Replace an acl item", tag: "acl",
+			access: admin, request: aci{}, response: aci{}, status: http.StatusOK, handle: updateACI},
+		{method: http.MethodDelete, path: "/v1/acl/{id}", summary: "Delete an acl item", tag: "acl",
+			access: admin, status: http.StatusNoContent, handle: deleteACI},
+		{method: http.MethodPost, path: "/v1/acl/check", summary: "Check the permission of a user or a role", tag: "acl",
+			access: admin, request: checkRequest{}, response: decision{}, status: http.StatusOK, handle: check},
+		{method: http.MethodPost, path: "/v1/acl/explain", summary: "Explain the permission of a user or a role", tag: "acl",
+			access: admin, request: checkRequest{}, response: explanation{}, status: http.StatusOK, handle: explain},
+	}
+}
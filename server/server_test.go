@@ -0,0 +1,228 @@
+package server_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	auth "github.com/Runway-Club/auth_lib"
+	"github.com/Runway-Club/auth_lib/domain"
+	"github.com/Runway-Club/auth_lib/server"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestServer(t *testing.T) {
+	auth.Initialize("../configs/dev.yaml", func() gorm.Dialector {
+		return sqlite.Open("file:server?mode=memory&cache=shared")
+	}, func() gorm.Dialector {
+		return sqlite.Open("file:server?mode=memory&cache=shared")
+	}, true)
+	auth.InitAPIKeys(func() gorm.Dialector {
+		return sqlite.Open("file:server?mode=memory&cache=shared")
+	})
+	handler := server.New(server.Options{})
+	do := func(method, path, token string, body interface{}, out interface{}) int {
+		var reader *bytes.Reader
+		if body != nil {
+			raw, _ := json.Marshal(body)
+			reader = bytes.NewReader(raw)
+		} else {
+			reader = bytes.NewReader(nil)
+		}
+		r := httptest.NewRequest(method, path, reader)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if out != nil {
+			_ = json.NewDecoder(w.Body).Decode(out)
+		}
+		return w.Code
+	}
+	signIn := func(username, password string) string {
+		token := &domain.Token{}
+		if status := do(http.MethodPost, "/v1/auth/sign-in", "", map[string]string{"username": username, "password": password}, token); status != http.StatusOK {
+			t.Fatalf("sign in %s: %d", username, status)
+		}
+		return token.Jwt
+	}
+
+	var userId, userToken, adminToken string
+	t.Run("sign up and sign in", func(t *testing.T) {
+		status := do(http.MethodPost, "/v1/auth/sign-up", "", map[string]string{"id": "admin", "username": "user00", "password": "Strong123456"}, nil)
+		if status != http.StatusBadRequest {
+			t.Errorf("expected the id to be rejected, got %d", status)
+		}
+		created := map[string]interface{}{}
+		status = do(http.MethodPost, "/v1/auth/sign-up", "", map[string]string{"username": "user01", "password": "Strong123456"}, &created)
+		if status != http.StatusCreated {
+			t.Errorf("expected 201, got %d", status)
+		}
+		userId, _ = created["id"].(string)
+		if userId == "" {
+			t.Error("expected a generated id")
+		}
+		body := &server.Error{}
+		status = do(http.MethodPost, "/v1/auth/sign-up", "", map[string]string{"username": "user01", "password": "Strong123456"}, body)
+		if status != http.StatusConflict || body.Code != "username_already_exist" {
+			t.Errorf("expected 409 username_already_exist, got %d %s", status, body.Code)
+		}
+		status = do(http.MethodPost, "/v1/auth/sign-in", "", map[string]string{"username": "user01", "password": "wrong-password"}, body)
+		if status != http.StatusUnauthorized || body.Code != "invalid_credentials" {
+			t.Errorf("expected 401 invalid_credentials, got %d %s", status, body.Code)
+		}
+		unknown := &server.Error{}
+		status = do(http.MethodPost, "/v1/auth/sign-in", "", map[string]string{"username": "nobody", "password": "wrong-password"}, unknown)
+		if status != http.StatusUnauthorized || *unknown != *body {
+			t.Errorf("expected an unknown username to be answered as a wrong password, got %d %+v", status, unknown)
+		}
+		userToken = signIn("user01", "Strong123456")
+		adminToken = signIn("admin", "Adminpassword@123")
+	})
+	t.Run("me and password", func(t *testing.T) {
+		me := map[string]interface{}{}
+		if status := do(http.MethodGet, "/v1/auth/me", userToken, nil, &me); status != http.StatusOK || me["id"] != userId {
+			t.Errorf("expected 200 %s, got %d %v", userId, status, me)
+		}
+		if _, ok := me["hpassword"]; ok {
+			t.Error("password hash should not be returned")
+		}
+		if status := do(http.MethodGet, "/v1/auth/me", "", nil, nil); status != http.StatusUnauthorized {
+			t.Errorf("expected 401, got %d", status)
+		}
+		mobileToken := &domain.Token{}
+		status := do(http.MethodPost, "/v1/auth/sign-in", "", map[string]string{"username": "user01", "password": "Strong123456", "audience": "mobile"}, mobileToken)
+		if status != http.StatusOK {
+			t.Fatalf("sign in for mobile: %d", status)
+		}
+		if status := do(http.MethodGet, "/v1/auth/me", mobileToken.Jwt, nil, nil); status != http.StatusUnauthorized {
+			t.Errorf("expected a mobile token to be rejected without audience, got %d", status)
+		}
+		r := httptest.NewRequest(http.MethodGet, "/v1/auth/me", nil)
+		r.Header.Set("Authorization", "Bearer "+mobileToken.Jwt)
+		w := httptest.NewRecorder()
+		server.New(server.Options{Audience: "mobile"}).ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Errorf("expected a mobile token to be accepted by mobile, got %d", w.Code)
+		}
+		status = do(http.MethodPost, "/v1/auth/password", userToken, map[string]string{"old_password": "Strong123456", "new_password": "Stronger123456"}, nil)
+		if status != http.StatusNoContent {
+			t.Errorf("expected 204, got %d", status)
+		}
+		userToken = signIn("user01", "Stronger123456")
+	})
+	t.Run("admin routes", func(t *testing.T) {
+		if status := do(http.MethodGet, "/v1/users", userToken, nil, nil); status != http.StatusForbidden {
+			t.Errorf("expected 403, got %d", status)
+		}
+		users := map[string]interface{}{}
+		if status := do(http.MethodGet, "/v1/users?page=1&size=10", adminToken, nil, &users); status != http.StatusOK {
+			t.Errorf("expected 200, got %d", status)
+		}
+		status := do(http.MethodPost, "/v1/acl", adminToken, map[string]string{
+			"id": "s100", "resource": "runway_auth/v1/users.GET", "payload": userId, "user_id": userId,
+		}, nil)
+		if status != http.StatusCreated {
+			t.Errorf("expected 201, got %d", status)
+		}
+		if status := do(http.MethodGet, "/v1/users/"+userId, userToken, nil, nil); status != http.StatusOK {
+			t.Errorf("expected 200, got %d", status)
+		}
+		if status := do(http.MethodGet, "/v1/users/admin", userToken, nil, nil); status != http.StatusForbidden {
+			t.Errorf("expected 403, got %d", status)
+		}
+		decision := map[string]interface{}{}
+		status = do(http.MethodPost, "/v1/acl/check", adminToken, map[string]string{
+			"user_id": userId, "resource": "runway_auth/v1/users.GET", "payload": userId,
+		}, &decision)
+		if status != http.StatusOK || decision["allowed"] != true {
+			t.Errorf("expected allowed, got %d %v", status, decision)
+		}
+		if status := do(http.MethodPut, "/v1/acl/s100", adminToken, map[string]string{"resource": "x", "effect": "maybe"}, nil); status != http.StatusBadRequest {
+			t.Errorf("expected 400, got %d", status)
+		}
+		if status := do(http.MethodDelete, "/v1/acl/missing", adminToken, nil, nil); status != http.StatusNotFound {
+			t.Errorf("expected 404, got %d", status)
+		}
+		if status := do(http.MethodDelete, "/v1/acl/s100", adminToken, nil, nil); status != http.StatusNoContent {
+			t.Errorf("expected 204, got %d", status)
+		}
+		_, err := auth.GetACIUseCase().GetById(context.Background(), "s100")
+		if err == nil {
+			t.Error("expected the aci to be deleted")
+		}
+	})
+	t.Run("api keys", func(t *testing.T) {
+		created := map[string]interface{}{}
+		if status := do(http.MethodPost, "/v1/auth/api-keys", userToken, map[string]string{"name": "script"}, &created); status != http.StatusCreated {
+			t.Fatalf("expected 201, got %d", status)
+		}
+		key, _ := created["key"].(string)
+		if status := do(http.MethodGet, "/v1/auth/me", key, nil, nil); status != http.StatusOK {
+			t.Errorf("expected the key to act as its owner, got %d", status)
+		}
+		if status := do(http.MethodPost, "/v1/auth/api-keys", key, map[string]string{"name": "nested"}, nil); status != http.StatusForbidden {
+			t.Errorf("expected an api key not to create keys, got %d", status)
+		}
+		user, err := auth.VerifyToken(context.Background(), userToken)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, limits := range []map[string]interface{}{
+			{"scope": "courses.read", "client_id": "spa"},
+			{"resources": []string{"v1/course.GET"}, "act": map[string]interface{}{"sub": "client:gw"}},
+		} {
+			limited, err := auth.GetJwtGenerator().GenerateToken(user, limits)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status := do(http.MethodPost, "/v1/auth/api-keys", limited, map[string]string{"name": "escape"}, nil); status != http.StatusForbidden {
+				t.Errorf("expected a token limited by %v not to create keys, got %d", limits, status)
+			}
+			status := do(http.MethodPost, "/v1/auth/password", limited, map[string]string{"old_password": "Stronger123456", "new_password": "Escape123456"}, nil)
+			if status != http.StatusForbidden {
+				t.Errorf("expected a token limited by %v not to change the password, got %d", limits, status)
+			}
+		}
+		keys := map[string][]map[string]interface{}{}
+		do(http.MethodGet, "/v1/auth/api-keys", userToken, nil, &keys)
+		if len(keys["data"]) != 1 || keys["data"][0]["last_used_at"] == nil {
+			t.Errorf("expected one used key, got %v", keys)
+		}
+		// static users may limit their keys to any resource
+		limited := map[string]interface{}{}
+		do(http.MethodPost, "/v1/auth/api-keys", adminToken, map[string]interface{}{"resources": []string{"runway_auth/v1/acl.GET"}}, &limited)
+		limitedKey, _ := limited["key"].(string)
+		if status := do(http.MethodGet, "/v1/acl", limitedKey, nil, nil); status != http.StatusOK {
+			t.Errorf("expected 200 within the resources of the key, got %d", status)
+		}
+		if status := do(http.MethodGet, "/v1/users", limitedKey, nil, nil); status != http.StatusForbidden {
+			t.Errorf("expected 403 outside the resources of the key, got %d", status)
+		}
+		id := created["api_key"].(map[string]interface{})["id"].(string)
+		if status := do(http.MethodDelete, "/v1/auth/api-keys/"+id, userToken, nil, nil); status != http.StatusNoContent {
+			t.Errorf("expected 204, got %d", status)
+		}
+		if status := do(http.MethodGet, "/v1/auth/me", key, nil, nil); status != http.StatusUnauthorized {
+			t.Errorf("expected a revoked key to be rejected, got %d", status)
+		}
+	})
+	t.Run("openapi", func(t *testing.T) {
+		spec := map[string]interface{}{}
+		if status := do(http.MethodGet, "/v1/openapi.json", "", nil, &spec); status != http.StatusOK {
+			t.Errorf("expected 200, got %d", status)
+		}
+		paths, _ := spec["paths"].(map[string]interface{})
+		if _, ok := paths["/v1/users/{id}"]; !ok {
+			t.Error("expected /v1/users/{id} in the spec")
+		}
+		schemas := spec["components"].(map[string]interface{})["schemas"].(map[string]interface{})
+		if _, ok := schemas["Token"]; !ok {
+			t.Error("expected the Token schema")
+		}
+	})
+}
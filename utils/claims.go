@@ -0,0 +1,19 @@
+package utils
+
+// ClaimStrings returns the claim name of claims as strings, it is []string when the claims were built
+// in process and []interface{} once decoded from a jwt. ok is false when the claim is not a list.
+func ClaimStrings(claims map[string]interface{}, name string) (values []string, ok bool) {
+	switch claim := claims[name].(type) {
+	case []string:
+		return claim, true
+	case []interface{}:
+		values = make([]string, 0, len(claim))
+		for _, value := range claim {
+			if value, ok := value.(string); ok {
+				values = append(values, value)
+			}
+		}
+		return values, true
+	}
+	return nil, false
+}
@@ -0,0 +1,82 @@
+package utils
+
+import (
+	"github.com/Runway-Club/auth_lib/domain"
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/vm"
+	"net"
+	"sync"
+	"time"
+)
+
+// compiled conditions by source
+var conditionCache sync.Map
+
+var conditionOptions = []expr.Option{
+	expr.AsBool(),
+	expr.Function("inCIDR", func(params ...interface{}) (interface{}, error) {
+		ip := net.ParseIP(params[0].(string))
+		_, network, err := net.ParseCIDR(params[1].(string))
+		if err != nil {
+			return false, err
+		}
+		return ip != nil && network.Contains(ip), nil
+	}, new(func(string, string) bool)),
+}
+
+func compileCondition(condition string) (*vm.Program, error) {
+	if program, ok := conditionCache.Load(condition); ok {
+		return program.(*vm.Program), nil
+	}
+	program, err := expr.Compile(condition, conditionOptions...)
+	if err != nil {
+		return nil, domain.ErrInvalidCondition
+	}
+	conditionCache.Store(condition, program)
+	return program, nil
+}
+
+// ValidateCondition checks that condition compiles to a boolean expression
+func ValidateCondition(condition string) error {
+	if condition == "" {
+		return nil
+	}
+	_, err := compileCondition(condition)
+	return err
+}
+
+// EvaluateCondition evaluates condition against attrs, an empty condition is always true.
+// Conditions cannot call anything but the expression builtins and inCIDR(ip, cidr).
+func EvaluateCondition(condition string, attrs *domain.Attributes) (bool, error) {
+	if condition == "" {
+		return true, nil
+	}
+	program, err := compileCondition(condition)
+	if err != nil {
+		return false, err
+	}
+	if attrs == nil {
+		attrs = &domain.Attributes{}
+	}
+	now := attrs.Time
+	if now.IsZero() {
+		now = time.Now()
+	}
+	result, err := expr.Run(program, map[string]interface{}{
+		"user":     attrs.User,
+		"resource": attrs.Resource,
+		"request": map[string]interface{}{
+			"ip": attrs.ClientIP,
+			"time": map[string]interface{}{
+				"hour":    now.Hour(),
+				"minute":  now.Minute(),
+				"weekday": int(now.Weekday()),
+				"unix":    now.Unix(),
+			},
+		},
+	})
+	if err != nil {
+		return false, domain.ErrInvalidCondition
+	}
+	return result.(bool), nil
+}
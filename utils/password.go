@@ -16,7 +16,9 @@ const (
 
 func CheckPasswordPolicy(password string, policy string) error {
 	// set default password policy
-	policy = string(PasswordLevel1)
+	if policy == "" {
+		policy = string(PasswordLevel1)
+	}
 	// check password policy
 	if policy == string(PasswordLevel1) {
 		// minimum 8 characters
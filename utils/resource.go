@@ -0,0 +1,227 @@
+package utils
+
+import "strings"
+
+// Resource patterns are split into tokens on "/" and ".", e.g. "v1/course.GET" is
+// v1 / course . GET. A "*" token matches exactly one token, a trailing "**" token
+// matches one or more remaining tokens:
+//
+//	v1/course.*   matches v1/course.GET, v1/course.PUT
+//	v1/*/lesson.GET matches v1/course/lesson.GET
+//	v1/**         matches everything under v1
+//	**            matches everything
+//
+// Payload patterns support "*" (any payload) and a trailing "*" for prefix matching
+// ("course-*"). Anything else is matched exactly.
+
+const (
+	anyToken     = "*"
+	anyRemaining = "**"
+)
+
+func splitResource(resource string) (tokens []string, separators []byte) {
+	start := 0
+	for i := 0; i < len(resource); i++ {
+		if resource[i] == '/' || resource[i] == '.' {
+			tokens = append(tokens, resource[start:i])
+			separators = append(separators, resource[i])
+			start = i + 1
+		}
+	}
+	tokens = append(tokens, resource[start:])
+	return tokens, separators
+}
+
+// IsResourcePattern reports whether resource contains wildcard tokens
+func IsResourcePattern(resource string) bool {
+	tokens, _ := splitResource(resource)
+	for _, token := range tokens {
+		if token == anyToken || token == anyRemaining {
+			return true
+		}
+	}
+	return false
+}
+
+// ResourcePatternPrefix returns the literal part of pattern before its first wildcard token,
+// including the trailing separator. It is always one of ResourcePrefixes of any resource
+// the pattern matches, which lets repositories look patterns up by an indexed column.
+func ResourcePatternPrefix(pattern string) string {
+	tokens, separators := splitResource(pattern)
+	prefix := strings.Builder{}
+	for i, token := range tokens {
+		if token == anyToken || token == anyRemaining {
+			break
+		}
+		prefix.WriteString(token)
+		if i < len(separators) {
+			prefix.WriteByte(separators[i])
+		}
+	}
+	return prefix.String()
+}
+
+// ResourcePrefixes returns every prefix of resource ending at a separator, including the empty prefix
+func ResourcePrefixes(resource string) []string {
+	prefixes := []string{""}
+	for i := 0; i < len(resource); i++ {
+		if resource[i] == '/' || resource[i] == '.' {
+			prefixes = append(prefixes, resource[:i+1])
+		}
+	}
+	return prefixes
+}
+
+// MatchResource reports whether resource is matched by pattern
+func MatchResource(pattern, resource string) bool {
+	if pattern == resource {
+		return true
+	}
+	pTokens, pSeparators := splitResource(pattern)
+	rTokens, rSeparators := splitResource(resource)
+	for i, token := range pTokens {
+		if token == anyRemaining && i == len(pTokens)-1 {
+			return len(rTokens) > i
+		}
+		if i >= len(rTokens) {
+			return false
+		}
+		if token != anyToken && token != rTokens[i] {
+			return false
+		}
+		if i < len(pSeparators) && (i >= len(rSeparators) || pSeparators[i] != rSeparators[i]) {
+			return false
+		}
+	}
+	return len(pTokens) == len(rTokens)
+}
+
+// MatchAnyResource reports whether resource is matched by one of patterns
+func MatchAnyResource(patterns []string, resource string) bool {
+	for _, pattern := range patterns {
+		if MatchResource(pattern, resource) {
+			return true
+		}
+	}
+	return false
+}
+
+// CoversResource reports whether every resource matched by sub, a resource or a pattern, is matched by
+// pattern, so that "v1/**" covers "v1/*" but "v1/*" does not cover "v1/**"
+func CoversResource(pattern, sub string) bool {
+	if pattern == sub {
+		return true
+	}
+	pTokens, pSeparators := splitResource(pattern)
+	sTokens, sSeparators := splitResource(sub)
+	for i, token := range pTokens {
+		if token == anyRemaining && i == len(pTokens)-1 {
+			return len(sTokens) > i
+		}
+		if i >= len(sTokens) {
+			return false
+		}
+		// "*" covers a single token of any value, but not the remaining tokens of a trailing "**"
+		if token == anyToken && sTokens[i] == anyRemaining && i == len(sTokens)-1 {
+			return false
+		}
+		if token != anyToken && token != sTokens[i] {
+			return false
+		}
+		if i < len(pSeparators) && (i >= len(sSeparators) || pSeparators[i] != sSeparators[i]) {
+			return false
+		}
+	}
+	return len(pTokens) == len(sTokens)
+}
+
+// CoversAnyResource reports whether sub, a resource or a pattern, is covered by one of patterns
+func CoversAnyResource(patterns []string, sub string) bool {
+	for _, pattern := range patterns {
+		if CoversResource(pattern, sub) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchPayload reports whether payload is matched by pattern
+func MatchPayload(pattern, payload string) bool {
+	if pattern == anyToken {
+		return true
+	}
+	if strings.HasSuffix(pattern, anyToken) {
+		return strings.HasPrefix(payload, strings.TrimSuffix(pattern, anyToken))
+	}
+	return pattern == payload
+}
+
+// PayloadsOverlap reports whether a payload is matched by both patterns a and b
+func PayloadsOverlap(a, b string) bool {
+	aPrefix, aPattern := strings.CutSuffix(a, anyToken)
+	bPrefix, bPattern := strings.CutSuffix(b, anyToken)
+	switch {
+	case aPattern && bPattern:
+		return strings.HasPrefix(aPrefix, bPrefix) || strings.HasPrefix(bPrefix, aPrefix)
+	case aPattern:
+		return strings.HasPrefix(b, aPrefix)
+	case bPattern:
+		return strings.HasPrefix(a, bPrefix)
+	}
+	return a == b
+}
+
+// CompareSpecificity orders two (resource pattern, payload pattern) pairs by precedence and
+// returns a negative number when a is more specific than b. Precedence is, in order:
+//  1. an exact resource before any resource pattern
+//  2. a longer literal resource prefix
+//  3. a pattern without a trailing "**"
+//  4. fewer "*" tokens
+//  5. an exact payload, then a longer payload prefix, then "*"
+func CompareSpecificity(aResource, aPayload, bResource, bPayload string) int {
+	aWildcard, bWildcard := IsResourcePattern(aResource), IsResourcePattern(bResource)
+	if aWildcard != bWildcard {
+		if aWildcard {
+			return 1
+		}
+		return -1
+	}
+	if aWildcard {
+		if d := len(ResourcePatternPrefix(bResource)) - len(ResourcePatternPrefix(aResource)); d != 0 {
+			return d
+		}
+		aAny, bAny := strings.HasSuffix(aResource, anyRemaining), strings.HasSuffix(bResource, anyRemaining)
+		if aAny != bAny {
+			if aAny {
+				return 1
+			}
+			return -1
+		}
+		if d := countAnyTokens(aResource) - countAnyTokens(bResource); d != 0 {
+			return d
+		}
+	}
+	return payloadRank(bPayload) - payloadRank(aPayload)
+}
+
+func countAnyTokens(pattern string) int {
+	count := 0
+	tokens, _ := splitResource(pattern)
+	for _, token := range tokens {
+		if token == anyToken {
+			count++
+		}
+	}
+	return count
+}
+
+func payloadRank(pattern string) int {
+	if pattern == anyToken {
+		return 0
+	}
+	if strings.HasSuffix(pattern, anyToken) {
+		return len(pattern)
+	}
+	// exact payloads always rank above prefixes
+	return 1 << 30
+}